@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/fjl/discv5-streams/fileserver"
+)
+
+// contactsController keeps the list of saved peers.
+type contactsController struct {
+	contacts      atomic.Pointer[contactsState]
+	changeEventCh chan struct{}
+
+	stateFile    string
+	wg           sync.WaitGroup
+	addCh        chan *contact
+	removeCh     chan *contact
+	retryLoadCh  chan struct{}
+	resetStateCh chan struct{}
+	closeCh      chan struct{}
+}
+
+type contactsState struct {
+	loading   bool // true during initialization
+	loadError error
+	list      contactList
+}
+
+type contactList []*contact
+
+// contact is a saved peer.
+type contact struct {
+	Name string
+	ENR  string
+
+	node *enode.Node
+}
+
+func newContact(name string, node *enode.Node) *contact {
+	return &contact{Name: name, ENR: node.String(), node: node}
+}
+
+// parseContactNode parses a node record. It accepts ENRs with or without the
+// "enr:" prefix, as well as file reference URLs.
+func parseContactNode(text string) (*enode.Node, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("empty node record")
+	}
+	if strings.HasPrefix(text, "discv5fs:") {
+		ref, err := fileserver.ParseURL(text)
+		if err != nil {
+			return nil, err
+		}
+		if len(ref.Node.Record().Signature()) == 0 {
+			return nil, errors.New("URL does not contain a node record")
+		}
+		return ref.Node, nil
+	}
+	if !strings.HasPrefix(text, "enr:") {
+		text = "enr:" + text
+	}
+	return enode.Parse(enode.ValidSchemes, text)
+}
+
+// add returns a copy of l with c added. An existing contact for the same node
+// is replaced.
+func (l contactList) add(c *contact) contactList {
+	var newlist contactList
+	for _, old := range l {
+		if old.node.ID() != c.node.ID() {
+			newlist = append(newlist, old)
+		}
+	}
+	newlist = append(newlist, c)
+	sort.Slice(newlist, func(i, j int) bool {
+		return newlist[i].Name < newlist[j].Name
+	})
+	return newlist
+}
+
+// remove returns a copy of l with c removed.
+func (l contactList) remove(c *contact) contactList {
+	var newlist contactList
+	for _, old := range l {
+		if old != c {
+			newlist = append(newlist, old)
+		}
+	}
+	return newlist
+}
+
+func newContactsController(stateFile string) *contactsController {
+	cc := &contactsController{
+		stateFile:     stateFile,
+		changeEventCh: make(chan struct{}, 1),
+		addCh:         make(chan *contact),
+		removeCh:      make(chan *contact),
+		retryLoadCh:   make(chan struct{}),
+		resetStateCh:  make(chan struct{}),
+		closeCh:       make(chan struct{}),
+	}
+	cc.publish(true, nil, nil)
+	cc.wg.Add(1)
+	go cc.stateLoop()
+	return cc
+}
+
+// State returns the current contact list.
+func (cc *contactsController) State() *contactsState {
+	return cc.contacts.Load()
+}
+
+// Changed returns a channel that fires whenever the contact list
+// has changed. This is used to trigger UI updates.
+func (cc *contactsController) Changed() <-chan struct{} {
+	return cc.changeEventCh
+}
+
+// AddContact saves a peer.
+func (cc *contactsController) AddContact(name string, node *enode.Node) {
+	select {
+	case cc.addCh <- newContact(name, node):
+	case <-cc.closeCh:
+	}
+}
+
+// RemoveContact removes a saved peer.
+func (cc *contactsController) RemoveContact(c *contact) {
+	select {
+	case cc.removeCh <- c:
+	case <-cc.closeCh:
+	}
+}
+
+// RetryLoad forces a reload of the contact list from disk.
+func (cc *contactsController) RetryLoad() {
+	select {
+	case cc.retryLoadCh <- struct{}{}:
+	case <-cc.closeCh:
+	}
+}
+
+// ResetDatabase starts over with an empty contact list.
+func (cc *contactsController) ResetDatabase() {
+	select {
+	case cc.resetStateCh <- struct{}{}:
+	case <-cc.closeCh:
+	}
+}
+
+// Close stops the controller.
+func (cc *contactsController) Close() {
+	close(cc.closeCh)
+	cc.wg.Wait()
+}
+
+// stateLoop maintains the contact list.
+func (cc *contactsController) stateLoop() {
+	defer cc.wg.Done()
+
+	var (
+		state         contactList
+		saveDone      chan struct{}
+		saveRequested bool
+		err           error
+	)
+
+	// Load the initial state from the file.
+	for {
+		state, err = cc.loadState()
+		if err == nil {
+			break
+		}
+
+		// There was an error loading the state file.
+		// Wait for a retry signal from the UI.
+		cc.publish(false, nil, err)
+		select {
+		case <-cc.retryLoadCh:
+			continue
+		case <-cc.resetStateCh:
+			state = nil
+			saveRequested = true
+		case <-cc.closeCh:
+			return
+		}
+		break
+	}
+
+	log.Println("contacts: state loaded")
+	cc.publish(false, state, nil)
+	for {
+		// Launch save if requested and not already running.
+		if saveRequested && saveDone == nil {
+			saveDone = make(chan struct{})
+			saveRequested = false
+			go func() {
+				err := cc.saveState(state)
+				if err != nil {
+					log.Println("contacts: save error:", err)
+				}
+				saveDone <- struct{}{}
+			}()
+		}
+
+		select {
+		case c := <-cc.addCh:
+			state = state.add(c)
+			saveRequested = true
+			cc.publish(false, state, nil)
+
+		case c := <-cc.removeCh:
+			state = state.remove(c)
+			saveRequested = true
+			cc.publish(false, state, nil)
+
+		case <-saveDone:
+			saveDone = nil
+
+		case <-cc.retryLoadCh:
+			// Ignore load error requests.
+
+		case <-cc.resetStateCh:
+			state = contactList{}
+			saveRequested = true
+			cc.publish(false, state, nil)
+
+		case <-cc.closeCh:
+			if saveDone != nil {
+				<-saveDone
+			}
+			cc.saveState(state)
+			return
+		}
+	}
+}
+
+// loadState loads the contact list from the state file.
+func (cc *contactsController) loadState() (contactList, error) {
+	fd, err := os.Open(cc.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var list contactList
+	dec := gob.NewDecoder(fd)
+	err = dec.Decode(&list)
+	fd.Close()
+
+	if err != nil {
+		log.Printf("contacts: load error: %v", err)
+		return nil, err
+	}
+
+	// Decode the node records.
+	for i := 0; i < len(list); i++ {
+		c := list[i]
+		c.node, err = parseContactNode(c.ENR)
+		if err != nil {
+			log.Printf("contacts: removing invalid contact %q: %v", c.Name, err)
+			list = append(list[:i], list[i+1:]...)
+			i--
+		}
+	}
+	return list, nil
+}
+
+// saveState saves the contact list to the state file.
+func (cc *contactsController) saveState(list contactList) error {
+	fd, err := os.OpenFile(cc.stateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := gob.NewEncoder(fd)
+	return enc.Encode(list)
+}
+
+func (cc *contactsController) publish(loading bool, list contactList, err error) {
+	cc.contacts.Store(&contactsState{loading, err, list})
+	select {
+	case cc.changeEventCh <- struct{}{}:
+	default:
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"errors"
 	"io/fs"
 	"log"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -38,8 +40,22 @@ type fileList []*fileRef
 type fileRef struct {
 	Name string
 	Path string
+	Dir  bool // shared directory, files in it are served by relative path
 
-	info fs.FileInfo
+	info   fs.FileInfo
+	ctx    context.Context // canceled when the file is removed
+	cancel context.CancelFunc
+}
+
+func newFileRef(name, path string, info fs.FileInfo) *fileRef {
+	fr := &fileRef{Name: name, Path: path, Dir: info.IsDir(), info: info}
+	fr.init()
+	return fr
+}
+
+// init sets up the context of a file reference.
+func (f *fileRef) init() {
+	f.ctx, f.cancel = context.WithCancel(context.Background())
 }
 
 // add returns a copy of l with ref added.
@@ -107,8 +123,16 @@ func (fc *filesController) ServeFile(tr *fileserver.TransferRequest) error {
 	if state.loading {
 		return errors.New("file list is loading")
 	}
+	name, err := fileserver.CleanFilename(tr.Filename)
+	if err != nil {
+		return err
+	}
 	for _, f := range state.list {
-		if f.Name == tr.Filename {
+		if f.Dir {
+			if rest, ok := strings.CutPrefix(name, f.Name+"/"); ok {
+				return fc.serveDirectory(tr, f, rest)
+			}
+		} else if f.Name == name && !tr.Archive {
 			return fc.serveFile(tr, f)
 		}
 	}
@@ -133,12 +157,21 @@ func (fc *filesController) serveFile(tr *fileserver.TransferRequest, f *fileRef)
 	if err != nil {
 		return err
 	}
-	return tr.SendFile(uint64(info.Size()), r)
+	// Uploads are canceled when the file is removed from the list.
+	return tr.SendFile(f.ctx, uint64(info.Size()), r)
 }
 
-// AddFile adds a file to the file space.
+// serveDirectory serves a file from a shared directory. The directory is read
+// on demand, so changes to its content are visible immediately. Unlike single
+// files, transfers from a directory are not canceled when it is removed.
+func (fc *filesController) serveDirectory(tr *fileserver.TransferRequest, dir *fileRef, name string) error {
+	tr.Filename = name
+	return fileserver.ServeFS(os.DirFS(dir.Path))(tr)
+}
+
+// AddFile adds a file or directory to the file space.
 func (fc *filesController) AddFile(path string, info fs.FileInfo) {
-	fr := &fileRef{info.Name(), path, info}
+	fr := newFileRef(info.Name(), path, info)
 	select {
 	case fc.addCh <- fr:
 	case <-fc.closeCh:
@@ -234,6 +267,7 @@ runMainLoop:
 
 		case ref := <-fc.removeCh:
 			state = state.remove(ref)
+			ref.cancel()
 			saveRequested = true
 			fc.publish(false, state, nil)
 
@@ -244,6 +278,9 @@ runMainLoop:
 			// Ignore load error requests.
 
 		case <-fc.resetStateCh:
+			for _, ref := range state {
+				ref.cancel()
+			}
 			state = fileList{}
 			saveRequested = true
 			fc.publish(false, state, nil)
@@ -283,6 +320,7 @@ func (fc *filesController) loadState() ([]*fileRef, error) {
 	// Update file sizes, and check if any files have gone missing.
 	for i := 0; i < len(files); i++ {
 		f := files[i]
+		f.init()
 		f.info, err = os.Stat(f.Path)
 		if err != nil {
 			log.Printf("fileSpace: removing stale file: %s", err)
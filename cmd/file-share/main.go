@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"gioui.org/app"
 	"gioui.org/io/system"
@@ -13,13 +14,22 @@ import (
 	"gioui.org/widget/material"
 	"gioui.org/x/explorer"
 	ethlog "github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/fjl/discv5-streams/host"
 )
 
 func main() {
 	dataDirFlag := flag.String("datadir", "", "data directory")
+	downloadDirFlag := flag.String("downloads", "", "directory for downloaded files (default ~/Downloads)")
+	natFlag := flag.String("nat", "any", "port mapping mechanism (any|none|upnp|pmp|extip:<IP>)")
 	flag.Parse()
 
+	natm, err := nat.Parse(*natFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -nat:", err)
+		os.Exit(1)
+	}
+
 	// Resolve data directory.
 	var dataDir string
 	if *dataDirFlag != "" {
@@ -33,10 +43,18 @@ func main() {
 		dataDir = dir
 	}
 
+	// Resolve download directory.
+	downloadDir := *downloadDirFlag
+	if downloadDir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			downloadDir = filepath.Join(home, "Downloads")
+		}
+	}
+
 	// Set up go-ethereum logging.
 	h := ethlog.LvlFilterHandler(ethlog.LvlTrace, ethlog.StreamHandler(os.Stderr, ethlog.TerminalFormat(false)))
 	ethlog.Root().SetHandler(h)
-	state := newAppState(dataDir, host.Config{})
+	state := newAppState(dataDir, downloadDir, host.Config{NAT: natm})
 
 	var (
 		title    = app.Title("FileShare")
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/fjl/discv5-streams/fileserver"
 	"github.com/fjl/discv5-streams/host"
+	"github.com/skip2/go-qrcode"
 )
 
 func TestAppStateSetup(t *testing.T) {
 	tmp := t.TempDir()
-	state := newAppState(tmp, host.ConfigForTesting)
+	state := newAppState(tmp, "", host.ConfigForTesting)
 	defer state.Close()
 
 	var (
@@ -71,3 +84,228 @@ func TestAppStateSetup(t *testing.T) {
 		t.Fatal("filesController did not start")
 	}
 }
+
+func TestCreateDestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "downloads")
+	want := []string{"file.txt", "file (1).txt", "file (2).txt"}
+	for _, name := range want {
+		file, err := createDestFile(dir, "file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file != filepath.Join(dir, name) {
+			t.Fatalf("got %q, want %q", file, name)
+		}
+	}
+}
+
+func TestDownloadName(t *testing.T) {
+	tests := map[string]string{
+		"file":        "file",
+		"dir/file":    "file",
+		"../../file":  "file",
+		"..":          "download",
+		"/":           "download",
+		"dir/sub/../": "dir",
+	}
+	for file, want := range tests {
+		if name := downloadName(file); name != want {
+			t.Errorf("%q: got %q, want %q", file, name, want)
+		}
+	}
+}
+
+func TestFinishDownload(t *testing.T) {
+	dir := t.TempDir()
+	part, dest := filepath.Join(dir, "file.part"), filepath.Join(dir, "file")
+	content := []byte("content")
+	if err := os.WriteFile(part, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := finishDownload(part, dest, new([32]byte)); !errors.Is(err, fileserver.ErrHashMismatch) {
+		t.Fatalf("got error %v, want ErrHashMismatch", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatal("destination file created despite hash mismatch")
+	}
+
+	hash := sha256.Sum256(content)
+	if err := finishDownload(part, dest, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, content) {
+		t.Fatal("wrong destination content")
+	}
+}
+
+func TestContactsPersist(t *testing.T) {
+	var r enr.Record
+	key, _ := crypto.GenerateKey()
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatal(err)
+	}
+	node, _ := enode.New(enode.ValidSchemes, &r)
+
+	// Check that all accepted formats parse.
+	ref := fileserver.TransferRef{Node: node, File: "file"}
+	for _, text := range []string{node.String(), strings.TrimPrefix(node.String(), "enr:"), ref.String()} {
+		n, err := parseContactNode(text)
+		if err != nil {
+			t.Fatalf("can't parse %q: %v", text, err)
+		}
+		if n.ID() != node.ID() {
+			t.Fatalf("wrong node ID from %q", text)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "contacts.gob")
+	cc := newContactsController(file)
+	cc.AddContact("peer", node)
+	cc.Close()
+
+	cc = newContactsController(file)
+	defer cc.Close()
+	for cc.State().loading {
+		<-cc.Changed()
+	}
+	state := cc.State()
+	if state.loadError != nil {
+		t.Fatal("load error:", state.loadError)
+	}
+	if len(state.list) != 1 || state.list[0].Name != "peer" || state.list[0].node.ID() != node.ID() {
+		t.Fatalf("wrong contacts after reload: %v", state.list)
+	}
+}
+
+func TestScanNodeQR(t *testing.T) {
+	var r enr.Record
+	key, _ := crypto.GenerateKey()
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatal(err)
+	}
+	node, _ := enode.New(enode.ValidSchemes, &r)
+
+	png, err := qrcode.Encode(node.String(), qrcode.Medium, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := scanNodeQR(bytes.NewReader(png))
+	if err != nil {
+		t.Fatal("scan error:", err)
+	}
+	if scanned.ID() != node.ID() {
+		t.Fatal("wrong node ID")
+	}
+
+	if _, err := scanNodeQR(strings.NewReader("not an image")); err == nil {
+		t.Fatal("expected error for invalid image")
+	}
+}
+
+func TestServeDirectory(t *testing.T) {
+	tmp := t.TempDir()
+	share := filepath.Join(tmp, "share")
+	if err := os.MkdirAll(filepath.Join(share, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("content")
+	if err := os.WriteFile(filepath.Join(share, "sub", "file.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fc := newFilesController(filepath.Join(tmp, "files.gob"))
+	defer fc.Close()
+	stat, _ := os.Stat(share)
+	fc.AddFile(share, stat)
+	for len(fc.State().list) == 0 {
+		<-fc.Changed()
+	}
+
+	host1, err := host.Listen(host.ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host1.Close()
+	host2, err := host.Listen(host.ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host2.Close()
+	if _, err := fileserver.NewServer(host1, fileserver.Config{Handler: fc.ServeFile}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := fileserver.NewClient(host2, fileserver.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := client.Request(ctx, host1.Discovery.Self(), "share/sub/file.txt")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("wrong content")
+	}
+
+	// Paths outside of the directory are rejected.
+	if _, err := client.Request(ctx, host1.Discovery.Self(), "share/../files.gob"); err == nil {
+		t.Fatal("request outside of shared directory succeeded")
+	}
+}
+
+func TestNetworkSettings(t *testing.T) {
+	s := networkSettings{ListenPort: 30303, NAT: "none", NoBootnodes: true, PrivateMode: true}
+	cfg := host.Config{ListenAddr: "127.0.0.1:0"}
+	if err := s.apply(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != "127.0.0.1:30303" {
+		t.Errorf("wrong listen address %q", cfg.ListenAddr)
+	}
+	if cfg.Discovery.Bootnodes == nil || len(cfg.Discovery.Bootnodes) != 0 {
+		t.Error("bootnodes not disabled")
+	}
+	if !cfg.NoDiscovery {
+		t.Error("discovery not disabled")
+	}
+
+	for _, bad := range []networkSettings{{ListenPort: 70000}, {NAT: "foo"}} {
+		if err := bad.check(); err == nil {
+			t.Errorf("no error for invalid settings %+v", bad)
+		}
+	}
+
+	// Check persistence.
+	net := &networkController{datadir: t.TempDir()}
+	if err := net.saveSettings(&s); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := net.loadSettings(); *loaded != s {
+		t.Errorf("wrong settings after load: %+v", loaded)
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	tests := []struct {
+		remaining, speed int64
+		want             time.Duration
+	}{
+		{1000, 100, 10 * time.Second},
+		{1000, 0, -1},
+		{-1, 100, -1},
+		{0, 100, 0},
+	}
+	for _, test := range tests {
+		if eta := estimateETA(test.remaining, test.speed); eta != test.want {
+			t.Errorf("estimateETA(%d, %d) = %v, want %v", test.remaining, test.speed, eta, test.want)
+		}
+	}
+}
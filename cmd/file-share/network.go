@@ -1,25 +1,38 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"errors"
+	"context"
+	"encoding/gob"
+	"fmt"
 	"log"
+	stdnet "net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/fjl/discv5-streams/fileserver"
 	"github.com/fjl/discv5-streams/host"
 )
 
+// restartDrainTimeout is how long a network restart waits for active transfers.
+const restartDrainTimeout = 10 * time.Second
+
+// maxDownloadSize is the largest file accepted for download.
+const maxDownloadSize = 64 << 30
+
+// downloadIdleTimeout is how long a download may go without receiving data.
+const downloadIdleTimeout = 30 * time.Second
+
 // networkController is the networkController connection state.
 type networkController struct {
 	datadir     string
 	hostConfig  *host.Config
+	settings    atomic.Pointer[networkSettings]
 	serveFunc   fileserver.ServerFunc
 	state       atomic.Pointer[networkState]
 	changeCh    chan struct{}
@@ -36,9 +49,46 @@ type networkState struct {
 	stats      networkStats
 }
 
+// networkSettings are the user-configurable network parameters. They are
+// applied on top of the host configuration given on the command line.
+type networkSettings struct {
+	ListenPort  int    // fixed UDP port, zero for random
+	NAT         string // port mapping mechanism, empty for default
+	NoBootnodes bool   // disables bootstrapping
+	PrivateMode bool   // disables discovery, peers are reached through links only
+}
+
+// apply modifies cfg according to the settings.
+func (s *networkSettings) apply(cfg *host.Config) error {
+	if s.ListenPort != 0 {
+		ip, _, _ := stdnet.SplitHostPort(cfg.ListenAddr)
+		cfg.ListenAddr = stdnet.JoinHostPort(ip, strconv.Itoa(s.ListenPort))
+	}
+	if s.NAT != "" {
+		natm, err := nat.Parse(s.NAT)
+		if err != nil {
+			return fmt.Errorf("invalid NAT setting: %w", err)
+		}
+		cfg.NAT = natm
+	}
+	if s.NoBootnodes {
+		cfg.Discovery.Bootnodes = []*enode.Node{}
+	}
+	cfg.NoDiscovery = s.PrivateMode
+	return nil
+}
+
+// check validates the settings.
+func (s *networkSettings) check() error {
+	if s.ListenPort < 0 || s.ListenPort > 65535 {
+		return fmt.Errorf("invalid port %d", s.ListenPort)
+	}
+	return s.apply(new(host.Config))
+}
+
 type networkStats struct {
-	TableNodes int
-	LocalENR   *enode.Node
+	host.Stats
+	LocalENR *enode.Node
 }
 
 func (net *networkController) Close() {
@@ -59,6 +109,25 @@ func (net *networkController) Restart() {
 	}
 }
 
+// Settings returns the current network settings.
+func (net *networkController) Settings() networkSettings {
+	return *net.settings.Load()
+}
+
+// SetSettings stores the network settings and restarts the network
+// to apply them.
+func (net *networkController) SetSettings(s networkSettings) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if err := net.saveSettings(&s); err != nil {
+		return err
+	}
+	net.settings.Store(&s)
+	net.Restart()
+	return nil
+}
+
 // SetClientChan sets the channel on which client instances are published.
 // This is used by transferController to get the client.
 func (net *networkController) SetClientChan(ch chan<- *fileserver.Client) {
@@ -84,6 +153,7 @@ func newNetworkController(dataDirectory string, config *host.Config, serve files
 		restartCh:   make(chan struct{}),
 		closeCh:     make(chan struct{}),
 	}
+	net.settings.Store(net.loadSettings())
 	net.publishState(&networkState{loading: true})
 	net.wg.Add(1)
 	go net.loop()
@@ -94,7 +164,7 @@ func (net *networkController) loop() {
 	defer net.wg.Done()
 
 restart:
-	host, client, err := net.start()
+	host, server, client, err := net.start()
 	if err != nil {
 		net.publishState(&networkState{startError: err})
 		select {
@@ -123,7 +193,11 @@ restart:
 			net.update(host)
 
 		case <-net.restartCh:
-			host.Close()
+			// Let active transfers finish before restarting.
+			ctx, cancel := context.WithTimeout(context.Background(), restartDrainTimeout)
+			host.Shutdown(ctx)
+			cancel()
+			server.Close()
 			goto restart
 
 		case <-net.closeCh:
@@ -132,62 +206,82 @@ restart:
 	}
 }
 
-func (net *networkController) start() (*host.Host, *fileserver.Client, error) {
+func (net *networkController) start() (*host.Host, *fileserver.Server, *fileserver.Client, error) {
 	cfg := *net.hostConfig
-
-	// Load node key, if requested. Otherwise, generate a new one and
-	// store it for next time.
-	if cfg.Discovery.PrivateKey == nil {
-		key, err := net.getNodeKey()
-		if err != nil {
-			return nil, nil, err
-		}
-		cfg.Discovery.PrivateKey = key
+	if err := net.settings.Load().apply(&cfg); err != nil {
+		return nil, nil, nil, err
 	}
 
+	// Load node key, if requested. Otherwise, the host generates a new one and
+	// stores it for next time.
+	cfg.NodeKeyFile = filepath.Join(net.datadir, "nodekey")
+
 	// Create the host.
 	host, err := host.Listen(cfg)
 	if err != nil {
 		log.Printf("can't listen: %v", err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Register the file server protocol.
-	config := fileserver.Config{Handler: net.serveFunc}
-	client := fileserver.NewClient(host, config)
-	fileserver.NewServer(host, config)
+	config := fileserver.Config{
+		Handler:     net.serveFunc,
+		MaxFileSize: maxDownloadSize,
+		ReadTimeout: downloadIdleTimeout,
+		Compression: true,
+	}
+	client, err := fileserver.NewClient(host, config)
+	if err != nil {
+		host.Close()
+		return nil, nil, nil, err
+	}
+	server, err := fileserver.NewServer(host, config)
+	if err != nil {
+		client.Close()
+		host.Close()
+		return nil, nil, nil, err
+	}
+	return host, server, client, nil
+}
 
-	return host, client, nil
+func (net *networkController) settingsFile() string {
+	return filepath.Join(net.datadir, "settings.gob")
 }
 
-func (net *networkController) getNodeKey() (*ecdsa.PrivateKey, error) {
-	err := os.MkdirAll(net.datadir, 0700)
+// loadSettings reads the settings file. Defaults are used if it doesn't exist.
+func (net *networkController) loadSettings() *networkSettings {
+	var s networkSettings
+	fd, err := os.Open(net.settingsFile())
 	if err != nil {
-		return nil, err
+		if !os.IsNotExist(err) {
+			log.Printf("network: can't load settings: %v", err)
+		}
+		return &s
 	}
+	defer fd.Close()
+	if err := gob.NewDecoder(fd).Decode(&s); err != nil {
+		log.Printf("network: invalid settings file: %v", err)
+		return new(networkSettings)
+	}
+	return &s
+}
 
-	keyFile := filepath.Join(net.datadir, "nodekey")
-	key, err := crypto.LoadECDSA(keyFile)
+func (net *networkController) saveSettings(s *networkSettings) error {
+	if err := os.MkdirAll(net.datadir, 0700); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(net.settingsFile(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			key, err = crypto.GenerateKey()
-			if err != nil {
-				log.Printf("network: can't generate key: %v", err)
-				return nil, err
-			}
-			if err := crypto.SaveECDSA(keyFile, key); err != nil {
-				log.Printf("network: can't save key: %v", err)
-				return nil, err
-			}
-		}
+		return err
 	}
-	return key, nil
+	defer fd.Close()
+	return gob.NewEncoder(fd).Encode(s)
 }
 
 func (net *networkController) update(host *host.Host) {
 	stats := networkStats{
-		TableNodes: len(host.Discovery.AllNodes()),
-		LocalENR:   host.LocalNode.Node(),
+		Stats:    host.Stats(),
+		LocalENR: host.LocalNode.Node(),
 	}
 	net.publishState(&networkState{stats: stats})
 }
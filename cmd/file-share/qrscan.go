@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+var errNoQRCode = errors.New("no QR code found in image")
+
+// decodeQRImage reads the text of a QR code contained in an image.
+func decodeQRImage(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", fmt.Errorf("can't decode image: %w", err)
+	}
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+	hints := map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_TRY_HARDER: true}
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, hints)
+	if err != nil {
+		return "", errNoQRCode
+	}
+	return result.GetText(), nil
+}
+
+// scanNodeQR reads a node record from a QR code image. Gio does not provide
+// camera access, so QR codes are scanned from images chosen by the user. On
+// mobile platforms, the image picker usually offers taking a photo.
+func scanNodeQR(r io.Reader) (*enode.Node, error) {
+	text, err := decodeQRImage(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseContactNode(text)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,10 +23,11 @@ import (
 
 // transfersController manages file transfers.
 type transfersController struct {
-	stateFile string
-	net       *networkController
-	state     atomic.Pointer[transfersState]
-	changeCh  chan struct{}
+	stateFile   string
+	downloadDir string
+	net         *networkController
+	state       atomic.Pointer[transfersState]
+	changeCh    chan struct{}
 
 	wg           sync.WaitGroup
 	startCh      chan fileserver.TransferRef
@@ -27,6 +35,7 @@ type transfersController struct {
 	retryLoadCh  chan struct{}
 	resetStateCh chan struct{}
 	modifyCh     chan transferListModify
+	actionCh     chan transferAction
 	clientCh     chan *fileserver.Client
 	closeCh      chan struct{}
 	rootContext  context.Context
@@ -60,6 +69,12 @@ const (
 	transferStatusDownloading
 	transferStatusDone
 	transferStatusError
+	transferStatusPaused
+)
+
+var (
+	errTransferPaused   = errors.New("transfer paused")
+	errTransferCanceled = errors.New("transfer canceled")
 )
 
 type transfer struct {
@@ -67,30 +82,73 @@ type transfer struct {
 
 	ID        uint64
 	Name      string
+	URL       string // encoded ref, for restoring it after load
 	Status    transferStatus
 	Created   time.Time
-	Size      int64  // total file size (as announced by server)
-	ReadBytes int64  // bytes downloaded so far
-	ReadSpeed int64  // bytes per second
-	DestFile  string // destination/output file
+	Size      int64         // total file size (as announced by server), -1 if unknown
+	ReadBytes int64         // bytes downloaded so far
+	ReadSpeed int64         // bytes per second
+	ETA       time.Duration // estimated time remaining, -1 if unknown
+	AvgSpeed  int64         // average bytes per second, set when done
+	DestFile  string        // destination/output file
 	Error     string
+
+	// Metadata announced by the server.
+	ModTime     time.Time
+	ContentType string
 }
 
 func (t *transfer) isDone() bool {
 	return t.Status == transferStatusDone || t.Status == transferStatusError
 }
 
+// isActive reports whether the transfer is running.
+func (t *transfer) isActive() bool {
+	return !t.isDone() && t.Status != transferStatusPaused
+}
+
+// partFile is the file holding the content of an incomplete download.
+func (t *transfer) partFile() string {
+	return t.DestFile + ".part"
+}
+
+// removeFiles deletes the files of an incomplete download.
+func (t *transfer) removeFiles() {
+	if t.DestFile != "" {
+		os.Remove(t.partFile())
+		os.Remove(t.DestFile)
+		t.DestFile = ""
+	}
+}
+
 type transferListModify func([]*transfer) []*transfer
 
-func newTransfersController(net *networkController, stateFile string) *transfersController {
+type transferAction struct {
+	id uint64
+	op transferOp
+}
+
+type transferOp int
+
+const (
+	transferOpPause transferOp = iota
+	transferOpResume
+	transferOpCancel
+	transferOpRetry
+	transferOpRemove
+)
+
+func newTransfersController(net *networkController, stateFile, downloadDir string) *transfersController {
 	t := &transfersController{
 		stateFile:    stateFile,
+		downloadDir:  downloadDir,
 		net:          net,
 		changeCh:     make(chan struct{}, 1),
 		clientCh:     make(chan *fileserver.Client),
 		startCh:      make(chan fileserver.TransferRef),
 		updateCh:     make(chan *transfer),
 		modifyCh:     make(chan transferListModify),
+		actionCh:     make(chan transferAction),
 		retryLoadCh:  make(chan struct{}),
 		resetStateCh: make(chan struct{}),
 		closeCh:      make(chan struct{}),
@@ -158,6 +216,40 @@ func (t *transfersController) StartTransfer(ref fileserver.TransferRef) {
 	}
 }
 
+// PauseTransfer stops a running download. It can be resumed later.
+func (t *transfersController) PauseTransfer(id uint64) {
+	t.action(transferAction{id, transferOpPause})
+}
+
+// ResumeTransfer restarts a paused download.
+func (t *transfersController) ResumeTransfer(id uint64) {
+	t.action(transferAction{id, transferOpResume})
+}
+
+// CancelTransfer stops a running or paused download, deletes its files and
+// removes it from the list.
+func (t *transfersController) CancelTransfer(id uint64) {
+	t.action(transferAction{id, transferOpCancel})
+}
+
+// RetryTransfer restarts a failed download from the beginning.
+func (t *transfersController) RetryTransfer(id uint64) {
+	t.action(transferAction{id, transferOpRetry})
+}
+
+// RemoveTransfer removes a finished transfer from the list. Downloaded files
+// are kept.
+func (t *transfersController) RemoveTransfer(id uint64) {
+	t.action(transferAction{id, transferOpRemove})
+}
+
+func (t *transfersController) action(a transferAction) {
+	select {
+	case t.actionCh <- a:
+	case <-t.closeCh:
+	}
+}
+
 func (t *transfersController) modify(mod transferListModify) {
 	select {
 	case t.modifyCh <- mod:
@@ -213,6 +305,7 @@ func (t *transfersController) mainLoop(state transfersState, client *fileserver.
 		saveRequested = state.wasReset
 		idCounter     = state.maxID() + 1
 		saveDone      chan struct{}
+		active        = make(map[uint64]context.CancelCauseFunc)
 	)
 	for {
 		// Launch save if requested and not already running.
@@ -230,17 +323,64 @@ func (t *transfersController) mainLoop(state transfersState, client *fileserver.
 
 		select {
 		case tr := <-t.startCh:
-			tx := t.startTransfer(idCounter, client, tr)
+			tx := newTransfer(idCounter, tr)
 			idCounter++
+			active[tx.ID] = t.launch(client, tx)
 			state.add(tx)
 			t.publishState(state)
 
 		case tx := <-t.updateCh:
+			// Progress updates are not saved, but status changes are. This
+			// persists the file size as soon as the download starts.
+			if prev := state.get(tx.ID); prev != nil && prev.Status != tx.Status {
+				saveRequested = true
+			}
 			state.update(tx)
 			t.publishState(state)
-			if tx.isDone() {
+			if !tx.isActive() {
+				delete(active, tx.ID)
+			}
+
+		case a := <-t.actionCh:
+			tx := state.get(a.id)
+			if tx == nil {
+				break
+			}
+			switch a.op {
+			case transferOpPause:
+				if cancel := active[a.id]; cancel != nil {
+					cancel(errTransferPaused)
+				}
+			case transferOpResume:
+				if tx.Status == transferStatusPaused && tx.ref.Node != nil {
+					resumed := *tx
+					resumed.Status = transferStatusConnecting
+					active[a.id] = t.launch(client, resumed)
+					state.update(&resumed)
+				}
+			case transferOpCancel:
+				// Running downloads delete their files when canceled.
+				if cancel := active[a.id]; cancel != nil {
+					cancel(errTransferCanceled)
+				} else if tx.Status == transferStatusPaused {
+					canceled := *tx
+					canceled.removeFiles()
+				}
+				state.remove(a.id)
 				saveRequested = true
+			case transferOpRetry:
+				if tx.Status == transferStatusError && tx.ref.Node != nil {
+					retry := newTransfer(tx.ID, tx.ref)
+					active[a.id] = t.launch(client, retry)
+					state.update(&retry)
+				}
+			case transferOpRemove:
+				if tx.isDone() {
+					state.remove(a.id)
+					saveRequested = true
+				}
 			}
+			t.publishState(state)
 
 		case fn := <-t.modifyCh:
 			state.list = fn(state.list)
@@ -263,11 +403,20 @@ func (t *transfersController) mainLoop(state transfersState, client *fileserver.
 			saveRequested = true
 
 		case <-t.closeCh:
+			// Running downloads are stopped by the shutdown. They are saved
+			// as paused and can be resumed after restart.
+			for id := range active {
+				if tx := state.get(id); tx != nil {
+					paused := *tx
+					paused.Status = transferStatusPaused
+					paused.ReadSpeed = 0
+					state.update(&paused)
+				}
+			}
 			if saveDone != nil {
 				<-saveDone
-			} else {
-				t.saveList(state.list)
 			}
+			t.saveList(state.list)
 			return
 		}
 	}
@@ -286,6 +435,25 @@ func (state *transfersState) add(tx transfer) {
 	state.list = list
 }
 
+func (state *transfersState) get(id uint64) *transfer {
+	for _, tx := range state.list {
+		if tx.ID == id {
+			return tx
+		}
+	}
+	return nil
+}
+
+func (state *transfersState) remove(id uint64) {
+	list := make([]*transfer, 0, len(state.list))
+	for _, tx := range state.list {
+		if tx.ID != id {
+			list = append(list, tx)
+		}
+	}
+	state.list = list
+}
+
 func (state *transfersState) update(tx *transfer) {
 	list := make([]*transfer, len(state.list))
 	for i, item := range state.list {
@@ -326,19 +494,21 @@ func (t *transfersController) loadList() ([]*transfer, error) {
 		log.Printf("transfers: load error: %v", err)
 		return nil, err
 	}
+	for _, tx := range list {
+		if tx.URL != "" {
+			tx.ref, _ = fileserver.ParseURL(tx.URL)
+		}
+		// Transfers that were running when the list was saved can be resumed.
+		if tx.isActive() {
+			tx.Status = transferStatusPaused
+			tx.ReadSpeed = 0
+		}
+	}
 
 	return list, nil
 }
 
 func (t *transfersController) saveList(list []*transfer) error {
-	// Remove in-progress transfers from list.
-	savedList := make([]*transfer, 0, len(list))
-	for _, tx := range list {
-		if tx.isDone() {
-			savedList = append(savedList, tx)
-		}
-	}
-
 	fd, err := os.OpenFile(t.stateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
@@ -346,19 +516,60 @@ func (t *transfersController) saveList(list []*transfer) error {
 	defer fd.Close()
 
 	enc := gob.NewEncoder(fd)
-	return enc.Encode(savedList)
+	return enc.Encode(list)
 }
 
-func (t *transfersController) startTransfer(id uint64, client *fileserver.Client, ref fileserver.TransferRef) transfer {
-	tx := transfer{
+func newTransfer(id uint64, ref fileserver.TransferRef) transfer {
+	return transfer{
 		ID:      id,
 		ref:     ref,
 		Name:    ref.File,
+		URL:     ref.String(),
 		Created: time.Now(),
 		Status:  transferStatusConnecting,
+		Size:    -1,
+		ETA:     -1,
+	}
+}
+
+// launch starts a download. The returned function stops it.
+func (t *transfersController) launch(client *fileserver.Client, tx transfer) context.CancelCauseFunc {
+	ctx, cancel := context.WithCancelCause(t.rootContext)
+	go t.download(ctx, client, tx)
+	return cancel
+}
+
+// downloadName returns the local file name for a remote file.
+func downloadName(file string) string {
+	name := path.Base(path.Clean("/" + file))
+	if name == "/" {
+		return "download"
+	}
+	return name
+}
+
+// createDestFile creates an empty file for the download in dir. If a file of
+// the same name already exists, a number is added to the name.
+func createDestFile(dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		file := filepath.Join(dir, name)
+		if i > 0 {
+			file = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		fd, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fd.Close()
+			return file, nil
+		}
+		if !os.IsExist(err) || i >= 1000 {
+			return "", err
+		}
 	}
-	go t.download(client, tx)
-	return tx
 }
 
 // updateTransfer sends a transfer update to the main loop.
@@ -370,55 +581,183 @@ func (t *transfersController) updateTransfer(tx transfer) {
 }
 
 // download executes a file transfer.
-func (t *transfersController) download(client *fileserver.Client, tx transfer) {
-	r, err := client.Request(t.rootContext, tx.ref.Node, tx.ref.File)
-	if err != nil {
+func (t *transfersController) download(ctx context.Context, client *fileserver.Client, tx transfer) {
+	err := t.runDownload(ctx, client, &tx)
+	switch cause := context.Cause(ctx); {
+	case err == nil:
+		tx.Status = transferStatusDone
+	case cause == errTransferCanceled:
+		tx.removeFiles()
+		tx.Status = transferStatusError
+		tx.Error = cause.Error()
+	case ctx.Err() != nil:
+		// Paused, or the app is shutting down.
+		tx.Status = transferStatusPaused
+	case errors.Is(err, fileserver.ErrFileTooLarge):
+		tx.removeFiles()
+		tx.Status = transferStatusError
+		tx.Error = fmt.Sprintf("File too large (limit %s)", bytesString(maxDownloadSize))
+	default:
+		tx.removeFiles()
 		tx.Status = transferStatusError
 		tx.Error = err.Error()
-		t.updateTransfer(tx)
-		return
 	}
-	defer r.Close()
-
-	tx.Status = transferStatusDownloading
-	tx.Size = r.Size()
+	tx.ReadSpeed = 0
+	tx.ETA = -1
 	t.updateTransfer(tx)
+}
 
-	pr := newProgressReader(r, func(bytes int64, speed int64) {
-		tx.ReadBytes = bytes
-		tx.ReadSpeed = speed
-		t.updateTransfer(tx)
-	})
+// runDownload fetches the file into the partial download file, continuing
+// where a previous attempt stopped. When complete, the content is verified and
+// moved to the destination file.
+func (t *transfersController) runDownload(ctx context.Context, client *fileserver.Client, tx *transfer) error {
+	// The destination file is created before downloading to reserve its name.
+	if tx.DestFile == "" {
+		dest, err := createDestFile(t.downloadDir, downloadName(tx.ref.File))
+		if err != nil {
+			return err
+		}
+		tx.DestFile = dest
+	}
+	part, err := os.OpenFile(tx.partFile(), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
 
-	n, err := io.CopyN(io.Discard, pr, tx.Size)
+	ref := tx.ref
+	if err := ref.Resolve(ctx); err != nil {
+		return err
+	}
+	r, err := client.RequestFrom(ctx, ref.Node, ref.File, uint64(offset))
 	if err != nil {
-		tx.Status = transferStatusError
-		tx.Error = err.Error()
-	} else {
-		tx.Status = transferStatusDone
+		return err
 	}
+	// Close the stream when ctx is canceled. This interrupts the copy below.
+	var (
+		closeOnce sync.Once
+		stop      = make(chan struct{})
+	)
+	closeStream := func() { closeOnce.Do(func() { r.Close() }) }
+	defer closeStream()
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeStream()
+		case <-stop:
+		}
+	}()
 
+	// The server may send less than requested. Discard the part of the
+	// previous attempt that will be sent again.
+	info := r.Info()
+	if info.Offset > uint64(offset) {
+		return fmt.Errorf("server sent invalid offset %d", info.Offset)
+	}
+	if info.Offset != uint64(offset) {
+		offset = int64(info.Offset)
+		if err := part.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := part.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	tx.Status = transferStatusDownloading
+	tx.Size = -1
+	if r.Size() >= 0 {
+		tx.Size = offset + r.Size()
+	}
+	tx.ReadBytes = offset
+	tx.ModTime = info.ModTime
+	tx.ContentType = info.ContentType
+	t.updateTransfer(*tx)
+
+	progress := *tx
+	pr := newProgressReader(r, r.Size(), func(p progressInfo) {
+		progress.ReadBytes = offset + p.bytes
+		progress.ReadSpeed = p.speed
+		progress.ETA = p.eta
+		t.updateTransfer(progress)
+	})
+	var n int64
+	if r.Size() < 0 {
+		n, err = io.Copy(part, pr)
+	} else {
+		n, err = io.CopyN(part, pr, r.Size())
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
 	pr.close()
+	tx.ReadBytes = offset + n
+	tx.AvgSpeed = pr.averageSpeed()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	tx.Size = tx.ReadBytes
 
-	tx.ReadBytes = n
-	t.updateTransfer(tx)
+	if err := part.Close(); err != nil {
+		return err
+	}
+	return finishDownload(tx.partFile(), tx.DestFile, tx.ref.SHA256)
+}
+
+// finishDownload verifies the content of a completed download and moves it to
+// the destination file.
+func finishDownload(part, dest string, hash *[32]byte) error {
+	if hash != nil {
+		fd, err := os.Open(part)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(h.Sum(nil), hash[:]) {
+			return fileserver.ErrHashMismatch
+		}
+	}
+	return os.Rename(part, dest)
 }
 
 // progressReader wraps an io.Reader and reports progress.
 type progressReader struct {
 	src    io.Reader
+	size   int64 // expected size, -1 if unknown
 	report progressFunc
+	start  time.Time
 	bytes  atomic.Int64
 	closed chan struct{}
 	wg     sync.WaitGroup
 }
 
-type progressFunc func(bytes int64, speed int64)
+type progressFunc func(progressInfo)
+
+type progressInfo struct {
+	bytes int64         // bytes read
+	speed int64         // current bytes per second
+	eta   time.Duration // estimated time remaining, -1 if unknown
+}
 
-func newProgressReader(src io.Reader, report progressFunc) *progressReader {
+func newProgressReader(src io.Reader, size int64, report progressFunc) *progressReader {
 	r := &progressReader{
 		src:    src,
+		size:   size,
 		report: report,
+		start:  time.Now(),
 		closed: make(chan struct{}, 1),
 	}
 	r.wg.Add(1)
@@ -432,6 +771,24 @@ func (r *progressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// averageSpeed returns the average number of bytes read per second.
+func (r *progressReader) averageSpeed() int64 {
+	elapsed := time.Since(r.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(math.Round(float64(r.bytes.Load()) / elapsed))
+}
+
+// estimateETA returns the time needed to read the remaining bytes at the given
+// speed. It returns -1 if the time can't be estimated.
+func estimateETA(remaining, speed int64) time.Duration {
+	if remaining < 0 || speed <= 0 {
+		return -1
+	}
+	return time.Duration(float64(remaining) / float64(speed) * float64(time.Second)).Round(time.Second)
+}
+
 // close stops the progress reporting loop.
 func (r *progressReader) close() {
 	close(r.closed)
@@ -456,7 +813,12 @@ func (r *progressReader) reportLoop() {
 			diff := bytes - lastBytes
 			sma.sample(float64(diff) / now.Sub(lastRead).Seconds())
 			lastRead, lastBytes = now, bytes
-			r.report(bytes, int64(math.Round(sma.value())))
+			speed := int64(math.Round(sma.value()))
+			eta := time.Duration(-1)
+			if r.size >= 0 {
+				eta = estimateETA(r.size-bytes, speed)
+			}
+			r.report(progressInfo{bytes, speed, eta})
 		case <-r.closed:
 			return
 		}
@@ -14,11 +14,12 @@ func _() {
 	_ = x[transferStatusDownloading-3]
 	_ = x[transferStatusDone-4]
 	_ = x[transferStatusError-5]
+	_ = x[transferStatusPaused-6]
 }
 
-const _transferStatus_name = "transferStatusCreatedtransferStatusResolvingtransferStatusConnectingtransferStatusDownloadingtransferStatusDonetransferStatusError"
+const _transferStatus_name = "transferStatusCreatedtransferStatusResolvingtransferStatusConnectingtransferStatusDownloadingtransferStatusDonetransferStatusErrortransferStatusPaused"
 
-var _transferStatus_index = [...]uint8{0, 21, 44, 68, 93, 111, 130}
+var _transferStatus_index = [...]uint8{0, 21, 44, 68, 93, 111, 130, 150}
 
 func (i transferStatus) String() string {
 	if i >= transferStatus(len(_transferStatus_index)-1) {
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"gioui.org/x/component"
+	"gioui.org/x/explorer"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"golang.org/x/exp/shiny/materialdesign/icons"
+)
+
+type contactsUI struct {
+	theme   *material.Theme
+	exp     *explorer.Explorer
+	popup   *popupNotifier
+	cc      *contactsController
+	changed chan struct{}
+
+	state contactListForUI
+
+	list       widget.List
+	sheet      *contactSheet
+	addButton  widget.Clickable
+	addIcon    *widget.Icon
+	removeIcon *widget.Icon
+	error      *errorMessageUI
+}
+
+type contactListForUI struct {
+	ptr  *contactsState
+	list []*contactForUI
+}
+
+type contactForUI struct {
+	*contact
+	removeButton widget.Clickable
+}
+
+// update creates contact list items from the current state.
+func (list *contactListForUI) update(data *contactsState) {
+	if data == list.ptr {
+		return // no changes
+	}
+	list.ptr = data
+	list.list = make([]*contactForUI, len(data.list))
+	for i, c := range data.list {
+		list.list[i] = &contactForUI{contact: c}
+	}
+}
+
+func newContactsUI(th *material.Theme, exp *explorer.Explorer, popup *popupNotifier, cc *contactsController) *contactsUI {
+	addIcon, _ := widget.NewIcon(icons.SocialPersonAdd)
+	removeIcon, _ := widget.NewIcon(icons.ActionDelete)
+	ui := &contactsUI{
+		theme:      th,
+		exp:        exp,
+		popup:      popup,
+		cc:         cc,
+		changed:    make(chan struct{}, 1),
+		addIcon:    addIcon,
+		removeIcon: removeIcon,
+		error:      newErrorMessageUI(th, cc.RetryLoad, cc.ResetDatabase),
+	}
+	go func() {
+		for range cc.Changed() {
+			ui.notifyChanged()
+		}
+	}()
+	return ui
+}
+
+// notifyChanged triggers a redraw of the view.
+func (ui *contactsUI) notifyChanged() {
+	select {
+	case ui.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (ui *contactsUI) AppBarTitle() string {
+	return "Contacts"
+}
+
+func (ui *contactsUI) AppBarActions() []*appMenuItem {
+	return []*appMenuItem{
+		{
+			Name:   "Remove all contacts",
+			Action: ui.cc.ResetDatabase,
+		},
+	}
+}
+
+func (ui *contactsUI) Changed() <-chan struct{} {
+	return ui.changed
+}
+
+func (ui *contactsUI) Deactivate() {
+	if ui.sheet != nil {
+		ui.sheet.close()
+	}
+}
+
+func (ui *contactsUI) Layout(gtx C) D {
+	state := ui.cc.State()
+
+	switch {
+	case state.loading:
+		return layout.Center.Layout(gtx, func(gtx C) D {
+			return material.Loader(ui.theme).Layout(gtx)
+		})
+
+	case state.loadError != nil:
+		errMsg := "Error loading contacts: " + state.loadError.Error()
+		return ui.error.Layout(gtx, errMsg)
+
+	default:
+		ui.state.update(state)
+		dim := ui.drawContactList(gtx)
+		if ui.sheet != nil {
+			ui.sheet.Layout(gtx)
+			if ui.sheet.isClosed() {
+				ui.sheet = nil
+			}
+		}
+		if ui.sheet == nil || ui.sheet.isClosing() {
+			layout.UniformInset(unit.Dp(12)).Layout(gtx, ui.drawAddButton)
+		}
+		return dim
+	}
+}
+
+// drawContactList shows the contact list.
+func (ui *contactsUI) drawContactList(gtx C) D {
+	ui.list.Axis = layout.Vertical
+	ls := material.List(ui.theme, &ui.list)
+	return ls.Layout(gtx, len(ui.state.list), func(gtx C, index int) D {
+		c := ui.state.list[index]
+		inset := layout.Inset{Top: 8, Bottom: 2, Left: 16, Right: 4}
+		if index == 0 {
+			inset.Top = 16
+		}
+
+		flex := layout.Flex{Axis: layout.Vertical}
+		return flex.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, func(gtx C) D {
+					return ui.drawContactRow(gtx, c)
+				})
+			}),
+			layout.Rigid(func(gtx C) D {
+				return component.Divider(ui.theme).Layout(gtx)
+			}),
+		)
+	})
+}
+
+func (ui *contactsUI) drawContactRow(gtx C, c *contactForUI) D {
+	if c.removeButton.Clicked() {
+		ui.cc.RemoveContact(c.contact)
+	}
+
+	flex := layout.Flex{Axis: layout.Horizontal}
+	dim := flex.Layout(gtx,
+		layout.Flexed(1.0, func(gtx C) D {
+			flex := layout.Flex{Axis: layout.Vertical}
+			return flex.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return material.Body1(ui.theme, c.Name).Layout(gtx)
+				}),
+				layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
+				layout.Rigid(func(gtx C) D {
+					return material.Caption(ui.theme, c.node.ID().TerminalString()).Layout(gtx)
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			fg := ui.theme.Palette.Bg
+			bg := ui.theme.Palette.Fg
+			btn := component.SimpleIconButton(fg, bg, &c.removeButton, ui.removeIcon)
+			btn.Size = unit.Dp(16)
+			return btn.Layout(gtx)
+		}),
+	)
+
+	// Expand the row to fill the available width.
+	dim.Size.X = gtx.Constraints.Max.X
+	return dim
+}
+
+func (ui *contactsUI) drawAddButton(gtx C) D {
+	if ui.addButton.Clicked() && ui.sheet == nil {
+		ui.sheet = ui.newContactSheet()
+	}
+	btn := material.IconButton(ui.theme, &ui.addButton, ui.addIcon, "Add Contact")
+	return layout.SE.Layout(gtx, btn.Layout)
+}
+
+// contactSheet is the form for adding a contact.
+type contactSheet struct {
+	ui     *contactsUI
+	modal  component.ModalState
+	name   component.TextField
+	enr    component.TextField
+	submit widget.Clickable
+
+	scan     widget.Clickable
+	scanning bool
+	scanned  chan scanResult
+}
+
+type scanResult struct {
+	node *enode.Node
+	err  error
+}
+
+func (ui *contactsUI) newContactSheet() *contactSheet {
+	s := &contactSheet{ui: ui, scanned: make(chan scanResult, 1)}
+	s.modal.State = component.Invisible
+	s.modal.Duration = 100 * time.Millisecond
+	s.modal.Show(time.Now(), s.drawSheet)
+	s.name.SingleLine = true
+	s.enr.SingleLine = true
+	s.enr.Submit = true
+	s.name.Focus()
+	return s
+}
+
+func (s *contactSheet) close() {
+	s.modal.Disappear(time.Now())
+}
+
+func (s *contactSheet) isClosed() bool {
+	return s.modal.State == component.Invisible
+}
+
+func (s *contactSheet) isClosing() bool {
+	return s.isClosed() || s.modal.State == component.Disappearing
+}
+
+func (s *contactSheet) handleSubmit() {
+	name := s.name.Text()
+	if name == "" {
+		s.name.SetError("Name is required")
+		return
+	}
+	s.name.ClearError()
+
+	node, err := parseContactNode(s.enr.Text())
+	if err != nil {
+		s.enr.SetError("Parse error: " + err.Error())
+		return
+	}
+	s.enr.ClearError()
+
+	s.ui.cc.AddContact(name, node)
+	s.ui.popup.ShowNotification("Saved contact " + name)
+	s.close()
+}
+
+// runScan reads a node record from a QR code image chosen by the user.
+func (s *contactSheet) runScan() {
+	var res scanResult
+	defer func() {
+		s.scanned <- res
+		s.ui.notifyChanged()
+	}()
+
+	f, err := s.ui.exp.ChooseFile(".png", ".jpg", ".jpeg")
+	if err != nil {
+		res.err = err
+		return
+	}
+	defer f.Close()
+	res.node, res.err = scanNodeQR(f)
+}
+
+// handleScanResult applies the result of runScan.
+func (s *contactSheet) handleScanResult(res scanResult) {
+	s.scanning = false
+	switch {
+	case res.err == nil:
+		s.enr.SetText(res.node.String())
+		s.enr.ClearError()
+	case errors.Is(res.err, explorer.ErrUserDecline):
+	case errors.Is(res.err, explorer.ErrNotAvailable):
+		s.ui.popup.ShowNotification("Image picker is not available on this device.")
+	default:
+		log.Println("QR scan error:", res.err)
+		s.ui.popup.ShowNotification("QR scan failed: " + res.err.Error())
+	}
+}
+
+func (s *contactSheet) Layout(gtx C) D {
+	m := component.Modal(s.ui.theme, &s.modal)
+	return m.Layout(gtx)
+}
+
+func (s *contactSheet) drawSheet(gtx C) D {
+	return drawSheetSurface(gtx, s.ui.theme, s, s.drawForm)
+}
+
+func (s *contactSheet) drawForm(gtx C) D {
+	if s.isClosing() {
+		gtx = gtx.Disabled()
+	}
+
+	select {
+	case res := <-s.scanned:
+		s.handleScanResult(res)
+	default:
+	}
+	if s.scan.Clicked() && !s.scanning {
+		s.scanning = true
+		go s.runScan()
+	}
+	if s.submit.Clicked() {
+		s.handleSubmit()
+	} else {
+		for _, ev := range s.enr.Events() {
+			if _, ok := ev.(widget.SubmitEvent); ok {
+				s.handleSubmit()
+			}
+		}
+	}
+
+	flex := layout.Flex{Axis: layout.Vertical}
+	return flex.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return s.name.Layout(gtx, s.ui.theme, "Name")
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return s.enr.Layout(gtx, s.ui.theme, "Node record (enr:...)")
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return layout.NE.Layout(gtx, func(gtx C) D {
+				flex := layout.Flex{Axis: layout.Horizontal}
+				return flex.Layout(gtx,
+					layout.Rigid(func(gtx C) D {
+						if s.scanning {
+							gtx = gtx.Disabled()
+						}
+						return material.Button(s.ui.theme, &s.scan, "Scan QR code").Layout(gtx)
+					}),
+					layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+					layout.Rigid(func(gtx C) D {
+						return material.Button(s.ui.theme, &s.submit, "Save").Layout(gtx)
+					}),
+				)
+			})
+		}),
+	)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
+	"time"
 
 	"gioui.org/io/clipboard"
 	"gioui.org/layout"
@@ -34,6 +38,7 @@ type filesUI struct {
 	shareIcon        *widget.Icon
 	removeIcon       *widget.Icon
 	error            *errorMessageUI
+	dirSheet         *directorySheet
 }
 
 type fileListForUI struct {
@@ -45,6 +50,34 @@ type fileRefForUI struct {
 	*fileRef
 	shareButton  widget.Clickable
 	removeButton widget.Clickable
+
+	// for directories
+	expandClick widget.Clickable
+	expanded    bool
+	entries     []*dirEntryForUI
+	readError   error
+}
+
+// dirEntryForUI is a file in a shared directory.
+type dirEntryForUI struct {
+	name        string // path relative to the file space
+	info        fs.FileInfo
+	shareButton widget.Clickable
+}
+
+// readEntries lists the files of a shared directory.
+func (file *fileRefForUI) readEntries() {
+	file.entries = nil
+	entries, err := os.ReadDir(file.Path)
+	file.readError = err
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name := path.Join(file.Name, e.Name())
+		file.entries = append(file.entries, &dirEntryForUI{name: name, info: info})
+	}
 }
 
 // update creates file list items from the current state.
@@ -82,6 +115,10 @@ func (ui *filesUI) AppBarTitle() string {
 
 func (ui *filesUI) AppBarActions() []*appMenuItem {
 	return []*appMenuItem{
+		{
+			Name:   "Share directory",
+			Action: ui.openDirectorySheet,
+		},
 		{
 			Name:   "Remove all files",
 			Action: ui.fs.ResetDatabase,
@@ -94,6 +131,9 @@ func (ui *filesUI) Changed() <-chan struct{} {
 }
 
 func (ui *filesUI) Deactivate() {
+	if ui.dirSheet != nil {
+		ui.dirSheet.close()
+	}
 }
 
 func (ui *filesUI) Layout(gtx C) D {
@@ -112,7 +152,15 @@ func (ui *filesUI) Layout(gtx C) D {
 	default:
 		ui.state.update(state)
 		dim := ui.drawFileList(gtx)
-		layout.UniformInset(unit.Dp(12)).Layout(gtx, ui.drawAddButton)
+		if ui.dirSheet != nil {
+			ui.dirSheet.Layout(gtx)
+			if ui.dirSheet.isClosed() {
+				ui.dirSheet = nil
+			}
+		}
+		if ui.dirSheet == nil || ui.dirSheet.isClosing() {
+			layout.UniformInset(unit.Dp(12)).Layout(gtx, ui.drawAddButton)
+		}
 		return dim
 	}
 }
@@ -163,7 +211,15 @@ func (ui *filesUI) drawFileButtons(gtx C, file *fileRefForUI) D {
 		ui.fs.RemoveFile(file.fileRef)
 	}
 	if file.shareButton.Clicked() {
-		ui.doShareFile(gtx, file)
+		ui.doShareFile(gtx, file.Name)
+	}
+	if file.Dir {
+		// Directories can't be shared as a whole.
+		fg := ui.theme.Palette.Bg
+		bg := ui.theme.Palette.Fg
+		btn := component.SimpleIconButton(fg, bg, &file.removeButton, ui.removeIcon)
+		btn.Size = unit.Dp(16)
+		return btn.Layout(gtx)
 	}
 
 	flex := layout.Flex{Axis: layout.Horizontal}
@@ -186,18 +242,80 @@ func (ui *filesUI) drawFileButtons(gtx C, file *fileRefForUI) D {
 }
 
 func (ui *filesUI) drawFileRowLeft(gtx C, file *fileRefForUI) D {
+	if file.expandClick.Clicked() {
+		file.expanded = !file.expanded
+		if file.expanded {
+			file.readEntries()
+		}
+	}
+
+	caption := bytesString(file.info.Size())
+	if file.Dir {
+		caption = "Directory, tap to show files"
+		if file.expanded {
+			caption = fmt.Sprintf("Directory, %d files", len(file.entries))
+		}
+		if file.readError != nil {
+			caption = "Directory: " + file.readError.Error()
+		}
+	}
+
 	flex := layout.Flex{Axis: layout.Vertical}
 	return flex.Layout(gtx,
 		layout.Rigid(func(gtx C) D {
-			return material.Body1(ui.theme, file.Name).Layout(gtx)
+			return file.expandClick.Layout(gtx, func(gtx C) D {
+				flex := layout.Flex{Axis: layout.Vertical}
+				return flex.Layout(gtx,
+					layout.Rigid(func(gtx C) D {
+						return material.Body1(ui.theme, file.Name).Layout(gtx)
+					}),
+					layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
+					layout.Rigid(func(gtx C) D {
+						return material.Caption(ui.theme, caption).Layout(gtx)
+					}),
+				)
+			})
 		}),
-		layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
-		layout.Rigid(func(gt C) D {
-			return material.Caption(ui.theme, bytesString(file.info.Size())).Layout(gtx)
+		layout.Rigid(func(gtx C) D {
+			if !file.expanded {
+				return D{}
+			}
+			return ui.drawDirEntries(gtx, file)
 		}),
 	)
 }
 
+// drawDirEntries shows the files of an expanded directory.
+func (ui *filesUI) drawDirEntries(gtx C, file *fileRefForUI) D {
+	children := make([]layout.FlexChild, len(file.entries))
+	for i, e := range file.entries {
+		e := e
+		children[i] = layout.Rigid(func(gtx C) D {
+			if e.shareButton.Clicked() {
+				ui.doShareFile(gtx, e.name)
+			}
+			inset := layout.Inset{Top: 4, Left: 16}
+			return inset.Layout(gtx, func(gtx C) D {
+				flex := layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}
+				return flex.Layout(gtx,
+					layout.Flexed(1, func(gtx C) D {
+						text := fmt.Sprintf("%s (%s)", path.Base(e.name), bytesString(e.info.Size()))
+						return material.Body2(ui.theme, text).Layout(gtx)
+					}),
+					layout.Rigid(func(gtx C) D {
+						fg := ui.theme.Palette.Bg
+						bg := ui.theme.Palette.Fg
+						btn := component.SimpleIconButton(fg, bg, &e.shareButton, ui.shareIcon)
+						btn.Size = unit.Dp(16)
+						return btn.Layout(gtx)
+					}),
+				)
+			})
+		})
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+}
+
 func (ui *filesUI) drawAddButton(gtx C) D {
 	if ui.addButton.Clicked() {
 		go ui.runAddFile()
@@ -206,14 +324,14 @@ func (ui *filesUI) drawAddButton(gtx C) D {
 	return layout.SE.Layout(gtx, btn.Layout)
 }
 
-func (ui *filesUI) doShareFile(gtx C, file *fileRefForUI) {
+func (ui *filesUI) doShareFile(gtx C, name string) {
 	netstate := ui.net.State()
 	node := netstate.stats.LocalENR
 	if node == nil {
 		ui.popup.ShowNotification("Network is down, try again later!")
 		return
 	}
-	ref := fileserver.TransferRef{Node: node, File: file.Name}
+	ref := fileserver.TransferRef{Node: node, File: name}
 	clipboard.WriteOp{Text: ref.String()}.Add(gtx.Ops)
 	ui.popup.ShowNotification("File reference copied to clipboard.")
 }
@@ -255,3 +373,92 @@ func bytesString(size int64) string {
 	}
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
 }
+
+func (ui *filesUI) openDirectorySheet() {
+	if ui.dirSheet == nil {
+		ui.dirSheet = ui.newDirectorySheet()
+	}
+}
+
+// directorySheet is the form for adding a shared directory.
+type directorySheet struct {
+	ui     *filesUI
+	modal  component.ModalState
+	input  component.TextField
+	submit widget.Clickable
+}
+
+func (ui *filesUI) newDirectorySheet() *directorySheet {
+	s := &directorySheet{ui: ui}
+	s.modal.State = component.Invisible
+	s.modal.Duration = 100 * time.Millisecond
+	s.modal.Show(time.Now(), s.drawSheet)
+	s.input.SingleLine = true
+	s.input.Submit = true
+	s.input.Focus()
+	return s
+}
+
+func (s *directorySheet) close() {
+	s.modal.Disappear(time.Now())
+}
+
+func (s *directorySheet) isClosed() bool {
+	return s.modal.State == component.Invisible
+}
+
+func (s *directorySheet) isClosing() bool {
+	return s.isClosed() || s.modal.State == component.Disappearing
+}
+
+func (s *directorySheet) handleSubmit(text string) {
+	stat, err := os.Stat(text)
+	if err == nil && !stat.IsDir() {
+		err = errors.New("not a directory")
+	}
+	if err != nil {
+		s.input.SetError(err.Error())
+		return
+	}
+	s.input.ClearError()
+	s.ui.fs.AddFile(text, stat)
+	s.close()
+}
+
+func (s *directorySheet) Layout(gtx C) D {
+	m := component.Modal(s.ui.theme, &s.modal)
+	return m.Layout(gtx)
+}
+
+func (s *directorySheet) drawSheet(gtx C) D {
+	return drawSheetSurface(gtx, s.ui.theme, s, s.drawForm)
+}
+
+func (s *directorySheet) drawForm(gtx C) D {
+	if s.isClosing() {
+		gtx = gtx.Disabled()
+	}
+
+	if s.submit.Clicked() {
+		s.handleSubmit(s.input.Text())
+	} else {
+		for _, ev := range s.input.Events() {
+			if ev, ok := ev.(widget.SubmitEvent); ok {
+				s.handleSubmit(ev.Text)
+			}
+		}
+	}
+
+	flex := layout.Flex{Axis: layout.Vertical}
+	return flex.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return s.input.Layout(gtx, s.ui.theme, "Directory path...")
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return layout.NE.Layout(gtx, func(gtx C) D {
+				return material.Button(s.ui.theme, &s.submit, "Share").Layout(gtx)
+			})
+		}),
+	)
+}
@@ -18,13 +18,20 @@ type appState struct {
 	net       *networkController
 	fs        *filesController
 	transfers *transfersController
+	contacts  *contactsController
 }
 
-func newAppState(dataDir string, config host.Config) *appState {
+// newAppState creates the app components. Downloaded files are saved to
+// downloadDir. If it is empty, they are saved in the data directory.
+func newAppState(dataDir, downloadDir string, config host.Config) *appState {
 	const appName = "discv5-fileshare"
 	fileSpaceFile := filepath.Join(dataDir, appName, "fileSpace.gob")
 	transfersFile := filepath.Join(dataDir, appName, "transfers.gob")
+	contactsFile := filepath.Join(dataDir, appName, "contacts.gob")
 	networkDir := filepath.Join(dataDir, appName, "network")
+	if downloadDir == "" {
+		downloadDir = filepath.Join(dataDir, appName, "downloads")
+	}
 	config.NodeDB = filepath.Join(networkDir, "nodes")
 
 	files := newFilesController(fileSpaceFile)
@@ -32,7 +39,8 @@ func newAppState(dataDir string, config host.Config) *appState {
 	st := &appState{
 		net:       net,
 		fs:        files,
-		transfers: newTransfersController(net, transfersFile),
+		transfers: newTransfersController(net, transfersFile, downloadDir),
+		contacts:  newContactsController(contactsFile),
 	}
 	return st
 }
@@ -41,6 +49,7 @@ func (st *appState) Close() {
 	st.net.Close()
 	st.fs.Close()
 	st.transfers.Close()
+	st.contacts.Close()
 }
 
 type mainUI struct {
@@ -62,6 +71,10 @@ type mainUI struct {
 	transfersIcon  *widget.Icon
 	transfersClick widget.Clickable
 
+	contacts      *contactsUI
+	contactsIcon  *widget.Icon
+	contactsClick widget.Clickable
+
 	// This is the 'current view' of the app.
 	current appView
 }
@@ -90,11 +103,13 @@ func newMainUI(th *material.Theme, exp *explorer.Explorer, state *appState) *mai
 	ui.filespaceIcon, _ = widget.NewIcon(icons.ContentInbox)
 	ui.networkIcon, _ = widget.NewIcon(icons.DeviceWiFiTethering)
 	ui.transfersIcon, _ = widget.NewIcon(icons.NotificationSync)
+	ui.contactsIcon, _ = widget.NewIcon(icons.SocialPeople)
 
 	ui.popup = newPopupNotifier(th)
 	ui.filespace = newFilesUI(th, exp, ui.popup, state.fs, state.net)
 	ui.network = newNetworkUI(th, ui.popup, state.net)
-	ui.transfers = newTransfersUI(th, state.transfers)
+	ui.transfers = newTransfersUI(th, state.transfers, state.contacts)
+	ui.contacts = newContactsUI(th, exp, ui.popup, state.contacts)
 
 	ui.modal = component.NewModal()
 	ui.appbar = component.NewAppBar(ui.modal)
@@ -115,6 +130,7 @@ func (ui *mainUI) actions() ([]component.AppBarAction, []component.OverflowActio
 	filespaceOverflow := component.OverflowAction{Name: "Files", Tag: viewChange{ui.filespace}}
 	networkOverflow := component.OverflowAction{Name: "Network", Tag: viewChange{ui.network}}
 	transfersOverflow := component.OverflowAction{Name: "Transfers", Tag: viewChange{ui.transfers}}
+	contactsOverflow := component.OverflowAction{Name: "Contacts", Tag: viewChange{ui.contacts}}
 	actions := []component.AppBarAction{
 		{
 			OverflowAction: networkOverflow,
@@ -130,6 +146,13 @@ func (ui *mainUI) actions() ([]component.AppBarAction, []component.OverflowActio
 				return a.Layout(gtx, bg, fg)
 			},
 		},
+		{
+			OverflowAction: contactsOverflow,
+			Layout: func(gtx C, bg, fg color.NRGBA) D {
+				a := component.SimpleIconAction(&ui.contactsClick, ui.contactsIcon, contactsOverflow)
+				return a.Layout(gtx, bg, fg)
+			},
+		},
 		{
 			OverflowAction: filespaceOverflow,
 			Layout: func(gtx C, bg, fg color.NRGBA) D {
@@ -164,6 +187,9 @@ func (ui *mainUI) Layout(gtx C) D {
 	if ui.transfersClick.Clicked() {
 		ui.changeView(ui.transfers)
 	}
+	if ui.contactsClick.Clicked() {
+		ui.changeView(ui.contacts)
+	}
 	for _, ev := range ui.appbar.Events(gtx) {
 		switch ev := ev.(type) {
 		case component.AppBarOverflowActionClicked:
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"image"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"gioui.org/io/clipboard"
 	"gioui.org/layout"
@@ -29,6 +32,8 @@ type networkUI struct {
 	qrcodeOp    paint.ImageOp
 	qrcodeClick widget.Clickable
 	renderedSeq uint64
+
+	settings *settingsSheet
 }
 
 type networkStatUI struct {
@@ -64,6 +69,18 @@ func newNetworkUI(theme *material.Theme, popup *popupNotifier, net *networkContr
 				return fmt.Sprintf("%d", s.TableNodes)
 			},
 		},
+		{
+			name: "Sessions",
+			render: func(s *networkStats) string {
+				return fmt.Sprintf("%d", s.Sessions)
+			},
+		},
+		{
+			name: "Traffic",
+			render: func(s *networkStats) string {
+				return fmt.Sprintf("%d kB in, %d kB out", s.BytesIn/1000, s.BytesOut/1000)
+			},
+		},
 	}
 	return ui
 }
@@ -78,6 +95,10 @@ func (ui *networkUI) AppBarActions() []*appMenuItem {
 			Name:   "Restart networking",
 			Action: ui.net.Restart,
 		},
+		{
+			Name:   "Network settings",
+			Action: ui.openSettings,
+		},
 	}
 }
 
@@ -86,9 +107,23 @@ func (ui *networkUI) Changed() <-chan struct{} {
 }
 
 func (ui *networkUI) Deactivate() {
+	if ui.settings != nil {
+		ui.settings.close()
+	}
 }
 
 func (ui *networkUI) Layout(gtx C) D {
+	dim := ui.drawState(gtx)
+	if ui.settings != nil {
+		ui.settings.Layout(gtx)
+		if ui.settings.isClosed() {
+			ui.settings = nil
+		}
+	}
+	return dim
+}
+
+func (ui *networkUI) drawState(gtx C) D {
 	state := ui.net.State()
 	switch {
 	case state.loading:
@@ -204,3 +239,119 @@ func (ui *networkUI) drawStat(gtx C, stat *networkStatUI) D {
 		}),
 	)
 }
+
+func (ui *networkUI) openSettings() {
+	if ui.settings == nil {
+		ui.settings = ui.newSettingsSheet()
+	}
+}
+
+// settingsSheet is the form for changing network settings.
+type settingsSheet struct {
+	ui          *networkUI
+	modal       component.ModalState
+	port        component.TextField
+	nat         component.TextField
+	noBootnodes widget.Bool
+	privateMode widget.Bool
+	submit      widget.Clickable
+}
+
+func (ui *networkUI) newSettingsSheet() *settingsSheet {
+	s := &settingsSheet{ui: ui}
+	s.modal.State = component.Invisible
+	s.modal.Duration = 100 * time.Millisecond
+	s.modal.Show(time.Now(), s.drawSheet)
+	s.port.SingleLine = true
+	s.port.Filter = "0123456789"
+	s.nat.SingleLine = true
+
+	current := ui.net.Settings()
+	if current.ListenPort != 0 {
+		s.port.SetText(strconv.Itoa(current.ListenPort))
+	}
+	s.nat.SetText(current.NAT)
+	s.noBootnodes.Value = current.NoBootnodes
+	s.privateMode.Value = current.PrivateMode
+	return s
+}
+
+func (s *settingsSheet) close() {
+	s.modal.Disappear(time.Now())
+}
+
+func (s *settingsSheet) isClosed() bool {
+	return s.modal.State == component.Invisible
+}
+
+func (s *settingsSheet) isClosing() bool {
+	return s.isClosed() || s.modal.State == component.Disappearing
+}
+
+func (s *settingsSheet) handleSubmit() {
+	settings := networkSettings{
+		NAT:         strings.TrimSpace(s.nat.Text()),
+		NoBootnodes: s.noBootnodes.Value,
+		PrivateMode: s.privateMode.Value,
+	}
+	if text := s.port.Text(); text != "" {
+		port, err := strconv.Atoi(text)
+		if err != nil || port > 65535 {
+			s.port.SetError("Invalid port number")
+			return
+		}
+		settings.ListenPort = port
+	}
+	s.port.ClearError()
+
+	if err := s.ui.net.SetSettings(settings); err != nil {
+		s.nat.SetError(err.Error())
+		return
+	}
+	s.nat.ClearError()
+	s.ui.popup.ShowNotification("Settings saved, restarting network.")
+	s.close()
+}
+
+func (s *settingsSheet) Layout(gtx C) D {
+	m := component.Modal(s.ui.theme, &s.modal)
+	return m.Layout(gtx)
+}
+
+func (s *settingsSheet) drawSheet(gtx C) D {
+	return drawSheetSurface(gtx, s.ui.theme, s, s.drawForm)
+}
+
+func (s *settingsSheet) drawForm(gtx C) D {
+	if s.isClosing() {
+		gtx = gtx.Disabled()
+	}
+	if s.submit.Clicked() {
+		s.handleSubmit()
+	}
+
+	flex := layout.Flex{Axis: layout.Vertical}
+	return flex.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return s.port.Layout(gtx, s.ui.theme, "UDP port (empty for random)")
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return s.nat.Layout(gtx, s.ui.theme, "NAT (any|none|upnp|pmp|extip:<IP>)")
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return material.CheckBox(s.ui.theme, &s.noBootnodes, "Disable bootstrap nodes").Layout(gtx)
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return material.CheckBox(s.ui.theme, &s.privateMode, "Private mode (no discovery)").Layout(gtx)
+		}),
+		layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+		layout.Rigid(func(gtx C) D {
+			return layout.NE.Layout(gtx, func(gtx C) D {
+				return material.Button(s.ui.theme, &s.submit, "Save").Layout(gtx)
+			})
+		}),
+	)
+}
@@ -4,12 +4,10 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"strings"
 	"time"
 
-	"gioui.org/io/pointer"
 	"gioui.org/layout"
-	"gioui.org/op/clip"
-	"gioui.org/op/paint"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
@@ -21,8 +19,9 @@ import (
 var errorColor = color.NRGBA{R: 127, G: 0, B: 0, A: 127}
 
 type transfersUI struct {
-	theme *material.Theme
-	tc    *transfersController
+	theme    *material.Theme
+	tc       *transfersController
+	contacts *contactsController
 
 	error    *errorMessageUI
 	sheet    *downloadSheet
@@ -30,17 +29,71 @@ type transfersUI struct {
 	dlButton widget.Clickable
 	dlIcon   *widget.Icon
 	errIcon  *widget.Icon
+
+	filter        transferFilter
+	filterClicks  [len(transferFilterNames)]widget.Clickable
+	filteredList  []*transfer
+	filteredState *transfersState
+
+	buttons    map[uint64]*transferButtons
+	pauseIcon  *widget.Icon
+	resumeIcon *widget.Icon
+	cancelIcon *widget.Icon
+	retryIcon  *widget.Icon
+	removeIcon *widget.Icon
+}
+
+// transferFilter selects the transfers shown in the list.
+type transferFilter int
+
+const (
+	transferFilterAll transferFilter = iota
+	transferFilterActive
+	transferFilterDone
+	transferFilterError
+)
+
+var transferFilterNames = [...]string{"All", "Active", "Done", "Failed"}
+
+func (f transferFilter) match(tx *transfer) bool {
+	switch f {
+	case transferFilterActive:
+		return !tx.isDone()
+	case transferFilterDone:
+		return tx.Status == transferStatusDone
+	case transferFilterError:
+		return tx.Status == transferStatusError
+	default:
+		return true
+	}
+}
+
+// transferButtons holds the widget state of the per-transfer buttons.
+type transferButtons struct {
+	pause, resume, cancel, retry, remove widget.Clickable
 }
 
-func newTransfersUI(theme *material.Theme, tc *transfersController) *transfersUI {
+func newTransfersUI(theme *material.Theme, tc *transfersController, contacts *contactsController) *transfersUI {
 	dlIcon, _ := widget.NewIcon(icons.FileFileDownload)
 	errIcon, _ := widget.NewIcon(icons.AlertError)
+	pauseIcon, _ := widget.NewIcon(icons.AVPause)
+	resumeIcon, _ := widget.NewIcon(icons.AVPlayArrow)
+	cancelIcon, _ := widget.NewIcon(icons.NavigationClose)
+	retryIcon, _ := widget.NewIcon(icons.NavigationRefresh)
+	removeIcon, _ := widget.NewIcon(icons.ActionDelete)
 	ui := &transfersUI{
-		tc:      tc,
-		theme:   theme,
-		error:   newErrorMessageUI(theme, tc.RetryLoad, tc.ResetState),
-		dlIcon:  dlIcon,
-		errIcon: errIcon,
+		tc:         tc,
+		contacts:   contacts,
+		theme:      theme,
+		error:      newErrorMessageUI(theme, tc.RetryLoad, tc.ResetState),
+		dlIcon:     dlIcon,
+		errIcon:    errIcon,
+		buttons:    make(map[uint64]*transferButtons),
+		pauseIcon:  pauseIcon,
+		resumeIcon: resumeIcon,
+		cancelIcon: cancelIcon,
+		retryIcon:  retryIcon,
+		removeIcon: removeIcon,
 	}
 	ui.list.Axis = layout.Vertical
 	return ui
@@ -82,7 +135,13 @@ func (ui *transfersUI) Layout(gtx C) D {
 		return ui.error.Layout(gtx, state.loadError.Error())
 
 	default:
-		dim := ui.drawTransferList(gtx, state.list)
+		flex := layout.Flex{Axis: layout.Vertical}
+		dim := flex.Layout(gtx,
+			layout.Rigid(ui.drawFilter),
+			layout.Flexed(1, func(gtx C) D {
+				return ui.drawTransferList(gtx, ui.filterList(state))
+			}),
+		)
 		if ui.sheet != nil {
 			ui.sheet.Layout(gtx)
 			if ui.sheet.isClosed() {
@@ -96,7 +155,62 @@ func (ui *transfersUI) Layout(gtx C) D {
 	}
 }
 
+// filterList returns the transfers matching the current filter.
+func (ui *transfersUI) filterList(state *transfersState) []*transfer {
+	if ui.filter == transferFilterAll {
+		return state.list
+	}
+	if ui.filteredState != state {
+		ui.filteredState = state
+		ui.filteredList = ui.filteredList[:0]
+		for _, tx := range state.list {
+			if ui.filter.match(tx) {
+				ui.filteredList = append(ui.filteredList, tx)
+			}
+		}
+	}
+	return ui.filteredList
+}
+
+// drawFilter shows the filter selection.
+func (ui *transfersUI) drawFilter(gtx C) D {
+	for i := range ui.filterClicks {
+		if ui.filterClicks[i].Clicked() {
+			ui.filter = transferFilter(i)
+			ui.filteredState = nil
+		}
+	}
+
+	inset := layout.Inset{Top: 8, Left: 16, Right: 16}
+	return inset.Layout(gtx, func(gtx C) D {
+		children := make([]layout.FlexChild, len(ui.filterClicks))
+		for i := range ui.filterClicks {
+			i := i
+			children[i] = layout.Rigid(func(gtx C) D {
+				btn := material.Button(ui.theme, &ui.filterClicks[i], transferFilterNames[i])
+				if transferFilter(i) != ui.filter {
+					btn.Background = ui.theme.Palette.Fg
+					btn.Color = ui.theme.Palette.Bg
+				}
+				return layout.Inset{Right: unit.Dp(8)}.Layout(gtx, btn.Layout)
+			})
+		}
+		return layout.Flex{Axis: layout.Horizontal}.Layout(gtx, children...)
+	})
+}
+
 func (ui *transfersUI) drawTransferList(gtx C, transfers []*transfer) D {
+	// Drop button state of removed transfers.
+	if len(ui.buttons) > len(transfers) {
+		keep := make(map[uint64]*transferButtons, len(transfers))
+		for _, tx := range transfers {
+			if b := ui.buttons[tx.ID]; b != nil {
+				keep[tx.ID] = b
+			}
+		}
+		ui.buttons = keep
+	}
+
 	list := material.List(ui.theme, &ui.list)
 	return list.Layout(gtx, len(transfers), func(gtx C, index int) D {
 		tx := transfers[len(transfers)-1-index]
@@ -129,6 +243,9 @@ func (ui *transfersUI) drawTransferRow(gtx C, tx *transfer) D {
 				layout.Flexed(1.0, func(gtx C) D {
 					return ui.drawTransferName(gtx, tx)
 				}),
+				layout.Rigid(func(gtx C) D {
+					return ui.drawTransferButtons(gtx, tx)
+				}),
 			)
 		}),
 		layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
@@ -146,12 +263,58 @@ func (ui *transfersUI) drawTransferRow(gtx C, tx *transfer) D {
 	return dim
 }
 
+func (ui *transfersUI) drawTransferButtons(gtx C, tx *transfer) D {
+	b := ui.buttons[tx.ID]
+	if b == nil {
+		b = new(transferButtons)
+		ui.buttons[tx.ID] = b
+	}
+	if b.pause.Clicked() {
+		ui.tc.PauseTransfer(tx.ID)
+	}
+	if b.resume.Clicked() {
+		ui.tc.ResumeTransfer(tx.ID)
+	}
+	if b.cancel.Clicked() {
+		ui.tc.CancelTransfer(tx.ID)
+	}
+	if b.retry.Clicked() {
+		ui.tc.RetryTransfer(tx.ID)
+	}
+	if b.remove.Clicked() {
+		ui.tc.RemoveTransfer(tx.ID)
+	}
+
+	button := func(click *widget.Clickable, icon *widget.Icon) layout.FlexChild {
+		return layout.Rigid(func(gtx C) D {
+			fg := ui.theme.Palette.Bg
+			bg := ui.theme.Palette.Fg
+			btn := component.SimpleIconButton(fg, bg, click, icon)
+			btn.Size = unit.Dp(16)
+			return btn.Layout(gtx)
+		})
+	}
+	flex := layout.Flex{Axis: layout.Horizontal}
+	switch {
+	case tx.Status == transferStatusPaused:
+		return flex.Layout(gtx, button(&b.resume, ui.resumeIcon), button(&b.cancel, ui.cancelIcon))
+	case tx.isActive():
+		return flex.Layout(gtx, button(&b.pause, ui.pauseIcon), button(&b.cancel, ui.cancelIcon))
+	case tx.Status == transferStatusError && tx.ref.Node != nil:
+		return flex.Layout(gtx, button(&b.retry, ui.retryIcon), button(&b.remove, ui.removeIcon))
+	case tx.isDone():
+		return flex.Layout(gtx, button(&b.remove, ui.removeIcon))
+	default:
+		return D{}
+	}
+}
+
 func (ui *transfersUI) drawTransferName(gtx C, tx *transfer) D {
 	return material.Body1(ui.theme, tx.Name).Layout(gtx)
 }
 
 func (ui *transfersUI) drawTransferProgress(gtx C, tx *transfer) D {
-	if tx.Status != transferStatusDownloading {
+	if (tx.Status != transferStatusDownloading && tx.Status != transferStatusPaused) || tx.Size < 0 {
 		return D{}
 	}
 	progress := float32(tx.ReadBytes) / float32(tx.Size)
@@ -162,13 +325,35 @@ func (ui *transfersUI) drawTransferStatus(gtx C, tx *transfer) D {
 	var text string
 	switch tx.Status {
 	case transferStatusConnecting, transferStatusResolving:
-		text = fmt.Sprintf("Connecting...")
+		text = "Connecting..."
+		if tx.Size >= 0 {
+			text = fmt.Sprintf("Connecting... (%s / %s)", bytesString(tx.ReadBytes), bytesString(tx.Size))
+		}
 	case transferStatusDownloading:
-		text = fmt.Sprintf("%s / %s (%s/s)", bytesString(tx.ReadBytes), bytesString(tx.Size), bytesString(tx.ReadSpeed))
+		if tx.Size < 0 {
+			text = fmt.Sprintf("%s (%s/s)", bytesString(tx.ReadBytes), bytesString(tx.ReadSpeed))
+		} else {
+			text = fmt.Sprintf("%s / %s (%s/s, %s)", bytesString(tx.ReadBytes), bytesString(tx.Size), bytesString(tx.ReadSpeed), etaString(tx))
+		}
 	case transferStatusError:
 		text = fmt.Sprintf("%s (%s)", tx.Error, tx.Created.Format(time.DateTime))
+	case transferStatusPaused:
+		if tx.Size < 0 {
+			text = fmt.Sprintf("Paused at %s", bytesString(tx.ReadBytes))
+		} else {
+			text = fmt.Sprintf("Paused at %s / %s", bytesString(tx.ReadBytes), bytesString(tx.Size))
+		}
 	case transferStatusDone:
 		text = fmt.Sprintf("%s (%s)", bytesString(tx.Size), tx.Created.Format(time.DateTime))
+		if tx.AvgSpeed > 0 {
+			text += fmt.Sprintf(", %s/s", bytesString(tx.AvgSpeed))
+		}
+		if tx.ContentType != "" {
+			text += ", " + tx.ContentType
+		}
+		if !tx.ModTime.IsZero() {
+			text += ", modified " + tx.ModTime.Local().Format(time.DateTime)
+		}
 	default:
 		text = bytesString(tx.Size)
 	}
@@ -206,6 +391,12 @@ type downloadSheet struct {
 	modal  component.ModalState
 	input  component.TextField
 	submit widget.Clickable
+
+	// Saved peers. When a peer is selected, the input is a file name.
+	peers      []*contact
+	peerClicks []widget.Clickable
+	peerList   widget.List
+	peer       *contact
 }
 
 func (ui *transfersUI) newDownloadSheet() *downloadSheet {
@@ -216,6 +407,11 @@ func (ui *transfersUI) newDownloadSheet() *downloadSheet {
 	s.input.SingleLine = true
 	s.input.Submit = true
 	s.input.Focus()
+	if state := ui.contacts.State(); state != nil {
+		s.peers = state.list
+		s.peerClicks = make([]widget.Clickable, len(s.peers))
+	}
+	s.peerList.Axis = layout.Horizontal
 	return s
 }
 
@@ -231,6 +427,24 @@ func (s *downloadSheet) isClosing() bool {
 	return s.isClosed() || s.modal.State == component.Disappearing
 }
 
+// drawPeers shows the saved peers as buttons.
+func (s *downloadSheet) drawPeers(gtx C) D {
+	if len(s.peers) == 0 {
+		return D{}
+	}
+	inset := layout.Inset{Bottom: unit.Dp(8)}
+	return inset.Layout(gtx, func(gtx C) D {
+		return material.List(s.ui.theme, &s.peerList).Layout(gtx, len(s.peers), func(gtx C, i int) D {
+			btn := material.Button(s.ui.theme, &s.peerClicks[i], s.peers[i].Name)
+			if s.peers[i] != s.peer {
+				btn.Background = s.ui.theme.Palette.Fg
+				btn.Color = s.ui.theme.Palette.Bg
+			}
+			return layout.Inset{Right: unit.Dp(8)}.Layout(gtx, btn.Layout)
+		})
+	})
+}
+
 func (s *downloadSheet) handleSubmit(text string) (err error) {
 	defer func() {
 		if err == nil {
@@ -240,9 +454,18 @@ func (s *downloadSheet) handleSubmit(text string) (err error) {
 		}
 	}()
 
-	ref, err := fileserver.ParseURL(text)
-	if err != nil {
-		return err
+	var ref fileserver.TransferRef
+	if s.peer != nil {
+		file, err := fileserver.CleanFilename(strings.TrimSpace(text))
+		if err != nil {
+			return err
+		}
+		ref = fileserver.TransferRef{Node: s.peer.node, File: file}
+	} else {
+		ref, err = fileserver.ParseURL(text)
+		if err != nil {
+			return err
+		}
 	}
 	s.ui.tc.StartTransfer(ref)
 	s.close()
@@ -255,23 +478,7 @@ func (s *downloadSheet) Layout(gtx C) D {
 }
 
 func (s *downloadSheet) drawSheet(gtx C) D {
-	inset := layout.Inset{Top: unit.Dp(64)}
-	return inset.Layout(gtx, func(gtx C) D {
-		// Draw the background.
-		rect := image.Rectangle{Max: gtx.Constraints.Max}
-		rr := clip.RRect{Rect: rect, NE: 16, NW: 16}
-		paint.FillShape(gtx.Ops, s.ui.theme.Bg, rr.Op(gtx.Ops))
-
-		// Add a click area to prevent closing the dialog.
-		area := clip.Rect(rect).Push(gtx.Ops)
-		defer area.Pop()
-		input := pointer.InputOp{Tag: s, Types: pointer.Press}
-		input.Add(gtx.Ops)
-
-		// Draw the content.
-		inset := layout.UniformInset(unit.Dp(16))
-		return inset.Layout(gtx, s.drawForm)
-	})
+	return drawSheetSurface(gtx, s.ui.theme, s, s.drawForm)
 }
 
 func (s *downloadSheet) drawForm(gtx C) D {
@@ -290,10 +497,25 @@ func (s *downloadSheet) drawForm(gtx C) D {
 		}
 	}
 
+	for i := range s.peerClicks {
+		if s.peerClicks[i].Clicked() {
+			if s.peer == s.peers[i] {
+				s.peer = nil
+			} else {
+				s.peer = s.peers[i]
+			}
+		}
+	}
+	hint := "File reference..."
+	if s.peer != nil {
+		hint = "File name on " + s.peer.Name + "..."
+	}
+
 	flex := layout.Flex{Axis: layout.Vertical}
 	return flex.Layout(gtx,
+		layout.Rigid(s.drawPeers),
 		layout.Rigid(func(gtx C) D {
-			return s.input.Layout(gtx, s.ui.theme, "File reference...")
+			return s.input.Layout(gtx, s.ui.theme, hint)
 		}),
 		layout.Rigid(func(gtx C) D {
 			return layout.Spacer{Height: unit.Dp(8)}.Layout(gtx)
@@ -305,3 +527,15 @@ func (s *downloadSheet) drawForm(gtx C) D {
 		}),
 	)
 }
+
+// etaString describes the remaining time of a download.
+func etaString(tx *transfer) string {
+	switch {
+	case tx.ReadSpeed == 0:
+		return "stalled"
+	case tx.ETA < 0:
+		return "unknown time left"
+	default:
+		return tx.ETA.String() + " left"
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"image/color"
 	"time"
 
+	"gioui.org/io/pointer"
 	"gioui.org/layout"
 	"gioui.org/op"
 	"gioui.org/op/clip"
@@ -232,3 +233,26 @@ func (n *popupNotifier) drawNotification(gtx C, notification *popupNotification)
 	label.Add(gtx.Ops)
 	return dim
 }
+
+// drawSheetSurface draws the background of a modal sheet and the content
+// widget on top of it. Clicks on the sheet are captured using tag, so they
+// don't close the modal.
+func drawSheetSurface(gtx C, theme *material.Theme, tag any, content layout.Widget) D {
+	inset := layout.Inset{Top: unit.Dp(64)}
+	return inset.Layout(gtx, func(gtx C) D {
+		// Draw the background.
+		rect := image.Rectangle{Max: gtx.Constraints.Max}
+		rr := clip.RRect{Rect: rect, NE: 16, NW: 16}
+		paint.FillShape(gtx.Ops, theme.Bg, rr.Op(gtx.Ops))
+
+		// Add a click area to prevent closing the dialog.
+		area := clip.Rect(rect).Push(gtx.Ops)
+		defer area.Pop()
+		input := pointer.InputOp{Tag: tag, Types: pointer.Press}
+		input.Add(gtx.Ops)
+
+		// Draw the content.
+		inset := layout.UniformInset(unit.Dp(16))
+		return inset.Layout(gtx, content)
+	})
+}
@@ -5,27 +5,41 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
-	"github.com/ethereum/go-ethereum/crypto"
 	ethlog "github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/fjl/discv5-streams/fileserver"
 	"github.com/fjl/discv5-streams/host"
+	"github.com/fjl/discv5-streams/kcpxfer"
 )
 
 func main() {
 	var (
 		// server mode:
-		serveFlag = flag.String("serve", "", "serve files (directory)")
+		serveFlag mountsFlag
+		recvFlag  = flag.String("recv", "", "accept uploads into directory")
 		// client:
 		dlFlag   = flag.String("file", "", "download file")
+		sendFlag = flag.String("send", "", "upload file")
 		nodeFlag = flag.String("node", "", "node to connect to")
 		// common flags:
 		listenAddr = flag.String("laddr", ":0", "UDP listen address")
-		keyFile    = flag.String("nodekey", "", "node key file")
+		network    = flag.String("net", "udp4", "UDP network (udp4, udp6 or udp for dual-stack)")
+		natFlag    = flag.String("nat", "none", "port mapping mechanism (any|none|upnp|pmp|extip:<IP>)")
+		keyFile    = flag.String("nodekey", "", "node key file, created if it doesn't exist")
+		nodeDB     = flag.String("nodedb", "", "node database directory (default: in-memory)")
+		bootnodes  = flag.String("bootnodes", "", "comma-separated bootstrap node records (default: built-in list)")
+		transport  = flag.String("transport", "utp", "stream transport (utp|kcp|kcp-nofec), must match the remote end")
+		noDiscover = flag.Bool("nodiscover", false, "disable discovery, only talk to nodes given explicitly")
 	)
+	flag.Var(&serveFlag, "serve", "serve files from `[name=]dir`, may be given multiple times")
 	flag.Parse()
 
 	h := ethlog.LvlFilterHandler(ethlog.LvlTrace, ethlog.StreamHandler(os.Stderr, ethlog.TerminalFormat(true)))
@@ -34,14 +48,25 @@ func main() {
 	// Load node key, if requested. Otherwise a new key will be generated
 	// by the host.
 	var hostconfig host.Config
+	hostconfig.NodeKeyFile = *keyFile
 	hostconfig.ListenAddr = *listenAddr
-	if *keyFile != "" {
-		key, err := crypto.LoadECDSA(*keyFile)
-		if err != nil {
-			log.Fatal("can't load key file:", err)
-			return
+	hostconfig.Network = *network
+	natm, err := nat.Parse(*natFlag)
+	if err != nil {
+		log.Fatal("invalid -nat: ", err)
+	}
+	hostconfig.NAT = natm
+	hostconfig.NodeDB = *nodeDB
+	hostconfig.NoDiscovery = *noDiscover
+	if *bootnodes != "" {
+		hostconfig.Discovery.Bootnodes = []*enode.Node{}
+		for _, s := range strings.Split(*bootnodes, ",") {
+			n, err := enode.Parse(enode.ValidSchemes, strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("invalid -bootnodes entry %q: %v", s, err)
+			}
+			hostconfig.Discovery.Bootnodes = append(hostconfig.Discovery.Bootnodes, n)
 		}
-		hostconfig.Discovery.PrivateKey = key
 	}
 
 	// Create the host.
@@ -54,24 +79,35 @@ func main() {
 
 	// If server mode is requested, run as server.
 	var config fileserver.Config
-	if *serveFlag != "" {
-		dir := *serveFlag
-		dirinfo, err := os.Stat(dir)
-		if err != nil {
-			log.Fatalf("can't open -serve directory: %v", err)
+	switch *transport {
+	case "utp":
+		config.Transport = fileserver.UTPTransport{}
+	case "kcp":
+		config.Transport = kcpxfer.StreamTransport{}
+	case "kcp-nofec":
+		config.Transport = kcpxfer.StreamTransport{DataShards: 1}
+	default:
+		log.Fatalf("invalid -transport %q", *transport)
+	}
+	if len(serveFlag) > 0 || *recvFlag != "" {
+		for _, m := range serveFlag {
+			checkDir("-serve", m.dir)
 		}
-		if !dirinfo.IsDir() {
-			log.Fatalf("-serve path is not a directory")
+		config.Handler = serveMounts(serveFlag)
+		if *recvFlag != "" {
+			checkDir("-recv", *recvFlag)
+			config.UploadHandler = receiveUploads(*recvFlag)
 		}
 		fmt.Println("server ENR:", host.LocalNode.Node().String())
-		config.Handler = fileserver.ServeFS(os.DirFS(dir))
-		fileserver.NewServer(host, config)
+		if _, err := fileserver.NewServer(host, config); err != nil {
+			log.Fatal(err)
+		}
 		select {}
 	}
 
 	// Run as client.
-	if *dlFlag == "" {
-		log.Fatalf("no file to download")
+	if *dlFlag == "" && *sendFlag == "" {
+		log.Fatalf("no file to download or send")
 		return
 	}
 	node, err := enode.Parse(enode.ValidSchemes, *nodeFlag)
@@ -81,15 +117,145 @@ func main() {
 	}
 
 	ctx := context.Background()
-	client := fileserver.NewClient(host, config)
+	client, err := fileserver.NewClient(host, config)
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer client.Close()
 
+	if *sendFlag != "" {
+		if err := send(ctx, client, node, *sendFlag); err != nil {
+			log.Fatalf("send error: %v", err)
+		}
+		return
+	}
 	r, err := client.Request(ctx, node, *dlFlag)
 	if err != nil {
 		log.Fatalf("request error: %v", err)
 		return
 	}
-	fmt.Println("copying file to stdout")
-	io.Copy(os.Stdout, r)
-	fmt.Println("done")
+	defer r.Close()
+	log.Printf("copying file to stdout")
+	pr := newProgressReader(r, r.Size())
+	_, err = io.Copy(os.Stdout, pr)
+	pr.close()
+	if err != nil {
+		log.Fatalf("download error: %v", err)
+	}
+}
+
+func checkDir(flag, dir string) {
+	dirinfo, err := os.Stat(dir)
+	if err != nil {
+		log.Fatalf("can't open %s directory: %v", flag, err)
+	}
+	if !dirinfo.IsDir() {
+		log.Fatalf("%s path %s is not a directory", flag, dir)
+	}
+}
+
+// send uploads a local file.
+func send(ctx context.Context, client *fileserver.Client, node *enode.Node, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+
+	pr := newProgressReader(f, stat.Size())
+	defer pr.close()
+	return client.Send(ctx, node, filepath.Base(file), uint64(stat.Size()), pr)
+}
+
+// receiveUploads returns an upload handler that stores files in dir.
+func receiveUploads(dir string) fileserver.UploadFunc {
+	return func(req *fileserver.UploadRequest) error {
+		name, err := fileserver.CleanFilename(req.Filename)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, path.Base(name))
+		r, err := req.Accept()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		log.Printf("receiving %s from %v (%d bytes)", dest, req.Node, req.Size)
+		_, err = fileserver.WriteFile(dest, r, int64(req.Size), nil)
+		return err
+	}
+}
+
+// mount is a directory served under a name.
+type mount struct {
+	name string // empty for the root directory
+	dir  string
+}
+
+// mountsFlag is the value of the -serve flag.
+type mountsFlag []mount
+
+func (f *mountsFlag) String() string {
+	var s []string
+	for _, m := range *f {
+		if m.name == "" {
+			s = append(s, m.dir)
+		} else {
+			s = append(s, m.name+"="+m.dir)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *mountsFlag) Set(value string) error {
+	var m mount
+	if name, dir, ok := strings.Cut(value, "="); ok {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid mount name %q", name)
+		}
+		m = mount{name, dir}
+	} else {
+		m = mount{dir: value}
+	}
+	for _, other := range *f {
+		if other.name == m.name {
+			if m.name == "" {
+				return fmt.Errorf("only one directory can be served without a name")
+			}
+			return fmt.Errorf("duplicate mount name %q", m.name)
+		}
+	}
+	*f = append(*f, m)
+	return nil
+}
+
+// serveMounts serves the given directories. Files of named mounts are
+// requested as "name/file". Other requests go to the root directory.
+func serveMounts(mounts []mount) fileserver.ServerFunc {
+	var root fileserver.ServerFunc
+	named := make(map[string]fileserver.ServerFunc)
+	for _, m := range mounts {
+		if m.name == "" {
+			root = fileserver.ServeFS(os.DirFS(m.dir))
+		} else {
+			named[m.name] = fileserver.ServeFS(os.DirFS(m.dir))
+		}
+	}
+	return func(tr *fileserver.TransferRequest) error {
+		if name, rest, ok := strings.Cut(tr.Filename, "/"); ok && named[name] != nil {
+			tr.Filename = rest
+			return named[name](tr)
+		}
+		if root == nil {
+			return fs.ErrNotExist
+		}
+		return root(tr)
+	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressReader wraps an io.Reader and prints transfer progress to stderr.
+// It is a simpler version of the progress reporting in cmd/file-share.
+type progressReader struct {
+	src    io.Reader
+	size   int64 // expected size, -1 if unknown
+	start  time.Time
+	bytes  atomic.Int64
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newProgressReader(src io.Reader, size int64) *progressReader {
+	r := &progressReader{
+		src:    src,
+		size:   size,
+		start:  time.Now(),
+		closed: make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.reportLoop()
+	return r
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.bytes.Add(int64(n))
+	return n, err
+}
+
+// close stops progress reporting and prints the final line.
+func (r *progressReader) close() {
+	close(r.closed)
+	r.wg.Wait()
+	r.print()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (r *progressReader) reportLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.print()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// print writes the current progress line.
+func (r *progressReader) print() {
+	var (
+		bytes = r.bytes.Load()
+		speed int64
+	)
+	if elapsed := time.Since(r.start).Seconds(); elapsed > 0 {
+		speed = int64(math.Round(float64(bytes) / elapsed))
+	}
+	if r.size >= 0 {
+		fmt.Fprintf(os.Stderr, "\r%s / %s (%s/s)   ", bytesString(bytes), bytesString(r.size), bytesString(speed))
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s (%s/s)   ", bytesString(bytes), bytesString(speed))
+	}
+}
+
+// bytesString formats a byte count with a decimal unit prefix.
+func bytesString(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
@@ -13,28 +13,47 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/fjl/discv5-streams/host"
+	"golang.org/x/time/rate"
 )
 
-// This is how long the client will wait for an xfer-start request from the server.
-const transferStartTimeout = 10 * time.Second
+// This is the interval of keepalive pings sent by Conn.
+const connKeepaliveInterval = 20 * time.Second
 
+// Errors returned by Client and TransferRequest. They may be wrapped, use
+// errors.Is to check for them.
 var (
-	errClientClosed             = errors.New("client closed")
-	errCanceled                 = errors.New("transfer canceled")
-	errRejectedByServer         = errors.New("server rejected transfer")
-	errTransferHandshakeTimeout = errors.New("transfer handshake timeout")
+	ErrClosed            = errors.New("client closed")
+	ErrCanceled          = errors.New("transfer canceled")
+	ErrRejected          = errors.New("server rejected transfer") // the server's reason is appended
+	ErrHandshakeTimeout  = errors.New("transfer handshake timeout")
+	ErrNoUDPEndpoint     = errors.New("destination node has no UDP endpoint")
+	ErrShuttingDown      = errors.New("shutting down")
+	ErrTransferAborted   = errors.New("transfer aborted by client")
+	ErrTooManyTransfers  = errors.New("too many transfers to node")
+	ErrTransportMismatch = errors.New("peer uses a different transport")
+	ErrFileTooLarge      = errors.New("file too large")    // see Config.MaxFileSize
+	ErrNotModified       = errors.New("file not modified") // see Client.RequestIfModified
+	ErrInvalidFilename   = errors.New("invalid file name") // see MaxFilenameLength
+)
+
+var (
+	errUnsupportedEncoding = errors.New("server uses unsupported content encoding")
+	errSizeExceeded        = errors.New("stream exceeds announced size")
 )
 
 type Client struct {
-	cfg  *Config
-	host *host.Host
+	cfg         *Config
+	host        *host.Host
+	uploadLimit *rate.Limiter
+	xfers       activeSet
 
 	wg     sync.WaitGroup
 	quit   chan struct{}
-	create chan clientCreateEv
+	create chan *clientCreateEv
 	cancel chan clientCancelEv
 	init   chan clientInitEv
 	start  chan clientStartEv
@@ -43,18 +62,156 @@ type Client struct {
 type ClientStream interface {
 	io.Reader
 	io.Closer
+
+	// Size returns the size of the transferred file.
+	// It returns -1 if the size is not known in advance.
 	Size() int64
+
+	// Info returns the file metadata announced by the server.
+	Info() FileInfo
+
+	// SetReadDeadline sets the deadline for Read calls. When the deadline
+	// passes, pending and future reads fail with a timeout error. A zero value
+	// for t means Read will only time out if Config.ReadTimeout is set.
+	SetReadDeadline(t time.Time) error
+}
+
+// FileInfo is metadata of a transferred file. All fields are optional and have
+// their zero value when the server did not provide them.
+type FileInfo struct {
+	Name        string    // name of the file on the server
+	ModTime     time.Time // modification time, with second precision
+	ContentType string    // MIME type
+
+	// Size is the content size in bytes, or -1 if it is unknown. For
+	// transfers started with RequestFrom, this is the size after Offset.
+	Size int64
+
+	// Offset is the position of the first byte of the stream in the file. It
+	// is zero unless the file was requested with Client.RequestFrom, and may
+	// be zero even then if the server does not support partial transfers.
+	Offset uint64
+}
+
+func (req *xferStartRequest) info() FileInfo {
+	info := FileInfo{Name: req.Name, ContentType: req.ContentType, Offset: req.Offset, Size: -1}
+	if req.FileSize != unknownFileSize {
+		info.Size = int64(req.FileSize)
+	}
+	if req.ModTime != 0 && req.ModTime <= math.MaxInt64 {
+		info.ModTime = time.Unix(int64(req.ModTime), 0)
+	}
+	return info
+}
+
+func (info *FileInfo) setRequest(req *xferStartRequest) {
+	req.Name = info.Name
+	req.ContentType = info.ContentType
+	req.Offset = info.Offset
+	if t := info.ModTime.Unix(); !info.ModTime.IsZero() && t > 0 {
+		req.ModTime = uint64(t)
+	}
+}
+
+// clientStream is the ClientStream returned by Request.
+type clientStream struct {
+	*streamSession
+	client   *Client
+	node     *enode.Node
+	id       uint16
+	info     FileInfo
+	content  io.Reader // decoded stream content
+	deadline time.Time // set by SetReadDeadline
+	read     int64
+	eof      bool
+	closed   bool
+}
+
+func (s *clientStream) Read(b []byte) (int, error) {
+	if timeout := s.client.cfg.ReadTimeout; timeout > 0 {
+		d := time.Now().Add(timeout)
+		if !s.deadline.IsZero() && s.deadline.Before(d) {
+			d = s.deadline
+		}
+		s.conn.SetReadDeadline(d)
+	}
+	n, err := s.content.Read(b)
+	s.read += int64(n)
+	if limit := s.client.cfg.MaxFileSize; limit > 0 && uint64(s.read) > limit {
+		// Streams of unknown size are cut off at the limit.
+		n -= int(uint64(s.read) - limit)
+		s.read = int64(limit)
+		return n, ErrFileTooLarge
+	}
+	if size := s.Size(); size >= 0 && s.read > size {
+		// Compressed streams can expand beyond the announced size.
+		n -= int(s.read - size)
+		s.read = size
+		return n, errSizeExceeded
+	}
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// Info returns the file metadata announced by the server.
+func (s *clientStream) Info() FileInfo {
+	return s.info
+}
+
+// SetReadDeadline sets the deadline for Read calls.
+func (s *clientStream) SetReadDeadline(t time.Time) error {
+	s.deadline = t
+	return s.conn.SetReadDeadline(t)
+}
+
+// Close closes the stream. If the transfer is incomplete, the server is
+// notified that the transfer was aborted.
+func (s *clientStream) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	defer s.client.xfers.end()
+	complete := s.eof || (s.Size() >= 0 && s.read >= s.Size())
+	if !complete {
+		if err := s.client.sendXferAbort(s.node, s.id); err != nil {
+			log.Printf("client: can't send abort: %v", err)
+		}
+	}
+	return s.streamSession.Close()
 }
 
 type clientTransfer struct {
-	createTime  time.Time
-	acceptStart chan *clientTransfer
-	started     chan *clientTransfer
-	session     *utpsession
-	fileSize    int64
-	err         error
+	state        clientTransferState
+	createTime   time.Time
+	pendingStart chan clientStartAccept // start request waiting for the init response
+	started      chan *clientTransfer
+	session      *streamSession
+
+	// These are set by the first start request handler.
+	fileSize  int64
+	info      FileInfo
+	encoding  string
+	err       error
+	startResp []byte        // response to the start request, resent for retries
+	startDone chan struct{} // closed when startResp is set
 }
 
+// clientTransferState tracks the transfer handshake. The client sends the init
+// request and the server responds, then the server sends the start request. The
+// server may send the start request before its init response is received, so a
+// start request arriving in state transferAwaitInit is held until the init
+// response is processed.
+type clientTransferState int
+
+const (
+	transferAwaitInit   clientTransferState = iota // init request sent
+	transferAwaitStart                             // init request accepted by server
+	transferEstablished                            // start request accepted
+)
+
 type transferKey struct {
 	node enode.ID
 	id   uint16
@@ -64,9 +221,10 @@ type transferKey struct {
 type (
 	clientCreateEv struct {
 		node    enode.ID
-		id      uint16
+		id      uint16 // assigned by loop
+		created chan bool
 		started chan *clientTransfer
-		session *utpsession
+		session *streamSession
 	}
 
 	clientCancelEv struct {
@@ -83,41 +241,114 @@ type (
 	clientStartEv struct {
 		node   enode.ID
 		req    xferStartRequest
-		accept chan *clientTransfer
+		accept chan clientStartAccept
 	}
 )
 
-func NewClient(host *host.Host, cfg Config) *Client {
+// clientStartAccept is the answer of loop to a start request. The transfer is
+// nil if the request must be rejected. If retry is true, the server has resent
+// a start request that was already accepted.
+type clientStartAccept struct {
+	t     *clientTransfer
+	retry bool
+}
+
+// NewClient returns a new file transfer client. It fails if the protocols of
+// cfg.Prefix are already registered on host.
+func NewClient(host *host.Host, cfg Config) (*Client, error) {
 	cfg = cfg.withDefaults()
 	c := &Client{
-		host:   host,
-		cfg:    &cfg,
-		quit:   make(chan struct{}),
-		create: make(chan clientCreateEv),
-		cancel: make(chan clientCancelEv),
-		init:   make(chan clientInitEv),
-		start:  make(chan clientStartEv),
+		host:        host,
+		cfg:         &cfg,
+		uploadLimit: newRateLimiter(cfg.MaxTotalUploadBytesPerSec),
+		quit:        make(chan struct{}),
+		create:      make(chan *clientCreateEv),
+		cancel:      make(chan clientCancelEv),
+		init:        make(chan clientInitEv),
+		start:       make(chan clientStartEv),
+	}
+	err := host.RegisterTalkHandlers(map[string]discover.TalkRequestHandler{
+		cfg.Prefix + "-start": c.handleXferStart,
+	})
+	if err != nil {
+		return nil, err
 	}
+	host.AddDrainer(c)
 	c.wg.Add(1)
 	go c.loop()
-
-	xferStart := cfg.Prefix + "-start"
-	host.Discovery.RegisterTalkHandler(xferStart, c.handleXferStart)
-	return c
+	return c, nil
 }
 
 // Request fetches a file from the given node.
 func (c *Client) Request(ctx context.Context, node *enode.Node, file string) (ClientStream, error) {
-	create := clientCreateEv{
-		id:      c.generateID(),
+	return c.request(ctx, node, xferInitRequest{Filename: file})
+}
+
+// RequestFrom fetches the part of a file starting at the given offset. This is
+// used to resume an interrupted download. Servers may ignore the offset and
+// send the whole file, so callers must check the Offset of the stream's Info.
+// The Size of the stream is the size of the transferred part.
+func (c *Client) RequestFrom(ctx context.Context, node *enode.Node, file string, offset uint64) (ClientStream, error) {
+	return c.request(ctx, node, xferInitRequest{Filename: file, Offset: offset})
+}
+
+// Precondition describes the client's copy of a file for conditional requests.
+// Both fields are optional.
+type Precondition struct {
+	ModTime time.Time // modification time of the copy, with second precision
+	SHA256  *[32]byte // hash of the copy
+}
+
+// RequestIfModified fetches a file only if the server's file differs from the
+// client's copy described by known. When the server reports that the file is
+// not modified, it returns ErrNotModified. Servers may ignore the precondition
+// and send the file anyway.
+func (c *Client) RequestIfModified(ctx context.Context, node *enode.Node, file string, known Precondition) (ClientStream, error) {
+	req := xferInitRequest{Filename: file}
+	if t := known.ModTime.Unix(); !known.ModTime.IsZero() && t > 0 {
+		req.IfModifiedSince = uint64(t)
+	}
+	if known.SHA256 != nil {
+		req.IfNoneMatch = known.SHA256[:]
+	}
+	return c.request(ctx, node, req)
+}
+
+// RequestArchive fetches all files matching pattern from the given node. The
+// files are delivered in a single transfer as a tar archive. Pattern syntax is
+// the same as for path.Match.
+func (c *Client) RequestArchive(ctx context.Context, node *enode.Node, pattern string) (ClientStream, error) {
+	return c.request(ctx, node, xferInitRequest{Filename: pattern, Archive: true})
+}
+
+func (c *Client) request(ctx context.Context, node *enode.Node, req xferInitRequest) (_ ClientStream, err error) {
+	if err := checkFilename(req.Filename); err != nil {
+		return nil, err
+	}
+	if !c.xfers.begin() {
+		return nil, ErrShuttingDown
+	}
+	defer func() {
+		if err != nil {
+			c.xfers.end()
+		}
+	}()
+
+	create := &clientCreateEv{
 		node:    node.ID(),
+		created: make(chan bool, 1),
 		started: make(chan *clientTransfer, 1),
-		session: newSession(c.host.Socket),
+		session: newSession(c.host.Socket, c.cfg.Transport),
 	}
 	if !clientEvent(c, c.create, create) {
-		return nil, errClientClosed
+		return nil, ErrClosed
+	}
+	if !<-create.created {
+		return nil, ErrTooManyTransfers
 	}
-	if err := c.sendXferInit(node, file, create.id); err != nil {
+	req.ID = create.id
+	req.Encodings = c.cfg.supportedEncodings()
+	if err := c.sendXferInit(node, &req); err != nil {
 		clientEvent(c, c.cancel, clientCancelEv{node.ID(), create.id})
 		return nil, err
 	}
@@ -129,15 +360,158 @@ func (c *Client) Request(ctx context.Context, node *enode.Node, file string) (Cl
 			return nil, t.err
 		}
 		create.session.transferSize = t.fileSize
-		return create.session, nil
+		stream := &clientStream{
+			streamSession: create.session,
+			client:        c,
+			node:          node,
+			id:            create.id,
+			info:          t.info,
+		}
+		stream.content = &decodeReader{r: create.session, encoding: t.encoding}
+		return stream, nil
 	case <-ctx.Done():
 		clientEvent(c, c.cancel, clientCancelEv{node.ID(), create.id})
 		return nil, ctx.Err()
 	}
 }
 
-func (c *Client) generateID() uint16 {
-	return uint16(rand.Intn(math.MaxUint16))
+// Send uploads a file to the given node. The remote node must have an upload handler
+// configured in order to accept the transfer.
+func (c *Client) Send(ctx context.Context, node *enode.Node, name string, size uint64, reader io.Reader) error {
+	if node.IP() == nil || node.UDP() == 0 {
+		return ErrNoUDPEndpoint
+	}
+	if err := checkFilename(name); err != nil {
+		return err
+	}
+	if !c.xfers.begin() {
+		return ErrShuttingDown
+	}
+	defer c.xfers.end()
+
+	initiator, err := c.host.SessionStore.Initiator(c.cfg.Prefix)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	req := &xferPushRequest{
+		Filename:        name,
+		FileSize:        size,
+		InitiatorSecret: initiator.Secret(),
+		Transport:       transportName(c.cfg.Transport),
+	}
+	reqBytes, _ := rlp.EncodeToBytes(req)
+	xferPush := c.cfg.Prefix + "-push"
+	respBytes, err := c.host.Discovery.TalkRequest(node, xferPush, reqBytes)
+	if err != nil {
+		return fmt.Errorf("upload request failed: %w", err)
+	}
+	var resp xferPushResponse
+	if err := rlp.DecodeBytes(respBytes, &resp); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if !resp.OK {
+		return rejectError(resp.Reason)
+	}
+
+	// Start the session. As the initiator, this side sends the first packet.
+	addr := &net.UDPAddr{IP: node.IP(), Port: node.UDP()}
+	w := newSession(c.host.Socket, c.cfg.Transport)
+	initiator.SetHandler(w.deliver)
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	session := initiator.Establish(ip, resp.RecipientSecret)
+	if err := w.connect(session, addr); err != nil {
+		return err
+	}
+	defer w.Close()
+
+	return w.sendContent(ctx, reader, int64(size), nil, newRateLimiter(c.cfg.MaxUploadBytesPerSec), c.uploadLimit)
+}
+
+// Conn is a handle for making many requests to a single node.
+type Conn struct {
+	client *Client
+	node   *enode.Node
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Dial prepares requests to the given node. The discovery handshake with the node
+// is performed immediately, and the session is kept alive until the Conn is closed.
+// Requests made through the Conn thus don't pay for the handshake.
+func (c *Client) Dial(node *enode.Node) (*Conn, error) {
+	if node.IP() == nil || node.UDP() == 0 {
+		return nil, ErrNoUDPEndpoint
+	}
+	if err := c.host.Discovery.Ping(node); err != nil {
+		return nil, err
+	}
+	conn := &Conn{client: c, node: node, closed: make(chan struct{})}
+	c.wg.Add(1)
+	go conn.keepalive()
+	return conn, nil
+}
+
+// Node returns the remote node.
+func (conn *Conn) Node() *enode.Node {
+	return conn.node
+}
+
+// Request fetches a file from the remote node.
+func (conn *Conn) Request(ctx context.Context, file string) (ClientStream, error) {
+	return conn.client.Request(ctx, conn.node, file)
+}
+
+// RequestArchive fetches all files matching pattern from the remote node.
+// See Client.RequestArchive for details.
+func (conn *Conn) RequestArchive(ctx context.Context, pattern string) (ClientStream, error) {
+	return conn.client.RequestArchive(ctx, conn.node, pattern)
+}
+
+// Send uploads a file to the remote node.
+func (conn *Conn) Send(ctx context.Context, name string, size uint64, reader io.Reader) error {
+	return conn.client.Send(ctx, conn.node, name, size, reader)
+}
+
+// Close stops the keepalive. Streams created by the Conn are not affected.
+func (conn *Conn) Close() {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+}
+
+func (conn *Conn) keepalive() {
+	defer conn.client.wg.Done()
+
+	ticker := time.NewTicker(connKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.client.host.Discovery.Ping(conn.node); err != nil {
+				log.Printf("client: keepalive ping to %x failed: %v", conn.node.ID().Bytes()[:8], err)
+			}
+		case <-conn.closed:
+			return
+		case <-conn.client.quit:
+			return
+		}
+	}
+}
+
+// freeTransferID picks a random transfer ID that isn't used by any live
+// transfer to the given node. It returns false if all IDs are in use.
+func freeTransferID(transfers map[transferKey]*clientTransfer, node enode.ID) (uint16, bool) {
+	start := uint16(rand.Intn(math.MaxUint16 + 1))
+	for i := 0; i <= math.MaxUint16; i++ {
+		id := start + uint16(i)
+		if _, ok := transfers[transferKey{node, id}]; !ok {
+			return id, true
+		}
+	}
+	return 0, false
 }
 
 func clientEvent[T any](c *Client, ch chan<- T, ev T) bool {
@@ -149,6 +523,12 @@ func clientEvent[T any](c *Client, ch chan<- T, ev T) bool {
 	}
 }
 
+// Drain makes new requests fail and waits for active transfers to finish,
+// or until ctx is canceled. Transfers are active until their stream is closed.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.xfers.drain(ctx)
+}
+
 func (c *Client) Close() {
 	close(c.quit)
 	c.wg.Wait()
@@ -159,66 +539,95 @@ func (c *Client) loop() {
 
 	var (
 		transfers = make(map[transferKey]*clientTransfer)
-		ticker    = time.NewTicker(10 * time.Second)
+		ticker    = time.NewTicker(c.cfg.StartTimeout / 4)
 	)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case create := <-c.create:
+			id, ok := freeTransferID(transfers, create.node)
+			if !ok {
+				create.created <- false
+				continue
+			}
+			create.id = id
+			create.created <- true
 			log.Printf("client: transfer created: %x:%d", create.node[:8], create.id)
 			key := transferKey{create.node, create.id}
 			transfers[key] = &clientTransfer{
-				started: create.started,
-				session: create.session,
+				createTime: time.Now(),
+				started:    create.started,
+				session:    create.session,
 			}
 
 		case cancel := <-c.cancel:
 			log.Printf("client: transfer canceled: %x:%d", cancel.node[:8], cancel.id)
 			key := transferKey{cancel.node, cancel.id}
-			t := transfers[key]
-			if t != nil {
-				t.err = errCanceled
-				if t.acceptStart != nil {
-					t.acceptStart <- nil
-				}
+			if t := transfers[key]; t != nil {
+				t.rejectPendingStart()
 				delete(transfers, key)
 			}
 
 		case init := <-c.init:
 			key := transferKey{init.node, init.id}
 			t := transfers[key]
-			if t == nil {
+			if t == nil || t.state != transferAwaitInit {
 				continue
 			}
 			if !init.resp.OK {
-				t.err = errRejectedByServer
+				t.rejectPendingStart()
 				delete(transfers, key)
 				continue
 			}
-			// It was accepted. Since the init response and start request are not
-			// synchronized, the start request might have arrived already. Unblock the
-			// start request handler if it did.
-			if t.acceptStart != nil {
-				t.acceptStart <- t
+			t.state = transferAwaitStart
+			if t.pendingStart != nil {
+				// The start request arrived before the init response.
+				t.establish(t.pendingStart)
+				t.pendingStart = nil
 			}
 
 		case start := <-c.start:
 			key := transferKey{start.node, start.req.ID}
 			t := transfers[key]
-			if t == nil {
-				continue
+			if t != nil && t.state != transferEstablished {
+				if err := c.checkStart(&start.req); err != nil {
+					// Reject the transfer before establishing the session.
+					log.Printf("client: rejecting transfer %x:%d: %v", start.node[:8], start.req.ID, err)
+					t.rejectPendingStart()
+					delete(transfers, key)
+					start.accept <- clientStartAccept{}
+					t.err = err
+					t.started <- t
+					continue
+				}
 			}
-			t.acceptStart = start.accept
-			if t.err == nil {
-				t.acceptStart <- t
+			switch {
+			case t == nil:
+				start.accept <- clientStartAccept{}
+			case t.state == transferAwaitInit:
+				// Hold the request until the init response is processed.
+				// If the server resent it, the earlier request is stale.
+				t.rejectPendingStart()
+				t.pendingStart = start.accept
+			case t.state == transferAwaitStart:
+				t.establish(start.accept)
+			case t.state == transferEstablished:
+				start.accept <- clientStartAccept{t: t, retry: true}
 			}
 
 		case <-ticker.C:
 			now := time.Now()
 			for key, t := range transfers {
-				if t.createTime.Add(transferStartTimeout).After(now) {
-					t.err = errTransferHandshakeTimeout
-					delete(transfers, key)
+				if now.Sub(t.createTime) < c.cfg.StartTimeout {
+					continue
+				}
+				delete(transfers, key)
+				if t.state != transferEstablished {
+					// The server didn't start the transfer in time.
+					t.rejectPendingStart()
+					t.err = ErrHandshakeTimeout
+					t.started <- t
 				}
 			}
 
@@ -228,60 +637,134 @@ func (c *Client) loop() {
 	}
 }
 
-func (c *Client) sendXferInit(node *enode.Node, file string, id uint16) error {
-	req := &xferInitRequest{Filename: file, ID: id}
+// checkStart verifies the size and encoding announced by the server.
+func (c *Client) checkStart(req *xferStartRequest) error {
+	size := req.FileSize
+	if c.cfg.MaxFileSize != 0 && size != unknownFileSize && size > c.cfg.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes", ErrFileTooLarge, size)
+	}
+	if req.Encoding == encodingIdentity {
+		return nil
+	}
+	for _, enc := range c.cfg.supportedEncodings() {
+		if enc == req.Encoding {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q", errUnsupportedEncoding, req.Encoding)
+}
+
+// establish accepts the start request of t.
+func (t *clientTransfer) establish(accept chan clientStartAccept) {
+	t.state = transferEstablished
+	t.startDone = make(chan struct{})
+	accept <- clientStartAccept{t: t}
+}
+
+// rejectPendingStart rejects the start request held in state transferAwaitInit.
+func (t *clientTransfer) rejectPendingStart() {
+	if t.pendingStart != nil {
+		t.pendingStart <- clientStartAccept{}
+		t.pendingStart = nil
+	}
+}
+
+func (c *Client) sendXferInit(node *enode.Node, req *xferInitRequest) error {
 	reqBytes, _ := rlp.EncodeToBytes(req)
 	xferInit := c.cfg.Prefix + "-init"
 	respBytes, err := c.host.Discovery.TalkRequest(node, xferInit, reqBytes)
 	if err != nil {
-		return err
+		return fmt.Errorf("transfer request failed: %w", err)
 	}
 
 	var resp xferInitResponse
 	if err := rlp.DecodeBytes(respBytes, &resp); err != nil {
-		return fmt.Errorf("invalid response: %v", err)
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	c.init <- clientInitEv{node.ID(), req.ID, resp}
+	if resp.NotModified {
+		return ErrNotModified
 	}
-	c.init <- clientInitEv{node.ID(), id, resp}
 	if !resp.OK {
-		return fmt.Errorf("server rejected transfer")
+		return rejectError(resp.Reason)
 	}
 	return nil
 }
 
+func (c *Client) sendXferAbort(node *enode.Node, id uint16) error {
+	req := &xferAbortRequest{ID: id}
+	reqBytes, _ := rlp.EncodeToBytes(req)
+	xferAbort := c.cfg.Prefix + "-abort"
+	_, err := c.host.Discovery.TalkRequest(node, xferAbort, reqBytes)
+	return err
+}
+
+// rejectError creates the error for a transfer rejected by the server.
+func rejectError(reason string) error {
+	if reason == "" {
+		return ErrRejected
+	}
+	return fmt.Errorf("%w: %s", ErrRejected, reason)
+}
+
 func (c *Client) handleXferStart(node enode.ID, addr *net.UDPAddr, reqBytes []byte) []byte {
 	var req xferStartRequest
 	if err := rlp.DecodeBytes(reqBytes, &req); err != nil {
 		return nil
 	}
-	if req.FileSize > math.MaxInt64 {
+	if req.FileSize > math.MaxInt64 && req.FileSize != unknownFileSize {
 		return nil // overflow, ignore request
 	}
 
-	accept := make(chan *clientTransfer, 1)
-	c.start <- clientStartEv{node, req, accept}
-
-	var transfer *clientTransfer
-	timeoutTimer := time.NewTimer(400 * time.Millisecond)
-	defer timeoutTimer.Stop()
+	accept := make(chan clientStartAccept, 1)
+	if !clientEvent(c, c.start, clientStartEv{node, req, accept}) {
+		return encodeXferStartResponse(false, [16]byte{})
+	}
+	var a clientStartAccept
 	select {
-	case transfer = <-accept:
-	case <-timeoutTimer.C:
-		fmt.Println("accept timeout")
+	case a = <-accept:
+	case <-c.quit:
 	}
-	if transfer == nil {
-		// Canceled or timed out.
+	transfer := a.t
+	switch {
+	case transfer == nil:
+		// Unknown, canceled or timed out.
 		return encodeXferStartResponse(false, [16]byte{})
+	case a.retry:
+		// The server didn't receive the response. Send it again.
+		select {
+		case <-transfer.startDone:
+			return transfer.startResp
+		case <-c.quit:
+			return nil
+		}
 	}
 
 	transfer.fileSize = int64(req.FileSize)
+	if req.FileSize == unknownFileSize {
+		transfer.fileSize = -1
+	}
+	transfer.info = req.info()
+	transfer.encoding = req.Encoding
+	transfer.startResp = c.startSession(transfer, addr, &req)
+	close(transfer.startDone)
 
 	// Relay accept signal to the waiting caller.
-	defer func() { transfer.started <- transfer }()
+	transfer.started <- transfer
+	return transfer.startResp
+}
 
+// startSession establishes the session of an accepted transfer and returns the
+// response to the start request.
+func (c *Client) startSession(transfer *clientTransfer, addr *net.UDPAddr, req *xferStartRequest) []byte {
+	if req.Transport != transportName(c.cfg.Transport) {
+		transfer.err = fmt.Errorf("%w: server transport %q", ErrTransportMismatch, req.Transport)
+		return encodeXferStartResponse(false, [16]byte{})
+	}
 	ip, _ := netip.AddrFromSlice(addr.IP)
 	rs, err := c.host.SessionStore.Recipient(c.cfg.Prefix, ip, req.InitiatorSecret)
 	if err != nil {
-		transfer.err = fmt.Errorf("session establishment failed: %v", err)
+		transfer.err = fmt.Errorf("session establishment failed: %w", err)
 		return encodeXferStartResponse(false, [16]byte{})
 	}
 	resp := encodeXferStartResponse(true, rs.Secret())
@@ -289,7 +772,10 @@ func (c *Client) handleXferStart(node enode.ID, addr *net.UDPAddr, reqBytes []by
 	// Start the session.
 	rs.SetHandler(transfer.session.deliver)
 	s := rs.Establish()
-	transfer.session.connect(s, addr)
+	if err := transfer.session.connect(s, addr); err != nil {
+		transfer.err = err
+		return encodeXferStartResponse(false, [16]byte{})
+	}
 	return resp
 }
 
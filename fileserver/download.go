@@ -0,0 +1,120 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrHashMismatch is returned by WriteFile and Client.Download when the
+// downloaded content does not match the expected hash.
+var ErrHashMismatch = errors.New("content hash mismatch")
+
+var (
+	errDownloadFiles = errors.New("download of multiple files is not supported")
+	errRangeHash     = errors.New("hash of a partial download can't be verified")
+)
+
+// Download fetches ref.File from ref.Node and saves it to dest. If ref.Range is
+// set, only that part of the file is saved. If ref.SHA256 is set, the content is
+// verified against it. See WriteFile for details.
+//
+// References to multiple files are not supported, and neither are references
+// with both a range and a hash, since the hash covers the whole file.
+func (c *Client) Download(ctx context.Context, ref TransferRef, dest string) (int64, error) {
+	if len(ref.Files) > 0 {
+		return 0, errDownloadFiles
+	}
+	var start uint64
+	if ref.Range != nil {
+		if ref.SHA256 != nil {
+			return 0, errRangeHash
+		}
+		start = uint64(ref.Range.Start)
+	}
+	if err := ref.Resolve(ctx); err != nil {
+		return 0, err
+	}
+	r, err := c.RequestFrom(ctx, ref.Node, ref.File, start)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// The server may send more than requested. Skip the part before the range.
+	size := r.Size()
+	info := r.Info()
+	if info.Offset > start {
+		return 0, fmt.Errorf("server sent invalid offset %d", info.Offset)
+	}
+	if skip := int64(start - info.Offset); skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if size >= 0 {
+			size -= skip
+		}
+	}
+	if ref.Range != nil && ref.Range.End >= 0 {
+		size = ref.Range.End - ref.Range.Start + 1
+	}
+	return WriteFile(dest, r, size, ref.SHA256)
+}
+
+// WriteFile saves the content of r to dest. If size is not negative, exactly
+// size bytes are read, and a shorter stream is an error. If wantHash is not
+// nil, the SHA256 hash of the content must match it.
+//
+// The content is written to a temporary file in the directory of dest, which is
+// renamed to dest when complete. On error, dest is left unmodified.
+func WriteFile(dest string, r io.Reader, size int64, wantHash *[32]byte) (n int64, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.part")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var (
+		h hash.Hash
+		w io.Writer = tmp
+	)
+	if wantHash != nil {
+		h = sha256.New()
+		w = io.MultiWriter(tmp, h)
+	}
+	if size < 0 {
+		n, err = io.Copy(w, r)
+	} else {
+		n, err = io.CopyN(w, r, size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	if h != nil && !bytes.Equal(h.Sum(nil), wantHash[:]) {
+		return n, ErrHashMismatch
+	}
+	if err = tmp.Sync(); err != nil {
+		return n, err
+	}
+	if err = tmp.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), dest)
+}
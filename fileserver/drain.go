@@ -0,0 +1,59 @@
+package fileserver
+
+import (
+	"context"
+	"sync"
+)
+
+// activeSet counts in-flight transfers. Once draining has started, no new
+// transfers can begin.
+type activeSet struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{} // closed when draining and active == 0
+}
+
+// begin registers a new transfer. It returns false if the set is draining.
+func (a *activeSet) begin() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.draining {
+		return false
+	}
+	a.active++
+	return true
+}
+
+// end unregisters a transfer started by begin.
+func (a *activeSet) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.active--
+	if a.draining && a.active == 0 {
+		close(a.idle)
+	}
+}
+
+// drain stops new transfers and waits for active ones to end.
+func (a *activeSet) drain(ctx context.Context) error {
+	a.mu.Lock()
+	if !a.draining {
+		a.draining = true
+		a.idle = make(chan struct{})
+		if a.active == 0 {
+			close(a.idle)
+		}
+	}
+	idle := a.idle
+	a.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,16 +1,38 @@
 package fileserver
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
 	"time"
+	"unicode/utf8"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/fjl/discv5-streams/host"
+	"github.com/fjl/discv5-streams/session"
+	"github.com/fjl/discv5-streams/sharedsocket"
+	"github.com/fjl/discv5-streams/utpconn"
 )
 
 // func init() {
@@ -36,6 +58,14 @@ type testSetup struct {
 }
 
 func newTestSetup(t *testing.T) *testSetup {
+	return newTestSetupWithConfig(t, Config{Handler: ServeFS(testFS)})
+}
+
+func newTestSetupWithConfig(t *testing.T, serverConfig Config) *testSetup {
+	return newTestSetupWithConfigs(t, serverConfig, Config{})
+}
+
+func newTestSetupWithConfigs(t *testing.T, serverConfig, clientConfig Config) *testSetup {
 	host1, err := host.Listen(host.ConfigForTesting)
 	if err != nil {
 		t.Fatal("listen error:", err)
@@ -47,13 +77,16 @@ func newTestSetup(t *testing.T) *testSetup {
 		t.Fatal("listen error:", err)
 	}
 
-	serverConfig := Config{Handler: ServeFS(testFS)}
-	return &testSetup{
-		serverHost: host1,
-		clientHost: host2,
-		server:     NewServer(host1, serverConfig),
-		client:     NewClient(host2, Config{}),
+	test := &testSetup{serverHost: host1, clientHost: host2}
+	if test.server, err = NewServer(host1, serverConfig); err != nil {
+		test.close()
+		t.Fatal(err)
 	}
+	if test.client, err = NewClient(host2, clientConfig); err != nil {
+		test.close()
+		t.Fatal(err)
+	}
+	return test
 }
 
 func (s *testSetup) close() {
@@ -84,6 +117,47 @@ func TestTransfer(t *testing.T) {
 	}
 }
 
+// This test checks that a completed download, read through the stream returned
+// by Client.Request, is not reported as aborted when the stream is closed.
+func TestClientRequestComplete(t *testing.T) {
+	sendErr := make(chan error, 1)
+	test := newTestSetupWithConfig(t, Config{
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			err := tr.SendFile(context.Background(), uint64(len(testContent)), bytes.NewReader(testContent))
+			sendErr <- err
+			return err
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+	r.Close()
+
+	select {
+	case err := <-sendErr:
+		if err != nil {
+			t.Fatal("SendFile error:", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("SendFile did not return")
+	}
+}
+
 func TestClientTransferSize(t *testing.T) {
 	test := newTestSetup(t)
 	defer test.close()
@@ -115,19 +189,1795 @@ func TestClientRejectHandling(t *testing.T) {
 	}
 }
 
-func TestClientTimeoutHandling(t *testing.T) {
+func TestClientRejectReason(t *testing.T) {
 	test := newTestSetup(t)
 	defer test.close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// The server will just time out this request, because the file does not exist.
+	// The server should reject this request because the file does not exist.
 	_, err := test.client.Request(ctx, test.serverNode(), "wrong-file")
 	if err == nil {
 		t.Fatal("expected error")
 	}
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("expected rejection error, got", err)
+	}
+	if !strings.Contains(err.Error(), fs.ErrNotExist.Error()) {
+		t.Fatal("rejection reason missing from error:", err)
+	}
+}
+
+func TestRejectReasonTruncation(t *testing.T) {
+	// The multi-byte rune crosses the length limit.
+	long := strings.Repeat("a", maxReasonLength-1) + "ü" + "tail"
+	reason := rejectReason(errors.New(long))
+	if !utf8.ValidString(reason) {
+		t.Fatalf("reason is not valid UTF-8: %q", reason)
+	}
+	if reason != long[:maxReasonLength-1] {
+		t.Fatalf("wrong reason %q", reason)
+	}
+
+	short := "access to ü.txt denied"
+	if reason := rejectReason(errors.New(short)); reason != short {
+		t.Fatalf("wrong reason %q", reason)
+	}
+}
+
+func TestClientTimeoutHandling(t *testing.T) {
+	test := newTestSetupWithConfig(t, Config{
+		// This handler accepts the request, but never starts the transfer.
+		Handler: func(tr *TransferRequest) error {
+			return tr.Accept()
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err == nil {
+		t.Fatal("expected error")
+	}
 	if !errors.Is(err, context.DeadlineExceeded) {
 		t.Fatal("expected timeout error")
 	}
 }
+
+// This test checks that Config.ReadTimeout fails a transfer which stops
+// delivering data.
+func TestClientReadTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	serverConfig := Config{
+		// This handler sends part of the file, then stalls.
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			r := io.MultiReader(bytes.NewReader(testContent[:1000]), stallReader(stall))
+			return tr.SendFile(context.Background(), uint64(len(testContent)), r)
+		},
+	}
+	clientConfig := Config{ReadTimeout: 200 * time.Millisecond}
+	test := newTestSetupWithConfigs(t, serverConfig, clientConfig)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	buf := make([]byte, 1000)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal("read error:", err)
+	}
+	_, err = r.Read(buf)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+// stallReader blocks until ch is closed.
+type stallReader chan struct{}
+
+func (ch stallReader) Read(b []byte) (int, error) {
+	<-ch
+	return 0, io.EOF
+}
+
+func TestClientSend(t *testing.T) {
+	received := make(chan []byte, 1)
+	test := newTestSetupWithConfig(t, Config{
+		UploadHandler: func(req *UploadRequest) error {
+			if req.Filename != "upload" {
+				return errors.New("wrong file name")
+			}
+			r, err := req.Accept()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			content, err := io.ReadAll(io.LimitReader(r, int64(req.Size)))
+			received <- content
+			return err
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := test.client.Send(ctx, test.serverNode(), "upload", uint64(len(testContent)), bytes.NewReader(testContent))
+	if err != nil {
+		t.Fatal("send error:", err)
+	}
+	select {
+	case content := <-received:
+		if !bytes.Equal(content, testContent) {
+			t.Fatal("wrong file content")
+		}
+	case <-ctx.Done():
+		t.Fatal("upload not received")
+	}
+}
+
+func TestClientSendRejected(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The server has no upload handler, so it should reject the upload.
+	err := test.client.Send(ctx, test.serverNode(), "upload", 10, bytes.NewReader(make([]byte, 10)))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestServerTransferLimit(t *testing.T) {
+	var (
+		accepted = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	test := newTestSetupWithConfig(t, Config{
+		MaxTransfersPerNode: 1,
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			accepted <- struct{}{}
+			<-release
+			return nil
+		},
+	})
+	defer test.close()
+
+	// Start the first transfer. The handler blocks, so it will remain active.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go test.client.Request(ctx, test.serverNode(), "file")
+	<-accepted
+	if n := test.server.ActiveTransfers(); n != 1 {
+		t.Fatal("wrong number of active transfers:", n)
+	}
+
+	// The second transfer should be rejected.
+	_, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if n := test.server.ActiveTransfers(); n != 1 {
+		t.Fatal("wrong number of active transfers:", n)
+	}
+
+	// When the handler returns, the slot is released.
+	close(release)
+	for start := time.Now(); test.server.ActiveTransfers() != 0; {
+		if time.Since(start) > 1*time.Second {
+			t.Fatal("transfer slot not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerRequestRateLimit(t *testing.T) {
+	test := newTestSetupWithConfig(t, Config{
+		Handler:                  ServeFS(testFS),
+		MaxRequestsPerNodePerSec: 1,
+		MaxRequestBurstPerNode:   2,
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The burst allows two requests.
+	for i := 0; i < 2; i++ {
+		r, err := test.client.Request(ctx, test.serverNode(), "file")
+		if err != nil {
+			t.Fatalf("request %d error: %v", i, err)
+		}
+		io.Copy(io.Discard, r)
+		r.Close()
+	}
+	// The third one exceeds the rate.
+	_, err := test.client.Request(ctx, test.serverNode(), "file")
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("expected rejection error, got", err)
+	}
+	if !strings.Contains(err.Error(), errTooManyRequests.Error()) {
+		t.Fatal("rejection reason missing from error:", err)
+	}
+}
+
+func TestServerUploadThrottle(t *testing.T) {
+	// The limiter allows a burst of one second worth of data, so transferring
+	// testContent should take at least half a second with this limit.
+	limit := len(testContent) / 2
+	test := newTestSetupWithConfig(t, Config{
+		Handler:              ServeFS(testFS),
+		MaxUploadBytesPerSec: limit,
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatal("transfer was not throttled, took", elapsed)
+	}
+}
+
+func TestServerSendFileCancel(t *testing.T) {
+	sendErr := make(chan error, 1)
+	test := newTestSetupWithConfig(t, Config{
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			// The reader cancels the context after delivering the first chunk.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := &cancelingReader{r: bytes.NewReader(testContent), cancel: cancel}
+			err := tr.SendFile(ctx, uint64(len(testContent)), r)
+			sendErr <- err
+			return err
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	select {
+	case err := <-sendErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("expected cancellation error, got", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("SendFile did not return")
+	}
+}
+
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.cancel()
+	return n, err
+}
+
+func TestClientAbort(t *testing.T) {
+	sendErr := make(chan error, 1)
+	test := newTestSetupWithConfig(t, Config{
+		// The transfer is throttled, so it would take a long time to complete.
+		MaxUploadBytesPerSec: len(testContent) / 10,
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			err := tr.SendFile(context.Background(), uint64(len(testContent)), bytes.NewReader(testContent))
+			sendErr <- err
+			return err
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 100)); err != nil {
+		t.Fatal("read error:", err)
+	}
+	r.Close()
+
+	select {
+	case err := <-sendErr:
+		if !errors.Is(err, ErrTransferAborted) {
+			t.Fatal("expected abort error, got", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("SendFile did not return")
+	}
+}
+
+func TestServerProgress(t *testing.T) {
+	progress := make(chan int64, 1)
+	test := newTestSetupWithConfig(t, Config{
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			if p := tr.Progress(); p != 0 {
+				return fmt.Errorf("non-zero progress %d before SendFile", p)
+			}
+			err := tr.SendFile(context.Background(), uint64(len(testContent)), bytes.NewReader(testContent))
+			progress <- tr.Progress()
+			return err
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal("read error:", err)
+	}
+
+	select {
+	case p := <-progress:
+		if p != int64(len(testContent)) {
+			t.Fatalf("wrong progress %d, want %d", p, len(testContent))
+		}
+	case <-ctx.Done():
+		t.Fatal("SendFile did not return")
+	}
+}
+
+func TestServerSendStream(t *testing.T) {
+	test := newTestSetupWithConfig(t, Config{
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			return tr.SendStream(context.Background(), bytes.NewReader(testContent))
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	if r.Size() != -1 {
+		t.Fatal("wrong size", r.Size())
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+}
+
+func TestClientMaxFileSize(t *testing.T) {
+	serverCfg := Config{Handler: ServeFS(testFS)}
+	clientCfg := Config{MaxFileSize: uint64(len(testContent) - 1)}
+	test := newTestSetupWithConfigs(t, serverCfg, clientCfg)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := test.client.Request(ctx, test.serverNode(), "file")
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal("wrong error:", err)
+	}
+
+	// The server side reports sizes it can't send with the same error.
+	err = new(TransferRequest).SendFile(ctx, math.MaxUint64, nil)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal("wrong SendFile error:", err)
+	}
+}
+
+func TestClientMaxFileSizeStream(t *testing.T) {
+	const limit = 1000
+	serverCfg := Config{
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			return tr.SendStream(context.Background(), bytes.NewReader(testContent))
+		},
+	}
+	test := newTestSetupWithConfigs(t, serverCfg, Config{MaxFileSize: limit})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal("wrong error:", err)
+	}
+	if !bytes.Equal(content, testContent[:limit]) {
+		t.Fatalf("wrong content: got %d bytes", len(content))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible line of text\n"), 10000)
+	fsys := fstest.MapFS{
+		"log.txt": &fstest.MapFile{Data: text},
+		"file":    &fstest.MapFile{Data: testContent},
+	}
+	cfg := Config{Handler: ServeFS(fsys), Compression: true}
+
+	tests := []struct {
+		name       string
+		file       string
+		clientCfg  Config
+		data       []byte
+		compressed bool
+	}{
+		{"text", "log.txt", cfg, text, true},
+		{"binary", "file", cfg, testContent, false},
+		{"client-disabled", "log.txt", Config{}, text, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup := newTestSetupWithConfigs(t, cfg, test.clientCfg)
+			defer setup.close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			r, err := setup.client.Request(ctx, setup.serverNode(), test.file)
+			if err != nil {
+				t.Fatal("request error:", err)
+			}
+			defer r.Close()
+			if r.Size() != int64(len(test.data)) {
+				t.Fatalf("wrong size %d", r.Size())
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal("read error:", err)
+			}
+			if !bytes.Equal(content, test.data) {
+				t.Fatal("wrong file content")
+			}
+
+			received := setup.clientHost.Stats().BytesIn
+			if compressed := received < uint64(len(test.data)/2); compressed != test.compressed {
+				t.Fatalf("received %d bytes for %d bytes of content, compressed %t", received, len(test.data), test.compressed)
+			}
+		})
+	}
+}
+
+func TestClientRequestArchive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a.txt": &fstest.MapFile{Data: []byte("file a")},
+		"dir/b.txt": &fstest.MapFile{Data: []byte("file b")},
+		"dir/c.bin": &fstest.MapFile{Data: testContent},
+	}
+	test := newTestSetupWithConfig(t, Config{Handler: ServeFS(fsys)})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.RequestArchive(ctx, test.serverNode(), "dir/*.txt")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("tar error:", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal("read error:", err)
+		}
+		if !bytes.Equal(content, fsys[hdr.Name].Data) {
+			t.Fatalf("wrong content for %s", hdr.Name)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "dir/a.txt,dir/b.txt" {
+		t.Fatal("wrong files in archive:", names)
+	}
+
+	// Patterns matching nothing are rejected.
+	_, err = test.client.RequestArchive(ctx, test.serverNode(), "nothing/*")
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("wrong error for empty match:", err)
+	}
+}
+
+func TestServerAuthorize(t *testing.T) {
+	var allowed atomic.Bool
+	test := newTestSetupWithConfig(t, Config{
+		Handler: ServeFS(testFS),
+		UploadHandler: func(req *UploadRequest) error {
+			r, err := req.Accept()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(io.Discard, io.LimitReader(r, int64(req.Size)))
+			return err
+		},
+		Authorize: func(node enode.ID, filename string) error {
+			if !allowed.Load() {
+				return errors.New("node not allowed")
+			}
+			return nil
+		},
+	})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := test.client.Request(ctx, test.serverNode(), "file")
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "node not allowed") {
+		t.Fatal("wrong error for unauthorized node:", err)
+	}
+	err = test.client.Send(ctx, test.serverNode(), "upload", 10, bytes.NewReader(make([]byte, 10)))
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "node not allowed") {
+		t.Fatal("wrong upload error for unauthorized node:", err)
+	}
+
+	allowed.Store(true)
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+	if err := test.client.Send(ctx, test.serverNode(), "upload", 10, bytes.NewReader(make([]byte, 10))); err != nil {
+		t.Fatal("send error:", err)
+	}
+}
+
+func TestServerTransferEvents(t *testing.T) {
+	type event struct {
+		kind string
+		TransferEvent
+	}
+	events := make(chan event, 10)
+	test := newTestSetupWithConfig(t, Config{
+		Handler:    ServeFS(testFS),
+		OnStart:    func(ev TransferEvent) { events <- event{"start", ev} },
+		OnComplete: func(ev TransferEvent) { events <- event{"complete", ev} },
+		OnError:    func(ev TransferEvent) { events <- event{"error", ev} },
+	})
+	defer test.close()
+	next := func() event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return event{}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal("read error:", err)
+	}
+	r.Close()
+
+	clientID := test.clientHost.LocalNode.ID()
+	if ev := next(); ev.kind != "start" || ev.Node != clientID || ev.Filename != "file" || ev.Bytes != 0 {
+		t.Fatalf("wrong start event %+v", ev)
+	}
+	if ev := next(); ev.kind != "complete" || ev.Bytes != int64(len(testContent)) || ev.Duration <= 0 || ev.Err != nil {
+		t.Fatalf("wrong complete event %+v", ev)
+	}
+
+	// Requests that fail before they are accepted only produce an error event.
+	if _, err := test.client.Request(ctx, test.serverNode(), "missing"); err == nil {
+		t.Fatal("request for missing file succeeded")
+	}
+	if ev := next(); ev.kind != "error" || ev.Filename != "missing" || ev.Err == nil {
+		t.Fatalf("wrong error event %+v", ev)
+	}
+}
+
+func TestClientDial(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	// Count the discv5 handshakes received by the server.
+	var handshakes atomic.Int32
+	serverID := test.serverHost.LocalNode.ID()
+	test.serverHost.AddHandler(sharedsocket.HandlerFunc(func(b []byte, from net.Addr) bool {
+		if flag, ok := discv5PacketFlag(b, serverID); ok && flag == discv5FlagHandshake {
+			handshakes.Add(1)
+		}
+		return false
+	}), host.SessionHandlerPriority+1)
+
+	conn, err := test.client.Dial(test.serverNode())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	if n := handshakes.Load(); n != 1 {
+		t.Fatalf("%d handshakes during Dial, want 1", n)
+	}
+
+	// Requests through the Conn reuse the session established by Dial.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		r, err := conn.Request(ctx, "file")
+		if err != nil {
+			t.Fatalf("request %d error: %v", i, err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("request %d read error: %v", i, err)
+		}
+		if !bytes.Equal(content, testContent) {
+			t.Fatalf("request %d: wrong file content", i)
+		}
+	}
+	if n := handshakes.Load(); n != 1 {
+		t.Fatalf("%d handshakes after requests, want 1", n)
+	}
+}
+
+const discv5FlagHandshake = 2
+
+// discv5PacketFlag unmasks the static header of a discv5 packet sent to dest
+// and returns its flag.
+func discv5PacketFlag(packet []byte, dest enode.ID) (byte, bool) {
+	const (
+		ivSize     = 16
+		headerSize = 6 + 2 + 1 + 12 + 2 // protocol ID, version, flag, nonce, authsize
+	)
+	if len(packet) < ivSize+headerSize {
+		return 0, false
+	}
+	block, err := aes.NewCipher(dest[:16])
+	if err != nil {
+		return 0, false
+	}
+	var head [headerSize]byte
+	cipher.NewCTR(block, packet[:ivSize]).XORKeyStream(head[:], packet[ivSize:ivSize+headerSize])
+	if string(head[:6]) != "discv5" {
+		return 0, false
+	}
+	return head[8], true
+}
+
+func TestDuplicateProtocol(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	if _, err := NewServer(test.serverHost, Config{}); err == nil {
+		t.Fatal("NewServer succeeded with duplicate prefix")
+	}
+	if _, err := NewServer(test.serverHost, Config{Prefix: "other"}); err != nil {
+		t.Fatal("NewServer failed with different prefix:", err)
+	}
+	want := []string{"other-abort", "other-init", "other-push", "xfer-abort", "xfer-init", "xfer-push"}
+	if protos := test.serverHost.Protocols(); !reflect.DeepEqual(protos, want) {
+		t.Fatalf("wrong protocols %q", protos)
+	}
+}
+
+// This test checks that Close aborts uploads in progress.
+func TestServerCloseUpload(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		readErr = make(chan error, 1)
+		stall   = make(chan struct{})
+	)
+	defer close(stall)
+	test := newTestSetupWithConfig(t, Config{
+		UploadHandler: func(req *UploadRequest) error {
+			r, err := req.Accept()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			buf := make([]byte, 1000)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				readErr <- err
+				return err
+			}
+			close(started)
+			_, err = io.Copy(io.Discard, r)
+			readErr <- err
+			return err
+		},
+	})
+	defer test.close()
+
+	// The client sends part of the file, then stalls.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		r := io.MultiReader(bytes.NewReader(testContent[:1000]), stallReader(stall))
+		test.client.Send(ctx, test.serverNode(), "upload", uint64(len(testContent)), r)
+	}()
+
+	select {
+	case <-started:
+	case err := <-readErr:
+		t.Fatal("read error:", err)
+	case <-ctx.Done():
+		t.Fatal("upload not started")
+	}
+	test.server.Close()
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrTransferAborted) {
+			t.Fatal("wrong read error after Close:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("upload not aborted by Close")
+	}
+}
+
+// This test checks that a closed server refuses requests, and that a new
+// server can be created on the same host afterwards.
+func TestServerClose(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	test.server.Close()
+	if protos := test.serverHost.Protocols(); len(protos) != 0 {
+		t.Fatalf("protocols still registered after Close: %q", protos)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := test.client.Request(ctx, test.serverNode(), "file"); err == nil {
+		t.Fatal("request to closed server succeeded")
+	}
+
+	// Create a new server with the same prefix.
+	if _, err := NewServer(test.serverHost, Config{Handler: ServeFS(testFS)}); err != nil {
+		t.Fatal("NewServer failed after Close:", err)
+	}
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+}
+
+func TestHostShutdown(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	stream, err := test.client.Request(context.Background(), test.serverNode(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown should wait for the active stream.
+	done := make(chan error, 1)
+	go func() { done <- test.clientHost.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatal("Shutdown returned while transfer active:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// New requests are rejected while draining.
+	if _, err := test.client.Request(context.Background(), test.serverNode(), "file"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatal("wrong error for request during shutdown:", err)
+	}
+
+	io.Copy(io.Discard, stream)
+	stream.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Shutdown error:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+// delayConn delays all outgoing packets.
+type delayConn struct {
+	*net.UDPConn
+	delay time.Duration
+}
+
+func (c *delayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	packet := append([]byte{}, b...)
+	time.AfterFunc(c.delay, func() { c.UDPConn.WriteTo(packet, addr) })
+	return len(b), nil
+}
+
+func (c *delayConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return c.WriteTo(b, addr)
+}
+
+// This test checks that transfers can be established on a high-latency link
+// when the handshake timeouts are raised.
+func TestTransferLatency(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host1, err := host.NewWithConn(&delayConn{pc.(*net.UDPConn), 150 * time.Millisecond}, host.ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host1.Close()
+	host2, err := host.Listen(host.ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host2.Close()
+
+	cfg := Config{
+		Handler:         ServeFS(testFS),
+		StartTimeout:    20 * time.Second,
+		StartRetryDelay: 500 * time.Millisecond,
+	}
+	if _, err := NewServer(host1, cfg); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(host2, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, err := client.Request(ctx, host1.Discovery.Self(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base := 20 * time.Millisecond
+	for attempt := 0; attempt < 20; attempt++ {
+		limit := base << attempt
+		if attempt >= 8 {
+			limit = maxStartRetryDelay
+		}
+		for i := 0; i < 50; i++ {
+			d := retryDelay(base, attempt)
+			if d < limit/2 || d > limit {
+				t.Fatalf("attempt %d: delay %v out of range [%v, %v]", attempt, d, limit/2, limit)
+			}
+		}
+	}
+}
+
+func TestTransferRefURL(t *testing.T) {
+	var r enr.Record
+	key, _ := crypto.GenerateKey()
+	enode.SignV4(&r, key)
+	node, _ := enode.New(enode.ValidSchemes, &r)
+	hash := sha256.Sum256([]byte("content"))
+	refs := []TransferRef{
+		{Node: node, File: "file"},
+		{Node: node, File: "dir/file", Files: []string{"a", "b c"}},
+		{Node: node, File: "file", Range: &ByteRange{Start: 1000, End: -1}},
+		{Node: node, File: "file", Range: &ByteRange{Start: 0, End: 99}, SHA256: &hash},
+		{Node: enode.NewV4(&key.PublicKey, net.IP{10, 0, 0, 1}, 0, 30303), File: "file"},
+		{Node: enode.NewV4(&key.PublicKey, net.ParseIP("2001:db8::1"), 0, 30303), File: "file"},
+		{Node: enode.NewV4(&key.PublicKey, nil, 0, 30303), Host: "example.com:30303", File: "file"},
+	}
+	for _, ref := range refs {
+		url := ref.String()
+		parsed, err := ParseURL(url)
+		if err != nil {
+			t.Fatalf("can't parse %q: %v", url, err)
+		}
+		if !reflect.DeepEqual(parsed, ref) {
+			t.Errorf("wrong round-trip result for %q:\ngot  %+v\nwant %+v", url, parsed, ref)
+		}
+	}
+
+	base := refs[0].String()
+	for _, query := range []string{"?range=10", "?range=10-5", "?range=-5", "?sha256=abcd", "?file="} {
+		if _, err := ParseURL(base + query); err == nil {
+			t.Errorf("no error for %q", query)
+		}
+	}
+	pubkey := hex.EncodeToString(crypto.FromECDSAPub(&key.PublicKey)[1:])
+	for _, url := range []string{
+		"discv5fs://abcd@10.0.0.1:30303/file",
+		"discv5fs://" + pubkey + "@10.0.0.1/file",
+		"discv5fs://" + pubkey + "@10.0.0.1:0/file",
+		"discv5fs://" + pubkey + "@:30303/file",
+	} {
+		if _, err := ParseURL(url); err == nil {
+			t.Errorf("no error for %q", url)
+		}
+	}
+}
+
+func TestTransferRefResolve(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	ref, err := ParseURL("discv5fs://" + hex.EncodeToString(crypto.FromECDSAPub(&key.PublicKey)[1:]) + "@localhost:30303/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Host != "localhost:30303" || ref.Node.IP() != nil {
+		t.Fatalf("wrong ref %+v", ref)
+	}
+	if err := ref.Resolve(context.Background()); err != nil {
+		t.Fatal("resolve error:", err)
+	}
+	if !ref.Node.IP().IsLoopback() || ref.Node.UDP() != 30303 {
+		t.Fatalf("wrong endpoint after Resolve: %v:%d", ref.Node.IP(), ref.Node.UDP())
+	}
+	if ref.Node.ID() != enode.PubkeyToIDV4(&key.PublicKey) {
+		t.Fatal("wrong node ID after Resolve")
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	valid := map[string]string{
+		"file":          "file",
+		"dir/file":      "dir/file",
+		"dir/../file":   "file",
+		"./dir//file":   "dir/file",
+		"%2e%2e/file":   "%2e%2e/file", // not decoded
+		"..%2f..%2fetc": "..%2f..%2fetc",
+	}
+	for name, want := range valid {
+		got, err := CleanFilename(name)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", name, err)
+		} else if got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+
+	invalid := []string{"", ".", "/", "..", "../file", "dir/../../file", "/etc/passwd", "//file", "..\\file", "file\x00.txt"}
+	for _, name := range invalid {
+		if _, err := CleanFilename(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%q: got error %v, want fs.ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestClientDownload(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "file")
+
+	// Wrong hash: the file must not be created.
+	ref := TransferRef{Node: test.serverNode(), File: "file", SHA256: new([32]byte)}
+	if _, err := test.client.Download(ctx, ref, dest); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("got error %v, want ErrHashMismatch", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("directory not empty after failed download: %v", entries)
+	}
+
+	// Correct hash.
+	hash := sha256.Sum256(testContent)
+	ref.SHA256 = &hash
+	n, err := test.client.Download(ctx, ref, dest)
+	if err != nil {
+		t.Fatal("download error:", err)
+	}
+	if n != int64(len(testContent)) {
+		t.Fatalf("wrong size %d", n)
+	}
+	content, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+}
+
+func TestClientDownloadRange(t *testing.T) {
+	// The second server ignores the requested offset.
+	ignoreOffset := Config{
+		Handler: func(tr *TransferRequest) error {
+			if err := tr.Accept(); err != nil {
+				return err
+			}
+			return tr.SendFile(context.Background(), uint64(len(testContent)), bytes.NewReader(testContent))
+		},
+	}
+	for _, cfg := range []Config{{Handler: ServeFS(testFS)}, ignoreOffset} {
+		test := newTestSetupWithConfig(t, cfg)
+		defer test.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dest := filepath.Join(t.TempDir(), "file")
+		for _, r := range []ByteRange{{1000, 1999}, {99000, -1}} {
+			ref := TransferRef{Node: test.serverNode(), File: "file", Range: &r}
+			if _, err := test.client.Download(ctx, ref, dest); err != nil {
+				t.Fatalf("range %v: download error: %v", r, err)
+			}
+			want := testContent[r.Start:]
+			if r.End >= 0 {
+				want = testContent[r.Start : r.End+1]
+			}
+			content, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, want) {
+				t.Fatalf("range %v: wrong content (%d bytes)", r, len(content))
+			}
+		}
+	}
+}
+
+func TestClientDownloadUnsupported(t *testing.T) {
+	client := new(Client)
+	dest := filepath.Join(t.TempDir(), "file")
+	refs := []TransferRef{
+		{File: "file", Files: []string{"other"}},
+		{File: "file", Range: &ByteRange{0, 10}, SHA256: new([32]byte)},
+	}
+	for _, ref := range refs {
+		if _, err := client.Download(context.Background(), ref, dest); err == nil {
+			t.Errorf("no error for %+v", ref)
+		}
+	}
+}
+
+func TestWriteFileShort(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "file")
+	_, err := WriteFile(dest, bytes.NewReader(testContent[:10]), 20, nil)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatal("destination file exists after failed write")
+	}
+}
+
+func TestClientFileInfo(t *testing.T) {
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"dir/doc.txt": &fstest.MapFile{Data: testContent, ModTime: modTime},
+	}
+	test := newTestSetupWithConfig(t, Config{Handler: ServeFS(fsys)})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "dir/doc.txt")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	info := r.Info()
+	if info.Name != "dir/doc.txt" {
+		t.Errorf("wrong name %q", info.Name)
+	}
+	if !info.ModTime.Equal(modTime) {
+		t.Errorf("wrong modification time %v, want %v", info.ModTime, modTime)
+	}
+	if !strings.HasPrefix(info.ContentType, "text/plain") {
+		t.Errorf("wrong content type %q", info.ContentType)
+	}
+	if info.Size != int64(len(testContent)) {
+		t.Errorf("wrong size %d", info.Size)
+	}
+}
+
+func TestClientRequestIfModified(t *testing.T) {
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"doc.txt":    &fstest.MapFile{Data: testContent, ModTime: modTime},
+		"notime.txt": &fstest.MapFile{Data: testContent},
+	}
+	test := newTestSetupWithConfig(t, Config{Handler: ServeFS(fsys)})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	node := test.serverNode()
+
+	// The client's copy is current.
+	_, err := test.client.RequestIfModified(ctx, node, "doc.txt", Precondition{ModTime: modTime})
+	if err != ErrNotModified {
+		t.Fatalf("wrong error for unmodified file: %v", err)
+	}
+
+	// The client's copy is older, and files without modification time are
+	// always sent.
+	for _, file := range []string{"doc.txt", "notime.txt"} {
+		r, err := test.client.RequestIfModified(ctx, node, file, Precondition{ModTime: modTime.Add(-time.Hour)})
+		if err != nil {
+			t.Fatalf("%s: request error: %v", file, err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: read error: %v", file, err)
+		}
+		if !bytes.Equal(content, testContent) {
+			t.Fatalf("%s: wrong file content", file)
+		}
+	}
+}
+
+func TestTransferRequestIfNoneMatch(t *testing.T) {
+	hash := sha256.Sum256(testContent)
+	handler := func(tr *TransferRequest) error {
+		if tr.IfNoneMatch != nil && *tr.IfNoneMatch == hash {
+			return tr.NotModified()
+		}
+		return errors.New("no hash in request")
+	}
+	test := newTestSetupWithConfig(t, Config{Handler: handler})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := test.client.RequestIfModified(ctx, test.serverNode(), "file", Precondition{SHA256: &hash})
+	if err != ErrNotModified {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
+
+func TestSendFileWithInfo(t *testing.T) {
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	sent := FileInfo{
+		Name:        "report.csv",
+		ModTime:     modTime,
+		ContentType: "text/csv",
+		Size:        int64(len(testContent)),
+	}
+	handler := func(tr *TransferRequest) error {
+		if err := tr.Accept(); err != nil {
+			return err
+		}
+		return tr.SendFileWithInfo(context.Background(), sent, bytes.NewReader(testContent))
+	}
+	test := newTestSetupWithConfig(t, Config{Handler: handler})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "query")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	info := r.Info()
+	if info.Name != sent.Name || info.ContentType != sent.ContentType || info.Size != sent.Size {
+		t.Errorf("wrong info %+v", info)
+	}
+	if !info.ModTime.Equal(modTime) {
+		t.Errorf("wrong modification time %v, want %v", info.ModTime, modTime)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+}
+
+func TestSendFileWithInfoUnknownSize(t *testing.T) {
+	handler := func(tr *TransferRequest) error {
+		if err := tr.Accept(); err != nil {
+			return err
+		}
+		info := FileInfo{Name: "stream", Size: -1}
+		return tr.SendFileWithInfo(context.Background(), info, bytes.NewReader(testContent))
+	}
+	test := newTestSetupWithConfig(t, Config{Handler: handler})
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "query")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	if info := r.Info(); info.Name != "stream" || info.Size != -1 {
+		t.Errorf("wrong info %+v", info)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+}
+
+func TestClientRequestFrom(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const offset = 1000
+	r, err := test.client.RequestFrom(ctx, test.serverNode(), "file", offset)
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+
+	if info := r.Info(); info.Offset != offset {
+		t.Fatalf("wrong offset %d", info.Offset)
+	}
+	if r.Size() != int64(len(testContent)-offset) {
+		t.Fatalf("wrong size %d", r.Size())
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent[offset:]) {
+		t.Fatal("wrong file content")
+	}
+}
+
+// This test runs many transfers at the same time, from multiple clients.
+func TestConcurrentTransfers(t *testing.T) {
+	const (
+		numClients   = 4
+		numTransfers = 16 // per client
+	)
+	fsys := fstest.MapFS{}
+	for i := 0; i < numTransfers; i++ {
+		data := make([]byte, 50000+i*1000)
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		fsys[fmt.Sprint("file", i)] = &fstest.MapFile{Data: data}
+	}
+	test := newTestSetupWithConfig(t, Config{
+		Handler:                ServeFS(fsys),
+		MaxConcurrentTransfers: numClients * numTransfers,
+		MaxTransfersPerNode:    numTransfers,
+	})
+	defer test.close()
+
+	clients := []*Client{test.client}
+	for len(clients) < numClients {
+		h, err := host.Listen(host.ConfigForTesting)
+		if err != nil {
+			t.Fatal("listen error:", err)
+		}
+		defer h.Close()
+		c, err := NewClient(h, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	errc := make(chan error, numClients*numTransfers)
+	for _, c := range clients {
+		for i := 0; i < numTransfers; i++ {
+			go func(c *Client, name string) {
+				r, err := c.Request(ctx, test.serverNode(), name)
+				if err != nil {
+					errc <- fmt.Errorf("%s: request error: %v", name, err)
+					return
+				}
+				defer r.Close()
+				content, err := io.ReadAll(r)
+				if err != nil {
+					errc <- fmt.Errorf("%s: read error: %v", name, err)
+					return
+				}
+				if !bytes.Equal(content, fsys[name].Data) {
+					errc <- fmt.Errorf("%s: wrong content", name)
+					return
+				}
+				errc <- nil
+			}(c, fmt.Sprint("file", i))
+		}
+	}
+	for i := 0; i < numClients*numTransfers; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	// The server finishes a transfer when the client has acknowledged all data,
+	// which can be shortly after the client has read it.
+	deadline := time.Now().Add(5 * time.Second)
+	for test.server.ActiveTransfers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := test.server.ActiveTransfers(); n != 0 {
+		t.Errorf("%d transfers still active", n)
+	}
+}
+
+func TestFreeTransferID(t *testing.T) {
+	var (
+		node      = enode.ID{1}
+		other     = enode.ID{2}
+		transfers = make(map[transferKey]*clientTransfer)
+	)
+	for i := 0; i <= math.MaxUint16; i++ {
+		if i != 1234 {
+			transfers[transferKey{node, uint16(i)}] = new(clientTransfer)
+		}
+	}
+	if id, ok := freeTransferID(transfers, node); !ok || id != 1234 {
+		t.Fatalf("got ID %d, %t; want 1234", id, ok)
+	}
+	if _, ok := freeTransferID(transfers, other); !ok {
+		t.Fatal("no ID for other node")
+	}
+
+	transfers[transferKey{node, 1234}] = new(clientTransfer)
+	if _, ok := freeTransferID(transfers, node); ok {
+		t.Fatal("got ID although all are in use")
+	}
+}
+
+// This test checks the client handshake state machine with start and init
+// response events arriving in different orders.
+func TestClientHandshakeOrder(t *testing.T) {
+	test := newTestSetup(t)
+	defer test.close()
+	c := test.client
+	node := enode.ID{1}
+
+	create := func() uint16 {
+		ev := &clientCreateEv{
+			node:    node,
+			created: make(chan bool, 1),
+			started: make(chan *clientTransfer, 1),
+			session: newSession(c.host.Socket, c.cfg.Transport),
+		}
+		c.create <- ev
+		if !<-ev.created {
+			t.Fatal("transfer not created")
+		}
+		return ev.id
+	}
+	startFrom := func(node enode.ID, id uint16) chan clientStartAccept {
+		accept := make(chan clientStartAccept, 1)
+		c.start <- clientStartEv{node, xferStartRequest{ID: id}, accept}
+		return accept
+	}
+	start := func(id uint16) chan clientStartAccept {
+		return startFrom(node, id)
+	}
+	// sync waits until loop has processed all previous events.
+	sync := func() {
+		if a := <-startFrom(enode.ID{2}, 0); a.t != nil {
+			t.Fatal("unknown transfer accepted")
+		}
+	}
+	pending := func(accept chan clientStartAccept) bool {
+		sync()
+		return len(accept) == 0
+	}
+	initOK := clientInitEv{node: node, resp: xferInitResponse{OK: true}}
+
+	t.Run("init-first", func(t *testing.T) {
+		id := create()
+		initOK.id = id
+		c.init <- initOK
+		if a := <-start(id); a.t == nil || a.retry {
+			t.Fatalf("wrong accept %+v", a)
+		}
+		// A resent start request is answered as a retry.
+		if a := <-start(id); a.t == nil || !a.retry {
+			t.Fatalf("wrong accept for resent request %+v", a)
+		}
+		c.cancel <- clientCancelEv{node, id}
+	})
+
+	t.Run("start-first", func(t *testing.T) {
+		id := create()
+		accept := start(id)
+		if !pending(accept) {
+			t.Fatal("start request accepted before init response")
+		}
+		initOK.id = id
+		c.init <- initOK
+		if a := <-accept; a.t == nil || a.retry {
+			t.Fatalf("wrong accept %+v", a)
+		}
+		c.cancel <- clientCancelEv{node, id}
+	})
+
+	t.Run("start-resent-before-init", func(t *testing.T) {
+		id := create()
+		accept1 := start(id)
+		accept2 := start(id)
+		if !pending(accept2) {
+			t.Fatal("resent start request accepted before init response")
+		}
+		if a := <-accept1; a.t != nil {
+			t.Fatal("stale start request accepted")
+		}
+		initOK.id = id
+		c.init <- initOK
+		if a := <-accept2; a.t == nil {
+			t.Fatal("start request rejected")
+		}
+		c.cancel <- clientCancelEv{node, id}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		id := create()
+		accept := start(id)
+		if !pending(accept) {
+			t.Fatal("start request accepted before init response")
+		}
+		c.cancel <- clientCancelEv{node, id}
+		if a := <-accept; a.t != nil {
+			t.Fatal("start request accepted after cancel")
+		}
+		// The init response is ignored after cancel.
+		initOK.id = id
+		c.init <- initOK
+		if a := <-start(id); a.t != nil {
+			t.Fatal("start request accepted after cancel")
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		id := create()
+		accept := start(id)
+		c.init <- clientInitEv{node: node, id: id, resp: xferInitResponse{OK: false}}
+		if a := <-accept; a.t != nil {
+			t.Fatal("start request accepted after reject")
+		}
+	})
+}
+
+// This test checks that requests with invalid file names are rejected before
+// the handler is called.
+func TestServerInvalidFilename(t *testing.T) {
+	var calls atomic.Int32
+	test := newTestSetupWithConfig(t, Config{
+		Handler: func(tr *TransferRequest) error {
+			calls.Add(1)
+			return errors.New("no")
+		},
+		UploadHandler: func(req *UploadRequest) error {
+			calls.Add(1)
+			return errors.New("no")
+		},
+	})
+	defer test.close()
+
+	var (
+		node = test.clientHost.Discovery.Self().ID()
+		addr = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303}
+	)
+	for _, name := range []string{
+		strings.Repeat("a", 64*1024),
+		"file\x00.txt",
+		"file\n.txt",
+		"\x1b[31mred",
+		"\xff\xfe",
+	} {
+		// Check the server directly, the long name doesn't fit into a packet.
+		initBytes, _ := rlp.EncodeToBytes(&xferInitRequest{ID: 1, Filename: name})
+		var initResp xferInitResponse
+		if err := rlp.DecodeBytes(test.server.handleXferInit(node, addr, initBytes), &initResp); err != nil {
+			t.Fatal("invalid init response:", err)
+		}
+		if initResp.OK || !strings.HasPrefix(initResp.Reason, ErrInvalidFilename.Error()) {
+			t.Errorf("%.20q: wrong init response %+v", name, initResp)
+		}
+		pushBytes, _ := rlp.EncodeToBytes(&xferPushRequest{Filename: name, FileSize: 1})
+		var pushResp xferPushResponse
+		if err := rlp.DecodeBytes(test.server.handleXferPush(node, addr, pushBytes), &pushResp); err != nil {
+			t.Fatal("invalid push response:", err)
+		}
+		if pushResp.OK || !strings.HasPrefix(pushResp.Reason, ErrInvalidFilename.Error()) {
+			t.Errorf("%.20q: wrong push response %+v", name, pushResp)
+		}
+
+		// The client doesn't send such requests.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := test.client.Request(ctx, test.serverNode(), name)
+		cancel()
+		if !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("%.20q: wrong client error %v", name, err)
+		}
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("handler called %d times", n)
+	}
+}
+
+// This test checks that a resent init request doesn't start the transfer again.
+func TestServerDuplicateInit(t *testing.T) {
+	var calls atomic.Int32
+	test := newTestSetupWithConfig(t, Config{
+		Handler: func(tr *TransferRequest) error {
+			calls.Add(1)
+			return errors.New("no")
+		},
+	})
+	defer test.close()
+
+	send := func(req *xferInitRequest) xferInitResponse {
+		reqBytes, _ := rlp.EncodeToBytes(req)
+		respBytes, err := test.clientHost.Discovery.TalkRequest(test.serverNode(), "xfer-init", reqBytes)
+		if err != nil {
+			t.Fatal("talk error:", err)
+		}
+		var resp xferInitResponse
+		if err := rlp.DecodeBytes(respBytes, &resp); err != nil {
+			t.Fatal("invalid response:", err)
+		}
+		return resp
+	}
+	req := &xferInitRequest{ID: 5, Filename: "file"}
+	resp1 := send(req)
+	resp2 := send(req)
+	if !reflect.DeepEqual(resp1, resp2) {
+		t.Errorf("different responses %+v, %+v", resp1, resp2)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler called %d times", n)
+	}
+
+	// A different request with the same ID is a new transfer.
+	send(&xferInitRequest{ID: 5, Filename: "other"})
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("handler called %d times", n)
+	}
+}
+
+// testTransport is a uTP transport with a different name.
+type testTransport struct {
+	UTPTransport
+	name  string
+	conns atomic.Int32
+}
+
+func (t *testTransport) Name() string {
+	return t.name
+}
+
+func (t *testTransport) NewConn(local, remote net.Addr, write func([]byte, net.Addr) (int, error)) (TransportConn, error) {
+	t.conns.Add(1)
+	return t.UTPTransport.NewConn(local, remote, write)
+}
+
+func TestTransport(t *testing.T) {
+	var (
+		serverTransport = &testTransport{name: "test"}
+		clientTransport = &testTransport{name: "test"}
+	)
+	test := newTestSetupWithConfigs(t,
+		Config{Handler: ServeFS(testFS), Transport: serverTransport},
+		Config{Transport: clientTransport},
+	)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := test.client.Request(ctx, test.serverNode(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(content, testContent) {
+		t.Fatal("wrong file content")
+	}
+	if n := serverTransport.conns.Load(); n != 1 {
+		t.Errorf("server transport created %d conns", n)
+	}
+	if n := clientTransport.conns.Load(); n != 1 {
+		t.Errorf("client transport created %d conns", n)
+	}
+}
+
+// This test checks that transfers between peers using different transports
+// are rejected.
+func TestTransportMismatch(t *testing.T) {
+	test := newTestSetupWithConfigs(t,
+		Config{Handler: ServeFS(testFS), UploadHandler: func(req *UploadRequest) error {
+			t.Error("upload handler called")
+			return nil
+		}},
+		Config{Transport: &testTransport{name: "test"}},
+	)
+	defer test.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := test.client.Request(ctx, test.serverNode(), "file")
+	if !errors.Is(err, ErrTransportMismatch) {
+		t.Fatalf("wrong request error: %v", err)
+	}
+	err = test.client.Send(ctx, test.serverNode(), "upload", 10, bytes.NewReader(make([]byte, 10)))
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), ErrTransportMismatch.Error()) {
+		t.Fatalf("wrong send error: %v", err)
+	}
+}
+
+// This test checks that the packet buffers of a stream fit the largest packet
+// of the transport.
+func TestStreamSessionPacketSize(t *testing.T) {
+	var (
+		ip     = netip.MustParseAddr("127.0.0.1")
+		addr   = &net.UDPAddr{IP: net.IP(ip.AsSlice()), Port: 30303}
+		store  = session.NewStore()
+		socket = new(captureSocket)
+	)
+	defer store.Close()
+
+	// Create a session pair like the transfer handshake does. The recipient
+	// secret must be read before Establish clears it.
+	initiator, err := store.Initiator("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiator.SetHandler(func(*session.Session, []byte, net.Addr) {})
+	recipient, err := store.Recipient("test", ip, initiator.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.SetHandler(func(*session.Session, []byte, net.Addr) {})
+	recipientSecret := recipient.Secret()
+	rs := recipient.Establish()
+	is := initiator.Establish(ip, recipientSecret)
+
+	ss := newSession(socket, UTPTransport{})
+	if err := ss.connect(is, addr); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.conn.(*utpconn.Conn).Abort()
+	conn := &captureConn{TransportConn: ss.conn}
+
+	// Send and receive the largest packet.
+	packet := make([]byte, UTPTransport{}.MaxPacketSize())
+	for i := range packet {
+		packet[i] = byte(i)
+	}
+	encBuffer := &ss.encBuffer[:1][0]
+	if _, err := ss.packetOut(packet, addr); err != nil {
+		t.Fatal("packetOut error:", err)
+	}
+	if len(socket.packet) != len(packet)+session.Overhead {
+		t.Fatalf("wrong encoded packet size %d", len(socket.packet))
+	}
+	if &ss.encBuffer[:1][0] != encBuffer {
+		t.Error("encode buffer was reallocated")
+	}
+	decBuffer := &ss.decBuffer[:1][0]
+	ss.conn = conn
+	ss.deliver(rs, socket.packet, addr)
+	if !bytes.Equal(conn.packet, packet) {
+		t.Fatal("wrong decoded packet")
+	}
+	if &ss.decBuffer[:1][0] != decBuffer {
+		t.Error("decode buffer was reallocated")
+	}
+}
+
+// captureSocket stores the last packet written to it.
+type captureSocket struct {
+	packet []byte
+}
+
+func (s *captureSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	s.packet = append(s.packet[:0], b...)
+	return len(b), nil
+}
+
+func (s *captureSocket) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30304}
+}
+
+// captureConn stores the last packet delivered to it.
+type captureConn struct {
+	TransportConn
+	packet []byte
+}
+
+func (c *captureConn) PacketIn(b []byte) {
+	c.packet = append(c.packet[:0], b...)
+}
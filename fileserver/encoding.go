@@ -0,0 +1,122 @@
+package fileserver
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"strings"
+	"sync/atomic"
+)
+
+// Content encodings. The client lists the encodings it supports in the init
+// request, and the server announces the encoding of the stream in the start
+// request. The empty encoding means the content is sent as is.
+const (
+	encodingIdentity = ""
+	encodingGzip     = "gzip"
+)
+
+// supportedEncodings returns the encodings announced by the client.
+func (cfg *Config) supportedEncodings() []string {
+	if !cfg.Compression {
+		return nil
+	}
+	return []string{encodingGzip}
+}
+
+// chooseEncoding picks the encoding of a transfer. Compression is only used
+// if it is enabled on the server, the client supports it, and the content
+// type is known to compress well.
+func (cfg *Config) chooseEncoding(clientEncodings []string, contentType string) string {
+	if !cfg.Compression || !Compressible(contentType) {
+		return encodingIdentity
+	}
+	for _, enc := range clientEncodings {
+		if enc == encodingGzip {
+			return encodingGzip
+		}
+	}
+	return encodingIdentity
+}
+
+// Compressible reports whether content of the given MIME type is compressed
+// when Config.Compression is enabled.
+func Compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/xml", "application/javascript", "application/x-tar":
+		return true
+	}
+	return false
+}
+
+// compressReader returns a reader of the gzip-compressed content of src. If size
+// is non-negative, exactly size bytes are read from src. The number of bytes read
+// from src is added to read, if non-nil.
+//
+// Compression runs in a goroutine, which exits when the returned reader is
+// closed.
+func compressReader(src io.Reader, size int64, read *atomic.Int64) io.ReadCloser {
+	if read != nil {
+		src = &countingReader{r: src, n: read}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		var err error
+		if size < 0 {
+			_, err = io.Copy(zw, src)
+		} else if _, err = io.CopyN(zw, src, size); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decodeReader decodes the content of a stream. The gzip header is read on the
+// first call to Read, so creating the reader doesn't block.
+type decodeReader struct {
+	r        io.Reader
+	encoding string
+	zr       *gzip.Reader
+}
+
+func (d *decodeReader) Read(b []byte) (int, error) {
+	if d.encoding == encodingIdentity {
+		return d.r.Read(b)
+	}
+	if d.zr == nil {
+		zr, err := gzip.NewReader(d.r)
+		if err != nil {
+			return 0, err
+		}
+		zr.Multistream(false)
+		d.zr = zr
+	}
+	return d.zr.Read(b)
+}
+
+// countingReader adds the number of bytes read to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n.Add(int64(n))
+	return n, err
+}
@@ -1,25 +1,53 @@
 package fileserver
 
 import (
+	"archive/tar"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"mime"
 	"path"
+	"strings"
+	"time"
 )
 
+var errNoMatch = errors.New("no files match pattern")
+
+// CleanFilename validates a requested file name and returns it in clean form.
+// Names are slash-separated paths relative to the served directory. Absolute
+// paths, paths escaping the directory through "..", backslashes and NUL bytes
+// are rejected with an error wrapping fs.ErrInvalid.
+//
+// Handlers that don't use ServeFS should check requested names with this
+// function before using them to access files.
+func CleanFilename(name string) (string, error) {
+	invalid := &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	if strings.ContainsAny(name, "\\\x00") {
+		return "", invalid
+	}
+	clean := path.Clean(name)
+	if clean == "." || !fs.ValidPath(clean) {
+		return "", invalid
+	}
+	return clean, nil
+}
+
 // ServeFS serves transfer requests from the given file system.
+// Archive requests are served as a tar archive of all matching files.
 func ServeFS(fsys fs.FS) ServerFunc {
 	return func(tr *TransferRequest) error {
+		if tr.Archive {
+			return serveArchive(fsys, tr)
+		}
 		return serveFile(fsys, tr)
 	}
 }
 
 func serveFile(fsys fs.FS, tr *TransferRequest) error {
-	filename := path.Clean(tr.Filename)
-	if filename == "." || !fs.ValidPath(filename) {
-		return fs.ErrInvalid
-	}
-
-	if err := tr.Accept(); err != nil {
+	filename, err := CleanFilename(tr.Filename)
+	if err != nil {
 		return err
 	}
 
@@ -36,10 +64,115 @@ func serveFile(fsys fs.FS, tr *TransferRequest) error {
 	if stat.IsDir() {
 		return fmt.Errorf("can't send directory")
 	}
+	if notModified(stat.ModTime(), tr.IfModifiedSince) {
+		return tr.NotModified()
+	}
+	info := FileInfo{
+		Name:        filename,
+		ModTime:     stat.ModTime(),
+		ContentType: mime.TypeByExtension(path.Ext(filename)),
+	}
+	size := uint64(stat.Size())
+	if seeker, ok := f.(io.Seeker); ok && tr.Offset > 0 {
+		if tr.Offset > size {
+			return fmt.Errorf("offset %d beyond end of file", tr.Offset)
+		}
+		if _, err := seeker.Seek(int64(tr.Offset), io.SeekStart); err != nil {
+			return err
+		}
+		info.Offset = tr.Offset
+		size -= tr.Offset
+	}
+	info.Size = int64(size)
+
+	if err := tr.Accept(); err != nil {
+		return err
+	}
+
+	err = tr.SendFileWithInfo(context.Background(), info, f)
+	if err != nil {
+		err = fmt.Errorf("send error: %w", err)
+	}
+	return err
+}
+
+// notModified reports whether a file with the given modification time is
+// unchanged since the client's copy. Files without a modification time are
+// always considered modified.
+func notModified(modTime, since time.Time) bool {
+	if since.IsZero() || modTime.Unix() <= 0 {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+func serveArchive(fsys fs.FS, tr *TransferRequest) error {
+	pattern, err := CleanFilename(tr.Filename)
+	if err != nil {
+		return err
+	}
+	matches, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, name := range matches {
+		stat, err := fs.Stat(fsys, name)
+		if err == nil && stat.Mode().IsRegular() {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return errNoMatch
+	}
 
-	err = tr.SendFile(uint64(stat.Size()), f)
+	if err := tr.Accept(); err != nil {
+		return err
+	}
+
+	tr.SetInfo(FileInfo{ContentType: "application/x-tar"})
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(fsys, files, pw))
+	}()
+	err = tr.SendStream(context.Background(), pr)
+	pr.Close()
 	if err != nil {
 		err = fmt.Errorf("send error: %w", err)
 	}
 	return err
 }
+
+// writeArchive writes the given files to w as a tar archive.
+func writeArchive(fsys fs.FS, files []string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, name := range files {
+		if err := addArchiveFile(tw, fsys, name); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addArchiveFile(tw *tar.Writer, fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -1,28 +1,141 @@
 package fileserver
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/fjl/discv5-streams/host"
+	"golang.org/x/time/rate"
 )
 
 var (
-	errAlreadyAccepted = errors.New("request already accepted")
-	errNotAccepted     = errors.New("request was not accepted")
+	errAlreadyAccepted  = errors.New("request already accepted")
+	errNotAccepted      = errors.New("request was not accepted")
+	errTooManyTransfers = errors.New("too many active transfers")
+	errServerClosed     = errors.New("server closed")
+	errTooManyRequests  = errors.New("too many requests")
+)
+
+// maxReasonLength is the maximum length of the rejection reason sent to clients.
+const maxReasonLength = 200
+
+// MaxFilenameLength is the longest file name accepted in transfer requests and
+// uploads, in bytes. Longer names are rejected with ErrInvalidFilename.
+const MaxFilenameLength = 1024
+
+// Default transfer limits of Server.
+const (
+	DefaultMaxConcurrentTransfers   = 128
+	DefaultMaxTransfersPerNode      = 16
+	DefaultMaxRequestsPerNodePerSec = 10
+)
+
+// Default handshake timeouts.
+const (
+	DefaultStartTimeout    = 10 * time.Second
+	DefaultStartRetryDelay = 20 * time.Millisecond
+	DefaultStartRetries    = 1
+
+	maxStartRetryDelay = 5 * time.Second
 )
 
 // Config is the configuration of Server and Client.
 type Config struct {
-	Prefix  string     // Protocol name, defaults to "xfer".
-	Handler ServerFunc // Called by the server for each request.
+	Prefix        string     // Protocol name, defaults to "xfer".
+	Handler       ServerFunc // Called by the server for each request.
+	UploadHandler UploadFunc // Called by the server for each upload.
+
+	// Authorize is called by the server before Handler and UploadHandler. When it
+	// returns an error, the request or upload is rejected and the error is sent to
+	// the client as the reason. If nil, all requests are passed to the handlers.
+	Authorize func(node enode.ID, filename string) error
+
+	// These limit the number of transfers the server will run at the same time.
+	// When a limit is reached, new requests are rejected.
+	MaxConcurrentTransfers int // Total limit, defaults to DefaultMaxConcurrentTransfers.
+	MaxTransfersPerNode    int // Limit per remote node, defaults to DefaultMaxTransfersPerNode.
+
+	// These limit the rate of file requests and uploads the server accepts from
+	// a single node. Requests exceeding the rate are rejected before they are
+	// processed. The burst defaults to MaxTransfersPerNode, so a node can use
+	// all of its transfer slots at once. Set MaxRequestsPerNodePerSec to a
+	// negative value to disable the limit.
+	MaxRequestsPerNodePerSec int // defaults to DefaultMaxRequestsPerNodePerSec
+	MaxRequestBurstPerNode   int // defaults to MaxTransfersPerNode
+
+	// These limit the throughput of outgoing transfers. Zero means unlimited.
+	MaxUploadBytesPerSec      int // Limit for each transfer.
+	MaxTotalUploadBytesPerSec int // Limit across all active transfers.
+
+	// These configure the transfer handshake. The defaults are tuned for
+	// low-latency networks and may need to be raised on slow links.
+	//
+	// StartTimeout is how long the client waits for the server to start a
+	// transfer after requesting it.
+	StartTimeout time.Duration // defaults to DefaultStartTimeout
+
+	// These configure how the server resends an unanswered start request.
+	// The delay before each retry doubles, starting at StartRetryDelay, and
+	// is randomized by up to half. Retries stop when StartTimeout has passed.
+	// Set StartRetries to a negative value to disable retries.
+	StartRetries    int           // defaults to DefaultStartRetries
+	StartRetryDelay time.Duration // defaults to DefaultStartRetryDelay
+
+	// Compression enables gzip compression of transfers. Clients announce
+	// support for it, and servers compress content of types accepted by
+	// Compressible when the client supports it. The size of a compressed
+	// transfer is the size of the uncompressed content.
+	Compression bool
+
+	// MaxFileSize is the largest file the client accepts. Transfers of larger
+	// files are rejected with ErrFileTooLarge before they start, and reading
+	// streams of unknown size fails with ErrFileTooLarge when they exceed it.
+	// Zero means unlimited.
+	MaxFileSize uint64
+
+	// ReadTimeout is the idle timeout of client streams. When no data arrives
+	// for this long, Read fails with a timeout error. Zero means streams don't
+	// time out, unless a deadline is set with ClientStream.SetReadDeadline.
+	ReadTimeout time.Duration
+
+	// Transport creates the stream connections of transfers. It defaults to
+	// UTPTransport. Transfers only work between peers using the same transport.
+	Transport Transport
+
+	// These are called by the server for file requests, regardless of the
+	// Handler. OnStart is called when the handler accepts a request. When the
+	// handler returns, OnComplete is called for accepted requests if there was
+	// no error, and OnError is called if the handler failed. The callbacks run
+	// on the handler goroutine and should not block.
+	OnStart    func(TransferEvent)
+	OnComplete func(TransferEvent)
+	OnError    func(TransferEvent)
+}
+
+// TransferEvent describes a file request served by Server.
+type TransferEvent struct {
+	Node     enode.ID
+	Addr     *net.UDPAddr
+	Filename string
+	Bytes    int64         // content bytes sent to the client
+	Duration time.Duration // time since the request was accepted, zero for OnStart
+	Err      error         // the handler error, set for OnError only
 }
 
 func (cfg Config) withDefaults() Config {
@@ -32,84 +145,501 @@ func (cfg Config) withDefaults() Config {
 	if cfg.Handler == nil {
 		cfg.Handler = defaultHandler
 	}
+	if cfg.UploadHandler == nil {
+		cfg.UploadHandler = defaultUploadHandler
+	}
+	if cfg.MaxConcurrentTransfers == 0 {
+		cfg.MaxConcurrentTransfers = DefaultMaxConcurrentTransfers
+	}
+	if cfg.MaxTransfersPerNode == 0 {
+		cfg.MaxTransfersPerNode = DefaultMaxTransfersPerNode
+	}
+	if cfg.MaxRequestsPerNodePerSec == 0 {
+		cfg.MaxRequestsPerNodePerSec = DefaultMaxRequestsPerNodePerSec
+	}
+	if cfg.MaxRequestBurstPerNode <= 0 {
+		cfg.MaxRequestBurstPerNode = cfg.MaxTransfersPerNode
+	}
+	if cfg.StartTimeout <= 0 {
+		cfg.StartTimeout = DefaultStartTimeout
+	}
+	if cfg.StartRetries == 0 {
+		cfg.StartRetries = DefaultStartRetries
+	}
+	if cfg.StartRetryDelay <= 0 {
+		cfg.StartRetryDelay = DefaultStartRetryDelay
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = UTPTransport{}
+	}
 	return cfg
 }
 
 type ServerFunc func(*TransferRequest) error
 
+type UploadFunc func(*UploadRequest) error
+
 // defaultHandler rejects all file requests.
 func defaultHandler(req *TransferRequest) error {
 	return nil
 }
 
+// defaultUploadHandler rejects all uploads.
+func defaultUploadHandler(req *UploadRequest) error {
+	return nil
+}
+
 // Server is the file transfer server. It handles transfer requests from clients
 // and calls the configured handler function.
 type Server struct {
 	cfg  *Config
 	host *host.Host
+	log  log.Logger
+
+	mu           sync.Mutex
+	active       int
+	activeByNode map[enode.ID]int
+	transfers    map[transferKey]*TransferRequest
+	uploads      map[*UploadRequest]struct{}
+	recentInits  map[transferKey]*initRecord
+	nodeLimits   map[enode.ID]*nodeLimiter
+	uploadLimit  *rate.Limiter
+	xfers        activeSet
+	closed       bool
 }
 
-// Server returns a new file transfer server.
-func NewServer(host *host.Host, cfg Config) *Server {
+// Server returns a new file transfer server. It fails if the protocols of
+// cfg.Prefix are already registered on host.
+func NewServer(host *host.Host, cfg Config) (*Server, error) {
 	cfg = cfg.withDefaults()
-	srv := &Server{host: host, cfg: &cfg}
-	xferInit := cfg.Prefix + "-init"
-	host.Discovery.RegisterTalkHandler(xferInit, srv.handleXferInit)
-	return srv
+	srv := &Server{
+		host:         host,
+		cfg:          &cfg,
+		log:          host.Logger(),
+		activeByNode: make(map[enode.ID]int),
+		transfers:    make(map[transferKey]*TransferRequest),
+		uploads:      make(map[*UploadRequest]struct{}),
+		recentInits:  make(map[transferKey]*initRecord),
+		nodeLimits:   make(map[enode.ID]*nodeLimiter),
+		uploadLimit:  newRateLimiter(cfg.MaxTotalUploadBytesPerSec),
+	}
+	err := host.RegisterTalkHandlers(map[string]discover.TalkRequestHandler{
+		srv.protocol("init"):  srv.handleXferInit,
+		srv.protocol("push"):  srv.handleXferPush,
+		srv.protocol("abort"): srv.handleXferAbort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	host.AddDrainer(srv)
+	return srv, nil
+}
+
+// Drain stops accepting new transfers and waits for active transfers
+// to finish, or until ctx is canceled.
+func (s *Server) Drain(ctx context.Context) error {
+	return s.xfers.drain(ctx)
+}
+
+// Close unregisters the protocols of the server from the host. Subsequent
+// requests are refused, and active transfers are aborted. Close doesn't wait
+// for handlers to return. Use Drain before Close to let transfers finish.
+//
+// After Close, a new server with the same protocol prefix can be created on
+// the host.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	transfers := make([]*TransferRequest, 0, len(s.transfers))
+	for _, tr := range s.transfers {
+		transfers = append(transfers, tr)
+	}
+	uploads := make([]*UploadRequest, 0, len(s.uploads))
+	for ur := range s.uploads {
+		uploads = append(uploads, ur)
+	}
+	s.mu.Unlock()
+
+	s.host.UnregisterTalkHandlers(s.protocol("init"), s.protocol("push"), s.protocol("abort"))
+	s.host.RemoveDrainer(s)
+	for _, tr := range transfers {
+		tr.abort()
+	}
+	for _, ur := range uploads {
+		ur.abort()
+	}
+}
+
+// protocol returns the name of a TALK protocol of the server.
+func (s *Server) protocol(name string) string {
+	return s.cfg.Prefix + "-" + name
+}
+
+// initRecord is the outcome of a recently handled init request.
+type initRecord struct {
+	req     []byte
+	created time.Time
+	done    chan struct{} // closed when resp is set
+	resp    []byte
 }
 
 func (s *Server) handleXferInit(node enode.ID, addr *net.UDPAddr, data []byte) []byte {
 	var req xferInitRequest
 	err := rlp.DecodeBytes(data, &req)
 	if err != nil {
-		log.Error("Invalid xferInitRequest", "id", node, "addr", addr, "err", err)
+		s.log.Error("Invalid xferInitRequest", "id", node, "addr", addr, "err", err)
 		return []byte{}
 	}
+	if !s.allowRequest(node) {
+		s.log.Debug("Rejecting transfer", "id", node, "addr", addr, "err", errTooManyRequests)
+		resp := xferInitResponse{OK: false, Reason: rejectReason(errTooManyRequests)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+
+	if err := checkFilename(req.Filename); err != nil {
+		s.log.Debug("Rejecting transfer", "id", node, "addr", addr, "err", err)
+		resp := xferInitResponse{OK: false, Reason: rejectReason(err)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+
+	// Clients resend the request when the response is lost. Answer retries
+	// with the earlier response instead of starting the transfer again.
+	rec, isNew := s.trackInit(transferKey{node, req.ID}, data)
+	if !isNew {
+		s.log.Debug("Duplicate xferInitRequest", "id", node, "addr", addr, "xfer", req.ID)
+		<-rec.done
+		return rec.resp
+	}
+	rec.resp = s.initTransfer(node, addr, &req)
+	close(rec.done)
+	return rec.resp
+}
 
-	accept := make(chan bool, 1)
+// nodeLimiter is the request rate limiter of a remote node.
+type nodeLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// allowRequest reports whether a request from node is within the per-node
+// request rate limit.
+func (s *Server) allowRequest(node enode.ID) bool {
+	if s.cfg.MaxRequestsPerNodePerSec < 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Limiters that were idle long enough to refill completely behave like
+	// new ones, so they can be removed.
+	now := time.Now()
+	refill := time.Duration(s.cfg.MaxRequestBurstPerNode) * time.Second / time.Duration(s.cfg.MaxRequestsPerNodePerSec)
+	for id, l := range s.nodeLimits {
+		if now.Sub(l.lastUsed) > refill {
+			delete(s.nodeLimits, id)
+		}
+	}
+	l := s.nodeLimits[node]
+	if l == nil {
+		l = &nodeLimiter{limiter: rate.NewLimiter(rate.Limit(s.cfg.MaxRequestsPerNodePerSec), s.cfg.MaxRequestBurstPerNode)}
+		s.nodeLimits[node] = l
+	}
+	l.lastUsed = now
+	return l.limiter.AllowN(now, 1)
+}
+
+// trackInit returns the record of an identical init request received within
+// StartTimeout. If there is none, it creates a new record and returns true.
+func (s *Server) trackInit(key transferKey, req []byte) (*initRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, rec := range s.recentInits {
+		if now.Sub(rec.created) > s.cfg.StartTimeout {
+			delete(s.recentInits, k)
+		}
+	}
+	if rec := s.recentInits[key]; rec != nil && bytes.Equal(rec.req, req) {
+		return rec, false
+	}
+	rec := &initRecord{
+		req:     append([]byte(nil), req...),
+		created: now,
+		done:    make(chan struct{}),
+	}
+	s.recentInits[key] = rec
+	return rec, true
+}
+
+func (s *Server) initTransfer(node enode.ID, addr *net.UDPAddr, req *xferInitRequest) []byte {
+	if s.cfg.Authorize != nil {
+		if err := s.cfg.Authorize(node, req.Filename); err != nil {
+			s.log.Debug("Rejecting unauthorized transfer", "id", node, "addr", addr, "err", err)
+			resp := xferInitResponse{OK: false, Reason: rejectReason(err)}
+			respBytes, _ := rlp.EncodeToBytes(&resp)
+			return respBytes
+		}
+	}
+	if err := s.acquireSlot(node); err != nil {
+		s.log.Debug("Rejecting transfer", "id", node, "addr", addr, "err", err)
+		resp := xferInitResponse{OK: false, Reason: rejectReason(err)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+
+	accept := make(chan xferInitResponse, 1)
 	creq := TransferRequest{
 		Node:       node,
 		Addr:       addr,
 		Filename:   req.Filename,
+		Archive:    req.Archive,
+		Offset:     req.Offset,
 		xferID:     req.ID,
+		encodings:  req.Encodings,
 		server:     s,
 		acceptInit: accept,
+		aborted:    make(chan struct{}),
+	}
+	if req.IfModifiedSince != 0 && req.IfModifiedSince <= math.MaxInt64 {
+		creq.IfModifiedSince = time.Unix(int64(req.IfModifiedSince), 0)
 	}
+	if len(req.IfNoneMatch) == 32 {
+		creq.IfNoneMatch = (*[32]byte)(req.IfNoneMatch)
+	}
+	s.addTransfer(&creq)
 	go s.runHandler(&creq)
 
-	ok := <-accept
-	resp := xferInitResponse{OK: ok}
+	resp := <-accept
 	respBytes, _ := rlp.EncodeToBytes(&resp)
 	return respBytes
 }
 
 func (s *Server) runHandler(creq *TransferRequest) {
+	defer s.releaseSlot(creq.Node)
+	defer s.removeTransfer(creq)
+
 	err := s.cfg.Handler(creq)
 	if err != nil {
-		log.Error("File transfer handler failed", "err", err)
+		s.log.Error("File transfer handler failed", "err", err)
+	}
+	creq.reject(err)
+	switch {
+	case err != nil && s.cfg.OnError != nil:
+		ev := creq.event()
+		ev.Err = err
+		s.cfg.OnError(ev)
+	case err == nil && !creq.started.IsZero() && s.cfg.OnComplete != nil:
+		s.cfg.OnComplete(creq.event())
 	}
-	creq.reject()
 }
 
-func (s *Server) sendXferStart(node enode.ID, addr *net.UDPAddr, req *xferStartRequest) (*xferStartResponse, error) {
+func (s *Server) handleXferPush(node enode.ID, addr *net.UDPAddr, data []byte) []byte {
+	var req xferPushRequest
+	err := rlp.DecodeBytes(data, &req)
+	if err != nil {
+		s.log.Error("Invalid xferPushRequest", "id", node, "addr", addr, "err", err)
+		return []byte{}
+	}
+	if !s.allowRequest(node) {
+		s.log.Debug("Rejecting upload", "id", node, "addr", addr, "err", errTooManyRequests)
+		resp := xferPushResponse{OK: false, Reason: rejectReason(errTooManyRequests)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+	if err := checkFilename(req.Filename); err != nil {
+		s.log.Debug("Rejecting upload", "id", node, "addr", addr, "err", err)
+		resp := xferPushResponse{OK: false, Reason: rejectReason(err)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+	if req.FileSize > math.MaxInt64 {
+		resp := xferPushResponse{OK: false, Reason: rejectReason(ErrFileTooLarge)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+	if req.Transport != transportName(s.cfg.Transport) {
+		err := fmt.Errorf("%w: client transport %q", ErrTransportMismatch, req.Transport)
+		s.log.Debug("Rejecting upload", "id", node, "addr", addr, "err", err)
+		resp := xferPushResponse{OK: false, Reason: rejectReason(err)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+	if s.cfg.Authorize != nil {
+		if err := s.cfg.Authorize(node, req.Filename); err != nil {
+			s.log.Debug("Rejecting unauthorized upload", "id", node, "addr", addr, "err", err)
+			resp := xferPushResponse{OK: false, Reason: rejectReason(err)}
+			respBytes, _ := rlp.EncodeToBytes(&resp)
+			return respBytes
+		}
+	}
+	if err := s.acquireSlot(node); err != nil {
+		s.log.Debug("Rejecting upload", "id", node, "addr", addr, "err", err)
+		resp := xferPushResponse{OK: false, Reason: rejectReason(err)}
+		respBytes, _ := rlp.EncodeToBytes(&resp)
+		return respBytes
+	}
+
+	accept := make(chan xferPushResponse, 1)
+	ureq := UploadRequest{
+		Node:            node,
+		Addr:            addr,
+		Filename:        req.Filename,
+		Size:            req.FileSize,
+		initiatorSecret: req.InitiatorSecret,
+		server:          s,
+		accept:          accept,
+	}
+	s.addUpload(&ureq)
+	go s.runUploadHandler(&ureq)
+
+	resp := <-accept
+	respBytes, _ := rlp.EncodeToBytes(&resp)
+	return respBytes
+}
+
+func (s *Server) runUploadHandler(ureq *UploadRequest) {
+	defer s.releaseSlot(ureq.Node)
+	defer s.removeUpload(ureq)
+
+	err := s.cfg.UploadHandler(ureq)
+	if err != nil {
+		s.log.Error("File upload handler failed", "err", err)
+	}
+	ureq.reject(err)
+}
+
+func (s *Server) handleXferAbort(node enode.ID, addr *net.UDPAddr, data []byte) []byte {
+	var req xferAbortRequest
+	err := rlp.DecodeBytes(data, &req)
+	if err != nil {
+		s.log.Error("Invalid xferAbortRequest", "id", node, "addr", addr, "err", err)
+		return []byte{}
+	}
+
+	s.mu.Lock()
+	creq := s.transfers[transferKey{node, req.ID}]
+	s.mu.Unlock()
+	if creq != nil {
+		s.log.Debug("Transfer aborted by client", "id", node, "addr", addr, "xfer", req.ID)
+		creq.abort()
+	}
+	respBytes, _ := rlp.EncodeToBytes(&xferAbortResponse{OK: creq != nil})
+	return respBytes
+}
+
+// addTransfer registers an active transfer request.
+func (s *Server) addTransfer(creq *TransferRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfers[transferKey{creq.Node, creq.xferID}] = creq
+}
+
+// removeTransfer removes a request registered by addTransfer.
+func (s *Server) removeTransfer(creq *TransferRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := transferKey{creq.Node, creq.xferID}
+	if s.transfers[key] == creq {
+		delete(s.transfers, key)
+	}
+}
+
+// addUpload registers an active upload. If the server was closed in the
+// meantime, the upload is aborted right away.
+func (s *Server) addUpload(ureq *UploadRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		ureq.abort()
+	}
+	s.uploads[ureq] = struct{}{}
+}
+
+// removeUpload removes an upload registered by addUpload.
+func (s *Server) removeUpload(ureq *UploadRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, ureq)
+}
+
+// ActiveTransfers returns the number of transfers currently being handled.
+func (s *Server) ActiveTransfers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// acquireSlot reserves a transfer slot for the given node. It returns an error
+// when the transfer limits have been reached or the server is shutting down.
+func (s *Server) acquireSlot(node enode.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errServerClosed
+	}
+	if s.active >= s.cfg.MaxConcurrentTransfers || s.activeByNode[node] >= s.cfg.MaxTransfersPerNode {
+		return errTooManyTransfers
+	}
+	if !s.xfers.begin() {
+		return ErrShuttingDown
+	}
+	s.active++
+	s.activeByNode[node]++
+	return nil
+}
+
+// releaseSlot frees a slot reserved by acquireSlot.
+func (s *Server) releaseSlot(node enode.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if s.activeByNode[node]--; s.activeByNode[node] <= 0 {
+		delete(s.activeByNode, node)
+	}
+	s.xfers.end()
+}
+
+func (s *Server) sendXferStart(ctx context.Context, node enode.ID, addr *net.UDPAddr, req *xferStartRequest) (*xferStartResponse, error) {
+	// The client gives up after StartTimeout, so there is no point in retrying
+	// for longer than that.
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.StartTimeout)
+	defer cancel()
+
 	xferStart := s.cfg.Prefix + "-start"
 	reqData, _ := rlp.EncodeToBytes(req)
-	respData, err := s.host.Discovery.TalkRequestToID(node, addr, xferStart, reqData)
-	if err != nil {
-		// Try one more time.
-		time.Sleep(20 * time.Millisecond)
+	var (
+		respData []byte
+		err      error
+	)
+	for attempt := 0; ; attempt++ {
 		respData, err = s.host.Discovery.TalkRequestToID(node, addr, xferStart, reqData)
-		if err != nil {
-			return nil, err
+		if err == nil || attempt >= s.cfg.StartRetries {
+			break
+		}
+		if !sleepContext(ctx, retryDelay(s.cfg.StartRetryDelay, attempt)) {
+			break
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	var resp xferStartResponse
 	if err := rlp.DecodeBytes(respData, &resp); err != nil {
 		return nil, fmt.Errorf("invalid xferStartResponse: %v", err)
 	}
 	if !resp.OK {
-		return nil, errCanceled
+		return nil, ErrCanceled
 	}
 	return &resp, nil
 }
@@ -119,10 +649,26 @@ type TransferRequest struct {
 	Node     enode.ID
 	Addr     *net.UDPAddr
 	Filename string
-	xferID   uint16
-	server   *Server
+	Archive  bool   // if set, Filename is a pattern and matching files should be sent as tar
+	Offset   uint64 // requested start offset, see SetInfo
+
+	// These are set for conditional requests. IfModifiedSince is the
+	// modification time of the client's copy of the file, with second
+	// precision, and IfNoneMatch is its SHA256 hash. When the file matches,
+	// the handler can call NotModified instead of Accept.
+	IfModifiedSince time.Time
+	IfNoneMatch     *[32]byte
 
-	acceptInit chan bool
+	xferID uint16
+	server *Server
+
+	info       FileInfo
+	encodings  []string  // content encodings supported by the client
+	started    time.Time // when the request was accepted
+	acceptInit chan xferInitResponse
+	abortOnce  sync.Once
+	aborted    chan struct{} // closed when the client aborts the transfer
+	sent       atomic.Int64
 }
 
 // Accept accepts the file transfer request. This must be called
@@ -131,36 +677,155 @@ func (r *TransferRequest) Accept() error {
 	if r.acceptInit == nil {
 		return errAlreadyAccepted
 	}
-	r.acceptInit <- true
+	r.acceptInit <- xferInitResponse{OK: true}
 	r.acceptInit = nil
+	ev := r.event()
+	r.started = time.Now()
+	if r.server.cfg.OnStart != nil {
+		r.server.cfg.OnStart(ev)
+	}
 	return nil
 }
 
-func (r *TransferRequest) reject() {
+// NotModified answers a conditional request, telling the client that its copy
+// of the file is current. It must be called instead of Accept, and the handler
+// should return nil afterwards.
+func (r *TransferRequest) NotModified() error {
+	if r.acceptInit == nil {
+		return errAlreadyAccepted
+	}
+	r.acceptInit <- xferInitResponse{OK: false, NotModified: true}
+	r.acceptInit = nil
+	return nil
+}
+
+// event creates the lifecycle event of the request.
+func (r *TransferRequest) event() TransferEvent {
+	ev := TransferEvent{
+		Node:     r.Node,
+		Addr:     r.Addr,
+		Filename: r.Filename,
+		Bytes:    r.sent.Load(),
+	}
+	if !r.started.IsZero() {
+		ev.Duration = time.Since(r.started)
+	}
+	return ev
+}
+
+func (r *TransferRequest) reject(err error) {
 	if r.acceptInit == nil {
 		return
 	}
-	r.acceptInit <- false
+	r.acceptInit <- xferInitResponse{OK: false, Reason: rejectReason(err)}
 	r.acceptInit = nil
 }
 
+// SetInfo sets the file metadata announced to the client. It must be called
+// before SendFile or SendStream. The Size field of info is ignored, the size
+// is given to SendFile instead.
+//
+// Handlers supporting partial transfers should send the content starting at
+// the requested Offset and announce it by setting info.Offset. Handlers that
+// leave info.Offset at zero send the whole file.
+func (r *TransferRequest) SetInfo(info FileInfo) {
+	r.info = info
+}
+
 // SendFile delivers the content in the given reader to the remote client.
-func (r *TransferRequest) SendFile(size uint64, reader io.Reader) error {
+// The transfer is aborted when ctx is canceled, or when the client aborts it.
+func (r *TransferRequest) SendFile(ctx context.Context, size uint64, reader io.Reader) error {
+	if size > math.MaxInt64 {
+		return ErrFileTooLarge
+	}
+	return r.send(ctx, size, reader)
+}
+
+// SendFileWithInfo delivers the content in the given reader to the remote
+// client and announces info as the file metadata. Unlike SendFile, the content
+// doesn't have to come from a file: info.Name can be any name, and the client
+// sees it as the name of the file. If info.Size is negative, the content is sent
+// as a stream of unknown size like with SendStream.
+func (r *TransferRequest) SendFileWithInfo(ctx context.Context, info FileInfo, reader io.Reader) error {
+	r.SetInfo(info)
+	if info.Size < 0 {
+		return r.SendStream(ctx, reader)
+	}
+	return r.SendFile(ctx, uint64(info.Size), reader)
+}
+
+// SendStream delivers the content in the given reader to the remote client. Unlike
+// SendFile, the size of the content does not need to be known in advance: all data
+// until EOF is sent. The client will see a stream of unknown size.
+func (r *TransferRequest) SendStream(ctx context.Context, reader io.Reader) error {
+	return r.send(ctx, unknownFileSize, reader)
+}
+
+func (r *TransferRequest) send(ctx context.Context, size uint64, reader io.Reader) error {
 	if r.acceptInit != nil {
 		return errNotAccepted
 	}
+	if r.isAborted() {
+		return ErrTransferAborted
+	}
 
-	w, err := r.startSession(size)
+	// Cancel the transfer when the client aborts.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.aborted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	encoding := r.server.cfg.chooseEncoding(r.encodings, r.info.ContentType)
+	w, err := r.startSession(ctx, size, encoding)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	_, err = io.CopyN(w, reader, int64(size))
+	contentSize := int64(size)
+	if size == unknownFileSize {
+		contentSize = -1
+	}
+	limiters := []*rate.Limiter{newRateLimiter(r.server.cfg.MaxUploadBytesPerSec), r.server.uploadLimit}
+	if encoding == encodingGzip {
+		// The compressed size isn't known, so the stream is sent until EOF.
+		zr := compressReader(reader, contentSize, &r.sent)
+		defer zr.Close()
+		err = w.sendContent(ctx, zr, -1, nil, limiters...)
+	} else {
+		err = w.sendContent(ctx, reader, contentSize, &r.sent, limiters...)
+	}
+	if err != nil && r.isAborted() {
+		return ErrTransferAborted
+	}
 	return err
 }
 
-func (r *TransferRequest) startSession(fileSize uint64) (io.WriteCloser, error) {
+// Progress returns the number of bytes sent by SendFile or SendStream so far.
+// It is safe to call this method concurrently with SendFile.
+func (r *TransferRequest) Progress() int64 {
+	return r.sent.Load()
+}
+
+func (r *TransferRequest) abort() {
+	r.abortOnce.Do(func() { close(r.aborted) })
+}
+
+func (r *TransferRequest) isAborted() bool {
+	select {
+	case <-r.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *TransferRequest) startSession(ctx context.Context, fileSize uint64, encoding string) (*streamSession, error) {
 	initiator, err := r.server.host.SessionStore.Initiator(r.server.cfg.Prefix)
 	if err != nil {
 		return nil, err
@@ -170,17 +835,188 @@ func (r *TransferRequest) startSession(fileSize uint64) (io.WriteCloser, error)
 		ID:              r.xferID,
 		InitiatorSecret: initiator.Secret(),
 		FileSize:        fileSize,
+		Transport:       transportName(r.server.cfg.Transport),
+		Encoding:        encoding,
 	}
-	resp, err := r.server.sendXferStart(r.Node, r.Addr, &req)
+	r.info.setRequest(&req)
+	resp, err := r.server.sendXferStart(ctx, r.Node, r.Addr, &req)
 	if err != nil {
 		return nil, err
 	}
 
-	w := newSession(r.server.host.Socket)
+	w := newSession(r.server.host.Socket, r.server.cfg.Transport)
 	initiator.SetHandler(w.deliver)
 	ip, _ := netip.AddrFromSlice(r.Addr.IP)
 	session := initiator.Establish(ip, resp.RecipientSecret)
-	w.connect(session, r.Addr)
-
+	if err := w.connect(session, r.Addr); err != nil {
+		return nil, err
+	}
 	return w, nil
 }
+
+// UploadRequest is a file upload from a remote client.
+type UploadRequest struct {
+	Node     enode.ID
+	Addr     *net.UDPAddr
+	Filename string
+	Size     uint64
+
+	initiatorSecret [16]byte
+	server          *Server
+	accept          chan xferPushResponse
+
+	mu      sync.Mutex
+	reader  *streamSession // set by Accept
+	aborted bool
+}
+
+// Accept accepts the upload. The returned reader delivers the file content.
+// This must be called as quickly as possible after receiving the request.
+func (r *UploadRequest) Accept() (io.ReadCloser, error) {
+	if r.accept == nil {
+		return nil, errAlreadyAccepted
+	}
+	if r.isAborted() {
+		r.reject(ErrTransferAborted)
+		return nil, ErrTransferAborted
+	}
+
+	ip, _ := netip.AddrFromSlice(r.Addr.IP)
+	rs, err := r.server.host.SessionStore.Recipient(r.server.cfg.Prefix, ip, r.initiatorSecret)
+	if err != nil {
+		err = fmt.Errorf("session establishment failed: %v", err)
+		r.reject(err)
+		return nil, err
+	}
+	resp := xferPushResponse{OK: true, RecipientSecret: rs.Secret()}
+
+	reader := newSession(r.server.host.Socket, r.server.cfg.Transport)
+	reader.transferSize = int64(r.Size)
+	rs.SetHandler(reader.deliver)
+	if err := reader.connect(rs.Establish(), r.Addr); err != nil {
+		r.reject(err)
+		return nil, err
+	}
+	if !r.setReader(reader) {
+		reader.abort()
+		r.reject(ErrTransferAborted)
+		return nil, ErrTransferAborted
+	}
+
+	r.accept <- resp
+	r.accept = nil
+	return &uploadReader{reader, r}, nil
+}
+
+// uploadReader is the content stream of an accepted upload.
+type uploadReader struct {
+	*streamSession
+	req *UploadRequest
+}
+
+func (r *uploadReader) Read(b []byte) (int, error) {
+	n, err := r.streamSession.Read(b)
+	if err != nil && r.req.isAborted() {
+		return n, ErrTransferAborted
+	}
+	return n, err
+}
+
+// setReader stores the stream of an accepted upload. It returns false if the
+// upload was aborted.
+func (r *UploadRequest) setReader(reader *streamSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.aborted {
+		return false
+	}
+	r.reader = reader
+	return true
+}
+
+// abort terminates the upload. Reads of an accepted upload fail afterwards.
+func (r *UploadRequest) abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aborted = true
+	if r.reader != nil {
+		r.reader.abort()
+	}
+}
+
+func (r *UploadRequest) isAborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+func (r *UploadRequest) reject(err error) {
+	if r.accept == nil {
+		return
+	}
+	r.accept <- xferPushResponse{OK: false, Reason: rejectReason(err)}
+	r.accept = nil
+}
+
+// checkFilename validates a file name received from a remote node. Names must
+// be valid UTF-8, may not contain control characters and may not be longer than
+// MaxFilenameLength. The returned error doesn't contain the name, so it is safe
+// to log.
+func checkFilename(name string) error {
+	if len(name) > MaxFilenameLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidFilename, MaxFilenameLength)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidFilename)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%w: contains control character %U", ErrInvalidFilename, c)
+		}
+	}
+	return nil
+}
+
+// rejectReason returns the reason sent to the client when a request
+// is rejected because of err.
+func rejectReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	reason := err.Error()
+	if len(reason) > maxReasonLength {
+		// Cut at a rune boundary to keep the text valid UTF-8.
+		n := maxReasonLength
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	return reason
+}
+
+// retryDelay returns the delay before the given retry attempt. The delay
+// doubles with each attempt, and a random jitter of up to half the delay
+// is subtracted.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < maxStartRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxStartRetryDelay && base < maxStartRetryDelay {
+		d = maxStartRetryDelay
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepContext waits for d to pass. It returns false if ctx is canceled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,172 @@
+package fileserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/fjl/discv5-streams/session"
+	"golang.org/x/time/rate"
+)
+
+// sendChunkSize is the amount of data written between cancellation checks.
+const sendChunkSize = 32 * 1024
+
+// streamSession is the stream of a transfer. It carries the packets of a
+// TransportConn over a session.
+type streamSession struct {
+	socket       writeSocket
+	transport    Transport
+	conn         TransportConn
+	session      *session.Session
+	transferSize int64
+
+	decBuffer []byte
+	encBuffer []byte
+}
+
+type writeSocket interface {
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+}
+
+func newSession(socket writeSocket, transport Transport) *streamSession {
+	size := maxPacketSize(transport)
+	us := &streamSession{
+		socket:    socket,
+		transport: transport,
+		decBuffer: make([]byte, 0, size),
+		encBuffer: make([]byte, 0, size+session.Overhead),
+	}
+	return us
+}
+
+func (r *streamSession) connect(s *session.Session, remote net.Addr) error {
+	r.session = s
+	conn, err := r.transport.NewConn(r.socket.LocalAddr(), remote, r.packetOut)
+	if err != nil {
+		return fmt.Errorf("can't create %s connection: %w", r.transport.Name(), err)
+	}
+	r.conn = conn
+	return nil
+}
+
+func (r *streamSession) deliver(s *session.Session, packet []byte, src net.Addr) {
+	if r.conn == nil {
+		return // connect failed
+	}
+	data, err := s.Decode(r.decBuffer[:0], packet)
+	if err != nil {
+		return
+	}
+	r.decBuffer = data[:0] // keep the buffer if Decode had to grow it
+	// var ptype byte
+	// if len(data) > 0 {
+	// 	ptype = data[0] & 0x0F
+	// }
+	// log.Trace("<< uTP packet", "type", ptype, "size", len(data), "addr", src)
+	r.conn.PacketIn(data)
+}
+
+func (r *streamSession) packetOut(b []byte, dst net.Addr) (n int, err error) {
+	// var ptype byte
+	// if len(b) > 0 {
+	// 	ptype = b[0] & 0x0F
+	// }
+	// log.Trace(">> uTP packet", "type", ptype, "size", len(b), "dst", dst)
+	data, err := r.session.Encode(r.encBuffer[:0], b)
+	if err != nil {
+		return 0, err
+	}
+	r.encBuffer = data[:0] // keep the buffer if Encode had to grow it
+	if _, err = r.socket.WriteTo(data, dst); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (r *streamSession) Size() int64 {
+	return r.transferSize
+}
+
+func (r *streamSession) Read(b []byte) (n int, err error) {
+	return r.conn.Read(b)
+}
+
+func (r *streamSession) Write(b []byte) (n int, err error) {
+	return r.conn.Write(b)
+}
+
+func (r *streamSession) Close() error {
+	return r.conn.Close()
+}
+
+// abort closes the connection without waiting for sent data to arrive, if the
+// transport supports it.
+func (r *streamSession) abort() {
+	if a, ok := r.conn.(interface{ Abort() }); ok {
+		a.Abort()
+		return
+	}
+	r.conn.Close()
+}
+
+// sendContent writes size bytes from src to the connection. If size is negative, all
+// content until EOF is sent. Writes are throttled by the given rate limiters. The
+// number of bytes written is added to sent, if non-nil.
+// When ctx is canceled, the transfer is aborted and the connection is closed
+// without waiting for sent data.
+func (r *streamSession) sendContent(ctx context.Context, src io.Reader, size int64, sent *atomic.Int64, limiters ...*rate.Limiter) error {
+	// Close the connection on cancellation. This unblocks any pending write.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.abort()
+		case <-done:
+		}
+	}()
+
+	var w io.Writer = r
+	if sent != nil {
+		w = &countingWriter{w: w, n: sent}
+	}
+	w = throttle(ctx, w, limiters...)
+	for size != 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := int64(sendChunkSize)
+		if size > 0 && chunk > size {
+			chunk = size
+		}
+		n, err := io.CopyN(w, src, chunk)
+		if size > 0 {
+			size -= n
+		}
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err == io.EOF && size < 0:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+// countingWriter adds the number of bytes written to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n.Add(int64(n))
+	return n, err
+}
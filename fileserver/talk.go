@@ -1,24 +1,67 @@
 package fileserver
 
+import "math"
+
+// unknownFileSize is the FileSize of xferStartRequest for streams
+// where the size is not known in advance.
+const unknownFileSize = math.MaxUint64
+
 // TALK messages.
 type (
 	xferInitRequest struct {
-		ID       uint16
-		Filename string
+		ID        uint16
+		Filename  string
+		Archive   bool     `rlp:"optional"`
+		Offset    uint64   `rlp:"optional"`
+		Encodings []string `rlp:"optional"` // content encodings supported by the client
+
+		// Conditional request: the client has a copy with this modification
+		// time (unix time in seconds) and SHA256 hash. Both are optional.
+		IfModifiedSince uint64 `rlp:"optional"`
+		IfNoneMatch     []byte `rlp:"optional"`
 	}
 
 	xferInitResponse struct {
-		OK bool
+		OK          bool
+		Reason      string `rlp:"optional"`
+		NotModified bool   `rlp:"optional"` // answer to a conditional request, OK is false
 	}
 
 	xferStartRequest struct {
 		ID              uint16
 		InitiatorSecret [16]byte
 		FileSize        uint64
+		Name            string `rlp:"optional"`
+		ModTime         uint64 `rlp:"optional"` // unix time in seconds, zero if unknown
+		ContentType     string `rlp:"optional"`
+		Offset          uint64 `rlp:"optional"` // start offset of the content
+		Transport       string `rlp:"optional"` // empty for uTP
+		Encoding        string `rlp:"optional"` // content encoding, empty for none
 	}
 
 	xferStartResponse struct {
 		OK              bool
 		RecipientSecret [16]byte
 	}
+
+	xferAbortRequest struct {
+		ID uint16
+	}
+
+	xferAbortResponse struct {
+		OK bool
+	}
+
+	xferPushRequest struct {
+		Filename        string
+		FileSize        uint64
+		InitiatorSecret [16]byte
+		Transport       string `rlp:"optional"` // empty for uTP
+	}
+
+	xferPushResponse struct {
+		OK              bool
+		RecipientSecret [16]byte
+		Reason          string `rlp:"optional"`
+	}
 )
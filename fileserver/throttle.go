@@ -0,0 +1,64 @@
+package fileserver
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter creates a limiter for the given rate.
+// It returns nil if bytesPerSec is zero, i.e. when there is no limit.
+func newRateLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// throttledWriter applies rate limits to writes.
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// throttle wraps w so writes are delayed according to the given limiters.
+// Nil limiters are ignored. Pending writes are aborted when ctx is canceled.
+func throttle(ctx context.Context, w io.Writer, limiters ...*rate.Limiter) io.Writer {
+	tw := &throttledWriter{ctx: ctx, w: w}
+	for _, l := range limiters {
+		if l != nil {
+			tw.limiters = append(tw.limiters, l)
+		}
+	}
+	if len(tw.limiters) == 0 {
+		return w
+	}
+	return tw
+}
+
+func (tw *throttledWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		// Limiters can't grant more than their burst size at once,
+		// so the write has to be split into chunks.
+		chunk := len(b)
+		for _, l := range tw.limiters {
+			if burst := l.Burst(); chunk > burst {
+				chunk = burst
+			}
+		}
+		for _, l := range tw.limiters {
+			if err := l.WaitN(tw.ctx, chunk); err != nil {
+				return n, err
+			}
+		}
+		written, err := tw.w.Write(b[:chunk])
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+	}
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package fileserver
+
+import (
+	"net"
+
+	"github.com/fjl/discv5-streams/utpconn"
+)
+
+// Transport creates the stream connections of transfers. The packets of a
+// stream are encrypted by the session of the transfer, so transports only deal
+// with reliable delivery and congestion control.
+//
+// Both ends of a transfer must use the same transport. The transport name is
+// announced in the transfer handshake, and transfers with peers using another
+// transport are rejected.
+type Transport interface {
+	// Name identifies the transport in the handshake.
+	Name() string
+
+	// NewConn creates the connection of a transfer with remote. The connection
+	// sends packets by calling write. Received packets are delivered through
+	// its PacketIn method.
+	NewConn(local, remote net.Addr, write func([]byte, net.Addr) (int, error)) (TransportConn, error)
+}
+
+// TransportConn is a stream connection created by a Transport.
+//
+// When the remote end closes the connection, Read returns io.EOF after all
+// data written before Close was received.
+type TransportConn interface {
+	net.Conn
+
+	// PacketIn delivers a received packet. The connection must not retain the
+	// packet buffer after PacketIn returns.
+	PacketIn(packet []byte)
+}
+
+// Transports may implement this interface to announce the size of their
+// packets. Packet buffers are sized accordingly.
+type packetSizer interface {
+	// MaxPacketSize returns the largest packet passed to the write function
+	// of connections created by the transport.
+	MaxPacketSize() int
+}
+
+// defaultMaxPacketSize is the packet size assumed for transports which don't
+// implement packetSizer.
+const defaultMaxPacketSize = 2048
+
+// maxPacketSize returns the largest packet sent by connections of t.
+func maxPacketSize(t Transport) int {
+	if ps, ok := t.(packetSizer); ok {
+		return ps.MaxPacketSize()
+	}
+	return defaultMaxPacketSize
+}
+
+const utpTransportName = "utp"
+
+// UTPTransport is the default transport, which uses uTP connections of
+// package utpconn.
+type UTPTransport struct {
+	Options []utpconn.SocketOption
+}
+
+// Name returns "utp".
+func (t UTPTransport) Name() string {
+	return utpTransportName
+}
+
+// MaxPacketSize returns utpconn.MaxPacketSize.
+func (t UTPTransport) MaxPacketSize() int {
+	return utpconn.MaxPacketSize
+}
+
+// NewConn creates a uTP connection.
+func (t UTPTransport) NewConn(local, remote net.Addr, write func([]byte, net.Addr) (int, error)) (TransportConn, error) {
+	return utpconn.NewConn(local, remote, write, t.Options...), nil
+}
+
+// transportName returns the name of t as sent in the handshake. It is empty
+// for uTP, which is used by peers that don't announce a transport.
+func transportName(t Transport) string {
+	if name := t.Name(); name != utpTransportName {
+		return name
+	}
+	return ""
+}
@@ -1,17 +1,69 @@
 package fileserver
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 )
 
 // TransferRef is a reference to a file on a remote node.
+//
+// The optional fields are encoded as URL query parameters:
+//
+//	discv5fs://<enr>/file?file=other&range=1000-&sha256=<hex>
+//
+// Instead of the ENR, the node can also be given like in enode:// URLs, i.e. as
+// the hex-encoded public key and the IP address or DNS name of the node:
+//
+//	discv5fs://<pubkey>@<host>:<port>/file
 type TransferRef struct {
 	Node *enode.Node
+	Host string // DNS name and UDP port of Node, see Resolve
 	File string
+
+	Files  []string   // additional files ("file" parameter)
+	Range  *ByteRange // requested part of File ("range" parameter)
+	SHA256 *[32]byte  // expected hash of File ("sha256" parameter)
+}
+
+// ByteRange is a range of bytes in a file. End is inclusive. It is -1 when
+// the range extends to the end of the file.
+type ByteRange struct {
+	Start, End int64
+}
+
+func parseByteRange(s string) (*ByteRange, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, errors.New("missing '-'")
+	}
+	r := &ByteRange{End: -1}
+	var err error
+	if r.Start, err = strconv.ParseInt(start, 10, 64); err != nil || r.Start < 0 {
+		return nil, errors.New("invalid start offset")
+	}
+	if end != "" {
+		if r.End, err = strconv.ParseInt(end, 10, 64); err != nil || r.End < r.Start {
+			return nil, errors.New("invalid end offset")
+		}
+	}
+	return r, nil
+}
+
+// String returns the range in "start-end" notation.
+func (r *ByteRange) String() string {
+	if r.End < 0 {
+		return fmt.Sprintf("%d-", r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
 }
 
 // ParseURL parses a transfer reference URL.
@@ -23,16 +75,102 @@ func ParseURL(text string) (ref TransferRef, err error) {
 	if u.Scheme != "discv5fs" {
 		return ref, errors.New("missing/wrong URL scheme")
 	}
-	enr := "enr:" + u.Host
-	node, err := enode.Parse(enode.ValidSchemes, enr)
+	node, host, err := parseURLNode(u)
 	if err != nil {
-		return ref, errors.New("invalid ENR host")
+		return ref, err
 	}
 	if u.Path == "" || u.Path == "/" {
 		return ref, errors.New("empty file path")
 	}
-	file := strings.TrimPrefix(u.Path, "/")
-	return TransferRef{Node: node, File: file}, nil
+	ref = TransferRef{Node: node, Host: host, File: strings.TrimPrefix(u.Path, "/")}
+
+	// Decode parameters. Unknown parameters are ignored.
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return ref, errors.New("invalid URL query")
+	}
+	for _, f := range query["file"] {
+		if f == "" {
+			return ref, errors.New("empty file parameter")
+		}
+		ref.Files = append(ref.Files, f)
+	}
+	if v := query.Get("range"); v != "" {
+		if ref.Range, err = parseByteRange(v); err != nil {
+			return ref, fmt.Errorf("invalid range parameter: %v", err)
+		}
+	}
+	if v := query.Get("sha256"); v != "" {
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != 32 {
+			return ref, errors.New("invalid sha256 parameter")
+		}
+		ref.SHA256 = new([32]byte)
+		copy(ref.SHA256[:], b)
+	}
+	return ref, nil
+}
+
+// parseURLNode decodes the host part of a transfer URL. The returned host is
+// non-empty when the node is given by DNS name.
+func parseURLNode(u *url.URL) (*enode.Node, string, error) {
+	if u.User == nil {
+		node, err := enode.Parse(enode.ValidSchemes, "enr:"+u.Host)
+		if err != nil {
+			return nil, "", errors.New("invalid ENR host")
+		}
+		return node, "", nil
+	}
+
+	// enode notation.
+	b, err := hex.DecodeString(u.User.Username())
+	if err != nil || len(b) != 64 {
+		return nil, "", errors.New("invalid node public key")
+	}
+	key, err := crypto.UnmarshalPubkey(append([]byte{0x04}, b...))
+	if err != nil {
+		return nil, "", errors.New("invalid node public key")
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || port == 0 {
+		return nil, "", errors.New("invalid node port")
+	}
+	if u.Hostname() == "" {
+		return nil, "", errors.New("missing node host")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return enode.NewV4(key, ip, 0, int(port)), "", nil
+	}
+	return enode.NewV4(key, nil, 0, int(port)), u.Host, nil
+}
+
+// Resolve looks up the IP address of ref.Host, and updates ref.Node with it.
+// It does nothing if the node is not given by DNS name.
+func (ref *TransferRef) Resolve(ctx context.Context) error {
+	if ref.Host == "" {
+		return nil
+	}
+	name, _, err := net.SplitHostPort(ref.Host)
+	if err != nil {
+		return err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", name)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IP address for %s", name)
+	}
+	// Prefer IPv4 because hosts listen on udp4 by default.
+	ip := ips[0]
+	for _, addr := range ips {
+		if addr.To4() != nil {
+			ip = addr
+			break
+		}
+	}
+	ref.Node = enode.NewV4(ref.Node.Pubkey(), ip, 0, ref.Node.UDP())
+	return nil
 }
 
 // String encodes the transfer reference as a URL.
@@ -42,5 +180,25 @@ func (ref *TransferRef) String() string {
 		Host:   strings.TrimPrefix(ref.Node.String(), "enr:"),
 		Path:   ref.File,
 	}
+	if ref.Host != "" || len(ref.Node.Record().Signature()) == 0 {
+		// The node has no signed record, use enode notation.
+		pubkey := crypto.FromECDSAPub(ref.Node.Pubkey())[1:]
+		u.User = url.User(hex.EncodeToString(pubkey))
+		u.Host = ref.Host
+		if u.Host == "" {
+			u.Host = net.JoinHostPort(ref.Node.IP().String(), strconv.Itoa(ref.Node.UDP()))
+		}
+	}
+	query := make(url.Values)
+	for _, f := range ref.Files {
+		query.Add("file", f)
+	}
+	if ref.Range != nil {
+		query.Set("range", ref.Range.String())
+	}
+	if ref.SHA256 != nil {
+		query.Set("sha256", hex.EncodeToString(ref.SHA256[:]))
+	}
+	u.RawQuery = query.Encode()
 	return u.String()
 }
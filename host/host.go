@@ -1,22 +1,82 @@
 package host
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	ethlog "github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/fjl/discv5-streams/session"
 	"github.com/fjl/discv5-streams/sharedsocket"
 )
 
+// sessionExpiryInterval is how often expired sessions are removed from the
+// session store.
+const sessionExpiryInterval = time.Second
+
+// SessionHandlerPriority is the packet handler priority of the session store.
+// Handlers added by AddHandler with a higher priority see packets before the
+// session store. Discovery receives all packets not accepted by any handler.
+const SessionHandlerPriority = 0
+
 // Config is the configuration of Host.
 type Config struct {
+	// Network is the UDP network to listen on: "udp4", "udp6" or "udp" for
+	// dual-stack. The default is "udp4". With NewWithConn, it is only used to
+	// tell udp6 sockets apart from dual-stack ones.
+	Network string
+
 	ListenAddr string
-	NodeDB     string // Path to node database directory.
 	Discovery  discover.Config
+
+	// NodeDB is the path of the node database directory. If empty, the
+	// database is kept in memory and nothing is written to disk.
+	NodeDB string
+
+	// NodeKeyFile is the file containing the node key. It is used when
+	// Discovery.PrivateKey is nil. If the file doesn't exist, a new key is
+	// generated and saved to it. When both are unset, a temporary key is
+	// generated.
+	NodeKeyFile string
+
+	// LocalNode is an existing local node to use instead of creating one.
+	// Discovery.PrivateKey must be set to the key of the node, and NodeDB is
+	// ignored. The Host doesn't close the database of LocalNode.
+	LocalNode *enode.LocalNode
+
+	// Log is the logger used by the Host and the protocols running on it.
+	// It is also used for discovery unless Discovery.Log is set.
+	// The default is the go-ethereum root logger.
+	Log ethlog.Logger
+
+	// NAT enables port mapping and external address detection. When set, a
+	// mapping is created for the UDP port and the external IP is advertised
+	// in the local node record.
+	NAT nat.Interface
+
+	// NoDiscovery runs discovery in direct-dial mode, for use with known peers.
+	// The host doesn't contact bootstrap nodes and doesn't seed its table from
+	// the node database, so it never joins the DHT on its own. NodeDB and
+	// Discovery.Bootnodes are ignored.
+	//
+	// The discv5 listener still runs, because TALK requests are carried by it.
+	// Requests to a node work when its record is known, e.g. from an enode URL,
+	// since discv5 performs the handshake directly with the node. Nodes that
+	// contact the host are added to the table and can be returned in response
+	// to FINDNODE.
+	//
+	// Note that the discovery table still runs its periodic refresh, which
+	// can't be disabled. The refresh lookups only reach the nodes in the table,
+	// i.e. nodes that have contacted the host or were contacted by it.
+	NoDiscovery bool
 }
 
 var ConfigForTesting = Config{
@@ -33,58 +93,122 @@ type Host struct {
 	NodeDB       *enode.DB
 	Discovery    *discover.UDPv5
 	SessionStore *session.Store
+
+	log     ethlog.Logger
+	started time.Time
+	quit    chan struct{}
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+
+	protoMu   sync.Mutex
+	protocols map[string]bool
+	drainers  []Drainer
+
+	ownDB bool // NodeDB is closed by Close
+}
+
+// Drainer is implemented by protocols that can finish active work before
+// the Host is closed.
+type Drainer interface {
+	// Drain stops accepting new work and waits until active work is done,
+	// or until ctx is canceled.
+	Drain(ctx context.Context) error
+}
+
+// Stats contains counters of a Host.
+type Stats struct {
+	TableNodes int           // nodes in the discovery table
+	Sessions   int           // active sub-protocol sessions
+	Uptime     time.Duration // time since Listen
+
+	// Traffic on the shared socket.
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesIn    uint64
+	BytesOut   uint64
 }
 
 // Listen creates a UDP listener on the configured address, and sets up the p2p
 // networking stack.
 func Listen(cfg Config) (*Host, error) {
-	// Assign config defaults.
+	switch cfg.Network {
+	case "":
+		cfg.Network = "udp4"
+	case "udp4", "udp6", "udp":
+	default:
+		return nil, fmt.Errorf("invalid network %q", cfg.Network)
+	}
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":0"
 	}
-	if cfg.Discovery.PrivateKey == nil {
-		ethlog.Info("Generating new node key")
-		key, err := crypto.GenerateKey()
-		if err != nil {
-			return nil, err
-		}
-		cfg.Discovery.PrivateKey = key
-	}
-	if cfg.Discovery.Bootnodes == nil {
-		cfg.Discovery.Bootnodes = parseDefaultBootnodes()
+	pc, err := net.ListenPacket(cfg.Network, cfg.ListenAddr)
+	if err != nil {
+		return nil, err
 	}
+	return NewWithConn(pc.(*net.UDPConn), cfg)
+}
 
-	// Listen.
-	conn, err := sharedsocket.Listen("udp4", cfg.ListenAddr)
-	if err != nil {
+// NewWithConn sets up the p2p networking stack on the given socket. The
+// ListenAddr in cfg is ignored. The Host takes ownership of the socket and
+// closes it when the Host is closed, or when NewWithConn returns an error.
+func NewWithConn(pc sharedsocket.UDPConn, cfg Config) (*Host, error) {
+	// Assign config defaults.
+	if cfg.Log == nil {
+		cfg.Log = ethlog.Root()
+	}
+	if cfg.Discovery.Log == nil {
+		cfg.Discovery.Log = cfg.Log
+	}
+	if err := setupNodeKey(&cfg); err != nil {
+		pc.Close()
 		return nil, err
 	}
+	if cfg.NoDiscovery {
+		cfg.Discovery.Bootnodes = []*enode.Node{}
+		cfg.NodeDB = ""
+	} else if cfg.Discovery.Bootnodes == nil {
+		cfg.Discovery.Bootnodes = parseDefaultBootnodes()
+	}
+
+	conn := sharedsocket.NewConn(pc)
 
 	// Configure LocalNode.
-	db, err := enode.OpenDB(cfg.NodeDB)
-	if err != nil {
-		return nil, fmt.Errorf("can't open nodes database: %w", err)
+	ln, ownDB := cfg.LocalNode, false
+	if ln == nil {
+		db, err := enode.OpenDB(cfg.NodeDB)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("can't open nodes database: %w", err)
+		}
+		ln, ownDB = enode.NewLocalNode(db, cfg.Discovery.PrivateKey), true
 	}
-	ln := enode.NewLocalNode(db, cfg.Discovery.PrivateKey)
-	laddr := conn.LocalAddr().(*net.UDPAddr)
-	if laddr.IP.IsUnspecified() {
-		ln.SetFallbackIP(net.IPv4(127, 0, 0, 1))
-	} else {
-		ln.SetFallbackIP(laddr.IP)
+	db := ln.Database()
+	closeDB := func() {
+		if ownDB {
+			db.Close()
+		}
+	}
+	laddr, _ := conn.LocalAddr().(*net.UDPAddr)
+	if laddr != nil {
+		setFallbackEndpoint(ln, laddr, cfg.Network)
 	}
-	ln.SetFallbackUDP(laddr.Port)
 
 	// Configure discovery.
 	discoverConn := conn.DefaultConn()
 	disc, err := discover.ListenV5(discoverConn, ln, cfg.Discovery)
 	if err != nil {
 		conn.Close()
+		closeDB()
 		return nil, err
 	}
 
 	// Configure session system.
 	sessionStore := session.NewStore()
-	conn.AddHandler(sessionStore)
+	sessionStore.SetLogger(cfg.Log)
+	sessionStore.StartExpiry(sessionExpiryInterval)
+	conn.AddHandlerWithPriority(sessionStore, SessionHandlerPriority)
 
 	stack := &Host{
 		Socket:       conn,
@@ -92,14 +216,236 @@ func Listen(cfg Config) (*Host, error) {
 		NodeDB:       db,
 		Discovery:    disc,
 		SessionStore: sessionStore,
+		log:          cfg.Log,
+		started:      time.Now(),
+		quit:         make(chan struct{}),
+		protocols:    make(map[string]bool),
+		ownDB:        ownDB,
+	}
+	if cfg.NAT != nil && laddr != nil {
+		stack.setupNAT(cfg.NAT, laddr)
 	}
 	return stack, nil
 }
 
-// Close terminates the stack.
+// setupNodeKey assigns the node key of cfg.
+func setupNodeKey(cfg *Config) error {
+	switch {
+	case cfg.Discovery.PrivateKey != nil:
+	case cfg.LocalNode != nil:
+		return errors.New("Discovery.PrivateKey must be set when LocalNode is given")
+	case cfg.NodeKeyFile != "":
+		key, created, err := LoadOrCreateKey(cfg.NodeKeyFile)
+		if err != nil {
+			return err
+		}
+		if created {
+			cfg.Log.Info("Generated new node key", "file", cfg.NodeKeyFile)
+		}
+		cfg.Discovery.PrivateKey = key
+	default:
+		cfg.Log.Info("Generating new node key")
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return err
+		}
+		cfg.Discovery.PrivateKey = key
+	}
+	if cfg.LocalNode != nil {
+		id := enode.PubkeyToIDV4(&cfg.Discovery.PrivateKey.PublicKey)
+		if id != cfg.LocalNode.ID() {
+			return errors.New("Discovery.PrivateKey is not the key of LocalNode")
+		}
+	}
+	return nil
+}
+
+// setFallbackEndpoint configures the local node endpoint from the listener address.
+func setFallbackEndpoint(ln *enode.LocalNode, laddr *net.UDPAddr, network string) {
+	switch {
+	case !laddr.IP.IsUnspecified():
+		ln.SetFallbackIP(laddr.IP)
+	case laddr.IP.To4() != nil:
+		ln.SetFallbackIP(net.IPv4(127, 0, 0, 1))
+	case network == "udp6":
+		ln.SetFallbackIP(net.IPv6loopback)
+	default:
+		// Dual-stack socket, configure both endpoints.
+		ln.SetFallbackIP(net.IPv4(127, 0, 0, 1))
+		ln.SetFallbackIP(net.IPv6loopback)
+	}
+	ln.SetFallbackUDP(laddr.Port)
+}
+
+// setupNAT creates the port mapping and sets the external IP of the local node.
+func (s *Host) setupNAT(natm nat.Interface, laddr *net.UDPAddr) {
+	if ip, ok := natm.(nat.ExtIP); ok {
+		// ExtIP doesn't block, set the IP right away.
+		s.LocalNode.SetStaticIP(net.IP(ip))
+	} else {
+		// Asking the router for the IP takes a while, do it in the background.
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ip, err := natm.ExternalIP()
+			if err != nil {
+				s.log.Warn("Can't get external IP", "interface", natm, "err", err)
+				return
+			}
+			s.LocalNode.SetStaticIP(ip)
+		}()
+	}
+	if !laddr.IP.IsLoopback() {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			nat.Map(natm, s.quit, "udp", laddr.Port, laddr.Port, "discv5-streams")
+		}()
+	}
+}
+
+// RegisterTalkHandlers registers handlers for discv5 TALK protocols. If any of
+// the protocol names is already registered on the Host, no handlers are
+// registered and an error is returned.
+func (s *Host) RegisterTalkHandlers(handlers map[string]discover.TalkRequestHandler) error {
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+
+	for name := range handlers {
+		if s.protocols[name] {
+			return fmt.Errorf("TALK protocol %q is already registered", name)
+		}
+	}
+	for name, fn := range handlers {
+		s.protocols[name] = true
+		s.Discovery.RegisterTalkHandler(name, fn)
+	}
+	return nil
+}
+
+// UnregisterTalkHandlers removes the handlers of the given TALK protocols. Requests
+// for them are then answered like requests for unknown protocols, and the names can
+// be registered again.
+func (s *Host) UnregisterTalkHandlers(names ...string) {
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+
+	for _, name := range names {
+		if s.protocols[name] {
+			delete(s.protocols, name)
+			s.Discovery.RegisterTalkHandler(name, unknownTalkHandler)
+		}
+	}
+}
+
+// unknownTalkHandler replaces unregistered TALK handlers. Discovery has no way
+// to remove a handler, but it sends an empty response for unknown protocols,
+// which is what this handler does as well.
+func unknownTalkHandler(enode.ID, *net.UDPAddr, []byte) []byte {
+	return nil
+}
+
+// AddHandler adds a handler for incoming packets on the socket. Handlers with
+// higher priority are called first. Use a priority above SessionHandlerPriority
+// to see packets before the session store, and a lower one to see packets that
+// aren't session packets. Handlers with equal priority are called in the order
+// they were added, i.e. after the session store for SessionHandlerPriority.
+//
+// Packets not accepted by any handler go to discovery.
+func (s *Host) AddHandler(h sharedsocket.Handler, priority int) {
+	s.Socket.AddHandlerWithPriority(h, priority)
+}
+
+// RemoveHandler removes a handler added by AddHandler.
+func (s *Host) RemoveHandler(h sharedsocket.Handler) {
+	s.Socket.RemoveHandler(h)
+}
+
+// Protocols returns the names of registered TALK protocols in sorted order.
+func (s *Host) Protocols() []string {
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+
+	names := make([]string, 0, len(s.protocols))
+	for name := range s.protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Logger returns the logger of the stack.
+func (s *Host) Logger() ethlog.Logger {
+	return s.log
+}
+
+// Stats returns the current counters of the stack.
+func (s *Host) Stats() Stats {
+	sock := s.Socket.Stats()
+	return Stats{
+		TableNodes: len(s.Discovery.AllNodes()),
+		Sessions:   s.SessionStore.Len(),
+		Uptime:     time.Since(s.started),
+		PacketsIn:  sock.Packets,
+		PacketsOut: sock.SentPackets,
+		BytesIn:    sock.Bytes,
+		BytesOut:   sock.SentBytes,
+	}
+}
+
+// AddDrainer registers a protocol to be drained by Shutdown.
+func (s *Host) AddDrainer(d Drainer) {
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+	s.drainers = append(s.drainers, d)
+}
+
+// RemoveDrainer removes a protocol registered with AddDrainer.
+func (s *Host) RemoveDrainer(d Drainer) {
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+	for i, dd := range s.drainers {
+		if dd == d {
+			s.drainers = append(s.drainers[:i:i], s.drainers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Shutdown drains all registered protocols and closes the stack. The stack is
+// closed even if draining fails because ctx was canceled, and ctx's error
+// is returned in that case.
+func (s *Host) Shutdown(ctx context.Context) error {
+	s.protoMu.Lock()
+	drainers := s.drainers
+	s.protoMu.Unlock()
+
+	errc := make(chan error, len(drainers))
+	for _, d := range drainers {
+		go func(d Drainer) { errc <- d.Drain(ctx) }(d)
+	}
+	var drainErr error
+	for range drainers {
+		if err := <-errc; err != nil && drainErr == nil {
+			drainErr = err
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// Close terminates the stack. It is safe to call Close more than once.
 func (s *Host) Close() error {
-	s.Discovery.Close()
-	err := s.Socket.Close()
-	s.NodeDB.Close()
-	return err
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		s.Discovery.Close()
+		s.closeErr = s.Socket.Close()
+		s.wg.Wait()
+		if s.ownDB {
+			s.NodeDB.Close()
+		}
+	})
+	return s.closeErr
 }
@@ -0,0 +1,60 @@
+package host
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// This test checks that a host in NoDiscovery mode ignores bootnodes and the
+// node database, and can still send TALK requests to a known node.
+func TestNoDiscovery(t *testing.T) {
+	peer, err := Listen(ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	err = peer.RegisterTalkHandlers(map[string]discover.TalkRequestHandler{
+		"echo": func(id enode.ID, addr *net.UDPAddr, msg []byte) []byte { return msg },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ConfigForTesting
+	cfg.NoDiscovery = true
+	cfg.Discovery.Bootnodes = []*enode.Node{peer.LocalNode.Node()}
+	cfg.NodeDB = filepath.Join(t.TempDir(), "nodes")
+	h, err := Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// The bootnode is not contacted.
+	time.Sleep(200 * time.Millisecond)
+	if n := h.Stats().TableNodes; n != 0 {
+		t.Fatalf("table has %d nodes", n)
+	}
+	if n := peer.Stats().TableNodes; n != 0 {
+		t.Fatalf("bootnode table has %d nodes", n)
+	}
+	if _, err := os.Stat(cfg.NodeDB); !os.IsNotExist(err) {
+		t.Fatal("node database created:", err)
+	}
+
+	// TALK works with the known node.
+	resp, err := h.Discovery.TalkRequest(peer.LocalNode.Node(), "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal("talk error:", err)
+	}
+	if !bytes.Equal(resp, []byte("hello")) {
+		t.Fatalf("wrong response %q", resp)
+	}
+}
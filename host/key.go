@@ -0,0 +1,36 @@
+package host
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// LoadOrCreateKey loads the node key stored in file. If the file doesn't exist,
+// a new key is generated and saved to it, creating the parent directory if
+// necessary. The returned bool reports whether the key was generated.
+func LoadOrCreateKey(file string) (key *ecdsa.PrivateKey, created bool, err error) {
+	key, err = crypto.LoadECDSA(file)
+	switch {
+	case err == nil:
+		return key, false, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, false, fmt.Errorf("can't load node key: %w", err)
+	}
+
+	key, err = crypto.GenerateKey()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, false, err
+	}
+	if err := crypto.SaveECDSA(file, key); err != nil {
+		return nil, false, fmt.Errorf("can't save node key: %w", err)
+	}
+	return key, true, nil
+}
@@ -0,0 +1,155 @@
+package kcpxfer
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// The stream of a transfer carries exactly Size bytes of content, after the
+// resume header if there is one. Since KCP has no notion of closing the
+// stream, the recipient signals completion by writing a single byte back to
+// the sender when it has read all content. Senders learn whether the recipient
+// does this through startResponse.AckComplete.
+
+const completeAck = 1
+
+var (
+	errTransferSize   = errors.New("write exceeds transfer size")
+	errIncomplete     = errors.New("transfer content not fully written")
+	errNoCompleteAck  = errors.New("recipient does not acknowledge completion")
+	errInvalidAck     = errors.New("invalid completion acknowledgement")
+	errReadOutgoing   = errors.New("read on outgoing transfer")
+	errWriteIncoming  = errors.New("write on incoming transfer")
+	errWaitOnIncoming = errors.New("wait on incoming transfer")
+)
+
+// Conn is the connection of a transfer.
+//
+// For incoming transfers, Read returns io.EOF after all content was received,
+// and io.ErrUnexpectedEOF if the transfer ends before that. For outgoing
+// transfers, Write accepts no more than the announced size, and Wait reports
+// when the recipient has received everything.
+//
+// Conn is not safe for concurrent use by multiple readers or writers.
+type Conn struct {
+	net.Conn
+	id          ID
+	size        uint64
+	pos         uint64
+	outgoing    bool
+	ackComplete bool // outgoing only: recipient acknowledges completion
+	acked       bool // incoming only: completion was acknowledged
+	progress    func(id ID, transferred, size uint64)
+}
+
+func (s *Server) newConn(xfer *xferState, size uint64, outgoing bool) *Conn {
+	return &Conn{
+		Conn:     xfer.session,
+		id:       xfer.id,
+		size:     size,
+		outgoing: outgoing,
+		progress: s.progress,
+	}
+}
+
+// ID returns the transfer ID.
+func (c *Conn) ID() ID {
+	return c.id
+}
+
+// Size returns the size of the transferred content.
+func (c *Conn) Size() uint64 {
+	return c.size
+}
+
+// Transferred returns the content offset reached by the transfer. For resumed
+// transfers, this includes the content sent before resuming.
+func (c *Conn) Transferred() uint64 {
+	return c.pos
+}
+
+// Read reads content of an incoming transfer.
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.outgoing {
+		return 0, errReadOutgoing
+	}
+	remaining := c.size - c.pos
+	if remaining == 0 {
+		c.ack()
+		return 0, io.EOF
+	}
+	if uint64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.advance(n)
+	if c.pos == c.size {
+		c.ack()
+		return n, nil
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ack signals completion to the sender. Write errors are ignored because all
+// content was received at this point.
+func (c *Conn) ack() {
+	if !c.acked {
+		c.acked = true
+		c.Conn.Write([]byte{completeAck})
+	}
+}
+
+// Write writes content of an outgoing transfer.
+func (c *Conn) Write(b []byte) (int, error) {
+	if !c.outgoing {
+		return 0, errWriteIncoming
+	}
+	var sizeErr error
+	if remaining := c.size - c.pos; uint64(len(b)) > remaining {
+		b = b[:remaining]
+		sizeErr = errTransferSize
+	}
+	n, err := c.Conn.Write(b)
+	c.advance(n)
+	if err == nil {
+		err = sizeErr
+	}
+	return n, err
+}
+
+func (c *Conn) advance(n int) {
+	if n == 0 {
+		return
+	}
+	c.pos += uint64(n)
+	if c.progress != nil {
+		c.progress(c.id, c.pos, c.size)
+	}
+}
+
+// Wait blocks until the recipient has received all content of an outgoing
+// transfer. It must be called after all content is written. Wait is subject to
+// the read deadline of the connection.
+func (c *Conn) Wait() error {
+	if !c.outgoing {
+		return errWaitOnIncoming
+	}
+	if c.pos < c.size {
+		return errIncomplete
+	}
+	if !c.ackComplete {
+		return errNoCompleteAck
+	}
+	var ack [1]byte
+	if _, err := io.ReadFull(c.Conn, ack[:]); err != nil {
+		return err
+	}
+	if ack[0] != completeAck {
+		return errInvalidAck
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package kcpxfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Transfers started by TransferResumable can continue an earlier, interrupted
+// transfer of the same content. Since the transfer ID is derived from the
+// content hash and sender, the recipient can find the data it received
+// previously and offer to resume at its length. The startResponse carries the
+// offset and the hash of the received prefix. The sender checks the prefix hash
+// against its content and writes the actual start offset as the first eight
+// bytes of the stream: either the offered offset, or zero if the prefix doesn't
+// match.
+
+var errInvalidResumeOffset = errors.New("sender chose invalid resume offset")
+
+// TransferResumable creates an outgoing transfer to the given node, resuming
+// an earlier transfer of the same content if the recipient has part of it.
+//
+// When TransferResumable returns, content is positioned at the offset where
+// the transfer resumes. The caller should copy the remainder of content to the
+// returned connection, then call Wait.
+func (s *Server) TransferResumable(n *enode.Node, contentHash [32]byte, content io.ReadSeeker, size int64) (*Conn, error) {
+	req := &startRequest{Hash: contentHash, Size: uint64(size), Resumable: true}
+	conn, resp, err := s.transfer(n, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Offset == 0 {
+		return conn, nil
+	}
+
+	offset, err := checkResumeOffset(content, size, resp.Offset, resp.PrefixHash)
+	if err == nil {
+		var hdr [8]byte
+		binary.BigEndian.PutUint64(hdr[:], offset)
+		_, err = conn.Conn.Write(hdr[:])
+	}
+	if err == nil {
+		_, err = content.Seek(int64(offset), io.SeekStart)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.pos = offset
+	return conn, nil
+}
+
+// checkResumeOffset returns offset if the first offset bytes of content match
+// prefixHash, and zero otherwise.
+func checkResumeOffset(content io.ReadSeeker, size int64, offset uint64, prefixHash [32]byte) (uint64, error) {
+	if offset > uint64(size) {
+		return 0, nil
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	h, err := hashPrefix(content, offset)
+	if err != nil {
+		return 0, fmt.Errorf("can't hash content prefix: %w", err)
+	}
+	if h != prefixHash {
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// AcceptResume accepts the transfer, offering to resume it after the data
+// already received from partial. It returns the offset at which the sender
+// starts the transfer. The caller must discard any previously received data
+// beyond this offset.
+//
+// If the sender doesn't support resumption, or partial is nil, the transfer
+// starts at offset zero.
+func (tr *TransferRequest) AcceptResume(partial io.Reader) (*Conn, uint64, error) {
+	var offer uint64
+	var prefixHash [32]byte
+	if tr.Resumable && partial != nil {
+		h := sha256.New()
+		n, err := io.Copy(h, io.LimitReader(partial, int64(tr.Size)+1))
+		if err != nil {
+			tr.Reject()
+			return nil, 0, fmt.Errorf("can't read partial content: %w", err)
+		}
+		if n > 0 && uint64(n) <= tr.Size {
+			offer = uint64(n)
+			copy(prefixHash[:], h.Sum(nil))
+		}
+	}
+
+	conn, err := tr.acceptAt(offer, prefixHash)
+	if err != nil || offer == 0 {
+		return conn, 0, err
+	}
+
+	// Read the start offset chosen by the sender.
+	var hdr [8]byte
+	if _, err := io.ReadFull(conn.Conn, hdr[:]); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	offset := binary.BigEndian.Uint64(hdr[:])
+	if offset != 0 && offset != offer {
+		conn.Close()
+		return nil, 0, errInvalidResumeOffset
+	}
+	conn.pos = offset
+	return conn, offset, nil
+}
+
+// hashPrefix computes the SHA256 hash of the first n bytes of r.
+func hashPrefix(r io.Reader, n uint64) (hash [32]byte, err error) {
+	h := sha256.New()
+	if _, err := io.CopyN(h, r, int64(n)); err != nil {
+		return hash, err
+	}
+	copy(hash[:], h.Sum(nil))
+	return hash, nil
+}
@@ -0,0 +1,295 @@
+package kcpxfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fjl/discv5-streams/fileserver"
+	"github.com/xtaci/kcp-go"
+)
+
+// StreamTransport runs KCP over the packets of another protocol. It implements
+// fileserver.Transport, so file transfers can use KCP instead of uTP.
+//
+// Unlike transfers started by Server, these connections carry streams of
+// unknown length. KCP has no way to end a stream, so the data is framed: each
+// frame has a two byte length prefix, and an empty frame marks the end of the
+// stream. An endpoint receiving the end of the stream answers with its own
+// empty frame, which tells the other end that all data has arrived.
+type StreamTransport struct {
+	// DataShards and ParityShards configure forward error correction. If both
+	// are zero, 10 data and 3 parity shards are used. Setting ParityShards to
+	// zero disables FEC. Both ends must use the same values, so they are part
+	// of the transport name.
+	DataShards   int
+	ParityShards int
+
+	// IdleTimeout is the time after which a connection that receives no packets
+	// is closed. The default is two minutes.
+	IdleTimeout time.Duration
+
+	// MaxQueuedPackets is the number of received packets buffered per
+	// connection. The default is 1024.
+	MaxQueuedPackets int
+}
+
+const (
+	streamTransportName = "kcp"
+	maxFrameSize        = 0xFFFF
+	lingerTimeout       = 10 * time.Second
+	kcpMTU              = 1200 // size of KCP packets, including the FEC header
+)
+
+var errIdleTimeout = errors.New("kcp connection idle timeout")
+
+var _ fileserver.Transport = StreamTransport{}
+
+// Name returns "kcp", followed by the FEC parameters if they are not the
+// defaults.
+func (t StreamTransport) Name() string {
+	t = t.withDefaults()
+	if t.DataShards == defaultDataShards && t.ParityShards == defaultParityShards {
+		return streamTransportName
+	}
+	return fmt.Sprintf("%s/%d+%d", streamTransportName, t.DataShards, t.ParityShards)
+}
+
+func (t StreamTransport) withDefaults() StreamTransport {
+	if t.DataShards == 0 && t.ParityShards == 0 {
+		t.DataShards = defaultDataShards
+		t.ParityShards = defaultParityShards
+	}
+	return t
+}
+
+// MaxPacketSize returns the largest packet sent by connections of the transport.
+func (t StreamTransport) MaxPacketSize() int {
+	return kcpMTU
+}
+
+// NewConn creates a KCP connection.
+func (t StreamTransport) NewConn(local, remote net.Addr, write func([]byte, net.Addr) (int, error)) (fileserver.TransportConn, error) {
+	t = t.withDefaults()
+	if err := checkShards(t.DataShards, t.ParityShards); err != nil {
+		return nil, err
+	}
+	if t.IdleTimeout == 0 {
+		t.IdleTimeout = defaultIdleTimeout
+	}
+	if t.MaxQueuedPackets <= 0 {
+		t.MaxQueuedPackets = defaultMaxQueue
+	}
+	out := &funcWriter{local: local, write: write}
+	conn := newKCPConn(remote, ID{}, out, t.MaxQueuedPackets, new(atomic.Uint64))
+	conn.raw = true
+	ks, err := kcp.NewConn3(0, remote, nil, t.DataShards, t.ParityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	setupKCP(ks)
+	c := &streamConn{
+		UDPSession:  ks,
+		conn:        conn,
+		idleTimeout: t.IdleTimeout,
+	}
+	c.idle = time.AfterFunc(t.IdleTimeout, c.expire)
+	return c, nil
+}
+
+// funcWriter is the output of stream connections.
+type funcWriter struct {
+	local net.Addr
+	write func([]byte, net.Addr) (int, error)
+}
+
+func (w *funcWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return w.write(b, addr)
+}
+
+func (w *funcWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+// streamConn is a connection created by StreamTransport.
+type streamConn struct {
+	*kcp.UDPSession
+	conn        *kcpConn
+	idle        *time.Timer
+	idleTimeout time.Duration
+
+	closed      atomic.Bool
+	expired     atomic.Bool
+	releaseOnce sync.Once
+
+	rmu       sync.Mutex // held by Read and while waiting for the end of stream
+	hdr       [2]byte
+	hdrLen    int
+	frameLeft int
+	eof       bool
+
+	wmu     sync.Mutex // held by Write and while sending the end of stream
+	endSent bool
+}
+
+// PacketIn delivers a received packet.
+func (c *streamConn) PacketIn(packet []byte) {
+	c.idle.Reset(c.idleTimeout)
+	c.conn.enqueue(append([]byte(nil), packet...))
+}
+
+// Read reads data of the stream. It returns io.EOF when the remote end has
+// closed the connection.
+func (c *streamConn) Read(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	wasEOF := c.eof
+	n, err := c.read(b)
+	if err == io.EOF && !wasEOF {
+		c.sendEnd()
+	}
+	return n, err
+}
+
+func (c *streamConn) read(b []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+	for c.frameLeft == 0 {
+		n, err := c.UDPSession.Read(c.hdr[c.hdrLen:])
+		c.hdrLen += n
+		if err != nil {
+			return 0, c.connError(err)
+		}
+		if c.hdrLen < len(c.hdr) {
+			continue
+		}
+		c.hdrLen = 0
+		c.frameLeft = int(binary.BigEndian.Uint16(c.hdr[:]))
+		if c.frameLeft == 0 {
+			c.eof = true
+			return 0, io.EOF
+		}
+	}
+	if len(b) > c.frameLeft {
+		b = b[:c.frameLeft]
+	}
+	n, err := c.UDPSession.Read(b)
+	c.frameLeft -= n
+	return n, c.connError(err)
+}
+
+// Write writes data to the stream.
+func (c *streamConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var hdr [2]byte
+	for len(b) > 0 {
+		if c.closed.Load() {
+			return n, net.ErrClosed
+		}
+		chunk := b
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(chunk)))
+		if _, err := c.UDPSession.WriteBuffers([][]byte{hdr[:], chunk}); err != nil {
+			return n, c.connError(err)
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// sendEnd writes the end of the stream.
+func (c *streamConn) sendEnd() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.writeEnd()
+}
+
+func (c *streamConn) writeEnd() error {
+	if c.endSent {
+		return nil
+	}
+	c.endSent = true
+	_, err := c.UDPSession.Write([]byte{0, 0})
+	return err
+}
+
+// Close ends the stream. Data written before Close is still delivered to the
+// remote end in the background. If a Write is blocked when Close is called,
+// the connection is closed immediately, and the remote end doesn't see the end
+// of the stream.
+func (c *streamConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	if !c.wmu.TryLock() {
+		c.release()
+		return nil
+	}
+	go c.linger()
+	return nil
+}
+
+// linger sends the end of the stream and waits for the remote end to answer
+// it, which means all sent data has arrived. Received data is discarded.
+func (c *streamConn) linger() {
+	defer c.release()
+
+	deadline := time.Now().Add(lingerTimeout)
+	c.UDPSession.SetDeadline(deadline)
+	err := c.writeEnd()
+	c.wmu.Unlock()
+	if err != nil {
+		return
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	buf := make([]byte, 1024)
+	for {
+		if _, err := c.read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// expire closes the connection when no packets were received for IdleTimeout.
+func (c *streamConn) expire() {
+	c.expired.Store(true)
+	c.release()
+}
+
+func (c *streamConn) release() {
+	c.releaseOnce.Do(func() {
+		c.idle.Stop()
+		c.UDPSession.Close()
+		c.conn.Close()
+	})
+}
+
+func (c *streamConn) connError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case c.expired.Load():
+		return errIdleTimeout
+	case c.closed.Load():
+		return net.ErrClosed
+	default:
+		return err
+	}
+}
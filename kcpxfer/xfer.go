@@ -1,24 +1,41 @@
 package kcpxfer
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/fjl/discv5-streams/session"
 	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/time/rate"
 )
 
 const (
-	ecParityShards = 3
-	ecDataShards   = 10
-	minPacketSize  = len(ID{})
+	defaultParityShards = 3
+	defaultDataShards   = 10
+	maxShards           = 256
+	minPacketSize       = len(ID{})
+
+	defaultIdleTimeout   = 2 * time.Minute
+	defaultAcceptTimeout = 500 * time.Millisecond
+	defaultMaxQueue      = 1024
+	expireInterval       = 10 * time.Second
+
+	// sessionProtocol is the protocol name used for key derivation of
+	// transfers encrypted with session.Session.
+	sessionProtocol = "kcpxfer"
 )
 
 // ID is a transfer identifier. IDs are assigned based on the hash of the
@@ -27,11 +44,20 @@ type ID [16]byte
 
 // TransferRequest represents a request for an incoming transfer.
 type TransferRequest struct {
+	ID   ID
 	Node enode.ID
 	Addr *net.UDPAddr
 	Hash [32]byte
 	Size uint64
 
+	// Resumable is set when the sender can resume the transfer at an offset.
+	// See AcceptResume.
+	Resumable bool
+
+	params       xferParams
+	resumeOffset uint64
+	resumeHash   [32]byte
+
 	mu           sync.Mutex
 	accept       chan *xferState
 	xfer         *xferState
@@ -39,14 +65,23 @@ type TransferRequest struct {
 	timeoutTimer *time.Timer
 }
 
-func (tr *TransferRequest) Accept() (net.Conn, error) {
+// Accept accepts the transfer. Reading from the returned connection yields
+// exactly Size bytes of content, followed by io.EOF.
+func (tr *TransferRequest) Accept() (*Conn, error) {
+	return tr.acceptAt(0, [32]byte{})
+}
+
+// acceptAt accepts the transfer, offering to resume at the given offset.
+func (tr *TransferRequest) acceptAt(offset uint64, prefixHash [32]byte) (*Conn, error) {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
 
 	if tr.xfer == nil {
 		return nil, errors.New("already accepted / timed out")
 	}
-	conn := tr.xfer.session
+	conn := tr.server.newConn(tr.xfer, tr.Size, false)
+	tr.resumeOffset = offset
+	tr.resumeHash = prefixHash
 	tr.doAccept(true)
 	return conn, nil
 }
@@ -76,12 +111,22 @@ func (tr *TransferRequest) doAccept(accepted bool) {
 // Protocol messages.
 type (
 	startRequest struct {
-		Size uint64
-		Hash [32]byte
+		Size         uint64
+		Hash         [32]byte
+		DataShards   uint     `rlp:"optional"`
+		ParityShards uint     `rlp:"optional"`
+		Secret       [16]byte `rlp:"optional"`
+		Resumable    bool     `rlp:"optional"`
+		Session      bool     `rlp:"optional"` // Secret is a session initiator secret
 	}
 
 	startResponse struct {
-		Accept bool
+		Accept      bool
+		Secret      [16]byte `rlp:"optional"`
+		Offset      uint64   `rlp:"optional"`
+		PrefixHash  [32]byte `rlp:"optional"`
+		Session     bool     `rlp:"optional"` // Secret is a session recipient secret
+		AckComplete bool     `rlp:"optional"` // recipient acknowledges completion
 	}
 )
 
@@ -100,6 +145,15 @@ type Server struct {
 	startAsRecipient chan *TransferRequest
 	registerXfer     chan *xferState
 	serveFunc        func(*TransferRequest) error
+	progress         func(id ID, transferred, size uint64)
+	sessions         *session.Store
+	dataShards       int
+	parityShards     int
+	idleTimeout      time.Duration
+	maxQueue         int
+	acceptTimeout    time.Duration
+	unknownPackets   atomic.Uint64
+	droppedPackets   atomic.Uint64
 }
 
 type ServerConfig struct {
@@ -107,70 +161,188 @@ type ServerConfig struct {
 	Discovery *discover.UDPv5
 	Conn      *net.UDPConn
 	InChannel <-chan discover.ReadPacket
+
+	// DataShards and ParityShards configure forward error correction of
+	// outgoing transfers. If both are zero, 10 data and 3 parity shards are
+	// used. Setting ParityShards to zero disables FEC.
+	//
+	// The values are sent to the recipient when starting a transfer, so
+	// the two endpoints do not need to be configured identically.
+	DataShards   int
+	ParityShards int
+
+	// IdleTimeout is the time after which a transfer that receives no packets
+	// is closed. The default is two minutes.
+	IdleTimeout time.Duration
+
+	// AcceptTimeout is how long the handler has to accept an incoming transfer.
+	// The default is 500ms.
+	AcceptTimeout time.Duration
+
+	// MaxQueuedPackets is the number of received packets buffered per transfer.
+	// When the queue is full, the oldest packet is dropped and will be
+	// retransmitted by KCP. The default is 1024.
+	MaxQueuedPackets int
+
+	// Progress is called when data of a transfer is read or written, with the
+	// content offset reached by the transfer. It is called synchronously by
+	// Conn.Read and Conn.Write and must not block.
+	Progress func(id ID, transferred, size uint64)
+
+	// Sessions enables the encrypted wire format of package session, which is
+	// also used by package fileserver. When set, packets of transfers with
+	// peers that support it are encoded by a session.Session instead of
+	// KCP's built-in encryption. Packets of these sessions must be delivered
+	// through InChannel. Note sessions expire when idle for ten seconds.
+	Sessions *session.Store
 }
 
 type xferState struct {
-	id      ID
-	conn    *kcpConn
-	session *kcp.UDPSession
+	id         ID
+	conn       *kcpConn
+	session    *kcp.UDPSession
+	lastActive time.Time // accessed by Server.loop only
+}
+
+// handleSessionPacket is the session.Session handler of transfers using the
+// session wire format. It is called by Server.loop.
+func (s *xferState) handleSessionPacket(sess *session.Session, packet []byte, src net.Addr) {
+	data, err := sess.Decode(nil, packet)
+	if err != nil {
+		return
+	}
+	s.lastActive = time.Now()
+	s.conn.enqueue(data)
 }
 
 func (s *xferState) close() {
 	s.session.Close()
+	s.conn.Close()
 }
 
 func NewServer(cfg ServerConfig) *Server {
 	if cfg.Discovery == nil || cfg.Conn == nil || cfg.InChannel == nil {
 		panic("invalid config")
 	}
+	if cfg.DataShards == 0 && cfg.ParityShards == 0 {
+		cfg.DataShards = defaultDataShards
+		cfg.ParityShards = defaultParityShards
+	}
+	if err := checkShards(cfg.DataShards, cfg.ParityShards); err != nil {
+		panic("invalid config: " + err.Error())
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	if cfg.AcceptTimeout == 0 {
+		cfg.AcceptTimeout = defaultAcceptTimeout
+	}
+	if cfg.MaxQueuedPackets <= 0 {
+		cfg.MaxQueuedPackets = defaultMaxQueue
+	}
 	s := &Server{
 		disc:             cfg.Discovery,
 		conn:             cfg.Conn,
 		packet:           cfg.InChannel,
 		serveFunc:        cfg.Handler,
+		progress:         cfg.Progress,
+		sessions:         cfg.Sessions,
 		startAsRecipient: make(chan *TransferRequest),
 		registerXfer:     make(chan *xferState),
+		dataShards:       cfg.DataShards,
+		parityShards:     cfg.ParityShards,
+		idleTimeout:      cfg.IdleTimeout,
+		maxQueue:         cfg.MaxQueuedPackets,
+		acceptTimeout:    cfg.AcceptTimeout,
 	}
 	go s.loop()
 	s.disc.RegisterTalkHandler("wrm", s.handleTalk)
 	return s
 }
 
-// Transfer creates an outgoing transfer to the given node.
-func (s *Server) Transfer(n *enode.Node, contentHash [32]byte, size int64) (net.Conn, error) {
+// Transfer creates an outgoing transfer to the given node. The caller should
+// write size bytes of content to the returned connection, then call Wait.
+func (s *Server) Transfer(n *enode.Node, contentHash [32]byte, size int64) (*Conn, error) {
+	req := &startRequest{Hash: contentHash, Size: uint64(size)}
+	conn, _, err := s.transfer(n, req)
+	return conn, err
+}
+
+// transfer performs the start handshake and registers the outgoing transfer.
+func (s *Server) transfer(n *enode.Node, req *startRequest) (*Conn, *startResponse, error) {
 	if n.IP() == nil && n.UDP() == 0 {
-		return nil, fmt.Errorf("destination node has no UDP endpoint")
+		return nil, nil, fmt.Errorf("destination node has no UDP endpoint")
 	}
 	addr := &net.UDPAddr{IP: n.IP(), Port: n.UDP()}
-	req := &startRequest{Hash: contentHash, Size: uint64(size)}
-	err := s.requestTransfer(n, req)
+	s.setShards(req)
+	var initiator *session.InitiatorState
+	if s.sessions != nil {
+		var err error
+		if initiator, err = s.sessions.Initiator(sessionProtocol); err != nil {
+			return nil, nil, err
+		}
+		req.Secret = initiator.Secret()
+		req.Session = true
+	} else {
+		req.Secret = newSecret()
+	}
+	resp, err := s.requestTransfer(n, req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	id := computeID(req.Hash, s.disc.Self().ID())
-	xfer := s.newState(id, addr)
+	params := xferParams{
+		dataShards:   s.dataShards,
+		parityShards: s.parityShards,
+	}
+	if initiator != nil && resp.Session {
+		params.establish = func(h session.SessionPacketHandler) *session.Session {
+			initiator.SetHandler(h)
+			return initiator.Establish(addrIP(addr), resp.Secret)
+		}
+	} else {
+		// The recipient doesn't support sessions.
+		params.key = deriveKey(id, req.Secret, resp.Secret)
+	}
+	xfer, err := s.newState(id, addr, params)
+	if err != nil {
+		return nil, nil, err
+	}
 	s.registerXfer <- xfer
-	return xfer.session, nil
+	conn := s.newConn(xfer, req.Size, true)
+	conn.ackComplete = resp.AckComplete
+	return conn, resp, nil
 }
 
-func (s *Server) requestTransfer(n *enode.Node, req *startRequest) error {
+// setShards stores the FEC parameters in req. The defaults are sent as zero, so
+// the optional fields can be omitted for recipients that don't know them.
+func (s *Server) setShards(req *startRequest) {
+	if s.dataShards == defaultDataShards && s.parityShards == defaultParityShards {
+		req.DataShards, req.ParityShards = 0, 0
+		return
+	}
+	req.DataShards = uint(s.dataShards)
+	req.ParityShards = uint(s.parityShards)
+}
+
+func (s *Server) requestTransfer(n *enode.Node, req *startRequest) (*startResponse, error) {
 	startmsg, err := rlp.EncodeToBytes(req)
 	if err != nil {
 		panic(err)
 	}
 	respmsg, err := s.disc.TalkRequest(n, "wrm", startmsg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var resp startResponse
 	if err := rlp.DecodeBytes(respmsg, &resp); err != nil {
-		return fmt.Errorf("invalid response: %v", err)
+		return nil, fmt.Errorf("invalid response: %v", err)
 	}
 	if !resp.Accept {
-		return fmt.Errorf("recipient rejected transfer")
+		return nil, fmt.Errorf("recipient rejected transfer")
 	}
-	return nil
+	return &resp, nil
 }
 
 func (s *Server) handleTalk(node enode.ID, addr *net.UDPAddr, data []byte) []byte {
@@ -180,14 +352,51 @@ func (s *Server) handleTalk(node enode.ID, addr *net.UDPAddr, data []byte) []byt
 		log.Error("Invalid xfer start request", "id", node, "addr", addr, "err", err)
 		return []byte{}
 	}
+	// Requests without FEC parameters come from senders using the defaults.
+	if req.DataShards == 0 && req.ParityShards == 0 {
+		req.DataShards = defaultDataShards
+		req.ParityShards = defaultParityShards
+	}
+	dataShards, parityShards := int(req.DataShards), int(req.ParityShards)
+	if req.DataShards > maxShards || req.ParityShards > maxShards {
+		err = errInvalidShards
+	} else {
+		err = checkShards(dataShards, parityShards)
+	}
+	if err != nil {
+		log.Error("Invalid xfer start request", "id", node, "addr", addr, "err", err)
+		resp, _ := rlp.EncodeToBytes(&startResponse{Accept: false})
+		return resp
+	}
 
+	params := xferParams{dataShards: dataShards, parityShards: parityShards}
+	var secret [16]byte
+	if req.Session && s.sessions != nil {
+		recipient, err := s.sessions.Recipient(sessionProtocol, addrIP(addr), req.Secret)
+		if err != nil {
+			log.Error("Could not create session", "id", node, "addr", addr, "err", err)
+			resp, _ := rlp.EncodeToBytes(&startResponse{Accept: false})
+			return resp
+		}
+		secret = recipient.Secret()
+		params.establish = func(h session.SessionPacketHandler) *session.Session {
+			recipient.SetHandler(h)
+			return recipient.Establish()
+		}
+	} else {
+		secret = newSecret()
+		params.key = deriveKey(computeID(req.Hash, node), req.Secret, secret)
+	}
 	creq := TransferRequest{
-		Node:   node,
-		Addr:   addr,
-		Hash:   req.Hash,
-		Size:   req.Size,
-		server: s,
-		accept: make(chan *xferState, 1),
+		ID:        computeID(req.Hash, node),
+		Node:      node,
+		Addr:      addr,
+		Hash:      req.Hash,
+		Size:      req.Size,
+		Resumable: req.Resumable,
+		params:    params,
+		server:    s,
+		accept:    make(chan *xferState, 1),
 	}
 
 	s.startAsRecipient <- &creq
@@ -195,15 +404,39 @@ func (s *Server) handleTalk(node enode.ID, addr *net.UDPAddr, data []byte) []byt
 
 	var resp []byte
 	if xfer != nil {
-		resp, _ = rlp.EncodeToBytes(&startResponse{Accept: true})
+		resp, _ = rlp.EncodeToBytes(&startResponse{
+			Accept:      true,
+			Secret:      secret,
+			Offset:      creq.resumeOffset,
+			PrefixHash:  creq.resumeHash,
+			Session:     params.establish != nil,
+			AckComplete: true,
+		})
 	} else {
 		resp, _ = rlp.EncodeToBytes(&startResponse{Accept: false})
 	}
 	return resp
 }
 
+// UnknownPackets returns the number of packets received for transfers
+// that don't exist.
+func (s *Server) UnknownPackets() uint64 {
+	return s.unknownPackets.Load()
+}
+
+// DroppedPackets returns the number of packets dropped because the receive
+// queue of a transfer was full.
+func (s *Server) DroppedPackets() uint64 {
+	return s.droppedPackets.Load()
+}
+
 func (s *Server) loop() {
-	xfers := make(map[ID]*xferState)
+	var (
+		xfers         = make(map[ID]*xferState)
+		expire        = time.NewTicker(expireInterval)
+		logUnknownPkt = rate.Sometimes{Interval: 5 * time.Second}
+	)
+	defer expire.Stop()
 
 	for {
 		select {
@@ -211,13 +444,30 @@ func (s *Server) loop() {
 			if len(pkt.Data) < minPacketSize {
 				continue
 			}
+			// Session packets are dispatched to xferState.handleSessionPacket.
+			if s.sessions != nil && s.sessions.HandlePacket(pkt.Data, pkt.Addr) {
+				continue
+			}
 			var id ID
 			copy(id[:], pkt.Data)
 			xfer := xfers[id]
 			if xfer != nil {
+				xfer.lastActive = time.Now()
 				xfer.conn.enqueue(pkt.Data[len(id):])
 			} else {
-				fmt.Printf("packet for unknown transfer %x\n", id[:])
+				n := s.unknownPackets.Add(1)
+				logUnknownPkt.Do(func() {
+					log.Debug("Packet for unknown transfer", "id", fmt.Sprintf("%x", id[:]), "addr", pkt.Addr, "total", n)
+				})
+			}
+
+		case now := <-expire.C:
+			for id, xfer := range xfers {
+				if now.Sub(xfer.lastActive) >= s.idleTimeout {
+					log.Debug("Closing idle transfer", "id", fmt.Sprintf("%x", id[:]))
+					xfer.close()
+					delete(xfers, id)
+				}
 			}
 
 		case tr := <-s.startAsRecipient:
@@ -225,56 +475,154 @@ func (s *Server) loop() {
 				tr.Reject()
 				continue
 			}
-			id := computeID(tr.Hash, tr.Node)
-			tr.xfer = s.newState(id, tr.Addr)
-			tr.timeoutTimer = time.AfterFunc(500*time.Millisecond, tr.Reject)
+			xfer, err := s.newState(tr.ID, tr.Addr, tr.params)
+			if err != nil {
+				log.Error("Could not establish kcp session", "err", err)
+				tr.accept <- nil
+				continue
+			}
+			tr.xfer = xfer
+			tr.timeoutTimer = time.AfterFunc(s.acceptTimeout, tr.Reject)
 			go func() { s.serveFunc(tr) }()
 
 		case xfer := <-s.registerXfer:
+			xfer.lastActive = time.Now()
 			xfers[xfer.id] = xfer
 		}
 	}
 }
 
-// newState creates a new transfer state.
-func (s *Server) newState(id ID, addr *net.UDPAddr) *xferState {
-	conn := newKCPConn(addr, id, s.conn)
-	session, err := kcp.NewConn3(0, addr, nil, ecDataShards, ecParityShards, conn)
-	if err != nil {
-		log.Error("Could not establish kcp session", "err", err)
+var errInvalidShards = errors.New("invalid FEC shard counts")
+
+// checkShards validates FEC parameters.
+func checkShards(dataShards, parityShards int) error {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > maxShards {
+		return errInvalidShards
+	}
+	return nil
+}
+
+// xferParams are the KCP session parameters of a transfer.
+type xferParams struct {
+	dataShards   int
+	parityShards int
+	key          []byte // nil for unencrypted transfers
+
+	// establish creates the session of transfers using the session wire
+	// format. It is nil for other transfers.
+	establish func(session.SessionPacketHandler) *session.Session
+}
+
+// addrIP returns the IP address of addr in the form used by session.Store.
+func addrIP(addr *net.UDPAddr) netip.Addr {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		ip, _ := netip.AddrFromSlice(ip4)
+		return ip
+	}
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return ip
+}
+
+// newSecret creates a random key exchange secret.
+func newSecret() (secret [16]byte) {
+	if _, err := rand.Read(secret[:]); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// deriveKey computes the encryption key of a transfer from the secrets
+// exchanged in startRequest and startResponse. The secrets travel over the
+// discv5 session, so only the two endpoints know them. When either secret is
+// missing, the peer doesn't support encryption and nil is returned.
+func deriveKey(id ID, initiatorSecret, recipientSecret [16]byte) []byte {
+	if initiatorSecret == ([16]byte{}) || recipientSecret == ([16]byte{}) {
 		return nil
 	}
-	setupKCP(session)
-	return &xferState{
-		id:      id,
-		conn:    conn,
-		session: session,
+	var sec [32]byte
+	copy(sec[:16], initiatorSecret[:])
+	copy(sec[16:], recipientSecret[:])
+	kdf := hkdf.New(sha256.New, sec[:], id[:], []byte("kcpxfer transfer key"))
+	key := make([]byte, 32)
+	kdf.Read(key)
+	return key
+}
+
+// newState creates a new transfer state.
+func (s *Server) newState(id ID, addr *net.UDPAddr, params xferParams) (*xferState, error) {
+	var crypt kcp.BlockCrypt
+	if params.key != nil {
+		var err error
+		if crypt, err = kcp.NewAESBlockCrypt(params.key); err != nil {
+			return nil, err
+		}
+	}
+	conn := newKCPConn(addr, id, s.conn, s.maxQueue, &s.droppedPackets)
+	xfer := &xferState{id: id, conn: conn}
+	if params.establish != nil {
+		conn.session = params.establish(xfer.handleSessionPacket)
 	}
+	ks, err := kcp.NewConn3(0, addr, crypt, params.dataShards, params.parityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	setupKCP(ks)
+	xfer.session = ks
+	return xfer, nil
+}
+
+// packetWriter is the output of kcpConn.
+type packetWriter interface {
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
 }
 
 // kcpConn implements net.PacketConn for use by KCP.
 type kcpConn struct {
-	id     ID
-	out    net.PacketConn
-	buffer []byte
-
-	mu      sync.Mutex
-	flag    *sync.Cond
-	inqueue [][]byte
-	remote  *net.UDPAddr
+	id      ID
+	out     packetWriter
+	buffer  []byte
+	session *session.Session // if set, packets are encoded by the session
+	raw     bool             // if set, packets are written without transfer ID
+
+	mu            sync.Mutex
+	flag          *sync.Cond
+	inqueue       [][]byte // ring buffer of received packets
+	inqueueHead   int
+	inqueueLen    int
+	dropped       *atomic.Uint64
+	remote        net.Addr
+	closed        bool
+	readDeadline  time.Time
+	readTimer     *time.Timer
+	writeDeadline time.Time
 }
 
-func newKCPConn(remote *net.UDPAddr, id ID, out net.PacketConn) *kcpConn {
-	o := &kcpConn{id: id, out: out, remote: remote}
+func newKCPConn(remote net.Addr, id ID, out packetWriter, maxQueue int, dropped *atomic.Uint64) *kcpConn {
+	o := &kcpConn{
+		id:      id,
+		out:     out,
+		remote:  remote,
+		inqueue: make([][]byte, maxQueue),
+		dropped: dropped,
+	}
 	o.flag = sync.NewCond(&o.mu)
 	return o
 }
 
-// enqueue adds a packet to the queue.
+// enqueue adds a packet to the queue. If the queue is full, the oldest
+// packet is dropped.
 func (o *kcpConn) enqueue(p []byte) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	o.inqueue = append(o.inqueue, p)
+	if o.inqueueLen == len(o.inqueue) {
+		o.inqueue[o.inqueueHead] = nil
+		o.inqueueHead = (o.inqueueHead + 1) % len(o.inqueue)
+		o.inqueueLen--
+		o.dropped.Add(1)
+	}
+	o.inqueue[(o.inqueueHead+o.inqueueLen)%len(o.inqueue)] = p
+	o.inqueueLen++
 	o.flag.Broadcast()
 	// fmt.Printf("KCP enqueue n=%d\n", len(p))
 }
@@ -284,19 +632,26 @@ func (o *kcpConn) enqueue(p []byte) {
 // are discarded.
 func (o *kcpConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	o.mu.Lock()
-	for len(o.inqueue) == 0 {
+	defer o.mu.Unlock()
+	for o.inqueueLen == 0 {
+		if o.closed {
+			return 0, nil, o.opError("read", net.ErrClosed)
+		}
+		if !o.readDeadline.IsZero() && !time.Now().Before(o.readDeadline) {
+			return 0, nil, o.opError("read", os.ErrDeadlineExceeded)
+		}
 		o.flag.Wait()
 	}
-	defer o.mu.Unlock()
 
 	// Move packet data into p.
-	n = copy(p, o.inqueue[0])
+	n = copy(p, o.inqueue[o.inqueueHead])
 
 	// Delete the packet from inqueue.
-	copy(o.inqueue, o.inqueue[1:])
-	o.inqueue = o.inqueue[:len(o.inqueue)-1]
+	o.inqueue[o.inqueueHead] = nil
+	o.inqueueHead = (o.inqueueHead + 1) % len(o.inqueue)
+	o.inqueueLen--
 
-	// log.Info("KCP read", "buf", len(p), "n", n, "remaining-in-q", len(o.inqueue))
+	// log.Info("KCP read", "buf", len(p), "n", n, "remaining-in-q", o.inqueueLen)
 	// fmt.Printf("KCP read n=%d from=%v\n", n, o.remote)
 	// kcpStatsDump(kcp.DefaultSnmp)
 	return n, o.remote, nil
@@ -304,24 +659,94 @@ func (o *kcpConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 
 // WriteTo just writes to the underlying connection.
 func (o *kcpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	// Add id to the head of packet.
-	o.buffer = o.buffer[:0]
-	o.buffer = append(o.buffer, o.id[:]...)
-	o.buffer = append(o.buffer, p...)
+	o.mu.Lock()
+	closed, deadline := o.closed, o.writeDeadline
+	o.mu.Unlock()
+	if closed {
+		return 0, o.opError("write", net.ErrClosed)
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, o.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	switch {
+	case o.raw:
+		return o.out.WriteTo(p, addr)
+	case o.session != nil:
+		if o.buffer, err = o.session.Encode(o.buffer[:0], p); err != nil {
+			return 0, o.opError("write", err)
+		}
+	default:
+		// Add id to the head of packet.
+		o.buffer = o.buffer[:0]
+		o.buffer = append(o.buffer, o.id[:]...)
+		o.buffer = append(o.buffer, p...)
+	}
 
 	n, err = o.out.WriteTo(o.buffer, addr)
 	// fmt.Printf("KCP write n=%d to=%v\n", n, addr)
 	return n, err
 }
 
-func (o *kcpConn) LocalAddr() net.Addr                { panic("not implemented") }
-func (o *kcpConn) Close() error                       { return nil }
-func (o *kcpConn) SetDeadline(t time.Time) error      { return nil }
-func (o *kcpConn) SetReadDeadline(t time.Time) error  { return nil }
-func (o *kcpConn) SetWriteDeadline(t time.Time) error { return nil }
+func (o *kcpConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: o.out.LocalAddr(), Addr: o.remote, Err: err}
+}
+
+// LocalAddr returns the address of the underlying connection.
+func (o *kcpConn) LocalAddr() net.Addr {
+	return o.out.LocalAddr()
+}
+
+// Close unblocks pending reads. It does not close the underlying connection.
+func (o *kcpConn) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	if o.readTimer != nil {
+		o.readTimer.Stop()
+	}
+	o.flag.Broadcast()
+	return nil
+}
+
+func (o *kcpConn) SetDeadline(t time.Time) error {
+	o.SetReadDeadline(t)
+	o.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for ReadFrom. Blocked reads return
+// a timeout error when the deadline is reached.
+func (o *kcpConn) SetReadDeadline(t time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.readDeadline = t
+	if o.readTimer != nil {
+		o.readTimer.Stop()
+		o.readTimer = nil
+	}
+	if !t.IsZero() {
+		o.readTimer = time.AfterFunc(time.Until(t), func() {
+			o.mu.Lock()
+			o.flag.Broadcast()
+			o.mu.Unlock()
+		})
+	}
+	o.flag.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for WriteTo. The deadline is not applied
+// to the underlying connection because it is shared with other transfers.
+func (o *kcpConn) SetWriteDeadline(t time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.writeDeadline = t
+	return nil
+}
 
 func setupKCP(s *kcp.UDPSession) {
-	s.SetMtu(1200)
+	s.SetMtu(kcpMTU)
 	s.SetStreamMode(true)
 	s.SetWriteDelay(false)
 	s.SetWindowSize(256, 256)
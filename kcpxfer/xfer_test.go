@@ -2,14 +2,26 @@ package kcpxfer
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/fjl/discv5-streams/fileserver"
+	"github.com/fjl/discv5-streams/host"
+	"github.com/fjl/discv5-streams/session"
 )
 
 func listenV5(t *testing.T, bootnodes []*enode.Node, unhandled chan discover.ReadPacket) (*discover.UDPv5, *net.UDPConn) {
@@ -71,7 +83,10 @@ func TestXfer(t *testing.T) {
 			}
 			t.Logf("accepted transfer hash=%x size=%d", tr.Hash[:], tr.Size)
 
-			data, _ := io.ReadAll(io.LimitReader(conn, int64(tr.Size)))
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Error("read error:", err)
+			}
 			if !bytes.Equal(data, content) {
 				t.Error("content mismatch")
 			}
@@ -89,7 +104,480 @@ func TestXfer(t *testing.T) {
 	if _, err := io.Copy(session, bytes.NewReader(content)); err != nil {
 		t.Fatal(err)
 	}
+	if err := session.Wait(); err != nil {
+		t.Fatal("wait error:", err)
+	}
 	t.Log("sent", len(content), "bytes")
 
 	<-done
 }
+
+func TestDeriveKey(t *testing.T) {
+	var (
+		id     = ID{1}
+		s1, s2 = newSecret(), newSecret()
+	)
+	key := deriveKey(id, s1, s2)
+	if len(key) != 32 {
+		t.Fatalf("wrong key length %d", len(key))
+	}
+	if bytes.Equal(key, deriveKey(ID{2}, s1, s2)) {
+		t.Error("same key for different transfer IDs")
+	}
+	if bytes.Equal(key, deriveKey(id, s2, s1)) {
+		t.Error("same key with swapped secrets")
+	}
+	if deriveKey(id, s1, [16]byte{}) != nil {
+		t.Error("non-nil key with missing recipient secret")
+	}
+}
+
+func TestKCPConnDeadline(t *testing.T) {
+	_, s := listenV5(t, nil, nil)
+	conn := newKCPConn(&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}, ID{}, s, 10, new(atomic.Uint64))
+	if conn.LocalAddr().String() != s.LocalAddr().String() {
+		t.Errorf("wrong LocalAddr %v", conn.LocalAddr())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := conn.ReadFrom(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("wrong error after read deadline: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+	_, _, err = conn.ReadFrom(make([]byte, 10))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("wrong error after close: %v", err)
+	}
+}
+
+func TestServerUnknownPackets(t *testing.T) {
+	in := make(chan discover.ReadPacket)
+	disc, s := listenV5(t, nil, nil)
+	srv := NewServer(ServerConfig{Discovery: disc, Conn: s, InChannel: in})
+
+	in <- discover.ReadPacket{Data: make([]byte, minPacketSize+10), Addr: &net.UDPAddr{}}
+	in <- discover.ReadPacket{Data: make([]byte, minPacketSize+10), Addr: &net.UDPAddr{}}
+	in <- discover.ReadPacket{Data: make([]byte, 2), Addr: &net.UDPAddr{}} // too short
+	if n := srv.UnknownPackets(); n != 2 {
+		t.Fatalf("wrong unknown packet count %d", n)
+	}
+}
+
+func TestCheckResumeOffset(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	prefixHash := sha256.Sum256(content[:400])
+
+	tests := []struct {
+		offset uint64
+		hash   [32]byte
+		want   uint64
+	}{
+		{offset: 400, hash: prefixHash, want: 400},
+		{offset: 400, hash: sha256.Sum256(content[:401]), want: 0},
+		{offset: 2000, hash: prefixHash, want: 0},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(content)
+		r.Seek(500, io.SeekStart)
+		got, err := checkResumeOffset(r, int64(len(content)), test.offset, test.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("offset %d: got %d, want %d", test.offset, got, test.want)
+		}
+	}
+}
+
+func TestKCPConnQueueLimit(t *testing.T) {
+	var (
+		dropped atomic.Uint64
+		conn    = newKCPConn(&net.UDPAddr{}, ID{}, nil, 3, &dropped)
+	)
+	for i := byte(0); i < 5; i++ {
+		conn.enqueue([]byte{i})
+	}
+	if n := dropped.Load(); n != 2 {
+		t.Fatalf("wrong dropped count %d", n)
+	}
+	buf := make([]byte, 1)
+	for want := byte(2); want < 5; want++ {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != want {
+			t.Fatalf("read packet %d, want %d", buf[0], want)
+		}
+	}
+}
+
+// This test checks transfers using the session wire format, and fallback to
+// KCP encryption when only one side supports sessions.
+func TestXferSession(t *testing.T) {
+	for _, test := range []struct {
+		name                  string
+		sender, recipient     *session.Store
+		wantSenderSessions    int
+		wantRecipientSessions int
+	}{
+		{"both", session.NewStore(), session.NewStore(), 1, 1},
+		{"sender-only", session.NewStore(), nil, 0, 0},
+		{"recipient-only", nil, session.NewStore(), 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			unhandled1 := make(chan discover.ReadPacket, 100)
+			disc1, s1 := listenV5(t, nil, unhandled1)
+			unhandled2 := make(chan discover.ReadPacket, 100)
+			disc2, s2 := listenV5(t, nil, unhandled2)
+
+			var (
+				content     = make([]byte, 256*1024)
+				contentHash = sha256.Sum256(content)
+				done        = make(chan []byte, 1)
+			)
+			sender := NewServer(ServerConfig{
+				Discovery: disc1,
+				Conn:      s1,
+				InChannel: unhandled1,
+				Sessions:  test.sender,
+			})
+			NewServer(ServerConfig{
+				Discovery: disc2,
+				Conn:      s2,
+				InChannel: unhandled2,
+				Sessions:  test.recipient,
+				Handler: func(tr *TransferRequest) error {
+					conn, err := tr.Accept()
+					if err != nil {
+						return err
+					}
+					data, _ := io.ReadAll(conn)
+					done <- data
+					return nil
+				},
+			})
+
+			conn, err := sender.Transfer(disc2.Self(), contentHash, int64(len(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(conn, bytes.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.Wait(); err != nil {
+				t.Fatal("wait error:", err)
+			}
+			select {
+			case data := <-done:
+				if !bytes.Equal(data, content) {
+					t.Fatal("content mismatch")
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("transfer timed out")
+			}
+
+			if test.sender != nil && test.sender.Len() != test.wantSenderSessions {
+				t.Errorf("sender has %d sessions", test.sender.Len())
+			}
+			if test.recipient != nil && test.recipient.Len() != test.wantRecipientSessions {
+				t.Errorf("recipient has %d sessions", test.recipient.Len())
+			}
+		})
+	}
+}
+
+// This test checks a transfer with non-default FEC parameters. The recipient
+// uses the parameters of the sender.
+func TestXferShards(t *testing.T) {
+	unhandled1 := make(chan discover.ReadPacket, 100)
+	disc1, s1 := listenV5(t, nil, unhandled1)
+	unhandled2 := make(chan discover.ReadPacket, 100)
+	disc2, s2 := listenV5(t, nil, unhandled2)
+
+	var (
+		content     = make([]byte, 256*1024)
+		contentHash = sha256.Sum256(content)
+		done        = make(chan []byte, 1)
+	)
+	sender := NewServer(ServerConfig{
+		Discovery:    disc1,
+		Conn:         s1,
+		InChannel:    unhandled1,
+		DataShards:   4,
+		ParityShards: 2,
+	})
+	NewServer(ServerConfig{
+		Discovery: disc2,
+		Conn:      s2,
+		InChannel: unhandled2,
+		Handler: func(tr *TransferRequest) error {
+			conn, err := tr.Accept()
+			if err != nil {
+				return err
+			}
+			data, _ := io.ReadAll(conn)
+			done <- data
+			return nil
+		},
+	})
+
+	conn, err := sender.Transfer(disc2.Self(), contentHash, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(conn, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Wait(); err != nil {
+		t.Fatal("wait error:", err)
+	}
+	select {
+	case data := <-done:
+		if !bytes.Equal(data, content) {
+			t.Fatal("content mismatch")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer timed out")
+	}
+}
+
+// This test checks that requests with the default FEC parameters keep the
+// layout of requests without them.
+func TestStartRequestShardsEncoding(t *testing.T) {
+	type oldStartRequest struct {
+		Size uint64
+		Hash [32]byte
+	}
+	old := oldStartRequest{Size: 100, Hash: [32]byte{1}}
+	oldEnc, _ := rlp.EncodeToBytes(&old)
+
+	// The defaults are omitted.
+	s := &Server{dataShards: defaultDataShards, parityShards: defaultParityShards}
+	req := &startRequest{Size: old.Size, Hash: old.Hash}
+	s.setShards(req)
+	enc, _ := rlp.EncodeToBytes(req)
+	if !bytes.Equal(enc, oldEnc) {
+		t.Fatalf("wrong encoding %x, want %x", enc, oldEnc)
+	}
+	if err := rlp.DecodeBytes(enc, new(oldStartRequest)); err != nil {
+		t.Fatal("old layout can't decode request:", err)
+	}
+
+	// Other parameters are sent.
+	s = &Server{dataShards: 4, parityShards: 2}
+	s.setShards(req)
+	if req.DataShards != 4 || req.ParityShards != 2 {
+		t.Fatalf("wrong shards %d+%d", req.DataShards, req.ParityShards)
+	}
+
+	// Requests in the old layout decode with zero shards, i.e. the defaults.
+	var dec startRequest
+	if err := rlp.DecodeBytes(oldEnc, &dec); err != nil {
+		t.Fatal("can't decode old layout:", err)
+	}
+	if dec.DataShards != 0 || dec.ParityShards != 0 {
+		t.Fatalf("wrong shards %d+%d in old request", dec.DataShards, dec.ParityShards)
+	}
+}
+
+// This test checks the size limit and completion signaling of Conn.
+func TestConnCompletion(t *testing.T) {
+	var (
+		content  = []byte("0123456789")
+		p1, p2   = net.Pipe()
+		progress []uint64
+		sender   = &Conn{Conn: p1, size: uint64(len(content)), outgoing: true, ackComplete: true}
+		receiver = &Conn{Conn: p2, size: uint64(len(content)), progress: func(id ID, n, size uint64) {
+			progress = append(progress, n)
+		}}
+	)
+	defer p1.Close()
+	defer p2.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		if _, err := sender.Write(append(content, 'x')); err != errTransferSize {
+			errc <- fmt.Errorf("wrong write error: %v", err)
+			return
+		}
+		errc <- sender.Wait()
+	}()
+
+	buf := make([]byte, 4)
+	var data []byte
+	for {
+		n, err := receiver.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("read error:", err)
+		}
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("wrong data %q", data)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(progress, []uint64{4, 8, 10}) {
+		t.Fatalf("wrong progress %v", progress)
+	}
+}
+
+func TestConnUnexpectedEOF(t *testing.T) {
+	p1, p2 := net.Pipe()
+	receiver := &Conn{Conn: p2, size: 10}
+	go func() {
+		p1.Write([]byte("01234"))
+		p1.Close()
+	}()
+	data, err := io.ReadAll(receiver)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("wrong error %v", err)
+	}
+	if string(data) != "01234" {
+		t.Fatalf("wrong data %q", data)
+	}
+}
+
+// streamPipe creates two connected StreamTransport connections.
+func streamPipe(t *testing.T) (c1, c2 fileserver.TransportConn) {
+	var (
+		addr1 = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+		addr2 = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 2}
+		ready = make(chan struct{})
+		err   error
+	)
+	deliver := func(to *fileserver.TransportConn) func([]byte, net.Addr) (int, error) {
+		return func(b []byte, addr net.Addr) (int, error) {
+			<-ready
+			(*to).PacketIn(b)
+			return len(b), nil
+		}
+	}
+	if c1, err = (StreamTransport{}).NewConn(addr1, addr2, deliver(&c2)); err != nil {
+		t.Fatal(err)
+	}
+	if c2, err = (StreamTransport{}).NewConn(addr2, addr1, deliver(&c1)); err != nil {
+		t.Fatal(err)
+	}
+	close(ready)
+	return c1, c2
+}
+
+func TestStreamTransport(t *testing.T) {
+	c1, c2 := streamPipe(t)
+	defer c2.Close()
+
+	content := make([]byte, 300*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	go func() {
+		c1.Write(content)
+		c1.Close()
+	}()
+
+	c2.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(c2)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("content mismatch")
+	}
+	if _, err := c1.Write([]byte{1}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("wrong error for write after close: %v", err)
+	}
+}
+
+func TestStreamTransportIdleTimeout(t *testing.T) {
+	tr := StreamTransport{IdleTimeout: 50 * time.Millisecond}
+	c, err := tr.NewConn(&net.UDPAddr{}, &net.UDPAddr{}, func(b []byte, addr net.Addr) (int, error) {
+		return len(b), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 10)); err != errIdleTimeout {
+		t.Fatalf("wrong error %v", err)
+	}
+}
+
+// This test runs a fileserver transfer over StreamTransport.
+func TestStreamTransportFileserver(t *testing.T) {
+	content := make([]byte, 512*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	fsys := fstest.MapFS{"file": &fstest.MapFile{Data: content}}
+
+	host1, err := host.Listen(host.ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host1.Close()
+	host2, err := host.Listen(host.ConfigForTesting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host2.Close()
+
+	cfg := fileserver.Config{Handler: fileserver.ServeFS(fsys), Transport: StreamTransport{}}
+	if _, err := fileserver.NewServer(host1, cfg); err != nil {
+		t.Fatal(err)
+	}
+	client, err := fileserver.NewClient(host2, fileserver.Config{Transport: StreamTransport{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, err := client.Request(ctx, host1.Discovery.Self(), "file")
+	if err != nil {
+		t.Fatal("request error:", err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func TestStreamTransportName(t *testing.T) {
+	tests := []struct {
+		tr   StreamTransport
+		want string
+	}{
+		{StreamTransport{}, "kcp"},
+		{StreamTransport{DataShards: 10, ParityShards: 3}, "kcp"},
+		{StreamTransport{DataShards: 10, ParityShards: 0}, "kcp/10+0"},
+		{StreamTransport{DataShards: 4, ParityShards: 2}, "kcp/4+2"},
+	}
+	for _, test := range tests {
+		if name := test.tr.Name(); name != test.want {
+			t.Errorf("%+v: got name %q, want %q", test.tr, name, test.want)
+		}
+	}
+	_, err := StreamTransport{DataShards: 300}.NewConn(&net.UDPAddr{}, &net.UDPAddr{}, nil)
+	if err != errInvalidShards {
+		t.Fatalf("wrong error for invalid shards: %v", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"sync/atomic"
 
 	"golang.org/x/crypto/hkdf"
 )
@@ -50,7 +51,7 @@ func (is *InitiatorState) Establish(srcIP netip.Addr, recipientSecret [16]byte)
 	if is.handler == nil {
 		panic("no handler set")
 	}
-	s := &Session{ip: srcIP, heapIndex: -1, handler: is.handler}
+	s := &Session{ip: canonicalIP(srcIP), heapIndex: -1, handler: is.handler}
 	s.derive(is.protocol, &is.secret, &recipientSecret, false)
 	is.st.store(s)
 	for i := range is.secret {
@@ -64,7 +65,7 @@ func (is *InitiatorState) Establish(srcIP netip.Addr, recipientSecret [16]byte)
 func (st *Store) Recipient(protocol string, srcIP netip.Addr, initiatorSecret [16]byte) (*RecipientState, error) {
 	r := &RecipientState{
 		st: st,
-		s:  &Session{ip: srcIP, heapIndex: -1},
+		s:  &Session{ip: canonicalIP(srcIP), heapIndex: -1},
 	}
 	_, err := io.ReadFull(crand.Reader, r.secret[:])
 	if err != nil {
@@ -108,6 +109,16 @@ func (r *RecipientState) Establish() *Session {
 const (
 	aesKeySize   = 16
 	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+// Overhead is the number of bytes added to a message by Encode: the session ID,
+// nonce and authentication tag.
+const Overhead = 8 + gcmNonceSize + gcmTagSize
+
+var (
+	errSessionRemoved = errors.New("session removed")
+	errPacketTooShort = errors.New("packet too short")
 )
 
 // Session represents an active session.
@@ -115,14 +126,25 @@ type Session struct {
 	ip           netip.Addr
 	ingressID    uint64
 	egressID     uint64
-	ingress      cipher.AEAD
-	egress       cipher.AEAD
+	ciphers      atomic.Pointer[sessionCiphers]
 	handler      SessionPacketHandler
 	nonceCounter uint32
 
 	heapIndex int
 }
 
+// sessionCiphers holds the session keys. The keys are zeroed and the ciphers are
+// dropped when the session is removed from the store.
+//
+// Note that crypto/aes provides no way to clear the expanded key schedule held
+// by the AEADs. It stays in memory until the ciphers are garbage collected.
+type sessionCiphers struct {
+	ingressKey [aesKeySize]byte
+	egressKey  [aesKeySize]byte
+	ingress    cipher.AEAD
+	egress     cipher.AEAD
+}
+
 type SessionPacketHandler func(*Session, []byte, net.Addr)
 
 func (s *Session) setIndex(i int) {
@@ -143,19 +165,39 @@ func (s *Session) derive(protocol string, initiatorSec, recipientSec *[16]byte,
 	info := "discv5 subprotocol session" + protocol
 	kdf := hkdf.New(sha256.New, sec[:], nil, []byte(info))
 	var kdata [48]byte
+	defer func() {
+		for i := range kdata {
+			kdata[i] = 0
+		}
+	}()
 	kdf.Read(kdata[:])
 
-	ingressKey := kdata[0:16]
-	egressKey := kdata[16:32]
+	c := new(sessionCiphers)
+	copy(c.ingressKey[:], kdata[0:16])
+	copy(c.egressKey[:], kdata[16:32])
 	s.ingressID = binary.BigEndian.Uint64(kdata[32:40])
 	s.egressID = binary.BigEndian.Uint64(kdata[40:48])
-	s.ingress, _ = newGCM(ingressKey)
-	s.egress, _ = newGCM(egressKey)
-
 	if isRecipient {
-		s.ingress, s.egress = s.egress, s.ingress
+		c.ingressKey, c.egressKey = c.egressKey, c.ingressKey
 		s.ingressID, s.egressID = s.egressID, s.ingressID
 	}
+	c.ingress, _ = newGCM(c.ingressKey[:])
+	c.egress, _ = newGCM(c.egressKey[:])
+	s.ciphers.Store(c)
+}
+
+// wipe zeroes the session keys and drops the ciphers. Encode/Decode fail with
+// errSessionRemoved after this. It is called by the store when the session is
+// removed.
+func (s *Session) wipe() {
+	c := s.ciphers.Swap(nil)
+	if c == nil {
+		return
+	}
+	for i := range c.ingressKey {
+		c.ingressKey[i] = 0
+		c.egressKey[i] = 0
+	}
 }
 
 // Encode creates an encrypted packet containing msg.
@@ -174,26 +216,38 @@ func (s *Session) Encode(dest []byte, msg []byte) ([]byte, error) {
 
 	dest = append(dest, idData[:]...)
 	dest = append(dest, nonceData[:]...)
-	dest = s.encrypt(dest, msg, nonceData[:], idData[:])
-	return dest, nil
+	return s.encrypt(dest, msg, nonceData[:], idData[:])
 }
 
 // Decode decrypts/authenticates a packet and appends the plaintext to dest.
 // dest must not overlap with packet.
 func (s *Session) Decode(dest []byte, packet []byte) ([]byte, error) {
-	if len(packet) < 36 {
-		return nil, errors.New("packet too short")
+	_, nonceData, err := DecodeHeader(packet)
+	if err != nil {
+		return nil, err
 	}
-
 	idData := packet[:8]
-	nonceData := packet[8:20]
 	return s.decrypt(dest, packet[20:], nonceData, idData)
 }
 
+// DecodeHeader returns the session ID and nonce of a packet without decrypting
+// it. The ID is the ingress ID of the receiving session, so it can be used to
+// route the packet before calling Decode. The returned nonce is a slice of packet.
+func DecodeHeader(packet []byte) (id uint64, nonce []byte, err error) {
+	if len(packet) < Overhead {
+		return 0, nil, errPacketTooShort
+	}
+	return binary.BigEndian.Uint64(packet[:8]), packet[8 : 8+gcmNonceSize], nil
+}
+
 // encrypt encrypts msg with the session's egress key. The ciphertext is appended to dest,
 // which must not overlap with plaintext.
-func (s *Session) encrypt(dest []byte, plaintext, nonce, authData []byte) []byte {
-	return s.egress.Seal(dest, nonce, plaintext, authData)
+func (s *Session) encrypt(dest []byte, plaintext, nonce, authData []byte) ([]byte, error) {
+	c := s.ciphers.Load()
+	if c == nil {
+		return nil, errSessionRemoved
+	}
+	return c.egress.Seal(dest, nonce, plaintext, authData), nil
 }
 
 // decrypt decrypts/authenticates a ciphertext with the session's ingress key and the
@@ -202,7 +256,11 @@ func (s *Session) decrypt(dest, ciphertext, nonce, authData []byte) ([]byte, err
 	if len(nonce) != gcmNonceSize {
 		return nil, fmt.Errorf("invalid GCM nonce size: %d", len(nonce))
 	}
-	return s.ingress.Open(dest, nonce, ciphertext, authData)
+	c := s.ciphers.Load()
+	if c == nil {
+		return nil, errSessionRemoved
+	}
+	return c.ingress.Open(dest, nonce, ciphertext, authData)
 }
 
 func newGCM(key []byte) (cipher.AEAD, error) {
@@ -1,9 +1,13 @@
 package session
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"net"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common/mclock"
 )
@@ -48,6 +52,119 @@ func TestSessionRoundtrip(t *testing.T) {
 	t.Log("msg2:", string(decbuf))
 }
 
+// This test checks session key derivation and packet encryption against fixed
+// values. It ensures that the wire format doesn't change accidentally.
+func TestSessionKnownAnswer(t *testing.T) {
+	var initiatorSec, recipientSec [16]byte
+	for i := range initiatorSec {
+		initiatorSec[i] = byte(i)
+		recipientSec[i] = byte(i + 16)
+	}
+	var is, rs Session
+	is.derive("proto", &initiatorSec, &recipientSec, false)
+	rs.derive("proto", &initiatorSec, &recipientSec, true)
+
+	// Check session IDs.
+	const (
+		wantInitiatorIngressID = 0xd38da26e4e661472
+		wantInitiatorEgressID  = 0x9b81ad2ccaf7f987
+	)
+	if is.ingressID != wantInitiatorIngressID || is.egressID != wantInitiatorEgressID {
+		t.Errorf("wrong initiator IDs: in %#x, eg %#x", is.ingressID, is.egressID)
+	}
+	if rs.ingressID != is.egressID || rs.egressID != is.ingressID {
+		t.Errorf("wrong recipient IDs: in %#x, eg %#x", rs.ingressID, rs.egressID)
+	}
+
+	// Check keys by comparing against ciphers created from the expected keys.
+	var (
+		nonce     = hexBytes("a0a1a2a3a4a5a6a7a8a9aaab")
+		plaintext = []byte("test message")
+	)
+	for _, test := range []struct {
+		name string
+		s    *Session
+		key  string
+	}{
+		{"initiator", &is, "694afd46637e2dffeb2e32b1202dbc5d"},
+		{"recipient", &rs, "da46d36428d4d5d378932bc7062fbdf1"},
+	} {
+		aead, err := newGCM(hexBytes(test.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := aead.Seal(nil, nonce, plaintext, nil)
+		got, err := test.s.encrypt(nil, plaintext, nonce, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: wrong egress key", test.name)
+		}
+	}
+
+	// Check a fixed packet.
+	packet := hexBytes("9b81ad2ccaf7f987" + "a0a1a2a3a4a5a6a7a8a9aaab" +
+		"80cbd6ba277ff59a94232ba63e8e995e59395eba60ebff7002e8ac1f")
+	var idData [8]byte
+	binary.BigEndian.PutUint64(idData[:], is.egressID)
+	ct, err := is.encrypt(nil, plaintext, nonce, idData[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ct, packet[20:]) {
+		t.Errorf("wrong ciphertext %x", ct)
+	}
+	dec, err := rs.Decode(nil, packet)
+	if err != nil {
+		t.Fatal("decode error:", err)
+	}
+	if !bytes.Equal(dec, plaintext) {
+		t.Errorf("wrong plaintext %q", dec)
+	}
+
+	// Check the packet layout created by Encode.
+	enc, err := is.Encode(nil, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc[:8], packet[:8]) {
+		t.Errorf("wrong session ID in packet: %x", enc[:8])
+	}
+	if !bytes.Equal(enc[8:12], []byte{0, 0, 0, 0}) {
+		t.Errorf("wrong nonce counter in packet: %x", enc[8:12])
+	}
+	if len(enc) != len(packet) {
+		t.Errorf("wrong packet length %d", len(enc))
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	packet := hexBytes("9b81ad2ccaf7f987" + "a0a1a2a3a4a5a6a7a8a9aaab" +
+		"80cbd6ba277ff59a94232ba63e8e995e59395eba60ebff7002e8ac1f")
+	id, nonce, err := DecodeHeader(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 0x9b81ad2ccaf7f987 {
+		t.Errorf("wrong ID %#x", id)
+	}
+	if !bytes.Equal(nonce, hexBytes("a0a1a2a3a4a5a6a7a8a9aaab")) {
+		t.Errorf("wrong nonce %x", nonce)
+	}
+	if _, _, err := DecodeHeader(packet[:Overhead-1]); err != errPacketTooShort {
+		t.Errorf("wrong error for short packet: %v", err)
+	}
+}
+
+func hexBytes(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
 // This test checks retrieval of sessions from the store.
 func TestSessionStore(t *testing.T) {
 	var (
@@ -77,14 +194,187 @@ func TestSessionStore(t *testing.T) {
 	if s2 != nil {
 		t.Fatal("session found with wrong IP address")
 	}
+	if n := st.Len(); n != 1 {
+		t.Fatalf("wrong Len %d", n)
+	}
 	// It should also not be found after it has expired.
 	clock.Run(sessionTimeout)
 	s3 := st.Get(ip1, s.ingressID)
 	if s3 != nil {
 		t.Fatal("session found after it has expired")
 	}
+	if n := st.Len(); n != 0 {
+		t.Fatalf("wrong Len %d after expiry", n)
+	}
+	// The expired session can no longer be used.
+	if _, err := s.Encode(nil, []byte("msg")); err != errSessionRemoved {
+		t.Fatalf("wrong Encode error after expiry: %v", err)
+	}
+}
+
+// This test checks that session keys are zeroed when sessions are removed
+// by Close.
+func TestSessionStoreCloseWipe(t *testing.T) {
+	st := NewStore()
+	r, err := st.Recipient("proto", netip.MustParseAddr("127.0.0.1"), [16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetHandler(dummyHandler)
+	s := r.Establish()
+	packet, err := s.Encode(nil, []byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.ciphers.Load()
+	st.Close()
+	if s.ciphers.Load() != nil {
+		t.Fatal("session keys not dropped")
+	}
+	if c.ingressKey != [aesKeySize]byte{} || c.egressKey != [aesKeySize]byte{} {
+		t.Fatal("session keys not zeroed")
+	}
+	if _, err := s.Encode(nil, []byte("msg")); err != errSessionRemoved {
+		t.Fatalf("wrong Encode error: %v", err)
+	}
+	if _, err := s.Decode(nil, packet); err != errSessionRemoved {
+		t.Fatalf("wrong Decode error: %v", err)
+	}
+}
+
+// This test checks that the ID filter tracks the sessions in the store.
+func TestSessionStoreFilter(t *testing.T) {
+	var (
+		ip    = netip.MustParseAddr("127.0.0.1")
+		clock = new(mclock.Simulated)
+	)
+	st := NewStore()
+	st.clock = clock
+
+	var ids []uint64
+	for i := 0; i < 10; i++ {
+		r, err := st.Recipient("proto", ip, [16]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetHandler(dummyHandler)
+		ids = append(ids, r.Establish().ingressID)
+	}
+	for _, id := range ids {
+		if !st.mayContain(id) {
+			t.Fatalf("ID %x not in filter", id)
+		}
+	}
+
+	// Unknown IDs are rejected without looking at the session map.
+	unknown := ids[0] + 1
+	for _, id := range ids {
+		if id%idFilterSize == unknown%idFilterSize {
+			t.Skip("filter collision")
+		}
+	}
+	packet := make([]byte, 64)
+	binary.BigEndian.PutUint64(packet, unknown)
+	if st.HandlePacket(packet, &net.UDPAddr{IP: ip.AsSlice()}) {
+		t.Fatal("packet with unknown ID handled")
+	}
+
+	clock.Run(sessionTimeout)
+	st.Len() // runs expiry
+	for i := range st.idFilter {
+		if n := st.idFilter[i].Load(); n != 0 {
+			t.Fatalf("filter slot %d is %d after expiry", i, n)
+		}
+	}
+}
+
+// This test checks that StartExpiry removes sessions without store access.
+func TestSessionStoreExpiry(t *testing.T) {
+	var (
+		ip    = netip.MustParseAddr("127.0.0.1")
+		clock = new(mclock.Simulated)
+	)
+	st := NewStore()
+	st.clock = clock
+	st.StartExpiry(time.Second)
+	defer st.Close()
+
+	r, err := st.Recipient("proto", ip, [16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetHandler(dummyHandler)
+	r.Establish()
+
+	clock.Run(sessionTimeout)
+	// The expiry goroutine runs concurrently with the test, so keep advancing
+	// the clock until it has removed the session.
+	for i := 0; ; i++ {
+		clock.WaitForTimers(1)
+		clock.Run(time.Second)
+		st.mu.Lock()
+		n := len(st.sessions)
+		st.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("session not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	st.Close()
+	st.Close() // second call is a no-op
 }
 
 func dummyHandler(s *Session, packet []byte, src net.Addr) {
 	panic("handler called")
 }
+
+// This test checks that IPv4 addresses match sessions regardless of whether
+// they are given as plain IPv4 or IPv4-mapped IPv6 addresses.
+func TestSessionStoreMappedIPv4(t *testing.T) {
+	var (
+		ip4    = netip.MustParseAddr("127.0.0.1")
+		mapped = netip.MustParseAddr("::ffff:127.0.0.1")
+		st     = NewStore()
+	)
+
+	// Establish with the mapped form, deliver with a 4-byte address.
+	var handled int
+	handler := func(*Session, []byte, net.Addr) { handled++ }
+	r, err := st.Recipient("proto", mapped, [16]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetHandler(handler)
+	s1 := r.Establish()
+	packet := make([]byte, 64)
+	binary.BigEndian.PutUint64(packet, s1.ingressID)
+	if !st.HandlePacket(packet, &net.UDPAddr{IP: net.IP(ip4.AsSlice())}) {
+		t.Fatal("packet from IPv4 address not handled")
+	}
+	if st.Get(ip4, s1.ingressID) != s1 {
+		t.Fatal("session not found by IPv4 address")
+	}
+
+	// Establish with the plain form, deliver with a 16-byte address.
+	i, err := st.Initiator("proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.SetHandler(handler)
+	s2 := i.Establish(ip4, [16]byte{2})
+	binary.BigEndian.PutUint64(packet, s2.ingressID)
+	if !st.HandlePacket(packet, &net.UDPAddr{IP: net.IP(mapped.AsSlice())}) {
+		t.Fatal("packet from IPv4-mapped address not handled")
+	}
+	if st.Get(mapped, s2.ingressID) != s2 {
+		t.Fatal("session not found by IPv4-mapped address")
+	}
+	if handled != 2 {
+		t.Fatalf("handler called %d times, want 2", handled)
+	}
+}
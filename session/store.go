@@ -1,10 +1,10 @@
 package session
 
 import (
-	"encoding/binary"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/mclock"
@@ -13,7 +13,10 @@ import (
 	"github.com/ethereum/go-ethereum/p2p/netutil"
 )
 
-const sessionTimeout = 10 * time.Second
+const (
+	sessionTimeout = 10 * time.Second
+	idFilterSize   = 4096
+)
 
 // Store keeps active sessions.
 type Store struct {
@@ -21,6 +24,15 @@ type Store struct {
 	sessions map[sessionKey]*Session
 	exp      *prque.Prque[mclock.AbsTime, *Session]
 	clock    mclock.Clock
+	log      ethlog.Logger
+
+	// These are set while the expiry loop is running.
+	expiryQuit chan struct{}
+	expiryDone chan struct{}
+
+	// idFilter counts the stored sessions by ingress ID. It is checked before
+	// taking the lock, so packets with unknown IDs are rejected cheaply.
+	idFilter [idFilterSize]atomic.Int32
 }
 
 type sessionKey struct {
@@ -33,26 +45,57 @@ func NewStore() *Store {
 		sessions: make(map[sessionKey]*Session),
 		exp:      prque.New[mclock.AbsTime]((*Session).setIndex),
 		clock:    mclock.System{},
+		log:      ethlog.Root(),
 	}
 }
 
+// SetLogger sets the logger of the store.
+func (st *Store) SetLogger(l ethlog.Logger) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.log = l
+}
+
 func (st *Store) store(s *Session) {
 	key := sessionKey{s.ip, s.ingressID}
 	st.mu.Lock()
 	defer st.mu.Unlock()
 
+	if old := st.sessions[key]; old != nil {
+		st.exp.Remove(old.heapIndex)
+		if old != s {
+			old.wipe()
+		}
+	} else {
+		st.idFilter[s.ingressID%idFilterSize].Add(1)
+	}
 	st.sessions[key] = s
 	st.exp.Push(s, st.clock.Now().Add(sessionTimeout))
 }
 
+// mayContain reports whether a session with the given ingress ID may exist.
+func (st *Store) mayContain(id uint64) bool {
+	return st.idFilter[id%idFilterSize].Load() > 0
+}
+
 // Get looks up a session by IP address and ID.
 func (st *Store) Get(srcIP netip.Addr, id uint64) *Session {
-	s, _ := st.get(srcIP, id)
+	s, _ := st.get(canonicalIP(srcIP), id)
 	return s
 }
 
+// canonicalIP returns the form of ip used as the session key. On dual-stack
+// sockets, IPv4 addresses can appear in their IPv4-mapped IPv6 form, which must
+// match sessions established with the plain IPv4 address and vice versa.
+func canonicalIP(ip netip.Addr) netip.Addr {
+	return ip.Unmap()
+}
+
 // get looks up a session by IP address and ID.
 func (st *Store) get(srcIP netip.Addr, id uint64) (*Session, SessionPacketHandler) {
+	if !st.mayContain(id) {
+		return nil, nil
+	}
 	st.mu.Lock()
 	defer st.mu.Unlock()
 
@@ -74,17 +117,13 @@ func (st *Store) HandlePacket(packet []byte, src net.Addr) bool {
 	if ipslice == nil {
 		return false
 	}
-	var srcIP netip.Addr
-	if ip4 := ipslice.To4(); ip4 != nil {
-		srcIP, _ = netip.AddrFromSlice(ip4)
-	} else {
-		srcIP, _ = netip.AddrFromSlice(ipslice)
-	}
+	srcIP, _ := netip.AddrFromSlice(ipslice)
+	srcIP = canonicalIP(srcIP)
 
-	if len(packet) < 36 {
+	id, _, err := DecodeHeader(packet)
+	if err != nil {
 		return false
 	}
-	id := binary.BigEndian.Uint64(packet[:8])
 
 	s, handler := st.get(srcIP, id)
 	if s == nil {
@@ -94,6 +133,82 @@ func (st *Store) HandlePacket(packet []byte, src net.Addr) bool {
 	return true
 }
 
+// Len returns the number of active sessions.
+func (st *Store) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.expire(st.clock.Now())
+	return len(st.sessions)
+}
+
+// StartExpiry starts a background goroutine that removes expired sessions at the
+// given interval. Without it, sessions are only removed when the store is
+// accessed. The goroutine runs until Close is called.
+func (st *Store) StartExpiry(interval time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.expiryQuit != nil {
+		return // already running
+	}
+	st.expiryQuit = make(chan struct{})
+	st.expiryDone = make(chan struct{})
+	go st.expiryLoop(interval, st.expiryQuit, st.expiryDone)
+}
+
+func (st *Store) expiryLoop(interval time.Duration, quit, done chan struct{}) {
+	defer close(done)
+	for {
+		timer := st.clock.NewTimer(interval)
+		select {
+		case <-timer.C():
+			st.mu.Lock()
+			st.expire(st.clock.Now())
+			st.mu.Unlock()
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Close stops the expiry goroutine and removes all sessions. The keys of
+// removed sessions are dropped, so they can no longer encode or decode packets.
+func (st *Store) Close() {
+	st.mu.Lock()
+	quit, done := st.expiryQuit, st.expiryDone
+	st.expiryQuit, st.expiryDone = nil, nil
+	st.mu.Unlock()
+
+	if quit != nil {
+		close(quit)
+		<-done
+	}
+	st.removeAll()
+}
+
+// OnSocketClosed closes the store. It is called when the socket delivering
+// packets to the store is closed.
+func (st *Store) OnSocketClosed() {
+	st.Close()
+}
+
+// removeAll removes all sessions.
+func (st *Store) removeAll() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, s := range st.sessions {
+		s.wipe()
+	}
+	st.sessions = make(map[sessionKey]*Session)
+	st.exp.Reset()
+	for i := range st.idFilter {
+		st.idFilter[i].Store(0)
+	}
+}
+
 // expire removes expired sessions.
 func (st *Store) expire(now mclock.AbsTime) {
 	for !st.exp.Empty() {
@@ -103,7 +218,9 @@ func (st *Store) expire(now mclock.AbsTime) {
 		}
 		st.exp.Pop()
 		key := sessionKey{s.ip, s.ingressID}
-		ethlog.Trace("Removing expired session", "ip", s.ip, "id", s.ingressID)
+		st.log.Trace("Removing expired session", "ip", s.ip, "id", s.ingressID)
 		delete(st.sessions, key)
+		st.idFilter[s.ingressID%idFilterSize].Add(-1)
+		s.wipe()
 	}
 }
@@ -0,0 +1,53 @@
+package sharedsocket
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchReader is implemented by ipv4.PacketConn and ipv6.PacketConn.
+// On Linux, ReadBatch uses recvmmsg. On other platforms, it reads a single packet.
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchReader returns a batchReader for conn, or nil if batched reads
+// are not supported by the connection type.
+func newBatchReader(conn UDPConn) batchReader {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	if addr, ok := uc.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(uc)
+	}
+	return ipv6.NewPacketConn(uc)
+}
+
+func (c *Conn) readLoopBatch(br batchReader) {
+	// As in readLoop, buffers have one extra byte to detect oversized packets.
+	msgs := make([]ipv4.Message, c.batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, c.bufferSize+1)}
+	}
+
+	for {
+		n, err := br.ReadBatch(msgs, 0)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("read error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		for _, m := range msgs[:n] {
+			addr, _ := m.Addr.(*net.UDPAddr)
+			c.dispatch(m.Buffers[0][:m.N], addr)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package sharedsocket
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -16,6 +19,15 @@ type Handler interface {
 	HandlePacket(packet []byte, addr net.Addr) bool
 }
 
+// ClosingHandler is a Handler that is notified when the Conn is closed.
+type ClosingHandler interface {
+	Handler
+
+	// OnSocketClosed is called by Conn.Close after packet dispatch has stopped.
+	// The underlying connection is already closed at this point.
+	OnSocketClosed()
+}
+
 type handlerFunc struct {
 	f func(packet []byte, addr net.Addr) bool
 }
@@ -48,19 +60,58 @@ type UDPConn interface {
 // can be retrieved using the DefaultConn method. The returned connection object is a
 // net.PacketConn that receives all packets that weren't accepted by any handler.
 type Conn struct {
-	conn UDPConn
+	conn       UDPConn
+	bufferSize int
+	batchSize  int
+	stats      connStats
 
 	wg       sync.WaitGroup
 	quit     chan struct{}
+	closed   bool       // protected by mutex
 	mutex    sync.Mutex // protects writes to the handler list
 	handlers atomic.Pointer[handlerList]
+
+	deliverMu    sync.Mutex
+	deliverDepth map[*net.UDPAddr]int // nesting depth of active Deliver calls
+}
+
+// MaxDeliverDepth is the maximum nesting depth of Deliver calls made from handlers.
+const MaxDeliverDepth = 8
+
+// ErrDeliverDepth is returned by Deliver when MaxDeliverDepth is exceeded.
+var ErrDeliverDepth = errors.New("too many nested Deliver calls")
+
+// DefaultReadBufferSize is the default maximum size of received packets.
+const DefaultReadBufferSize = 2048
+
+// Config contains optional settings of Conn.
+type Config struct {
+	// ReadBufferSize is the maximum size of received packets. Larger packets are
+	// dropped. Defaults to DefaultReadBufferSize if not positive.
+	ReadBufferSize int
+
+	// ReadBatchSize enables batched reads when set to a value greater than one.
+	// Up to ReadBatchSize packets are then read with a single system call, if the
+	// platform supports it. Handlers are still called for each packet.
+	ReadBatchSize int
 }
 
 // NewConn creates a new connection.
 func NewConn(p UDPConn) *Conn {
+	return NewConnWithConfig(p, Config{})
+}
+
+// NewConnWithConfig creates a new connection with the given settings.
+func NewConnWithConfig(p UDPConn, cfg Config) *Conn {
+	if cfg.ReadBufferSize <= 0 {
+		cfg.ReadBufferSize = DefaultReadBufferSize
+	}
 	c := &Conn{
-		conn: p,
-		quit: make(chan struct{}),
+		conn:         p,
+		bufferSize:   cfg.ReadBufferSize,
+		batchSize:    cfg.ReadBatchSize,
+		quit:         make(chan struct{}),
+		deliverDepth: make(map[*net.UDPAddr]int),
 	}
 	c.handlers.Store(new(handlerList))
 	c.wg.Add(1)
@@ -70,7 +121,14 @@ func NewConn(p UDPConn) *Conn {
 
 // Listen creates a UDP listener and wraps it with a Conn.
 func Listen(network, address string) (*Conn, error) {
-	pc, err := net.ListenPacket(network, address)
+	return ListenWithConfig(network, address, net.ListenConfig{}, Config{})
+}
+
+// ListenWithConfig creates a UDP listener using lc and wraps it with a Conn. Socket
+// options that must be set before the socket is bound, such as SO_REUSEPORT, can
+// be set by the Control function of lc.
+func ListenWithConfig(network, address string, lc net.ListenConfig, cfg Config) (*Conn, error) {
+	pc, err := lc.ListenPacket(context.Background(), network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -79,50 +137,74 @@ func Listen(network, address string) (*Conn, error) {
 		pc.Close()
 		return nil, fmt.Errorf("ListenPacket returned a non-UDP connection (type %T)", pc)
 	}
-	return NewConn(udpc), nil
+	return NewConnWithConfig(udpc, cfg), nil
 }
 
 // Close terminates the connection.
 // This also closes the underlying connection.
 func (c *Conn) Close() error {
-	// If there is a defaultConn, it needs to be closed as well. But defaultConn.Close()
-	// would acquire c.mutex in unsetDefaultConn, causing a deadlock.
-	// So it is closed by the defer construction below.
-	var dcToClose *defaultConn
+	// If there are default outlets, they need to be closed as well. But defaultConn.Close()
+	// would acquire c.mutex in removeDefaultConn, causing a deadlock.
+	// So they are closed by the defer construction below. The same applies to
+	// handlers, which might want to remove themselves in OnSocketClosed.
+	var (
+		dcToClose []*defaultConn
+		toNotify  []ClosingHandler
+	)
 	defer func() {
-		if dcToClose != nil {
-			dcToClose.Close()
+		for _, dc := range dcToClose {
+			dc.Close()
+		}
+		for _, h := range toNotify {
+			h.OnSocketClosed()
 		}
 	}()
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if c.quit == nil {
+	if c.closed {
 		return nil
 	}
 
 	l := c.handlers.Load()
 	if l.defaultConn != nil {
-		dcToClose = l.defaultConn
+		dcToClose = append(dcToClose, l.defaultConn)
 	}
+	dcToClose = append(dcToClose, l.taps...)
 	close(c.quit)
 	err := c.conn.Close()
 	c.wg.Wait()
-	c.quit = nil
+	c.closed = true
+	for _, e := range l.hs {
+		if ch, ok := e.h.(ClosingHandler); ok {
+			toNotify = append(toNotify, ch)
+		}
+	}
 	return err
 }
 
 // WriteTo writes a packet with payload b to addr. This is a direct write
 // to the underlying connection.
 func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	return c.conn.WriteTo(b, addr)
+	n, err := c.conn.WriteTo(b, addr)
+	c.countWrite(n, err)
+	return n, err
 }
 
 // WriteTo writes a packet with payload b to addr. This is a direct write
 // to the underlying connection.
 func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
-	return c.conn.WriteToUDP(b, addr)
+	n, err := c.conn.WriteToUDP(b, addr)
+	c.countWrite(n, err)
+	return n, err
+}
+
+func (c *Conn) countWrite(n int, err error) {
+	if err == nil {
+		c.stats.sentPackets.Add(1)
+		c.stats.sentBytes.Add(uint64(n))
+	}
 }
 
 // LocalAddr returns the local network address of the socket, if known.
@@ -130,15 +212,122 @@ func (c *Conn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
 
-// AddHandler defines a new handler for incoming packets.
-// The order in which handlers are added matters.Handlers will be called in the
-// order they were added.
+// ErrNoSyscallConn is returned by SyscallConn when the socket passed to NewConn
+// doesn't provide access to the underlying file descriptor.
+var ErrNoSyscallConn = errors.New("socket does not implement syscall.Conn")
+
+// SyscallConn returns a raw network connection of the underlying socket. This
+// can be used to set socket options. The socket must not be read from or
+// written to through the raw connection, since that would interfere with
+// dispatch.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrNoSyscallConn
+	}
+	return sc.SyscallConn()
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer of the
+// socket. Raising it helps to avoid packet loss during high-throughput
+// transfers.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	bc, ok := c.conn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return ErrNoSyscallConn
+	}
+	return bc.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the size of the operating system's transmit buffer of the
+// socket.
+func (c *Conn) SetWriteBuffer(bytes int) error {
+	bc, ok := c.conn.(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return ErrNoSyscallConn
+	}
+	return bc.SetWriteBuffer(bytes)
+}
+
+// Stats contains packet counters of a Conn.
+type Stats struct {
+	Packets   uint64 // packets received
+	Bytes     uint64 // bytes received
+	Truncated uint64 // packets dropped because they exceeded the read buffer size
+	Unmatched uint64 // packets dropped because no handler accepted them and there was no default outlet
+	Delivered uint64 // packets passed to Deliver
+
+	SentPackets uint64 // packets sent
+	SentBytes   uint64 // bytes sent
+
+	// Handlers contains the number of packets accepted by each handler,
+	// in dispatch order.
+	Handlers []HandlerStats
+
+	// These count packets passed to default outlets. When there are multiple
+	// outlets, each copy of a packet is counted.
+	Default        uint64 // packets delivered
+	DefaultBlocked uint64 // deliveries that had to wait because the outlet's queue was full
+	DefaultDropped uint64 // packets dropped because the outlet or Conn was closed
+}
+
+// HandlerStats contains the counters of a single handler.
+type HandlerStats struct {
+	Handler  Handler
+	Priority int
+	Accepted uint64
+}
+
+type connStats struct {
+	packets        atomic.Uint64
+	bytes          atomic.Uint64
+	truncated      atomic.Uint64
+	unmatched      atomic.Uint64
+	delivered      atomic.Uint64
+	sentPackets    atomic.Uint64
+	sentBytes      atomic.Uint64
+	deflt          atomic.Uint64
+	defaultBlocked atomic.Uint64
+	defaultDropped atomic.Uint64
+}
+
+// Stats returns the current packet counters.
+func (c *Conn) Stats() Stats {
+	l := c.handlers.Load()
+	st := Stats{
+		Packets:        c.stats.packets.Load(),
+		Bytes:          c.stats.bytes.Load(),
+		Truncated:      c.stats.truncated.Load(),
+		Unmatched:      c.stats.unmatched.Load(),
+		Delivered:      c.stats.delivered.Load(),
+		SentPackets:    c.stats.sentPackets.Load(),
+		SentBytes:      c.stats.sentBytes.Load(),
+		Handlers:       make([]HandlerStats, len(l.hs)),
+		Default:        c.stats.deflt.Load(),
+		DefaultBlocked: c.stats.defaultBlocked.Load(),
+		DefaultDropped: c.stats.defaultDropped.Load(),
+	}
+	for i, e := range l.hs {
+		st.Handlers[i] = HandlerStats{e.h, e.priority, e.accepted.Load()}
+	}
+	return st
+}
+
+// AddHandler defines a new handler for incoming packets. This is equivalent to
+// AddHandlerWithPriority(h, 0).
 func (c *Conn) AddHandler(h Handler) {
+	c.AddHandlerWithPriority(h, 0)
+}
+
+// AddHandlerWithPriority defines a new handler for incoming packets. Handlers with
+// higher priority are called first. Handlers with equal priority are called in the
+// order they were added.
+func (c *Conn) AddHandlerWithPriority(h Handler, priority int) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	l := c.handlers.Load()
-	c.handlers.Store(l.append(h))
+	c.handlers.Store(l.insert(h, priority))
 }
 
 // RemoveHandler removes a handler.
@@ -150,10 +339,13 @@ func (c *Conn) RemoveHandler(h Handler) {
 	c.handlers.Store(l.remove(h))
 }
 
-// DefaultConn creates and retrieves the default outlet. This connection receives all
-// packets that are not accepted by any handler. Note that only one default outlet exists
-// at any time. The first call to DefaultConn creates it, and subsequent calls return the
-// existing connection. The default outlet connection is removed when it is closed.
+// DefaultConn creates and retrieves the shared default outlet. This connection receives
+// all packets that are not accepted by any handler. The first call to DefaultConn creates
+// it, and subsequent calls return the existing connection. The shared outlet is removed
+// when it is closed, and the next call creates a new one.
+//
+// Additional outlets can be created with NewDefaultConn. Every outlet, including the
+// shared one, receives its own copy of each unmatched packet.
 func (c *Conn) DefaultConn() UDPConn {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -167,21 +359,49 @@ func (c *Conn) DefaultConn() UDPConn {
 	return l.defaultConn
 }
 
-func (c *Conn) unsetDefaultConn() {
+// NewDefaultConn creates an additional default outlet. Unlike DefaultConn, every call
+// creates a new connection. All default outlets, including the one returned by
+// DefaultConn, receive their own copy of each packet that isn't accepted by any
+// handler. The outlet is removed when it is closed.
+//
+// Note that packet dispatch waits for the outlet when its queue is full, so the
+// returned connection must be read continuously.
+func (c *Conn) NewDefaultConn() UDPConn {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	dc := newDefaultConn(c)
 	l := c.handlers.Load()
-	c.handlers.Store(l.setDefault(nil))
+	c.handlers.Store(l.addTap(dc))
+	return dc
+}
+
+func (c *Conn) removeDefaultConn(dc *defaultConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	l := c.handlers.Load()
+	if l.defaultConn == dc {
+		c.handlers.Store(l.setDefault(nil))
+	} else {
+		c.handlers.Store(l.removeTap(dc))
+	}
 }
 
 func (c *Conn) readLoop() {
 	defer c.wg.Done()
 
+	if c.batchSize > 1 {
+		if br := newBatchReader(c.conn); br != nil {
+			c.readLoopBatch(br)
+			return
+		}
+	}
+
+	// The buffer has one extra byte to detect packets larger than bufferSize.
 	var (
-		buf = make([]byte, 2048)
+		buf = make([]byte, c.bufferSize+1)
 	)
-recv:
 	for {
 		n, addr, err := c.conn.ReadFromUDP(buf)
 		if errors.Is(err, net.ErrClosed) {
@@ -193,37 +413,113 @@ recv:
 			time.Sleep(100 * time.Millisecond)
 			continue
 		}
-		packet := buf[:n]
+		c.dispatch(buf[:n], addr)
+	}
+}
 
-		l := c.handlers.Load()
-		for _, h := range l.hs {
-			if h.HandlePacket(packet, addr) {
-				continue recv
-			}
-		}
-		if l.defaultConn != nil {
-			l.defaultConn.deliver(packet, addr, c.quit)
+// dispatch passes a received packet to the handlers.
+func (c *Conn) dispatch(packet []byte, addr *net.UDPAddr) {
+	if len(packet) > c.bufferSize {
+		c.stats.truncated.Add(1)
+		log.Printf("dropped packet from %v: larger than read buffer size %d", addr, c.bufferSize)
+		return
+	}
+
+	c.stats.packets.Add(1)
+	c.stats.bytes.Add(uint64(len(packet)))
+	c.handle(packet, addr)
+}
+
+// Deliver passes a packet to the handlers as if it was received on the socket.
+// This is meant for handlers that decapsulate tunneled or relayed packets.
+// Dispatch happens synchronously, and the packet is not retained after Deliver
+// returns.
+//
+// Handlers may call Deliver. A call is nested when it passes the address given
+// to the handler by an enclosing Deliver. To prevent infinite loops, the nesting
+// depth is limited to MaxDeliverDepth. Independent calls, e.g. from different
+// goroutines, don't count against each other's depth.
+func (c *Conn) Deliver(packet []byte, addr *net.UDPAddr) error {
+	select {
+	case <-c.quit:
+		return net.ErrClosed
+	default:
+	}
+
+	// Handlers get a private copy of addr, which identifies this call
+	// when they re-inject the packet.
+	c.deliverMu.Lock()
+	depth := c.deliverDepth[addr] + 1
+	if depth > MaxDeliverDepth {
+		c.deliverMu.Unlock()
+		return ErrDeliverDepth
+	}
+	from := new(net.UDPAddr)
+	*from = *addr
+	c.deliverDepth[from] = depth
+	c.deliverMu.Unlock()
+	defer func() {
+		c.deliverMu.Lock()
+		delete(c.deliverDepth, from)
+		c.deliverMu.Unlock()
+	}()
+
+	c.stats.delivered.Add(1)
+	c.handle(packet, from)
+	return nil
+}
+
+// handle passes a packet to the handlers and default outlets.
+func (c *Conn) handle(packet []byte, addr *net.UDPAddr) {
+	l := c.handlers.Load()
+	for _, e := range l.hs {
+		if e.h.HandlePacket(packet, addr) {
+			e.accepted.Add(1)
+			return
 		}
 	}
+	if l.defaultConn == nil && len(l.taps) == 0 {
+		c.stats.unmatched.Add(1)
+		return
+	}
+	if l.defaultConn != nil {
+		l.defaultConn.deliver(packet, addr, c.quit)
+	}
+	for _, dc := range l.taps {
+		dc.deliver(packet, addr, c.quit)
+	}
 }
 
 // handlerList keeps the list of packet handlers and the optional default outlet.
 // This is implemented as a copy-on-write structure because the handlers
 type handlerList struct {
-	hs          []Handler
+	hs          []handlerEntry
 	defaultConn *defaultConn
+	taps        []*defaultConn // outlets created by NewDefaultConn
 }
 
-func (l *handlerList) append(h Handler) *handlerList {
-	newlist := make([]Handler, 0, len(l.hs)+1)
-	newlist = append(newlist, l.hs...)
-	newlist = append(newlist, h)
-	return &handlerList{newlist, l.defaultConn}
+type handlerEntry struct {
+	h        Handler
+	priority int
+	accepted *atomic.Uint64 // number of packets accepted by h
+}
+
+// insert adds h after all handlers with priority >= p.
+func (l *handlerList) insert(h Handler, p int) *handlerList {
+	i := 0
+	for i < len(l.hs) && l.hs[i].priority >= p {
+		i++
+	}
+	newlist := make([]handlerEntry, 0, len(l.hs)+1)
+	newlist = append(newlist, l.hs[:i]...)
+	newlist = append(newlist, handlerEntry{h, p, new(atomic.Uint64)})
+	newlist = append(newlist, l.hs[i:]...)
+	return &handlerList{newlist, l.defaultConn, l.taps}
 }
 
 func (l *handlerList) remove(h Handler) *handlerList {
 	for i := range l.hs {
-		if l.hs[i] == h {
+		if l.hs[i].h == h {
 			return l.removeIndex(i)
 		}
 	}
@@ -231,24 +527,45 @@ func (l *handlerList) remove(h Handler) *handlerList {
 }
 
 func (l *handlerList) removeIndex(i int) *handlerList {
-	newlist := make([]Handler, 0, len(l.hs)-1)
+	newlist := make([]handlerEntry, 0, len(l.hs)-1)
 	newlist = append(newlist, l.hs[:i]...)
 	newlist = append(newlist, l.hs[i+1:]...)
-	return &handlerList{newlist, l.defaultConn}
+	return &handlerList{newlist, l.defaultConn, l.taps}
 }
 
 func (l *handlerList) setDefault(dc *defaultConn) *handlerList {
-	return &handlerList{l.hs, dc}
+	return &handlerList{l.hs, dc, l.taps}
+}
+
+func (l *handlerList) addTap(dc *defaultConn) *handlerList {
+	newtaps := make([]*defaultConn, 0, len(l.taps)+1)
+	newtaps = append(newtaps, l.taps...)
+	newtaps = append(newtaps, dc)
+	return &handlerList{l.hs, l.defaultConn, newtaps}
+}
+
+func (l *handlerList) removeTap(dc *defaultConn) *handlerList {
+	newtaps := make([]*defaultConn, 0, len(l.taps))
+	for _, t := range l.taps {
+		if t != dc {
+			newtaps = append(newtaps, t)
+		}
+	}
+	return &handlerList{l.hs, l.defaultConn, newtaps}
 }
 
 // defaultConn is a net.PacketConn that relays unmatched incoming packets on Conn.
 type defaultConn struct {
-	conn         *Conn
-	in           chan *packet
-	readDeadline *time.Timer
-	mutex        sync.Mutex
-	buffers      []*packet
-	closed       bool
+	conn *Conn
+	in   chan *packet
+	done chan struct{} // closed by Close
+
+	mutex           sync.Mutex
+	buffers         []*packet
+	closed          bool
+	readDeadline    time.Time
+	readDeadlineSet chan struct{} // closed when readDeadline changes
+	writeDeadline   time.Time
 }
 
 type packet struct {
@@ -258,15 +575,19 @@ type packet struct {
 
 func newDefaultConn(c *Conn) *defaultConn {
 	return &defaultConn{
-		conn: c,
-		in:   make(chan *packet, 100),
+		conn:            c,
+		in:              make(chan *packet, 100),
+		done:            make(chan struct{}),
+		readDeadlineSet: make(chan struct{}),
 	}
 }
 
 // deliver delivers a packet to the application.
 func (dc *defaultConn) deliver(b []byte, addr *net.UDPAddr, quit chan struct{}) bool {
+	stats := &dc.conn.stats
 	p, ok := dc.getPacket()
 	if !ok {
+		stats.defaultDropped.Add(1)
 		return false // connection closed
 	}
 	p.b = append(p.b[:0], b...)
@@ -274,8 +595,22 @@ func (dc *defaultConn) deliver(b []byte, addr *net.UDPAddr, quit chan struct{})
 
 	select {
 	case dc.in <- p:
+		stats.deflt.Add(1)
+		return true
+	default:
+	}
+
+	// The queue is full, wait for the application to read.
+	stats.defaultBlocked.Add(1)
+	select {
+	case dc.in <- p:
+		stats.deflt.Add(1)
 	case <-quit:
+		stats.defaultDropped.Add(1)
 		dc.recyclePacket(p)
+	case <-dc.done:
+		stats.defaultDropped.Add(1)
+		return false
 	}
 	return true
 }
@@ -287,14 +622,17 @@ func (dc *defaultConn) LocalAddr() net.Addr {
 
 // Close closes the connection.
 // Note this also removes dc as the default outlet from the Conn.
+//
+// The packet queue is never closed because dispatch may still be sending on it.
+// Pending reads and sends are released through dc.done instead.
 func (dc *defaultConn) Close() error {
 	dc.mutex.Lock()
 	defer dc.mutex.Unlock()
 
 	if !dc.closed {
-		close(dc.in)
+		close(dc.done)
 		dc.closed = true
-		dc.conn.unsetDefaultConn()
+		dc.conn.removeDefaultConn(dc)
 	}
 	return nil
 }
@@ -307,51 +645,101 @@ func (dc *defaultConn) ReadFrom(b []byte) (int, net.Addr, error) {
 
 // ReadFromUDP reads a packet from the connection.
 func (dc *defaultConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
-	var timeout <-chan time.Time
-	if dc.readDeadline != nil {
-		timeout = dc.readDeadline.C
-	}
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
 
-	select {
-	case p, ok := <-dc.in:
-		if !ok {
+	for {
+		dc.mutex.Lock()
+		deadline, deadlineSet := dc.readDeadline, dc.readDeadlineSet
+		dc.mutex.Unlock()
+
+		// Check for close first, the queue may still hold packets.
+		select {
+		case <-dc.done:
 			return 0, nil, io.EOF
+		default:
+		}
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, dc.timeoutError()
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case <-dc.done:
+			return 0, nil, io.EOF
+		case p := <-dc.in:
+			n, addr := copy(b, p.b), p.addr
+			dc.recyclePacket(p) // p may be reused after this
+			return n, addr, nil
+		case <-timeout:
+			return 0, nil, dc.timeoutError()
+		case <-deadlineSet:
+			// The deadline was changed, start over.
 		}
-		n := copy(b, p.b)
-		dc.recyclePacket(p)
-		return n, p.addr, nil
-	case <-timeout:
-		dc.readDeadline = nil
-		// TODO: return net.OpError with timeout == true
-		return 0, nil, errors.New("timeout")
 	}
 }
 
-// SetReadDeadline sets the deadline of the next read.
+func (dc *defaultConn) timeoutError() error {
+	return &net.OpError{Op: "read", Net: "udp", Addr: dc.LocalAddr(), Err: os.ErrDeadlineExceeded}
+}
+
+// SetReadDeadline sets the deadline of reads. A zero value for t means reads
+// will not time out. Once the deadline has passed, reads time out immediately
+// until it is changed. Pending reads are affected as well.
 func (dc *defaultConn) SetReadDeadline(t time.Time) error {
-	if dc.readDeadline == nil {
-		dc.readDeadline = time.NewTimer(time.Now().Sub(t))
-	} else {
-		dc.readDeadline.Reset(t.Sub(time.Now()))
-	}
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	dc.readDeadline = t
+	close(dc.readDeadlineSet)
+	dc.readDeadlineSet = make(chan struct{})
 	return nil
 }
 
 // WriteTo writes a packet to the connection.
 func (dc *defaultConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if dc.writeDeadlinePassed() {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: os.ErrDeadlineExceeded}
+	}
 	return dc.conn.WriteTo(b, addr)
 }
 
 // WriteTo writes a packet to the connection.
 func (dc *defaultConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
-	return dc.conn.WriteTo(b, addr)
+	return dc.WriteTo(b, addr)
 }
 
-// SetWriteDeadline sets the deadline of the next write. Note that this affects the
-// underlying connection directly, i.e. other users of the SharedConn will be affected as
-// well.
+// SetWriteDeadline sets the deadline of writes. A zero value for t means writes
+// will not time out.
+//
+// The deadline only applies to writes through this connection, other users of the
+// underlying socket are not affected. Since writes on a UDP socket don't wait for
+// the remote end, the deadline is checked before each write.
 func (dc *defaultConn) SetWriteDeadline(t time.Time) error {
-	return dc.conn.conn.SetWriteDeadline(t)
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	dc.writeDeadline = t
+	return nil
+}
+
+func (dc *defaultConn) writeDeadlinePassed() bool {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	return !dc.writeDeadline.IsZero() && !time.Now().Before(dc.writeDeadline)
 }
 
 // SetDeadline sets the read and write deadline.
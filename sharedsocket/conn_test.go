@@ -3,8 +3,11 @@ package sharedsocket
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -127,6 +130,457 @@ func TestDefaultConnClose(t *testing.T) {
 	}
 }
 
+// This test checks that reads on the DefaultConn time out with a net.Error.
+func TestDefaultConnReadTimeout(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	dc := c1.DefaultConn()
+	start := time.Now()
+	dc.SetReadDeadline(start.Add(50 * time.Millisecond))
+	_, _, err = dc.ReadFrom(make([]byte, 1024))
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatal("read returned before deadline:", d)
+	}
+}
+
+// This test checks that the first read deadline is applied correctly.
+func TestDefaultConnReadDeadline(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	dc := c1.DefaultConn()
+	buf := make([]byte, 1024)
+
+	// A deadline one second in the future blocks the read for that long.
+	start := time.Now()
+	dc.SetReadDeadline(start.Add(1 * time.Second))
+	if _, _, err := dc.ReadFrom(buf); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if d := time.Since(start); d < 1*time.Second || d > 2*time.Second {
+		t.Fatal("wrong timeout duration:", d)
+	}
+
+	// A deadline in the past times out immediately.
+	start = time.Now()
+	dc.SetReadDeadline(start.Add(-1 * time.Second))
+	if _, _, err := dc.ReadFrom(buf); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("past deadline did not time out immediately:", d)
+	}
+}
+
+// This test checks that a passed read deadline keeps applying to later reads,
+// and that changing the deadline affects a pending read.
+func TestDefaultConnReadDeadlineSticky(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	dc := c1.DefaultConn()
+	buf := make([]byte, 1024)
+
+	dc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		_, _, err := dc.ReadFrom(buf)
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("read %d: expected timeout error, got %v", i, err)
+		}
+		if d := time.Since(start); i > 0 && d > 500*time.Millisecond {
+			t.Fatal("read after deadline did not time out immediately:", d)
+		}
+	}
+
+	// Clearing the deadline, then setting one while a read is pending.
+	dc.SetReadDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := dc.ReadFrom(buf)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dc.SetReadDeadline(time.Now())
+	select {
+	case err := <-errc:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatal("expected timeout error, got", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("pending read not affected by new deadline")
+	}
+}
+
+// This test checks that a write deadline on DefaultConn doesn't affect
+// writes through Conn.
+func TestDefaultConnWriteDeadline(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	addr := c1.LocalAddr()
+
+	dc := c1.DefaultConn()
+	dc.SetWriteDeadline(time.Now().Add(-1 * time.Second))
+	_, err = dc.WriteTo([]byte("x"), addr)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if _, err := c1.WriteTo([]byte("x"), addr); err != nil {
+		t.Fatal("write through Conn failed:", err)
+	}
+
+	dc.SetWriteDeadline(time.Time{})
+	if _, err := dc.WriteTo([]byte("x"), addr); err != nil {
+		t.Fatal("write after clearing deadline failed:", err)
+	}
+}
+
+// This test checks that packets larger than the read buffer are dropped and counted.
+func TestConnReadBufferSize(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := NewConnWithConfig(pc.(UDPConn), Config{ReadBufferSize: 4000})
+	defer c1.Close()
+
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	var received = make(chan int, 2)
+	c1.AddHandler(HandlerFunc(func(b []byte, from net.Addr) bool {
+		received <- len(b)
+		return true
+	}))
+
+	// send a packet larger than the default buffer size
+	if _, err := c2.WriteTo(make([]byte, 3000), c1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	timeout := 1 * time.Second
+	if err := tryRecv(received, 3000, timeout); err != nil {
+		t.Fatal("handler:", err)
+	}
+
+	// send a packet larger than the configured buffer size, then a small one
+	if _, err := c2.WriteTo(make([]byte, 5000), c1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.WriteTo(make([]byte, 10), c1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tryRecv(received, 10, timeout); err != nil {
+		t.Fatal("handler:", err)
+	}
+	if n := c1.Stats().Truncated; n != 1 {
+		t.Fatal("wrong truncated packet count", n)
+	}
+
+	// a negative size selects the default
+	pc3, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3 := NewConnWithConfig(pc3.(UDPConn), Config{ReadBufferSize: -1})
+	defer c3.Close()
+	if c3.bufferSize != DefaultReadBufferSize {
+		t.Fatal("wrong buffer size", c3.bufferSize)
+	}
+}
+
+// This test checks that handlers are called in priority order.
+func TestConnHandlerPriority(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	var (
+		order []string
+		done  = make(chan []string, 1)
+	)
+	handler := func(name string, last bool) Handler {
+		return HandlerFunc(func(b []byte, from net.Addr) bool {
+			order = append(order, name)
+			if last {
+				done <- order
+			}
+			return last
+		})
+	}
+	c1.AddHandler(handler("last", true))
+	c1.AddHandlerWithPriority(handler("high", false), 10)
+	c1.AddHandler(handler("unreached", false))
+	c1.AddHandlerWithPriority(handler("high2", false), 10)
+	c1.AddHandlerWithPriority(handler("highest", false), 20)
+
+	_, err = c2.WriteTo([]byte("x"), c1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"highest", "high", "high2", "last"}
+	if err := tryRecv(done, expected, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// This test checks that batched reads deliver every packet.
+func TestConnReadBatch(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := NewConnWithConfig(pc.(UDPConn), Config{ReadBatchSize: 8})
+	defer c1.Close()
+
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	const count = 20
+	var received = make(chan string, count)
+	c1.AddHandler(HandlerFunc(func(b []byte, from net.Addr) bool {
+		received <- fmt.Sprintf("%s from %v", b, from)
+		return true
+	}))
+
+	for i := 0; i < count; i++ {
+		msg := fmt.Sprintf("packet %d", i)
+		if _, err := c2.WriteTo([]byte(msg), c1.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		expected := fmt.Sprintf("packet %d from %v", i, c2.LocalAddr())
+		if err := tryRecv(received, expected, 1*time.Second); err != nil {
+			t.Fatal("handler:", err)
+		}
+	}
+}
+
+// This test checks the packet counters.
+func TestConnStats(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	var received = make(chan bool, 10)
+	handler1 := HandlerFunc(func(b []byte, from net.Addr) bool {
+		match := string(b) == "h1"
+		received <- match
+		return match
+	})
+	c1.AddHandler(handler1)
+	dc := c1.DefaultConn()
+
+	for _, msg := range []string{"h1", "h1", "other"} {
+		if _, err := c2.WriteTo([]byte(msg), c1.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if err := tryRecv(received, msg == "h1", 1*time.Second); err != nil {
+			t.Fatal("handler:", err)
+		}
+	}
+	if _, _, err := dc.ReadFrom(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without default outlet, the packet is counted as unmatched.
+	dc.Close()
+	if _, err := c2.WriteTo([]byte("other"), c1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tryRecv(received, false, 1*time.Second); err != nil {
+		t.Fatal("handler:", err)
+	}
+
+	st := c1.Stats()
+	if st.Packets != 4 || st.Bytes != 14 {
+		t.Errorf("wrong packet/byte counts: %d, %d", st.Packets, st.Bytes)
+	}
+	if len(st.Handlers) != 1 || st.Handlers[0].Accepted != 2 {
+		t.Errorf("wrong handler stats: %+v", st.Handlers)
+	}
+	if st.Default != 1 {
+		t.Errorf("wrong default outlet count: %d", st.Default)
+	}
+	// The unmatched packet is counted after the handler returns.
+	for i := 0; i < 10 && c1.Stats().Unmatched != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := c1.Stats().Unmatched; n != 1 {
+		t.Errorf("wrong unmatched count: %d", n)
+	}
+
+	// Check send counters.
+	if _, err := c1.WriteTo([]byte("hello"), c2.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if st := c1.Stats(); st.SentPackets != 1 || st.SentBytes != 5 {
+		t.Errorf("wrong sent packet/byte counts: %d, %d", st.SentPackets, st.SentBytes)
+	}
+}
+
+// This test checks that unmatched packets are delivered to all default outlets.
+func TestDefaultConnFanOut(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	var (
+		dcread  = make(chan readEvent, 3)
+		outlets = []UDPConn{c1.DefaultConn(), c1.NewDefaultConn(), c1.NewDefaultConn()}
+	)
+	for _, dc := range outlets {
+		go func(dc UDPConn) {
+			msg := make([]byte, 1024)
+			n, addr, err := dc.ReadFrom(msg)
+			dcread <- readEvent{msg[:n], addr, err}
+		}(dc)
+	}
+
+	_, err = c2.WriteTo([]byte("other"), c1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEv := readEvent{[]byte("other"), c2.LocalAddr(), nil}
+	for range outlets {
+		if err := tryRecv(dcread, expectedEv, 1*time.Second); err != nil {
+			t.Fatal("default conn:", err)
+		}
+	}
+
+	// Closing an outlet removes it, the others keep working.
+	outlets[1].Close()
+	go func() {
+		msg := make([]byte, 1024)
+		n, addr, err := outlets[2].ReadFrom(msg)
+		dcread <- readEvent{msg[:n], addr, err}
+	}()
+	_, err = c2.WriteTo([]byte("other"), c1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tryRecv(dcread, expectedEv, 1*time.Second); err != nil {
+		t.Fatal("default conn:", err)
+	}
+}
+
+// This test checks that closing an outlet while dispatch is blocked on its full
+// queue releases the dispatcher.
+func TestDefaultConnCloseBlocked(t *testing.T) {
+	c, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 3}
+	dc := c.NewDefaultConn()
+	for i := 0; i < cap(dc.(*defaultConn).in); i++ {
+		if err := c.Deliver([]byte("fill"), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// This delivery blocks because the queue is full.
+	delivered := make(chan error, 1)
+	go func() { delivered <- c.Deliver([]byte("blocked"), addr) }()
+	time.Sleep(50 * time.Millisecond)
+	dc.Close()
+
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Fatal("deliver error:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("dispatch still blocked after outlet was closed")
+	}
+	if _, _, err := dc.ReadFrom(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("wrong read error after close: %v", err)
+	}
+}
+
+type closingHandler struct {
+	Handler
+	closed chan bool
+}
+
+func (h *closingHandler) OnSocketClosed() {
+	h.closed <- true
+}
+
+// This test checks that handlers are notified when the Conn is closed.
+func TestConnCloseNotify(t *testing.T) {
+	c1, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &closingHandler{
+		Handler: HandlerFunc(func(b []byte, from net.Addr) bool { return false }),
+		closed:  make(chan bool, 2),
+	}
+	c1.AddHandler(h)
+	c1.Close()
+	c1.Close()
+
+	if err := tryRecv(h.closed, true, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.closed:
+		t.Fatal("OnSocketClosed called twice")
+	default:
+	}
+}
+
 type readEvent struct {
 	data []byte
 	from net.Addr
@@ -146,3 +600,157 @@ func tryRecv[T any](ch <-chan T, expected T, timeout time.Duration) error {
 		return errors.New("receive timeout")
 	}
 }
+
+// This test checks that packets injected with Deliver are dispatched to the
+// handlers, and that handlers re-injecting packets can't loop forever.
+func TestConnDeliver(t *testing.T) {
+	c, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var (
+		addr    = &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 3}
+		inner   = make(chan string, 1)
+		loops   int
+		loopErr error
+	)
+	// The tunnel handler decapsulates packets starting with "T".
+	c.AddHandlerWithPriority(HandlerFunc(func(b []byte, from net.Addr) bool {
+		if len(b) == 0 || b[0] != 'T' {
+			return false
+		}
+		if err := c.Deliver(b[1:], from.(*net.UDPAddr)); err != nil {
+			t.Error("deliver error:", err)
+		}
+		return true
+	}), 1)
+	// The loop handler re-injects packets indefinitely.
+	c.AddHandler(HandlerFunc(func(b []byte, from net.Addr) bool {
+		if string(b) != "loop" {
+			return false
+		}
+		loops++
+		if err := c.Deliver(b, from.(*net.UDPAddr)); err != nil {
+			loopErr = err
+		}
+		return true
+	}))
+	c.AddHandler(HandlerFunc(func(b []byte, from net.Addr) bool {
+		if from.String() != addr.String() {
+			t.Errorf("wrong source address %v", from)
+		}
+		inner <- string(b)
+		return true
+	}))
+
+	if err := c.Deliver([]byte("TTinner"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-inner; msg != "inner" {
+		t.Fatalf("wrong packet %q", msg)
+	}
+	if n := c.Stats().Delivered; n != 3 {
+		t.Errorf("wrong delivered count %d", n)
+	}
+
+	if err := c.Deliver([]byte("loop"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if loops != MaxDeliverDepth || loopErr != ErrDeliverDepth {
+		t.Fatalf("wrong loop result: %d calls, err %v", loops, loopErr)
+	}
+
+	c.Close()
+	if err := c.Deliver([]byte("x"), addr); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("wrong error after close: %v", err)
+	}
+}
+
+// This test checks that concurrent Deliver calls which aren't nested don't
+// count against the depth limit.
+func TestConnDeliverConcurrent(t *testing.T) {
+	c, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The handler waits until all calls are running.
+	const n = 2 * MaxDeliverDepth
+	var entered sync.WaitGroup
+	entered.Add(n)
+	c.AddHandler(HandlerFunc(func(b []byte, from net.Addr) bool {
+		entered.Done()
+		entered.Wait()
+		return true
+	}))
+
+	var (
+		addr = &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 3}
+		errc = make(chan error, n)
+	)
+	for i := 0; i < n; i++ {
+		go func() {
+			err := c.Deliver([]byte("relay"), addr)
+			if err != nil {
+				entered.Done()
+			}
+			errc <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Error("deliver error:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for Deliver")
+		}
+	}
+}
+
+func TestConnSyscallConn(t *testing.T) {
+	var controlled bool
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			controlled = true
+			return nil
+		},
+	}
+	c, err := ListenWithConfig("udp", "127.0.0.1:0", lc, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !controlled {
+		t.Fatal("Control function not called")
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal("SyscallConn error:", err)
+	}
+	if err := rc.Control(func(fd uintptr) {}); err != nil {
+		t.Fatal("Control error:", err)
+	}
+	if err := c.SetReadBuffer(1 << 20); err != nil {
+		t.Fatal("SetReadBuffer error:", err)
+	}
+
+	// Sockets without access to the file descriptor are reported.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := NewConn(struct{ UDPConn }{pc.(UDPConn)})
+	defer wrapped.Close()
+	if _, err := wrapped.SyscallConn(); err != ErrNoSyscallConn {
+		t.Fatal("wrong SyscallConn error:", err)
+	}
+	if err := wrapped.SetReadBuffer(1 << 20); err != ErrNoSyscallConn {
+		t.Fatal("wrong SetReadBuffer error:", err)
+	}
+}
@@ -1,8 +1,6 @@
 package utpconn
 
 import (
-	"context"
-	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -21,6 +19,7 @@ type Conn struct {
 	recv_id, send_id uint16
 	seq_nr, ack_nr   uint16
 	lastAck          uint16
+	dupAcks          int // number of duplicate acks of lastAck, see checkDuplicateAck
 	lastTimeDiff     uint32
 	peerWndSize      uint32
 	cur_window       uint32
@@ -40,6 +39,7 @@ type Conn struct {
 	// When the conn was allocated.
 	created time.Time
 
+	initiator bool // Conn was created by Socket.Dial
 	synAcked  bool // Syn is acked by the acceptor. Initiator also tracks it.
 	gotFin    missinggo.Event
 	wroteFin  missinggo.Event
@@ -54,7 +54,13 @@ type Conn struct {
 	inbound    []recv
 	inboundWnd int
 	connDeadlines
-	latencies []time.Duration
+
+	// Round-trip time estimate, see addLatency.
+	srtt, rttvar time.Duration
+	rto          time.Duration
+
+	// The receive window was too small for a full packet, see updateWindow.
+	windowFull bool
 
 	// We need to send state packet.
 	pendingSendState              bool
@@ -67,36 +73,66 @@ type Conn struct {
 	// This timer fires when no packet has been received for a period.
 	packetReadTimeoutTimer *time.Timer
 
+	// This timer sends keepalive packets, see WithKeepAlive.
+	keepAliveTimer *time.Timer
+
+	// Data written but not sent yet, see WithWriteDelay.
+	writeBuf        []byte
+	flushTimer      *time.Timer
+	flushTimerArmed bool
+
+	// Called when the Conn is destroyed, with mu held.
+	onDestroy func()
+
 	mu sync.Mutex
 }
 
 type WriteFunc func([]byte, net.Addr) (int, error)
 
+// NewConn creates a connection to remoteAddr. Outgoing packets are sent using the write
+// function, and incoming packets must be passed to PacketIn. The connection is assumed
+// to be established already, i.e. no SYN is sent. Both ends must be created with
+// NewConn.
 func NewConn(localAddr net.Addr, remoteAddr net.Addr, write WriteFunc, opt ...SocketOption) *Conn {
-	config := defaultSocketConfig()
-	for _, o := range opt {
-		o(&config)
-	}
+	config := newSocketConfig(opt)
+	c := newConn(localAddr, remoteAddr, write, &config)
+
+	// Pretend that Syn/Ack have already happened. Both ends start at the
+	// same sequence number.
+	c.synAcked = true
+	c.updateCanWrite()
+	c.seq_nr = config.firstSeqNr(1)
+	c.lastAck = c.seq_nr - 1
+	c.ack_nr = c.seq_nr - 1
+
+	c.startKeepAlive()
+	return c
+}
+
+func newConn(localAddr net.Addr, remoteAddr net.Addr, write WriteFunc, config *socketConfig) *Conn {
 	c := &Conn{
 		writeToFunc:      write,
 		localAddr:        localAddr,
 		remoteSocketAddr: remoteAddr,
-		config:           &config,
+		config:           config,
 		created:          time.Now(),
 	}
+	c.connDeadlines.init(&c.mu)
 	c.startTimestamp = nowTimestamp()
 	c.sendPendingSendSendStateTimer = missinggo.StoppedFuncTimer(c.sendPendingSendStateTimerCallback)
 	c.packetReadTimeoutTimer = time.AfterFunc(config.packetReadTimeout, c.receivePacketTimeoutCallback)
-
-	// Pretend that Syn/Ack have already happened.
-	c.synAcked = true
-	c.updateCanWrite()
-	c.lastAck = 0
-	c.ack_nr = 0
-	c.seq_nr = 1
 	return c
 }
 
+// startKeepAlive starts the keepalive timer, if enabled. This must be called
+// after the Conn is fully initialized.
+func (c *Conn) startKeepAlive() {
+	if c.config.keepAlive > 0 {
+		c.keepAliveTimer = missinggo.StoppedFuncTimer(c.keepAliveCallback)
+		c.keepAliveTimer.Reset(c.config.keepAlive)
+	}
+}
+
 func (c *Conn) age() time.Duration {
 	return time.Since(c.created)
 }
@@ -125,15 +161,15 @@ func (c *Conn) sendPendingState() {
 // So far as the spec makes clear, this is how many more, as-yet-unacked bytes
 // we can fit into our receive buffers.
 func (c *Conn) wndSize() uint32 {
-	if len(c.readBuf)+c.inboundWnd > readBufferLen {
+	if len(c.readBuf)+c.inboundWnd > c.config.readBuffer {
 		return 0
 	}
-	return uint32(readBufferLen - len(c.readBuf) - c.inboundWnd)
+	return uint32(c.config.readBuffer - len(c.readBuf) - c.inboundWnd)
 }
 
 func (c *Conn) makePacket(_type st, connID, seqNr uint16, payload []byte) (p []byte) {
 	var selAck selectiveAckBitmask
-	for i := 1; i < len(c.inbound); i++ {
+	for i := 1; i < len(c.inbound) && i <= maxSelectiveAckBits; i++ {
 		if c.inbound[i].seen {
 			selAck.SetBit(i - 1)
 		}
@@ -181,10 +217,12 @@ func (c *Conn) send(_type st, connID uint16, payload []byte, seqNr uint16) (err
 	if n1 != len(p) {
 		panic(n1)
 	}
+	telemIncr(c.config.bgCtx, "sentPackets", int(1), units.None)
+	telemIncr(c.config.bgCtx, "sentBytes", n1, units.Bytes)
 	if c.unpendSendState() && _type != stState {
 		// We needed to send a state packet, but this packet suppresses that
 		// need.
-		telemIncr(context.TODO(), "unsentStatePackets", int(1), units.None)
+		telemIncr(c.config.bgCtx, "unsentStatePackets", int(1), units.None)
 	}
 	return
 }
@@ -201,7 +239,7 @@ func (c *Conn) pendSendState() {
 	if c.pendingSendState {
 		// A state packet is pending but hasn't been sent, and we want to send
 		// another.
-		telemIncr(context.TODO(), "unsentStatePackets", int(1), units.None)
+		telemIncr(c.config.bgCtx, "unsentStatePackets", int(1), units.None)
 	}
 	c.pendingSendState = true
 	if !c.sendPendingSendStateTimerActive {
@@ -224,8 +262,8 @@ func (c *Conn) write(_type st, connID uint16, payload []byte, seqNr uint16) (n i
 	if c.wroteFin.IsSet() {
 		panic("can't write after fin")
 	}
-	if len(payload) > maxPayloadSize {
-		payload = payload[:maxPayloadSize]
+	if maxPayload := c.maxPayloadSize(); len(payload) > maxPayload {
+		payload = payload[:maxPayload]
 	}
 	err = c.send(_type, connID, payload, seqNr)
 	if err != nil {
@@ -254,38 +292,41 @@ func (c *Conn) write(_type st, connID uint16, payload []byte, seqNr uint16) (n i
 	return
 }
 
-// TODO: Introduce a minimum latency.
-func (c *Conn) latency() (ret time.Duration) {
-	if len(c.latencies) == 0 {
-		return c.config.initialLatency
-	}
-	for _, l := range c.latencies {
-		ret += l
-	}
-	ret = (ret + time.Duration(len(c.latencies)) - 1) / time.Duration(len(c.latencies))
-	return
-}
-
 func (c *Conn) sendState() {
 	c.send(stState, c.send_id, nil, c.seq_nr)
 
-	telemIncr(context.TODO(), "sentStatePackets", int(1), units.None)
+	telemIncr(c.config.bgCtx, "sentStatePackets", int(1), units.None)
 }
 
 func (c *Conn) sendReset() {
 	c.send(stReset, c.send_id, nil, c.seq_nr)
 }
 
+// addLatency updates the RTT estimate with a new sample, as described in RFC 6298.
 func (c *Conn) addLatency(l time.Duration) {
-	c.latencies = append(c.latencies, l)
-	if len(c.latencies) > 10 {
-		c.latencies = c.latencies[len(c.latencies)-10:]
+	if c.srtt == 0 {
+		c.srtt = l
+		c.rttvar = l / 2
+	} else {
+		delta := c.srtt - l
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + l) / 8
+	}
+	rto := c.srtt + 4*c.rttvar
+	if rto < minResendTimeout {
+		rto = minResendTimeout
+	} else if rto > maxResendTimeout {
+		rto = maxResendTimeout
 	}
+	c.rto = rto
 }
 
 // Ack our send with the given sequence number.
 func (c *Conn) ack(nr uint16) {
-	ctx := context.TODO()
+	ctx := c.config.bgCtx
 	if !seqLess(c.lastAck, nr) {
 		// Already acked.
 		return
@@ -293,16 +334,21 @@ func (c *Conn) ack(nr uint16) {
 	i := nr - c.lastAck - 1
 	if int(i) >= len(c.unackedSends) {
 		// Remote has acknowledged receipt of packets we haven't even sent.
-		telemIncr(context.TODO(), "acksReceivedAheadOfSyn", int(1), units.None)
+		telemIncr(ctx, "acksReceivedAheadOfSyn", int(1), units.None)
 		logctx.Debugf(ctx, "got ack ahead of syn (%x > %x)", nr, c.seq_nr-1)
 		return
 	}
 	s := c.unackedSends[i]
 	latency, first := s.Ack()
 	if first {
+		telemIncr(ctx, "ackedPackets", int(1), units.None)
 		c.cur_window -= s.payloadSize
 		c.updateCanWrite()
-		c.addLatency(latency)
+		// Following Karn's algorithm, resent packets are not used for RTT
+		// estimation because it's unknown which transmission was acked.
+		if !s.resent {
+			c.addLatency(latency)
+		}
 	}
 	// Trim sends that aren't needed anymore.
 	for len(c.unackedSends) != 0 {
@@ -341,10 +387,61 @@ func (c *Conn) seqSend(seqNr uint16) *send {
 	return c.unackedSends[i]
 }
 
+// maxPayloadSize returns the maximum payload size of data packets.
+func (c *Conn) maxPayloadSize() int {
+	return c.config.mtu - maxHeaderSize
+}
+
+// resendTimeout returns the current retransmission timeout. Before any RTT has been
+// measured, it is derived from the configured initial latency.
 func (c *Conn) resendTimeout() time.Duration {
-	l := c.latency()
-	ret := missinggo.JitterDuration(3*l, l)
-	return ret
+	if c.rto == 0 {
+		return 3 * c.config.initialLatency
+	}
+	return c.rto
+}
+
+// ConnStats contains statistics of a Conn.
+type ConnStats struct {
+	SmoothedRTT   time.Duration // zero until the first RTT sample
+	RTTVariance   time.Duration
+	ResendTimeout time.Duration
+
+	// Sequence numbers. SeqNr is the number of the next packet sent, LastAck
+	// is the highest sent packet acknowledged by the peer, and AckNr is the
+	// highest packet received in order.
+	SeqNr   uint16
+	LastAck uint16
+	AckNr   uint16
+	Unacked int // number of sent packets waiting for acknowledgement
+}
+
+// Stats returns the current connection statistics.
+func (c *Conn) Stats() ConnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ConnStats{
+		SmoothedRTT:   c.srtt,
+		RTTVariance:   c.rttvar,
+		ResendTimeout: c.resendTimeout(),
+		SeqNr:         c.seq_nr,
+		LastAck:       c.lastAck,
+		AckNr:         c.ack_nr,
+		Unacked:       len(c.unackedSends),
+	}
+}
+
+// ConnIDs returns the connection IDs. Packets sent by the peer carry recvID in
+// their header, packets sent by c carry sendID. For connections created by
+// NewConn, both IDs are zero.
+func (c *Conn) ConnIDs() (recvID, sendID uint16) {
+	return c.recv_id, c.send_id
+}
+
+// IsInitiator reports whether the connection was created by Socket.Dial.
+func (c *Conn) IsInitiator() bool {
+	return c.initiator
 }
 
 func (c *Conn) ackSkipped(seqNr uint16) {
@@ -358,28 +455,66 @@ func (c *Conn) ackSkipped(seqNr uint16) {
 	}
 	switch send.acksSkipped {
 	case 3, 60:
-		telemIncr(context.TODO(), "ackSkippedResends", int(1), units.None)
+		telemIncr(c.config.bgCtx, "ackSkippedResends", int(1), units.None)
 		send.resend()
-		send.resendTimer.Reset(c.resendTimeout() * time.Duration(send.numResends))
+		send.resendTimer.Reset(c.resendTimeout() * time.Duration(send.numResends+1))
 	default:
 	}
 }
 
+// checkDuplicateAck implements fast retransmit for peers that don't send
+// selective ACKs. When state packets acknowledge the same sequence number
+// dupAckThreshold times in a row while data is outstanding, the packet after it
+// is presumed lost and resent without waiting for the resend timer.
+func (c *Conn) checkDuplicateAck(h header) {
+	if h.AckNr != c.lastAck {
+		c.dupAcks = 0
+		return
+	}
+	if h.Type != stState || len(c.unackedSends) == 0 || h.hasSelectiveAck() {
+		return
+	}
+	c.dupAcks++
+	if c.dupAcks != dupAckThreshold {
+		return
+	}
+	send := c.seqSend(h.AckNr + 1)
+	if send == nil || send.acked.IsSet() {
+		return
+	}
+	telemIncr(c.config.bgCtx, "dupAckResends", int(1), units.None)
+	send.resend()
+	send.resendTimer.Reset(c.resendTimeout() * time.Duration(send.numResends+1))
+}
+
 // Handle a packet destined for this connection.
 func (c *Conn) receivePacket(h header, payload []byte) {
 	c.packetReadTimeoutTimer.Reset(c.config.packetReadTimeout)
+	telemIncr(c.config.bgCtx, "receivedPackets", int(1), units.None)
+	telemIncr(c.config.bgCtx, "receivedBytes", len(payload), units.Bytes)
 	c.processDelivery(h, payload)
 }
 
 func (c *Conn) receivePacketTimeoutCallback() {
 	c.mu.Lock()
-	c.destroy(errors.New("no packet read timeout"))
+	c.destroy(ErrTimeout{Msg: "no packet received"})
 	c.mu.Unlock()
 }
 
+func (c *Conn) keepAliveCallback() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.IsSet() || c.destroyed.IsSet() {
+		return
+	}
+	c.sendState()
+	c.keepAliveTimer.Reset(c.config.keepAlive)
+}
+
 func (c *Conn) lazyDestroy() {
 	if c.wroteFin.IsSet() && len(c.unackedSends) <= 1 && (c.gotFin.IsSet() || c.closed.IsSet()) {
-		c.destroy(errors.New("lazily destroyed"))
+		c.destroy(ErrClosed)
 	}
 }
 
@@ -396,14 +531,16 @@ func (c *Conn) PacketIn(payload []byte) {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.processDelivery(h, payload)
+	c.receivePacket(h, payload)
 }
 
 func (c *Conn) processDelivery(h header, payload []byte) {
-	telemIncr(context.TODO(), "deliveriesProcessed", int(1), units.None)
+	telemIncr(c.config.bgCtx, "deliveriesProcessed", int(1), units.None)
 	defer c.lazyDestroy()
 
-	c.assertHeader(h)
+	if !c.checkHeader(h) {
+		return
+	}
 	c.peerWndSize = h.WndSize
 	c.applyAcks(h)
 	if h.Timestamp == 0 {
@@ -413,7 +550,7 @@ func (c *Conn) processDelivery(h header, payload []byte) {
 	}
 
 	if h.Type == stReset {
-		c.destroy(errors.New("peer reset"))
+		c.destroy(ErrConnReset)
 		return
 	}
 	if !c.synAcked {
@@ -443,31 +580,51 @@ func (c *Conn) processDelivery(h header, payload []byte) {
 	// Derived from running in production:
 	// grep -oP '(?<=packet out of order, index=)\d+' log | sort -n | uniq -c
 	// 64 should correspond to 8 bytes of selective ack.
-	if inboundIndex >= maxUnackedInbound {
+	if inboundIndex >= c.config.recvWindow {
 		// Discard packet too far ahead.
-		logctx.Debugf(context.TODO(), "received packet from %s %d ahead of next seqnr (%x > %x)", c.remoteSocketAddr, inboundIndex, h.SeqNr, c.ack_nr+1)
+		logctx.Debugf(c.config.bgCtx, "received packet from %s %d ahead of next seqnr (%x > %x)", c.remoteSocketAddr, inboundIndex, h.SeqNr, c.ack_nr+1)
+		return
+	}
+	// Enforce the receive window. The next expected packet is accepted while
+	// the buffer isn't over the limit, so the connection can make progress even
+	// if the buffer is full of out-of-order packets.
+	buffered := len(c.readBuf) + c.inboundWnd
+	if buffered+len(payload) > c.config.readBuffer && (inboundIndex > 0 || buffered > c.config.readBuffer) {
+		c.windowFull = true
 		return
 	}
 	// Extend inbound so the new packet has a place.
 	for inboundIndex >= len(c.inbound) {
 		c.inbound = append(c.inbound, recv{})
 	}
+	// The payload is retained if it can't be consumed right away. Copy it,
+	// because the caller of PacketIn may reuse the buffer.
+	if inboundIndex > 0 || len(c.readBuf) >= c.config.readBuffer {
+		payload = append([]byte(nil), payload...)
+	}
 	c.inbound[inboundIndex] = recv{true, payload, h.Type}
 	c.inboundWnd += len(payload)
 	c.processInbound()
+	if c.wndSize() < uint32(c.config.mtu) {
+		c.windowFull = true
+	}
 }
 
 func (c *Conn) applyAcks(h header) {
+	c.checkDuplicateAck(h)
 	c.ackTo(h.AckNr)
 	for _, ext := range h.Extensions {
 		switch ext.Type {
 		case extensionTypeSelectiveAck:
 			c.ackSkipped(h.AckNr + 1)
 			bitmask := selectiveAckBitmask{ext.Bytes}
-			for i := 0; i < bitmask.NumBits(); i++ {
+			// The bitmask is padded to a multiple of 32 bits. Bits after the
+			// last set bit are packets the receiver hasn't seen yet, which
+			// doesn't mean they were skipped.
+			for i := 0; i <= bitmask.LastSetBit(); i++ {
 				if bitmask.BitIsSet(i) {
 					nr := h.AckNr + 2 + uint16(i)
-					logctx.Debugf(context.TODO(), "selectively acked %d", nr)
+					logctx.Debugf(c.config.bgCtx, "selectively acked %d", nr)
 					c.ack(nr)
 				} else {
 					c.ackSkipped(h.AckNr + 2 + uint16(i))
@@ -477,15 +634,25 @@ func (c *Conn) applyAcks(h header) {
 	}
 }
 
-func (c *Conn) assertHeader(h header) {
+// checkHeader reports whether the connection ID of h belongs to c.
+func (c *Conn) checkHeader(h header) bool {
+	want := c.recv_id
 	if h.Type == stSyn {
-		if h.ConnID != c.send_id {
-			panic(fmt.Sprintf("%d != %d", h.ConnID, c.send_id))
-		}
-	} else {
-		if h.ConnID != c.recv_id {
-			panic("erroneous delivery")
-		}
+		want = c.send_id
+	}
+	if h.ConnID != want {
+		logctx.Debugf(c.config.bgCtx, "dropping %v packet from %s with wrong conn ID (%d != %d)", h.Type, c.remoteSocketAddr, h.ConnID, want)
+		return false
+	}
+	return true
+}
+
+// updateWindow tells the sender about free buffer space after a read, if the
+// receive window was too small to send a full packet.
+func (c *Conn) updateWindow() {
+	if c.windowFull && c.wndSize() >= uint32(c.config.mtu) {
+		c.windowFull = false
+		c.pendSendState()
 	}
 }
 
@@ -495,7 +662,7 @@ func (c *Conn) updateReadBufNotEmpty() {
 
 func (c *Conn) processInbound() {
 	// Consume consecutive next packets.
-	for !c.gotFin.IsSet() && len(c.inbound) > 0 && c.inbound[0].seen && len(c.readBuf) < readBufferLen {
+	for !c.gotFin.IsSet() && len(c.inbound) > 0 && c.inbound[0].seen && len(c.readBuf) < c.config.readBuffer {
 		c.ack_nr++
 		p := c.inbound[0]
 		c.inbound = c.inbound[1:]
@@ -522,7 +689,8 @@ func (c *Conn) recvSynAck() (err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.waitAck(1)
+	// The SYN is the only packet sent so far.
+	c.waitAck(c.seq_nr - 1)
 	if c.err != nil {
 		err = c.err
 	}
@@ -541,27 +709,72 @@ func (c *Conn) writeFin() {
 }
 
 func (c *Conn) destroy(reason error) {
+	if !c.destroyed.IsSet() && c.onDestroy != nil {
+		defer c.onDestroy()
+	}
 	c.destroyed.Set()
 	if c.err == nil {
 		c.err = reason
 	}
 }
 
-func (c *Conn) closeNow() (err error) {
+// Close closes the connection. Buffered data is sent, followed by a FIN packet,
+// and Close blocks until the remote end has acknowledged all sent data. If that
+// doesn't happen within the write timeout, or the connection fails in another
+// way, Close returns the error of the connection.
+//
+// The acknowledgement of the FIN packet itself isn't awaited, because the
+// remote end may tear down its side of the connection as soon as it has
+// received the FIN.
+//
+// Use Abort to close the connection without waiting.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.closed.Set()
+	c.flushWriteBuf()
 	c.writeFin()
-	c.destroy(errors.New("destroyed"))
-	return
+	c.lazyDestroy()
+	for !c.destroyed.IsSet() {
+		missinggo.WaitEvents(&c.mu, &c.destroyed)
+	}
+	// The FIN may still be unacknowledged, see lazyDestroy.
+	if len(c.unackedSends) > 1 {
+		return c.err
+	}
+	return nil
 }
 
-func (c *Conn) Close() (err error) {
+// Abort closes the connection immediately. Unacknowledged data is discarded,
+// and the remote end is told to reset the connection.
+func (c *Conn) Abort() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.destroyed.IsSet() {
+		return
+	}
 	c.closed.Set()
+	c.sendReset()
+	c.destroy(ErrClosed)
+}
+
+// CloseWrite shuts down the writing side of the connection. Buffered data is
+// sent, followed by a FIN packet. After receiving the FIN, the remote end gets
+// io.EOF from Read, but can still write. Reading from c continues to work until
+// the remote end closes its writing side.
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.IsSet() {
+		return ErrClosed
+	}
+	c.flushWriteBuf()
 	c.writeFin()
 	c.lazyDestroy()
-	return
+	return nil
 }
 
 func (c *Conn) LocalAddr() net.Addr {
@@ -579,6 +792,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		if n != 0 {
 			// Inbound packets are backed up when the read buffer is too big.
 			c.processInbound()
+			c.updateWindow()
 			return
 		}
 		if c.gotFin.IsSet() || c.closed.IsSet() {
@@ -615,7 +829,7 @@ func (c *Conn) String() string {
 
 func (c *Conn) updateCanWrite() {
 	c.canWrite.SetBool(c.synAcked &&
-		len(c.unackedSends) < maxUnackedSends &&
+		len(c.unackedSends) < c.config.sendWindow &&
 		c.cur_window <= c.peerWndSize)
 }
 
@@ -623,6 +837,10 @@ func (c *Conn) Write(p []byte) (n int, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.config.writeDelay > 0 {
+		return c.writeBuffered(p)
+	}
+
 	for len(p) != 0 {
 		if c.wroteFin.IsSet() || c.closed.IsSet() {
 			err = ErrClosed
@@ -0,0 +1,638 @@
+package utpconn
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/stdctx/telctx"
+	"github.com/brendoncarroll/stdctx/units"
+)
+
+// connPair creates two connected Conns on a lossless network.
+func connPair(opt ...SocketOption) (*Conn, *Conn) {
+	return NewSimNet(0).Pair(opt...)
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	c1, c2 := connPair()
+	defer c1.Close()
+	defer c2.Close()
+
+	start := time.Now()
+	c2.SetReadDeadline(start.Add(100 * time.Millisecond))
+	_, err := c2.Read(make([]byte, 10))
+	if !IsTimeout(err) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatal("read returned before deadline:", d)
+	}
+
+	// Clearing the deadline makes reads work again.
+	c2.SetReadDeadline(time.Time{})
+	if _, err := c1.Write([]byte("hello")); err != nil {
+		t.Fatal("write error:", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("wrong data %q", buf)
+	}
+}
+
+func TestConnWindowSize(t *testing.T) {
+	c1, c2 := connPair(
+		WithConnOption(WithSendWindow(1024)),
+		WithConnOption(WithRecvWindow(1024)),
+	)
+	defer c1.Close()
+	defer c2.Close()
+
+	if c1.config.sendWindow != 1024 || c1.config.recvWindow != 1024 {
+		t.Fatal("window options not applied")
+	}
+
+	data := make([]byte, 2<<20)
+	rand.Read(data)
+	go func() {
+		c1.Write(data)
+	}()
+	received := make([]byte, len(data))
+	c2.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(c2, received); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+}
+
+func TestConnWindowClamp(t *testing.T) {
+	c, c2 := connPair(
+		WithConnOption(WithSendWindow(0)),
+		WithConnOption(WithRecvWindow(1<<20)),
+	)
+	defer c.Close()
+	defer c2.Close()
+	if c.config.sendWindow != 1 {
+		t.Error("wrong send window", c.config.sendWindow)
+	}
+	if c.config.recvWindow != maxWindow {
+		t.Error("wrong receive window", c.config.recvWindow)
+	}
+}
+
+func TestConnWriteDelay(t *testing.T) {
+	var packets int
+	c1, c2 := connPair(WithConnOption(WithWriteDelay(50 * time.Millisecond)))
+	defer c1.Close()
+	defer c2.Close()
+	countPackets := c1.writeToFunc
+	c1.writeToFunc = func(b []byte, addr net.Addr) (int, error) {
+		packets++ // called with c1.mu held
+		return countPackets(b, addr)
+	}
+
+	// Small writes are coalesced into a single packet.
+	for i := 0; i < 10; i++ {
+		if _, err := c1.Write([]byte("0123456789")); err != nil {
+			t.Fatal("write error:", err)
+		}
+	}
+	c1.mu.Lock()
+	if packets != 0 {
+		t.Errorf("%d packets sent before delay expired", packets)
+	}
+	c1.mu.Unlock()
+
+	buf := make([]byte, 100)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(buf, bytes.Repeat([]byte("0123456789"), 10)) {
+		t.Fatalf("wrong data %q", buf)
+	}
+	c1.mu.Lock()
+	if packets != 1 {
+		t.Errorf("%d packets sent, want 1", packets)
+	}
+	c1.mu.Unlock()
+
+	// Flush sends immediately.
+	c1.Write([]byte("flush"))
+	c1.Flush()
+	c2.SetReadDeadline(time.Now().Add(40 * time.Millisecond))
+	if _, err := io.ReadFull(c2, buf[:5]); err != nil {
+		t.Fatal("read error after flush:", err)
+	}
+}
+
+func TestConnResendTimeout(t *testing.T) {
+	for _, test := range []struct {
+		rtt time.Duration
+		min time.Duration
+		max time.Duration
+	}{
+		{5 * time.Millisecond, minResendTimeout, minResendTimeout},
+		{300 * time.Millisecond, 300 * time.Millisecond, 400 * time.Millisecond},
+	} {
+		c, c2 := connPair()
+		if rto := c.resendTimeout(); rto != 3*c.config.initialLatency {
+			t.Fatal("wrong initial resend timeout", rto)
+		}
+		for i := 0; i < 20; i++ {
+			c.addLatency(test.rtt)
+		}
+		st := c.Stats()
+		if st.SmoothedRTT != test.rtt {
+			t.Errorf("rtt %v: wrong smoothed RTT %v", test.rtt, st.SmoothedRTT)
+		}
+		if st.ResendTimeout < test.min || st.ResendTimeout > test.max {
+			t.Errorf("rtt %v: resend timeout %v not in range [%v, %v]", test.rtt, st.ResendTimeout, test.min, test.max)
+		}
+		c.Close()
+		c2.Close()
+	}
+}
+
+func TestConnMTU(t *testing.T) {
+	var maxSize int
+	c1, c2 := connPair(WithConnOption(WithMTU(1000)))
+	defer c1.Close()
+	defer c2.Close()
+	write := c1.writeToFunc
+	c1.writeToFunc = func(b []byte, addr net.Addr) (int, error) {
+		if len(b) > maxSize {
+			maxSize = len(b) // called with c1.mu held
+		}
+		return write(b, addr)
+	}
+
+	data := make([]byte, 20000)
+	rand.Read(data)
+	go c1.Write(data)
+	received := make([]byte, len(data))
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, received); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+	c1.mu.Lock()
+	defer c1.mu.Unlock()
+	if maxSize > 1000 {
+		t.Fatal("sent packet larger than MTU:", maxSize)
+	}
+}
+
+func TestConnKeepAlive(t *testing.T) {
+	opts := []SocketOption{
+		WithPacketReadTimeout(200 * time.Millisecond),
+		WithConnOption(WithKeepAlive(50 * time.Millisecond)),
+	}
+	c1, c2 := connPair(opts...)
+	defer c1.Close()
+	defer c2.Close()
+
+	// The connection stays alive while idle for longer than the read timeout.
+	time.Sleep(500 * time.Millisecond)
+	if _, err := c1.Write([]byte("hello")); err != nil {
+		t.Fatal("write error:", err)
+	}
+	buf := make([]byte, 5)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal("read error:", err)
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	c1, c2 := connPair()
+	defer c1.Close()
+	defer c2.Close()
+
+	// Send a request and half-close.
+	if _, err := c1.Write([]byte("request")); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if err := c1.CloseWrite(); err != nil {
+		t.Fatal("CloseWrite error:", err)
+	}
+	if _, err := c1.Write([]byte("x")); err != ErrClosed {
+		t.Fatal("wrong error for write after CloseWrite:", err)
+	}
+
+	// The remote end reads the request until EOF, then responds.
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	req, err := io.ReadAll(c2)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(req) != "request" {
+		t.Fatalf("wrong request %q", req)
+	}
+	if _, err := c2.Write([]byte("response")); err != nil {
+		t.Fatal("response write error:", err)
+	}
+	c2.CloseWrite()
+
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(c1)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(resp) != "response" {
+		t.Fatalf("wrong response %q", resp)
+	}
+}
+
+// This test checks that Close waits for sent data to be acknowledged.
+func TestConnCloseFlush(t *testing.T) {
+	sn := NewSimNet(1)
+	sn.SetLoss(0.1)
+	sn.SetLatency(5 * time.Millisecond)
+	c1, c2 := sn.Pair()
+	defer c2.Close()
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	received := make(chan []byte, 1)
+	go func() {
+		c2.SetReadDeadline(time.Now().Add(10 * time.Second))
+		b, _ := io.ReadAll(c2)
+		received <- b
+	}()
+
+	if _, err := c1.Write(data); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatal("close error:", err)
+	}
+	c1.mu.Lock()
+	unacked := len(c1.unackedSends)
+	c1.mu.Unlock()
+	if unacked > 1 {
+		t.Fatalf("%d sends unacknowledged after Close", unacked)
+	}
+	if b := <-received; !bytes.Equal(b, data) {
+		t.Fatalf("received data does not match (%d bytes)", len(b))
+	}
+}
+
+func TestConnAbort(t *testing.T) {
+	c1, c2 := connPair()
+	defer c2.Close()
+
+	if _, err := c1.Write([]byte("hello")); err != nil {
+		t.Fatal("write error:", err)
+	}
+	c1.Abort()
+	if _, err := c1.Write([]byte("x")); err != ErrClosed {
+		t.Fatal("wrong write error after Abort:", err)
+	}
+
+	// Reading on the remote end fails when the reset arrives.
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadAll(c2)
+	if !IsReset(err) {
+		t.Fatal("wrong read error:", err)
+	}
+}
+
+func TestConnSelectiveAckResend(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		hold    = true
+		sent    = make(map[uint16][][]byte) // data packets by seq_nr
+		states  [][]byte                    // state packets of c2
+		n       = NewSimNet(0)
+		c1, c2  = n.Pair()
+		addr1   = c1.LocalAddr().String()
+		packets = 40
+	)
+	defer c1.Close()
+	defer c2.Close()
+	// Capture all packets until hold is cleared.
+	n.SetFilter(func(p []byte, from net.Addr) bool {
+		var h header
+		if _, err := h.Unmarshal(p); err != nil {
+			t.Error("invalid packet:", err)
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case h.Type == stData && from.String() == addr1:
+			sent[h.SeqNr] = append(sent[h.SeqNr], p)
+		case h.Type == stState && from.String() != addr1:
+			states = append(states, p)
+		}
+		return hold
+	})
+	// waitState waits for c2 to acknowledge the given highest sequence number.
+	waitState := func(last uint16) []byte {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			for _, p := range states {
+				var h header
+				h.Unmarshal(p)
+				for _, ext := range h.Extensions {
+					sa := selectiveAckBitmask{ext.Bytes}
+					if h.AckNr+2+uint16(sa.LastSetBit()) == last {
+						mu.Unlock()
+						return p
+					}
+				}
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("no state packet acknowledging", last)
+		return nil
+	}
+	resent := func() (seqs []uint16) {
+		mu.Lock()
+		defer mu.Unlock()
+		for seq, ps := range sent {
+			if len(ps) > 1 {
+				seqs = append(seqs, seq)
+			}
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		return seqs
+	}
+
+	// Send all packets without waiting for the peer's window.
+	c1.mu.Lock()
+	c1.peerWndSize = defaultReadBufferSize
+	c1.updateCanWrite()
+	c1.mu.Unlock()
+	data := make([]byte, packets*c1.maxPayloadSize())
+	rand.Read(data)
+	if _, err := c1.Write(data); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if len(sent) != packets {
+		t.Fatalf("%d packets sent, want %d", len(sent), packets)
+	}
+
+	// Deliver packets 1 and 3..20 to c2. Packet 2 is lost and 21..40 are in
+	// flight. The bitmask covers 3..34 and ends with unset bits.
+	for seq := uint16(1); seq <= 20; seq++ {
+		if seq != 2 {
+			c2.PacketIn(sent[seq][0])
+		}
+	}
+	state := waitState(20)
+	// Deliver the state three times to trigger resending skipped packets.
+	for i := 0; i < 3; i++ {
+		c1.PacketIn(state)
+	}
+	if r := resent(); !reflect.DeepEqual(r, []uint16{2}) {
+		t.Fatalf("resent packets %v, want [2]", r)
+	}
+
+	// Deliver the rest except 36. The bitmask now spans more than 32 bits.
+	for seq := uint16(21); seq <= uint16(packets); seq++ {
+		if seq != 36 {
+			c2.PacketIn(sent[seq][0])
+		}
+	}
+	state = waitState(uint16(packets))
+	var h header
+	h.Unmarshal(state)
+	sa := selectiveAckBitmask{h.Extensions[0].Bytes}
+	if len(sa.Bytes) != 8 {
+		t.Errorf("wrong bitmask length %d", len(sa.Bytes))
+	}
+	for seq := uint16(3); seq <= uint16(packets); seq++ {
+		if set := sa.BitIsSet(int(seq - h.AckNr - 2)); set != (seq != 36) {
+			t.Errorf("bit for packet %d is %t", seq, set)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		c1.PacketIn(state)
+	}
+	if r := resent(); !reflect.DeepEqual(r, []uint16{2, 36}) {
+		t.Fatalf("resent packets %v, want [2 36]", r)
+	}
+
+	// Deliver the resent packets. All data is readable now.
+	mu.Lock()
+	hold = false
+	lost := [][]byte{sent[2][1], sent[36][1]}
+	mu.Unlock()
+	for _, p := range lost {
+		c2.PacketIn(p)
+	}
+	received := make([]byte, len(data))
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, received); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+}
+
+// This test checks that duplicate ACKs without selective ACK trigger a resend
+// before the resend timer fires.
+func TestConnDuplicateAckResend(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		sent   = make(map[uint16]int) // data packets by seq_nr
+		n      = NewSimNet(0)
+		c1, c2 = n.Pair()
+		addr1  = c1.LocalAddr().String()
+	)
+	defer c1.Abort()
+	defer c2.Abort()
+	// Drop all packets, counting data packets of c1.
+	n.SetFilter(func(p []byte, from net.Addr) bool {
+		var h header
+		h.Unmarshal(p)
+		if h.Type == stData && from.String() == addr1 {
+			mu.Lock()
+			sent[h.SeqNr]++
+			mu.Unlock()
+		}
+		return true
+	})
+	sendCount := func(seq uint16) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent[seq]
+	}
+
+	// Send some packets. The resend timer is set high enough to not interfere.
+	c1.mu.Lock()
+	c1.rto = 10 * time.Second
+	c1.peerWndSize = defaultReadBufferSize
+	c1.updateCanWrite()
+	first := c1.seq_nr
+	ackNr := c1.lastAck
+	c1.mu.Unlock()
+	if _, err := c1.Write(make([]byte, 4*c1.maxPayloadSize())); err != nil {
+		t.Fatal("write error:", err)
+	}
+
+	// Deliver duplicate acks of the packet before the first one.
+	buf := make([]byte, maxHeaderSize)
+	for i := 1; i <= dupAckThreshold; i++ {
+		if n := sendCount(first); n != 1 {
+			t.Fatalf("packet sent %d times after %d duplicate acks", n, i-1)
+		}
+		h := header{Type: stState, Version: 1, ConnID: c1.recv_id, AckNr: ackNr, WndSize: defaultReadBufferSize}
+		c1.PacketIn(buf[:h.Marshal(buf)])
+	}
+	if n := sendCount(first); n != 2 {
+		t.Fatalf("packet sent %d times after %d duplicate acks, want 2", n, dupAckThreshold)
+	}
+	if n := sendCount(first + 1); n != 1 {
+		t.Fatalf("next packet sent %d times, want 1", n)
+	}
+}
+
+func TestConnReadBufferLimit(t *testing.T) {
+	const limit = 32 * 1024
+	c1, c2 := connPair(WithConnOption(WithReadBuffer(limit)))
+	defer c1.Close()
+	defer c2.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go c1.Write(data)
+
+	// While nothing is read, the buffer stays within the limit. The next
+	// expected packet may exceed it.
+	maxSize := limit + c2.maxPayloadSize()
+	bufferSize := func() int {
+		c2.mu.Lock()
+		defer c2.mu.Unlock()
+		return len(c2.readBuf) + c2.inboundWnd
+	}
+	for i := 0; i < 20; i++ {
+		if size := bufferSize(); size > maxSize {
+			t.Fatalf("buffer size %d exceeds limit", size)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := bufferSize(); size < limit/2 {
+		t.Fatalf("buffer not filled: %d bytes", size)
+	}
+
+	// Read slowly. The transfer completes without exceeding the limit.
+	received := make([]byte, 0, len(data))
+	buf := make([]byte, 4096)
+	c2.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for len(received) < len(data) {
+		if size := bufferSize(); size > maxSize {
+			t.Fatalf("buffer size %d exceeds limit", size)
+		}
+		n, err := c2.Read(buf)
+		if err != nil {
+			t.Fatal("read error:", err)
+		}
+		received = append(received, buf[:n]...)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	c1, c2 := connPair()
+	defer c1.Close()
+	defer c2.Close()
+
+	// Deliver a reset packet to c1.
+	c1.mu.Lock()
+	h := header{Type: stReset, Version: 1, ConnID: c1.recv_id, SeqNr: 1}
+	c1.mu.Unlock()
+	buf := make([]byte, maxHeaderSize)
+	c1.PacketIn(buf[:h.Marshal(buf)])
+
+	if _, err := c1.Read(make([]byte, 10)); !IsReset(err) {
+		t.Fatal("wrong read error:", err)
+	}
+	if _, err := c1.Write([]byte("x")); !IsReset(err) {
+		t.Fatal("wrong write error:", err)
+	}
+	if IsTimeout(ErrConnReset) {
+		t.Fatal("reset reported as timeout")
+	}
+}
+
+// testCollector records metrics reported through telctx.
+type testCollector struct {
+	mu      sync.Mutex
+	metrics map[string]int
+}
+
+func (c *testCollector) Incr(m string, x any, u units.Unit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics[m] += x.(int)
+}
+
+func (c *testCollector) Set(m string, x any, u units.Unit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics[m] = x.(int)
+}
+
+func (c *testCollector) get(m string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metrics[m]
+}
+
+func TestConnTelemetry(t *testing.T) {
+	col := &testCollector{metrics: make(map[string]int)}
+	ctx := telctx.NewContext(context.Background(), col)
+	c1, c2 := connPair(WithBackground(ctx))
+	defer c1.Close()
+	defer c2.Close()
+
+	data := make([]byte, 20000)
+	rand.Read(data)
+	go c1.Write(data)
+	received := make([]byte, len(data))
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, received); err != nil {
+		t.Fatal("read error:", err)
+	}
+
+	// Wait for the data to be acknowledged.
+	deadline := time.Now().Add(5 * time.Second)
+	for col.get("ackedPackets") < len(data)/minMTU && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := col.get("ackedPackets"); n < len(data)/minMTU {
+		t.Fatal("too few acked packets:", n)
+	}
+	if n := col.get("sentBytes"); n < len(data) {
+		t.Fatal("too few sent bytes:", n)
+	}
+	if n := col.get("receivedBytes"); n < len(data) {
+		t.Fatal("too few received bytes:", n)
+	}
+	if sent, recv := col.get("sentPackets"), col.get("receivedPackets"); sent == 0 || recv == 0 {
+		t.Fatalf("no packets counted: sent %d, received %d", sent, recv)
+	}
+}
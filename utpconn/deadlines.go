@@ -1,18 +1,23 @@
 package utpconn
 
 import (
+	"sync"
 	"time"
 
 	"github.com/anacrolix/missinggo"
 )
 
 type deadline struct {
+	mu     sync.Locker // protects passed, which is waited on under the same lock
 	t      time.Time
 	passed missinggo.Event
 	timer  *time.Timer
 }
 
 func (me *deadline) set(t time.Time) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
 	me.t = t
 	me.passed.Clear()
 	if me.timer != nil {
@@ -37,6 +42,9 @@ func (me *deadline) update() {
 }
 
 func (me *deadline) callback() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
 	me.update()
 }
 
@@ -46,17 +54,32 @@ type connDeadlines struct {
 	read, write deadline
 }
 
+func (c *connDeadlines) init(mu sync.Locker) {
+	c.read.mu = mu
+	c.write.mu = mu
+}
+
+// SetDeadline sets the read and write deadlines.
 func (c *connDeadlines) SetDeadline(t time.Time) error {
 	c.read.set(t)
 	c.write.set(t)
 	return nil
 }
 
+// SetReadDeadline sets the deadline for Read calls. When the deadline passes, pending
+// and future reads return ErrTimeout. A zero value for t means Read will not time out.
 func (c *connDeadlines) SetReadDeadline(t time.Time) error {
 	c.read.set(t)
 	return nil
 }
 
+// SetWriteDeadline sets the deadline for Write calls. When the deadline passes, a
+// Write that is waiting for send window space returns ErrTimeout. A zero value for t
+// means Write will not time out.
+//
+// The write deadline is unrelated to WithWriteTimeout. Write returns as soon as the
+// data is queued for sending. WithWriteTimeout limits how long queued data may remain
+// unacknowledged before the connection is destroyed.
 func (c *connDeadlines) SetWriteDeadline(t time.Time) error {
 	c.write.set(t)
 	return nil
@@ -9,4 +9,8 @@
 // Socket is a wrapper of net.PacketConn, and performs dispatching of uTP packets
 // to attached uTP Conns. Dial and Accept is done via Socket. Conn implements
 // net.Conn over uTP, via aforementioned Socket.
+//
+// Conns can also be created directly with NewConn when the connection is set up by
+// other means, such as an encrypted session negotiated out of band. The caller then
+// delivers incoming packets using Conn.PacketIn.
 package utpconn
@@ -5,8 +5,10 @@ import (
 	"net"
 )
 
+// Errors returned by Conn. Timeouts are reported as ErrTimeout.
 var (
-	ErrClosed = net.ErrClosed
+	ErrClosed    = net.ErrClosed                               // closed locally
+	ErrConnReset = errors.New("utp: connection reset by peer") // peer sent a reset
 )
 
 type ErrTimeout struct {
@@ -22,6 +24,11 @@ func IsTimeout(err error) bool {
 	return errors.As(err, &ErrTimeout{})
 }
 
+// IsReset reports whether err means that the connection was reset by the peer.
+func IsReset(err error) bool {
+	return errors.Is(err, ErrConnReset)
+}
+
 func IsAckTimeout(err error) bool {
 	var e ErrTimeout
 	return errors.As(err, &e) && e.IsAck
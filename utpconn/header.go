@@ -74,6 +74,16 @@ func (h *header) Unmarshal(b []byte) (n int, err error) {
 	return
 }
 
+// hasSelectiveAck reports whether h carries a selective ACK extension.
+func (h *header) hasSelectiveAck() bool {
+	for _, ext := range h.Extensions {
+		if ext.Type == extensionTypeSelectiveAck {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *header) Marshal(p []byte) (n int) {
 	n = 20 + func() (ret int) {
 		for _, ext := range h.Extensions {
@@ -133,3 +143,13 @@ func (me *selectiveAckBitmask) SetBit(index int) {
 func (me *selectiveAckBitmask) BitIsSet(index int) bool {
 	return me.Bytes[index/8]>>uint(index%8)&1 == 1
 }
+
+// LastSetBit returns the index of the highest set bit, or -1 if no bit is set.
+func (me *selectiveAckBitmask) LastSetBit() int {
+	for i := me.NumBits() - 1; i >= 0; i-- {
+		if me.BitIsSet(i) {
+			return i
+		}
+	}
+	return -1
+}
@@ -32,3 +32,57 @@ func TestDecode(t *testing.T) {
 	}
 	spew.Dump(hdr)
 }
+
+func TestHeaderSelectiveAckRoundTrip(t *testing.T) {
+	for _, bits := range [][]int{
+		{0},
+		{31},
+		{0, 31, 32},
+		{63},
+		{5, 64},
+		{maxSelectiveAckBits - 1},
+	} {
+		var selAck selectiveAckBitmask
+		for _, i := range bits {
+			selAck.SetBit(i)
+		}
+		h := header{
+			Type:       stState,
+			Version:    1,
+			ConnID:     3,
+			SeqNr:      100,
+			AckNr:      200,
+			WndSize:    1 << 20,
+			Extensions: []extensionField{{Type: extensionTypeSelectiveAck, Bytes: selAck.Bytes}},
+		}
+		buf := make([]byte, minMTU)
+		n := h.Marshal(buf)
+		if n > maxHeaderSize {
+			t.Errorf("bits %v: header size %d exceeds maxHeaderSize %d", bits, n, maxHeaderSize)
+		}
+
+		var dec header
+		dn, err := dec.Unmarshal(buf[:n])
+		if err != nil {
+			t.Fatalf("bits %v: unmarshal error: %v", bits, err)
+		}
+		if dn != n {
+			t.Errorf("bits %v: decoded %d bytes, marshaled %d", bits, dn, n)
+		}
+		assert.Equal(t, h, dec)
+
+		decAck := selectiveAckBitmask{dec.Extensions[0].Bytes}
+		for i := 0; i < decAck.NumBits(); i++ {
+			want := false
+			for _, b := range bits {
+				want = want || b == i
+			}
+			if decAck.BitIsSet(i) != want {
+				t.Errorf("bits %v: bit %d is %t after decoding", bits, i, !want)
+			}
+		}
+		if last := decAck.LastSetBit(); last != bits[len(bits)-1] {
+			t.Errorf("bits %v: wrong last set bit %d", bits, last)
+		}
+	}
+}
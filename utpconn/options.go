@@ -2,6 +2,7 @@ package utpconn
 
 import (
 	"context"
+	"math"
 	"time"
 )
 
@@ -24,6 +25,15 @@ type socketConfig struct {
 	connConfig
 }
 
+func newSocketConfig(opt []SocketOption) socketConfig {
+	config := defaultSocketConfig()
+	for _, o := range opt {
+		o(&config)
+	}
+	config.connConfig.validate()
+	return config
+}
+
 func defaultSocketConfig() socketConfig {
 	return socketConfig{
 		bgCtx: context.Background(),
@@ -33,11 +43,34 @@ func defaultSocketConfig() socketConfig {
 		packetReadTimeout: 2 * time.Minute,
 
 		backlogLen: DefaultBacklogLen,
+
+		connConfig: connConfig{
+			recvWindow: defaultRecvWindow,
+			sendWindow: defaultSendWindow,
+			mtu:        minMTU,
+			readBuffer: defaultReadBufferSize,
+		},
 	}
 }
 
 // WithBackground sets the background context.
 // This can be used to enable instrumentation with the stdctx library.
+//
+// Connections report these counters to the telctx collector of the context:
+//
+//	sentPackets, sentBytes          all packets written, including resends
+//	receivedPackets, receivedBytes  packets received, bytes counts payload only
+//	ackedPackets                    sent packets acknowledged by the remote end
+//	resentPackets                   packets sent again after a timeout or loss
+//	sentStatePackets                acknowledgements sent without data
+//	unsentStatePackets              acknowledgements made redundant by other packets
+//	ackSkippedResends               fast resends triggered by selective ACKs
+//	dupAckResends                   fast resends triggered by duplicate ACKs
+//	acksReceivedAheadOfSyn          acknowledgements of packets never sent
+//	deliveriesProcessed             packets processed by the connection
+//
+// Metrics of all connections are reported under the same names. Use telctx.Group
+// to tell sockets apart.
 func WithBackground(ctx context.Context) SocketOption {
 	return func(c *socketConfig) {
 		c.bgCtx = ctx
@@ -82,7 +115,130 @@ func WithConnOption(o ConnOption) SocketOption {
 	}
 }
 
-type connConfig struct{}
+type connConfig struct {
+	recvWindow int
+	sendWindow int
+	writeDelay time.Duration
+	mtu        int
+	keepAlive  time.Duration
+	readBuffer int
+
+	// Set by WithInitialSeqNr.
+	initialSeqNr    uint16
+	hasInitialSeqNr bool
+}
+
+// firstSeqNr returns the sequence number of the first packet sent by a Conn.
+// Unless it is set by WithInitialSeqNr, def is used.
+func (c *connConfig) firstSeqNr(def uint16) uint16 {
+	if c.hasInitialSeqNr {
+		return c.initialSeqNr
+	}
+	return def
+}
+
+// validate clamps window sizes to the supported range.
+func (c *connConfig) validate() {
+	c.recvWindow = clampWindow(c.recvWindow)
+	c.sendWindow = clampWindow(c.sendWindow)
+	if c.mtu < minPacketSize {
+		c.mtu = minPacketSize
+	} else if c.mtu > minMTU {
+		c.mtu = minMTU
+	}
+	if c.readBuffer < minMTU {
+		c.readBuffer = minMTU
+	} else if c.readBuffer > math.MaxInt32 {
+		c.readBuffer = math.MaxInt32
+	}
+}
+
+func clampWindow(n int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > maxWindow {
+		return maxWindow
+	}
+	return n
+}
 
 // ConnOption is used to configure Conn specific options
 type ConnOption func(*connConfig)
+
+// WithRecvWindow sets the maximum number of out-of-order packets buffered by the
+// receiver. Packets further ahead are dropped. The default is 256. Values are
+// clamped to the range 1 to 32767.
+func WithRecvWindow(n int) ConnOption {
+	return func(c *connConfig) {
+		c.recvWindow = n
+	}
+}
+
+// WithReadBuffer sets the number of received bytes buffered until they are
+// read. The space left in the buffer is advertised to the sender as the
+// receive window, so a slow reader makes the sender wait instead of growing the
+// buffer. The default is 1MiB. Values below 1438 are raised to that.
+func WithReadBuffer(n int) ConnOption {
+	return func(c *connConfig) {
+		c.readBuffer = n
+	}
+}
+
+// WithMTU sets the maximum size of sent packets, including the uTP header. Lower
+// this when the network path can't carry packets of the default size (1438 bytes)
+// without fragmentation, e.g. for PPPoE or VPN links. Values are clamped to the
+// range 512 to 1438. Path MTU discovery is not performed.
+func WithMTU(n int) ConnOption {
+	return func(c *connConfig) {
+		c.mtu = n
+	}
+}
+
+// WithKeepAlive enables sending a state packet at the given interval. This keeps
+// an idle connection from hitting the packet read timeout on the remote end, and
+// refreshes any state kept for the connection by the transport, such as an
+// encrypted session. Since state packets are not acknowledged, both ends should
+// enable keepalive. It is disabled by default.
+func WithKeepAlive(interval time.Duration) ConnOption {
+	return func(c *connConfig) {
+		c.keepAlive = interval
+	}
+}
+
+// WithWriteDelay enables coalescing of small writes. Written data is held back for up
+// to d, so that successive writes can be sent in a single packet. Full packets are
+// sent immediately. Use Conn.Flush to send buffered data before the delay expires.
+// Write coalescing is disabled by default.
+func WithWriteDelay(d time.Duration) ConnOption {
+	return func(c *connConfig) {
+		c.writeDelay = d
+	}
+}
+
+// WithSendWindow sets the maximum number of sent packets that may be awaiting
+// acknowledgement. Write blocks while the window is full. The default is 256.
+// Values are clamped to the range 1 to 32767.
+//
+// On links with a high bandwidth-delay product, the send window limits throughput
+// to roughly sendWindow * 1400 bytes per round-trip. The receiver's window should
+// be increased along with it.
+func WithSendWindow(n int) ConnOption {
+	return func(c *connConfig) {
+		c.sendWindow = n
+	}
+}
+
+// WithInitialSeqNr sets the sequence number of the first packet sent. This is
+// meant for testing the handling of sequence number wraparound. By default,
+// connections created by Socket.Dial and NewConn start at 1, and accepted
+// connections start at a random number.
+//
+// NewConn doesn't perform a handshake, so both ends of such a connection must
+// use the same initial sequence number.
+func WithInitialSeqNr(n uint16) ConnOption {
+	return func(c *connConfig) {
+		c.initialSeqNr = n
+		c.hasInitialSeqNr = true
+	}
+}
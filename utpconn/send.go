@@ -1,11 +1,11 @@
 package utpconn
 
 import (
-	"context"
 	"time"
 
 	"github.com/anacrolix/missinggo"
 	"github.com/brendoncarroll/stdctx/logctx"
+	"github.com/brendoncarroll/stdctx/units"
 )
 
 type send struct {
@@ -21,6 +21,7 @@ type send struct {
 	acksSkipped int
 	resendTimer *time.Timer
 	numResends  int
+	resent      bool
 }
 
 // first is true if this is the first time the send is acked. latency is
@@ -67,8 +68,11 @@ func (s *send) resend() {
 	if s.acked.IsSet() {
 		return
 	}
+	s.resent = true
+	ctx := s.conn.config.bgCtx
+	telemIncr(ctx, "resentPackets", int(1), units.None)
 	err := s.conn.send(s._type, s.connID, s.payload, s.seqNr)
 	if err != nil {
-		logctx.Warnf(context.TODO(), "error resending packet: %s", err)
+		logctx.Warnf(ctx, "error resending packet: %s", err)
 	}
 }
@@ -0,0 +1,186 @@
+package utpconn
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SimNet is an in-memory packet network for testing Conns. Packets written by
+// one end are delivered to the other end through PacketIn, with configurable
+// loss, reordering and latency. The random decisions are driven by a seeded
+// source, so a given seed always drops and delays the same packets.
+type SimNet struct {
+	mu      sync.Mutex
+	rand    *rand.Rand
+	loss    float64
+	reorder float64
+	latency time.Duration
+	filter  func(packet []byte, from net.Addr) bool
+	conns   map[string]*Conn
+	ready   chan struct{}
+
+	sent, dropped int
+}
+
+// NewSimNet creates an empty network.
+func NewSimNet(seed int64) *SimNet {
+	return &SimNet{
+		rand:  rand.New(rand.NewSource(seed)),
+		conns: make(map[string]*Conn),
+		ready: make(chan struct{}),
+	}
+}
+
+// SetLoss sets the probability of dropping a packet.
+func (n *SimNet) SetLoss(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = p
+}
+
+// SetReorder sets the probability of delaying a packet by a random amount of
+// up to twice the latency, so it arrives after packets sent later.
+func (n *SimNet) SetReorder(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.reorder = p
+}
+
+// SetLatency sets the one-way delay of all packets.
+func (n *SimNet) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = d
+}
+
+// SetFilter installs a function that decides whether a packet is dropped. It is
+// applied in addition to random loss.
+func (n *SimNet) SetFilter(drop func(packet []byte, from net.Addr) bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.filter = drop
+}
+
+// Stats returns the number of packets written and dropped.
+func (n *SimNet) Stats() (sent, dropped int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sent, n.dropped
+}
+
+// Pair creates two connected Conns on the network.
+func (n *SimNet) Pair(opt ...SocketOption) (*Conn, *Conn) {
+	var (
+		addr1 = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+		addr2 = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 2}
+	)
+	c1 := NewConn(addr1, addr2, n.Write(addr1), opt...)
+	c2 := NewConn(addr2, addr1, n.Write(addr2), opt...)
+	n.mu.Lock()
+	n.conns[addr1.String()] = c1
+	n.conns[addr2.String()] = c2
+	n.mu.Unlock()
+	close(n.ready)
+	return c1, c2
+}
+
+// Write returns the write callback of the endpoint at addr.
+func (n *SimNet) Write(from net.Addr) WriteFunc {
+	return func(b []byte, to net.Addr) (int, error) {
+		packet := append([]byte(nil), b...)
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		n.sent++
+		if n.rand.Float64() < n.loss || (n.filter != nil && n.filter(packet, from)) {
+			n.dropped++
+			return len(b), nil
+		}
+		delay := n.latency
+		if n.rand.Float64() < n.reorder {
+			delay += time.Duration(n.rand.Int63n(int64(2*n.latency) + 1))
+		}
+		go n.deliver(packet, to, delay)
+		return len(b), nil
+	}
+}
+
+func (n *SimNet) deliver(packet []byte, to net.Addr, delay time.Duration) {
+	<-n.ready
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	n.mu.Lock()
+	c := n.conns[to.String()]
+	n.mu.Unlock()
+	if c != nil {
+		c.PacketIn(packet)
+	}
+}
+
+// testSimNetTransfer sends data from c1 to c2 and checks that it arrives.
+func testSimNetTransfer(t *testing.T, c1, c2 *Conn, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	go c1.Write(data)
+	received := make([]byte, len(data))
+	c2.SetReadDeadline(time.Now().Add(20 * time.Second))
+	if _, err := io.ReadFull(c2, received); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+}
+
+func TestSimNetLoss(t *testing.T) {
+	n := NewSimNet(1)
+	n.SetLoss(0.1)
+	n.SetLatency(2 * time.Millisecond)
+	c1, c2 := n.Pair(WithInitialLatency(20 * time.Millisecond))
+	defer c1.Close()
+	defer c2.Close()
+
+	testSimNetTransfer(t, c1, c2, 200000)
+	if _, dropped := n.Stats(); dropped == 0 {
+		t.Fatal("no packets dropped")
+	}
+}
+
+func TestSimNetReorder(t *testing.T) {
+	n := NewSimNet(2)
+	n.SetReorder(0.3)
+	n.SetLatency(5 * time.Millisecond)
+	c1, c2 := n.Pair()
+	defer c1.Close()
+	defer c2.Close()
+
+	testSimNetTransfer(t, c1, c2, 200000)
+}
+
+// This test checks transfers across the wraparound of sequence numbers and
+// across the middle of the sequence number space.
+func TestSimNetSeqNrWrap(t *testing.T) {
+	for _, seq := range []uint16{0xfff0, 0x7ff0} {
+		n := NewSimNet(3)
+		n.SetLoss(0.05)
+		n.SetReorder(0.2)
+		n.SetLatency(2 * time.Millisecond)
+		c1, c2 := n.Pair(
+			WithInitialLatency(20*time.Millisecond),
+			WithConnOption(WithInitialSeqNr(seq)),
+		)
+		testSimNetTransfer(t, c1, c2, 200000)
+		if st := c1.Stats(); !seqLess(seq, st.SeqNr) || st.SeqNr-seq < 100 {
+			t.Errorf("initial seq %#x: sequence number %#x did not advance far enough", seq, st.SeqNr)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,237 @@
+package utpconn
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+var errBacklogFull = errors.New("accept backlog full")
+
+// Socket multiplexes uTP connections over a net.PacketConn. Connections are
+// established with a SYN handshake using Dial and Accept.
+type Socket struct {
+	pc     net.PacketConn
+	config socketConfig
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	closed bool
+
+	backlog chan *Conn
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+var _ net.Listener = (*Socket)(nil)
+
+// connKey identifies a connection by remote address and receive ID.
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// NewSocket creates a socket on top of pc. The socket takes ownership of pc,
+// reading from it until the socket is closed.
+func NewSocket(pc net.PacketConn, opt ...SocketOption) *Socket {
+	s := &Socket{
+		pc:     pc,
+		config: newSocketConfig(opt),
+		conns:  make(map[connKey]*Conn),
+		quit:   make(chan struct{}),
+	}
+	s.backlog = make(chan *Conn, s.config.backlogLen)
+	s.wg.Add(1)
+	go s.readLoop()
+	return s
+}
+
+// Addr returns the local address of the socket.
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket and the underlying connection.
+// All connections of the socket are destroyed.
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.quit)
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	err := s.pc.Close()
+	s.wg.Wait()
+	for _, c := range conns {
+		c.mu.Lock()
+		c.destroy(ErrClosed)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Accept waits for an incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.quit:
+		return nil, ErrClosed
+	}
+}
+
+// Dial establishes a connection to addr.
+func (s *Socket) Dial(ctx context.Context, addr net.Addr) (*Conn, error) {
+	c := newConn(s.pc.LocalAddr(), addr, s.pc.WriteTo, &s.config)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	key := connKey{addr: addr.String()}
+	for {
+		key.id = uint16(rand.Intn(0x10000))
+		_, used := s.conns[key]
+		_, nextUsed := s.conns[connKey{key.addr, key.id + 1}]
+		if !used && !nextUsed {
+			break
+		}
+	}
+	c.recv_id = key.id
+	c.send_id = key.id + 1
+	c.seq_nr = c.config.firstSeqNr(1)
+	c.lastAck = c.seq_nr - 1
+	c.initiator = true
+	s.register(key, c)
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.writeSyn()
+	c.mu.Unlock()
+
+	// Wait for the SYN to be acknowledged.
+	done := make(chan error, 1)
+	go func() { done <- c.recvSynAck() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.destroy(ctx.Err())
+		c.mu.Unlock()
+		<-done
+		return nil, ctx.Err()
+	}
+	c.startKeepAlive()
+	return c, nil
+}
+
+// register adds a connection. s.mu must be held.
+func (s *Socket) register(key connKey, c *Conn) {
+	s.conns[key] = c
+	c.onDestroy = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conns[key] == c {
+			delete(s.conns, key)
+		}
+	}
+}
+
+func (s *Socket) readLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxRecvSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.dispatch(buf[:n], addr)
+	}
+}
+
+// dispatch passes a packet to the connection it belongs to.
+func (s *Socket) dispatch(packet []byte, from net.Addr) {
+	var h header
+	if _, err := h.Unmarshal(packet); err != nil {
+		return
+	}
+	// SYN carries the initiator's receive ID. The accepting side
+	// receives on the next ID.
+	id := h.ConnID
+	if h.Type == stSyn {
+		id++
+	}
+	key := connKey{from.String(), id}
+
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil && h.Type == stSyn && !s.closed {
+		c = s.acceptSyn(key, h, from)
+		s.mu.Unlock()
+		if c != nil {
+			s.queueAccept(c)
+		}
+		return
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+	// A SYN for an existing connection must be a retransmission of the SYN
+	// that created it. Other IDs may map to a dialed connection, drop them.
+	if h.Type == stSyn && h.ConnID != c.send_id {
+		return
+	}
+	c.PacketIn(packet)
+}
+
+// acceptSyn creates the connection for an incoming SYN. s.mu must be held.
+func (s *Socket) acceptSyn(key connKey, h header, from net.Addr) *Conn {
+	c := newConn(s.pc.LocalAddr(), from, s.pc.WriteTo, &s.config)
+	c.recv_id = h.ConnID + 1
+	c.send_id = h.ConnID
+	c.seq_nr = c.config.firstSeqNr(uint16(rand.Intn(0x10000)))
+	c.lastAck = c.seq_nr - 1
+	c.ack_nr = h.SeqNr
+	c.synAcked = true
+	c.updateCanWrite()
+	s.register(key, c)
+	return c
+}
+
+// queueAccept acknowledges the SYN and adds c to the accept backlog.
+// When the backlog is full, the connection is reset.
+func (s *Socket) queueAccept(c *Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case s.backlog <- c:
+		c.sendState()
+		c.startKeepAlive()
+	default:
+		c.sendReset()
+		c.destroy(errBacklogFull)
+	}
+}
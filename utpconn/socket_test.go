@@ -0,0 +1,200 @@
+package utpconn
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestSocket(t *testing.T, opt ...SocketOption) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSocket(pc, opt...)
+}
+
+func TestSocketDialAccept(t *testing.T) {
+	testSocketDialAccept(t)
+}
+
+// This test checks the handshake when the sequence numbers of both ends
+// wrap around during the transfer.
+func TestSocketDialAcceptSeqNrWrap(t *testing.T) {
+	testSocketDialAccept(t, WithConnOption(WithInitialSeqNr(0xffff)))
+}
+
+func testSocketDialAccept(t *testing.T, opt ...SocketOption) {
+	s1 := newTestSocket(t, opt...)
+	defer s1.Close()
+	s2 := newTestSocket(t, opt...)
+	defer s2.Close()
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+
+	// The accepting side echoes everything back.
+	go func() {
+		c, err := s2.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.CopyN(c, c, int64(len(data)))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := s1.Dial(ctx, s2.Addr())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer c.Close()
+
+	go c.Write(data)
+	received := make([]byte, len(data))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, received); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("echoed data does not match")
+	}
+}
+
+func TestSocketDialTimeout(t *testing.T) {
+	s1 := newTestSocket(t)
+	defer s1.Close()
+
+	// Nothing is listening on this address.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := s1.Dial(ctx, pc.LocalAddr()); err != context.DeadlineExceeded {
+		t.Fatal("wrong error:", err)
+	}
+	s1.mu.Lock()
+	defer s1.mu.Unlock()
+	if len(s1.conns) != 0 {
+		t.Fatal("connection not removed after failed dial")
+	}
+}
+
+func TestSocketClose(t *testing.T) {
+	s := newTestSocket(t)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Accept()
+		errc <- err
+	}()
+	s.Close()
+	if err := <-errc; err != ErrClosed {
+		t.Fatal("wrong error from Accept:", err)
+	}
+}
+
+func TestSocketConnIDs(t *testing.T) {
+	s1 := newTestSocket(t)
+	defer s1.Close()
+	s2 := newTestSocket(t)
+	defer s2.Close()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := s2.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c.(*Conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c1, err := s1.Dial(ctx, s2.Addr())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer c1.Close()
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	defer c2.Close()
+
+	if !c1.IsInitiator() {
+		t.Error("dialed conn is not initiator")
+	}
+	if c2.IsInitiator() {
+		t.Error("accepted conn is initiator")
+	}
+	recv1, send1 := c1.ConnIDs()
+	recv2, send2 := c2.ConnIDs()
+	if recv1 != send2 || send1 != recv2 {
+		t.Errorf("conn IDs don't match: dialer (%d, %d), acceptor (%d, %d)", recv1, send1, recv2, send2)
+	}
+	if send1 != recv1+1 {
+		t.Errorf("wrong dialer send ID %d, recv ID is %d", send1, recv1)
+	}
+}
+
+// This test checks that a SYN whose ID maps onto a dialed connection is dropped
+// instead of being delivered to it.
+func TestSocketBadSyn(t *testing.T) {
+	s1 := newTestSocket(t)
+	defer s1.Close()
+	s2 := newTestSocket(t)
+	defer s2.Close()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := s2.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c.(*Conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c1, err := s1.Dial(ctx, s2.Addr())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer c1.Close()
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	defer c2.Close()
+
+	// Send a SYN from the accepting socket which dispatch maps to the
+	// receive ID of the dialed connection.
+	recv1, _ := c1.ConnIDs()
+	syn := header{Type: stSyn, ConnID: recv1 - 1, SeqNr: 1}
+	buf := make([]byte, 20)
+	if _, err := s2.pc.WriteTo(buf[:syn.Marshal(buf)], s1.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection still works.
+	go c2.Write([]byte("ping"))
+	msg := make([]byte, 4)
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c1, msg); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(msg) != "ping" {
+		t.Fatalf("wrong message %q", msg)
+	}
+}
@@ -6,29 +6,55 @@ import (
 	"net"
 	"time"
 
+	"github.com/brendoncarroll/stdctx/telctx"
 	"github.com/brendoncarroll/stdctx/units"
 )
 
+// MaxPacketSize is the largest packet sent by a Conn. It is the default MTU,
+// see WithMTU.
+const MaxPacketSize = minMTU
+
 const (
 	// IPv6 min MTU is 1280, -40 for IPv6 header, and ~8 for fragment header?
+	// This is the default and maximum packet size, see WithMTU.
 	minMTU = 1438 // Why?
 
+	// Smallest packet size accepted by WithMTU.
+	minPacketSize = 512
+
 	// uTP header of 20, +2 for the next extension, and an optional selective
 	// ACK.
-	maxHeaderSize  = 20 + 2 + (((maxUnackedInbound+7)/8)+3)/4*4
-	maxPayloadSize = minMTU - maxHeaderSize
-	maxRecvSize    = 0x2000
+	maxHeaderSize = 20 + 2 + (((maxSelectiveAckBits+7)/8)+3)/4*4
+	maxRecvSize   = 0x2000
+
+	// Default window sizes in packets. See WithRecvWindow and WithSendWindow.
+	defaultRecvWindow = 256
+	defaultSendWindow = 256
+
+	// Upper limit of window sizes. Windows must not exceed half the
+	// sequence number space, or seqLess can't order packets.
+	maxWindow = 0x7fff
 
-	// Maximum out-of-order packets to buffer.
-	maxUnackedInbound = 256
-	maxUnackedSends   = 256
+	// Maximum number of packets covered by the selective ACK extension.
+	// This is fixed to keep the header size constant. With a larger receive
+	// window, out-of-order packets beyond this are buffered but not acked
+	// selectively.
+	maxSelectiveAckBits = 256
 
-	readBufferLen = 1 << 20 // ~1MiB
+	// Default size of the receive buffer, see WithReadBuffer.
+	defaultReadBufferSize = 1 << 20 // ~1MiB
 
 	// How long to wait before sending a state packet, after one is required.
 	// This prevents spamming a state packet for every packet received, and
 	// non-state packets that are being sent also fill the role.
 	pendingSendStateDelay = 500 * time.Microsecond
+
+	// Bounds of the retransmission timeout.
+	minResendTimeout = 50 * time.Millisecond
+	maxResendTimeout = 60 * time.Second
+
+	// Number of duplicate acks that trigger a fast resend.
+	dupAckThreshold = 3
 )
 
 type read struct {
@@ -90,9 +116,9 @@ func seqLess(a, b uint16) bool {
 }
 
 func telemIncr(ctx context.Context, m string, x any, u units.Unit) {
-
+	telctx.FromContext(ctx).Incr(m, x, u)
 }
 
 func telemMark(ctx context.Context, m string, x any, u units.Unit) {
-
+	telctx.FromContext(ctx).Set(m, x, u)
 }
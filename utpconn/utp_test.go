@@ -0,0 +1,32 @@
+package utpconn
+
+import "testing"
+
+func TestSeqLess(t *testing.T) {
+	for _, test := range []struct {
+		a, b uint16
+		less bool
+	}{
+		{0, 1, true},
+		{1, 0, false},
+		{5, 5, false},
+		// Wraparound.
+		{0xffff, 0, true},
+		{0, 0xffff, false},
+		{0xfff0, 0x0010, true},
+		{0x0010, 0xfff0, false},
+		// Crossing the middle of the sequence number space.
+		{0x7fff, 0x8000, true},
+		{0x8000, 0x7fff, false},
+		// Numbers further apart than half the space are ordered the other way.
+		{0x0000, 0x7fff, true},
+		{0x0000, 0x8001, false},
+		{0x8001, 0x0000, true},
+		{0xffff, 0x7ffe, true},
+		{0xffff, 0x8000, false},
+	} {
+		if got := seqLess(test.a, test.b); got != test.less {
+			t.Errorf("seqLess(%#x, %#x) = %t, want %t", test.a, test.b, got, test.less)
+		}
+	}
+}
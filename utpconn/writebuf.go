@@ -0,0 +1,114 @@
+package utpconn
+
+import (
+	"github.com/anacrolix/missinggo"
+)
+
+// writeBuffered implements Write when write coalescing is enabled.
+// Data is appended to writeBuf, and full packets are sent as soon as the
+// send window allows.
+func (c *Conn) writeBuffered(p []byte) (n int, err error) {
+	maxPayload := c.maxPayloadSize()
+	if c.writeBuf == nil {
+		c.writeBuf = make([]byte, 0, maxPayload)
+	}
+	for len(p) != 0 {
+		if err = c.writeErr(); err != nil {
+			return
+		}
+		if len(c.writeBuf) == maxPayload {
+			if !c.canWrite.IsSet() {
+				c.waitWritable()
+				continue
+			}
+			c.flushWriteBuf()
+		}
+		n1 := copy(c.writeBuf[len(c.writeBuf):maxPayload], p)
+		c.writeBuf = c.writeBuf[:len(c.writeBuf)+n1]
+		n += n1
+		p = p[n1:]
+	}
+	if len(c.writeBuf) == maxPayload && c.canWrite.IsSet() {
+		c.flushWriteBuf()
+	}
+	if len(c.writeBuf) > 0 {
+		c.armFlushTimer()
+	}
+	return
+}
+
+// Flush sends all data buffered by Write. It blocks until the send window
+// allows sending. Flush does nothing if write coalescing is disabled.
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.writeBuf) > 0 {
+		if err := c.writeErr(); err != nil {
+			return err
+		}
+		if c.canWrite.IsSet() {
+			c.flushWriteBuf()
+			break
+		}
+		c.waitWritable()
+	}
+	return nil
+}
+
+// writeErr returns the error for writes in the current connection state.
+func (c *Conn) writeErr() error {
+	if c.wroteFin.IsSet() || c.closed.IsSet() {
+		return ErrClosed
+	}
+	if c.destroyed.IsSet() {
+		return c.err
+	}
+	if c.connDeadlines.write.passed.IsSet() {
+		return ErrTimeout{}
+	}
+	return nil
+}
+
+func (c *Conn) waitWritable() {
+	missinggo.WaitEvents(&c.mu,
+		&c.wroteFin,
+		&c.closed,
+		&c.destroyed,
+		&c.connDeadlines.write.passed,
+		&c.canWrite)
+}
+
+// flushWriteBuf sends the buffered data as a single packet, ignoring the send window.
+func (c *Conn) flushWriteBuf() {
+	if len(c.writeBuf) == 0 || c.wroteFin.IsSet() || c.destroyed.IsSet() {
+		return
+	}
+	// write copies the payload, so the buffer can be reused.
+	c.write(stData, c.send_id, c.writeBuf, c.seq_nr)
+	c.writeBuf = c.writeBuf[:0]
+}
+
+func (c *Conn) armFlushTimer() {
+	if c.flushTimerArmed {
+		return
+	}
+	if c.flushTimer == nil {
+		c.flushTimer = missinggo.StoppedFuncTimer(c.flushTimerCallback)
+	}
+	c.flushTimer.Reset(c.config.writeDelay)
+	c.flushTimerArmed = true
+}
+
+func (c *Conn) flushTimerCallback() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushTimerArmed = false
+	if c.canWrite.IsSet() {
+		c.flushWriteBuf()
+	} else if len(c.writeBuf) > 0 {
+		// The window is full, try again later.
+		c.armFlushTimer()
+	}
+}